@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// deleteProjectFiles removes everything a project has in storage and on disk.
+func (s *Server) deleteProjectFiles(projectID string) error {
+	var errs []error
+	keys := []string{deployPrefix(projectID)}
+	for _, f := range archiveFormats {
+		keys = append(keys, uploadKey(projectID, f.format))
+	}
+	for _, key := range keys {
+		if err := s.storage.Delete(key); err != nil {
+			errs = append(errs, fmt.Errorf("cannot remove %s: %w", key, err))
+		}
+	}
+	for _, path := range []string{
+		filepath.Join(s.cfg.ProjectsDir, projectID),
+		filepath.Join(s.cfg.StagingDir, projectID),
+		filepath.Join(s.cfg.StagingDir, projectID+".branch"),
+	} {
+		if err := os.RemoveAll(path); err != nil {
+			errs = append(errs, fmt.Errorf("cannot remove %s: %w", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deleteProjectRows removes a project and every row that references it, and
+// queues its files for removal.
+func deleteProjectRows(tx *sql.Tx, projectID string) error {
+	for _, stmt := range []string{
+		"DELETE FROM postbuild_results WHERE project_id = ?",
+		"DELETE FROM project_history WHERE project_id = ?",
+		"DELETE FROM project_transfers WHERE project_id = ?",
+		"DELETE FROM subdomain_redirects WHERE project_id = ?",
+		"DELETE FROM project_tags WHERE project_id = ?",
+		"DELETE FROM project_aliases WHERE project_id = ?",
+		"DELETE FROM branch_deploys WHERE project_id = ?",
+		"DELETE FROM project_schedules WHERE project_id = ?",
+		"DELETE FROM deployments WHERE project_id = ?",
+		"DELETE FROM project_env WHERE project_id = ?",
+		"DELETE FROM project_members WHERE project_id = ?",
+		"DELETE FROM projects WHERE id = ?",
+	} {
+		if _, err := tx.Exec(stmt, projectID); err != nil {
+			return err
+		}
+	}
+	return queueFileCleanup(tx, projectID)
+}
+
+func (s *Server) userProjectIDs(userID int) ([]string, error) {
+	rows, err := s.db.Query("SELECT id FROM projects WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// deleteAccount removes a user and their projects, and queues the projects'
+// files for removal. Service accounts of orgs the user leaves empty go too. Builds are cancelled first so nothing writes to a
+// project while it is removed.
+func (s *Server) deleteAccount(userID int) error {
+	orphans, err := s.orphanedServiceAccounts(userID)
+	if err != nil {
+		return err
+	}
+	for _, id := range orphans {
+		if err := s.deleteAccount(id); err != nil {
+			return fmt.Errorf("service account %d: %w", id, err)
+		}
+	}
+
+	projectIDs, err := s.userProjectIDs(userID)
+	if err != nil {
+		return err
+	}
+	s.builds.cancelAndWait(projectIDs, 10*time.Second)
+
+	// Members of the projects lose them from their lists too
+	audience := map[int]bool{userID: true}
+	for _, id := range projectIDs {
+		for _, memberID := range s.projectAudience(id) {
+			audience[memberID] = true
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range projectIDs {
+		if err := deleteProjectRows(tx, id); err != nil {
+			return err
+		}
+	}
+	if err := leaveOrgs(tx, userID); err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		"DELETE FROM email_verifications WHERE user_id = ?",
+		"DELETE FROM api_keys WHERE user_id = ?",
+		"DELETE FROM refresh_tokens WHERE user_id = ?",
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM password_resets WHERE user_id = ?",
+		"DELETE FROM recovery_codes WHERE user_id = ?",
+		"DELETE FROM project_members WHERE user_id = ?",
+		"DELETE FROM sso_identities WHERE user_id = ?",
+		"DELETE FROM login_events WHERE user_id = ?",
+		"DELETE FROM known_devices WHERE user_id = ?",
+		"DELETE FROM ip_allowlist WHERE user_id = ?",
+		// Their files go in pruneExports below
+		"UPDATE data_exports SET expires_at = 0 WHERE user_id = ?",
+		"DELETE FROM account_unlocks WHERE user_id = ?",
+		"DELETE FROM service_accounts WHERE user_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	} {
+		if _, err := tx.Exec(stmt, userID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for id := range audience {
+		s.projectsCache.invalidate(id)
+	}
+	s.wakeCleanup()
+	s.pruneExports()
+	return nil
+}
+
+// handleDeleteAccount deletes the caller's account. As confirmation the body
+// must repeat the password and the account's email, plus a two-factor code if
+// that is on. The account is gone when this returns; its files are removed in
+// the background, hence 202.
+func (s *Server) handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	var req struct {
+		Password string `json:"password"`
+		Confirm  string `json:"confirm"`
+		OTP      string `json:"otp"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+
+	var email, hash string
+	if err := s.db.QueryRow("SELECT email, password FROM users WHERE id = ?", userID).Scan(&email, &hash); err != nil {
+		writeJSONError(w, http.StatusNotFound, "user_not_found", "User not found")
+		return
+	}
+	if !checkPassword(req.Password, hash) {
+		writeJSONError(w, http.StatusForbidden, "wrong_password", "Incorrect password")
+		return
+	}
+	if !strings.EqualFold(strings.TrimSpace(req.Confirm), email) {
+		writeJSONError(w, http.StatusBadRequest, "confirmation_required", "Set confirm to your account's email address to delete it")
+		return
+	}
+	if !s.requireSecondFactor(w, userID, req.OTP) {
+		return
+	}
+
+	if err := s.deleteAccount(userID); err != nil {
+		log.Printf("user %d: account deletion failed: %v", userID, err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Could not delete account")
+		return
+	}
+	log.Printf("user %d: account deleted", userID)
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeleteAccount(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery")
+	project, _ := ts.upload(t, token, "doomed", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+
+	deployDir := filepath.Join(ts.cfg.DeployDir, project.ID)
+	if _, err := os.Stat(deployDir); err != nil {
+		t.Fatalf("deploy output missing before deletion: %v", err)
+	}
+
+	del := func(body map[string]string) *http.Response {
+		return ts.do(t, "DELETE", "/api/account", token, jsonBody(body), "application/json", nil)
+	}
+	if resp := del(map[string]string{"password": "correct horse battery"}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("without confirmation: status %d, want 400", resp.StatusCode)
+	}
+	if resp := del(map[string]string{"password": "wrong", "confirm": "ada@example.com"}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("wrong password: status %d, want 403", resp.StatusCode)
+	}
+	if resp := del(map[string]string{"password": "correct horse battery", "confirm": "ada@example.com"}); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("delete: status %d", resp.StatusCode)
+	}
+
+	if resp := ts.do(t, "GET", "/api/projects", token, nil, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token after deletion: status %d, want 401", resp.StatusCode)
+	}
+	creds := map[string]string{"email": "ada@example.com", "password": "correct horse battery"}
+	if resp := ts.postJSON(t, "/api/login", "", creds, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("login after deletion: status %d, want 401", resp.StatusCode)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var queued int
+		ts.db.QueryRow("SELECT COUNT(*) FROM file_cleanup").Scan(&queued)
+		_, err := os.Stat(deployDir)
+		if queued == 0 && os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("files not cleaned up: %d queued, stat error %v", queued, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestDeleteAccountNeedsSecondFactor(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery")
+
+	var setup struct{ Secret string }
+	ts.postJSON(t, "/api/auth/2fa/setup", token, nil, &setup)
+	code, _ := totpCode(setup.Secret, time.Now().Unix()/totpPeriod)
+	var verified struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if resp := ts.postJSON(t, "/api/auth/2fa/verify", token, map[string]string{"code": code}, &verified); resp.StatusCode != http.StatusOK {
+		t.Fatalf("enable 2fa: status %d", resp.StatusCode)
+	}
+
+	body := map[string]string{"password": "correct horse battery", "confirm": "ada@example.com"}
+	if resp := ts.do(t, "DELETE", "/api/account", token, jsonBody(body), "application/json", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("without a code: status %d, want 403", resp.StatusCode)
+	}
+	body["otp"] = verified.RecoveryCodes[0]
+	if resp := ts.do(t, "DELETE", "/api/account", token, jsonBody(body), "application/json", nil); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("with a recovery code: status %d, want 202", resp.StatusCode)
+	}
+}
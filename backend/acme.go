@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// With GRAPE_ACME=true the API terminates TLS itself, getting certificates
+// from Let's Encrypt (or GRAPE_ACME_DIRECTORY) for the base domain, project
+// subdomains and GRAPE_ACME_HOSTS as they are first requested. autocert
+// renews them 30 days before they expire.
+var (
+	acmeEnabled   = envString("GRAPE_ACME", "false") == "true"
+	acmeEmail     = envString("GRAPE_ACME_EMAIL", "")
+	acmeDirectory = envString("GRAPE_ACME_DIRECTORY", acme.LetsEncryptURL)
+	acmeCacheDir  = envString("GRAPE_ACME_CACHE_DIR", "acme")
+	acmeHTTPAddr  = envString("GRAPE_HTTP_ADDR", ":80")
+	acmeHTTPSAddr = envString("GRAPE_HTTPS_ADDR", ":443")
+	acmeHosts     = parseCommaSet(envString("GRAPE_ACME_HOSTS", ""))
+)
+
+// parseCommaSet splits a comma-separated setting into a set of lowercase
+// entries.
+func parseCommaSet(v string) map[string]bool {
+	hosts := map[string]bool{}
+	for _, h := range strings.Split(v, ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			hosts[h] = true
+		}
+	}
+	return hosts
+}
+
+// acmeHostPolicy only lets certificates be requested for hosts this server
+// answers for, so nobody can make it spend the CA's rate limits on others.
+func (s *Server) acmeHostPolicy(_ context.Context, host string) error {
+	host = strings.ToLower(host)
+	if host == baseDomain || acmeHosts[host] {
+		return nil
+	}
+	if strings.HasSuffix(host, "."+baseDomain) {
+		if projectID, _ := s.previewForHost(host); projectID != "" || s.siteForHost(host) != "" || s.redirectForHost(host) != "" {
+			return nil
+		}
+		if projectID, _ := s.aliasForHost(host); projectID != "" {
+			return nil
+		}
+		if projectID, _ := s.branchForHost(host); projectID != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("acme: no site is served at %q", host)
+}
+
+func (s *Server) newCertManager() *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(acmeCacheDir),
+		HostPolicy: s.acmeHostPolicy,
+		Email:      acmeEmail,
+		Client:     &acme.Client{DirectoryURL: acmeDirectory},
+	}
+}
+
+// startACMEServers serves the API and sites over HTTPS on GRAPE_HTTPS_ADDR,
+// answering TLS-ALPN-01 challenges there, and HTTP-01 challenges on
+// GRAPE_HTTP_ADDR, which redirects everything else to HTTPS.
+func (s *Server) startACMEServers() []*http.Server {
+	m := s.newCertManager()
+	https := &http.Server{Addr: acmeHTTPSAddr, Handler: s.Handler(), TLSConfig: m.TLSConfig()}
+	plain := &http.Server{Addr: acmeHTTPAddr, Handler: m.HTTPHandler(nil)}
+	go func() {
+		if err := https.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	go func() {
+		if err := plain.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	log.Printf("Serving HTTPS on %s with ACME certificates, challenges and redirects on %s", acmeHTTPSAddr, acmeHTTPAddr)
+	return []*http.Server{https, plain}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestSiteServedOnItsHost(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+
+	get := func(host string) (int, string) {
+		req, _ := http.NewRequest("GET", ts.http.URL+"/", nil)
+		req.Host = host
+		resp, err := ts.http.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if status, body := get(project.Subdomain); status != http.StatusOK || body != "<h1>hello</h1>" {
+		t.Errorf("site host: %d %q", status, body)
+	}
+	if status, _ := get("nope." + baseDomain); status != http.StatusNotFound {
+		t.Errorf("unknown subdomain: status %d, want 404", status)
+	}
+
+	ctx := context.Background()
+	if err := ts.acmeHostPolicy(ctx, project.Subdomain); err != nil {
+		t.Errorf("project subdomain refused: %v", err)
+	}
+	if err := ts.acmeHostPolicy(ctx, baseDomain); err != nil {
+		t.Errorf("base domain refused: %v", err)
+	}
+	for _, host := range []string{"nope." + baseDomain, "example.com"} {
+		if ts.acmeHostPolicy(ctx, host) == nil {
+			t.Errorf("certificate allowed for %s", host)
+		}
+	}
+}
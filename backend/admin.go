@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// adminMiddleware lets through only signed-in users whose token carries the
+// admin role. The role is checked against the database as well, so demoting
+// an admin takes effect before their token expires.
+func (s *Server) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return s.authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if isAdmin, _ := r.Context().Value("isAdmin").(bool); !isAdmin {
+			writeJSONError(w, http.StatusForbidden, "forbidden", "Admin access required")
+			return
+		}
+		var isAdmin bool
+		err := s.db.QueryRow("SELECT is_admin FROM users WHERE id = ?", r.Context().Value("userID").(int)).Scan(&isAdmin)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !isAdmin {
+			writeJSONError(w, http.StatusForbidden, "forbidden", "Admin access required")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// promoteAdmin grants the admin role to the user with the given email. New
+// tokens carry the role; existing ones must be refreshed by logging in again.
+func (s *Server) promoteAdmin(email string) error {
+	res, err := s.db.Exec("UPDATE users SET is_admin = 1 WHERE email = ?", email)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no user with email %s", email)
+	}
+	return nil
+}
+
+type adminUser struct {
+	ID        int    `json:"id"`
+	Email     string `json:"email"`
+	Verified  bool   `json:"verified"`
+	IsAdmin   bool   `json:"is_admin"`
+	Tier      string `json:"tier"`
+	Projects  int    `json:"projects"`
+	CreatedAt int64  `json:"created_at"`
+	LastLogin int64  `json:"last_login,omitempty"`
+}
+
+func (s *Server) handleAdminListUsers(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.db.Query(`
+		SELECT u.id, u.email, u.verified, u.is_admin, COALESCE(u.tier, 'free'), COALESCE(u.created_at, 0),
+			(SELECT COUNT(*) FROM projects p WHERE p.user_id = u.id),
+			COALESCE((SELECT MAX(created_at) FROM login_events l WHERE l.user_id = u.id AND l.success = 1), 0)
+		FROM users u
+		ORDER BY u.id
+	`)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []adminUser{}
+	for rows.Next() {
+		var u adminUser
+		if err := rows.Scan(&u.ID, &u.Email, &u.Verified, &u.IsAdmin, &u.Tier, &u.CreatedAt, &u.Projects, &u.LastLogin); err != nil {
+			continue
+		}
+		users = append(users, u)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+type adminProject struct {
+	Project
+	OwnerEmail string `json:"owner_email"`
+}
+
+func (s *Server) handleAdminListProjects(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.db.Query(`
+		SELECT p.id, p.user_id, p.name, p.status, p.subdomain, p.created_at, p.url_preset, p.force_https, u.email
+		FROM projects p JOIN users u ON u.id = p.user_id
+		ORDER BY p.created_at DESC
+	`)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	projects := []adminProject{}
+	for rows.Next() {
+		var p adminProject
+		err := rows.Scan(&p.ID, &p.UserID, &p.Name, &p.Status, &p.Subdomain, &p.CreatedAt, &p.Preset, &p.ForceHTTPS, &p.OwnerEmail)
+		if err != nil {
+			continue
+		}
+		projects = append(projects, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projects)
+}
+
+// deleteProject cancels any running build, then removes the project's rows
+// and queues its files for removal.
+func (s *Server) deleteProject(projectID string) error {
+	s.builds.cancelAndWait([]string{projectID}, 10*time.Second)
+	audience := s.projectAudience(projectID)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := deleteProjectRows(tx, projectID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, userID := range audience {
+		s.projectsCache.invalidate(userID)
+	}
+
+	s.wakeCleanup()
+	return nil
+}
+
+// handleAdminDeleteProject force-removes any user's project, e.g. an abusive
+// deployment.
+func (s *Server) handleAdminDeleteProject(w http.ResponseWriter, r *http.Request) {
+	projectID := mux.Vars(r)["id"]
+
+	var userID int
+	if err := s.db.QueryRow("SELECT user_id FROM projects WHERE id = ?", projectID).Scan(&userID); err != nil {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.deleteProject(projectID); err != nil {
+		log.Printf("project %s: admin deletion failed: %v", projectID, err)
+		http.Error(w, "Could not delete project", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("project %s (user %d) deleted by admin %d", projectID, userID, r.Context().Value("userID").(int))
+	s.publishStatus(projectID, userID, "deleted")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminFailBuild marks a queued or building project as failed and stops
+// its build, for builds stuck beyond their timeout. The status changes first,
+// so whatever the cancelled build reports afterwards is discarded.
+func (s *Server) handleAdminFailBuild(w http.ResponseWriter, r *http.Request) {
+	projectID := mux.Vars(r)["id"]
+
+	var (
+		userID int
+		status string
+	)
+	if err := s.db.QueryRow("SELECT user_id, status FROM projects WHERE id = ?", projectID).Scan(&userID, &status); err != nil {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+	if status != "queued" && status != "building" {
+		writeJSONError(w, http.StatusConflict, "not_building", "Project has no build in progress")
+		return
+	}
+
+	adminID := r.Context().Value("userID").(int)
+	ok, err := s.updateProjectStatus(projectID, status, "failed")
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		writeJSONError(w, http.StatusConflict, "not_building", "The build finished in the meantime")
+		return
+	}
+	note := fmt.Sprintf("\nError: build stopped by an administrator at %s", time.Now().UTC().Format(time.RFC3339))
+	if err := s.appendBuildLog(projectID, note); err != nil {
+		log.Printf("project %s: cannot append to build log: %v", projectID, err)
+	}
+	s.builds.cancel(projectID)
+	for _, id := range s.projectAudience(projectID) {
+		s.projectsCache.invalidate(id)
+	}
+	log.Printf("project %s (user %d) build failed by admin %d", projectID, userID, adminID)
+	s.publishStatus(projectID, userID, "failed")
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hangingRunner never finishes a build on its own.
+type hangingRunner struct{}
+
+func (hangingRunner) Run(ctx context.Context, projectPath, stagePath string, timeout time.Duration, env []string, onStage func(string)) (string, error) {
+	onStage("build")
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func (ts *testServer) signUpAdmin(t *testing.T, email, password string) string {
+	t.Helper()
+	ts.signUp(t, email, password)
+	if err := ts.promoteAdmin(email); err != nil {
+		t.Fatal(err)
+	}
+	return ts.login(t, email, password).Token
+}
+
+func TestAdminRoutes(t *testing.T) {
+	ts := newTestServer(t, hangingRunner{})
+	user := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	admin := ts.signUpAdmin(t, "root@example.com", "correct horse battery 1")
+
+	if resp := ts.do(t, "GET", "/api/admin/users", user, nil, "", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("non-admin listing users: status %d, want 403", resp.StatusCode)
+	}
+	var users []adminUser
+	if resp := ts.do(t, "GET", "/api/admin/users", admin, nil, "", &users); resp.StatusCode != http.StatusOK {
+		t.Fatalf("list users: status %d", resp.StatusCode)
+	}
+	if len(users) != 2 || users[0].Email != "ada@example.com" || users[0].IsAdmin || !users[1].IsAdmin || users[1].LastLogin == 0 {
+		t.Errorf("users = %+v", users)
+	}
+
+	project, _ := ts.upload(t, user, "site", siteZip(t))
+	if resp := ts.do(t, "POST", "/api/admin/projects/"+project.ID+"/fail", user, nil, "", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("non-admin failing a build: status %d, want 403", resp.StatusCode)
+	}
+	if resp := ts.do(t, "POST", "/api/admin/projects/"+project.ID+"/fail", admin, nil, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("fail build: status %d", resp.StatusCode)
+	}
+	if got := ts.waitForStatus(t, user, project.ID); got.Status != "failed" {
+		t.Errorf("status after failing = %s", got.Status)
+	}
+	var logs struct {
+		Log string `json:"log"`
+	}
+	ts.do(t, "GET", "/api/projects/"+project.ID+"/logs", user, nil, "", &logs)
+	if !strings.Contains(logs.Log, "stopped by an administrator") {
+		t.Errorf("log = %q", logs.Log)
+	}
+	if resp := ts.do(t, "POST", "/api/admin/projects/"+project.ID+"/fail", admin, nil, "", nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("failing a finished build: status %d, want 409", resp.StatusCode)
+	}
+
+	// Demotion takes effect before the admin's token expires
+	if _, err := ts.db.Exec("UPDATE users SET is_admin = 0 WHERE email = ?", "root@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if resp := ts.do(t, "GET", "/api/admin/users", admin, nil, "", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("demoted admin: status %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	user := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	admin := ts.signUpAdmin(t, "root@example.com", "correct horse battery 1")
+	project, _ := ts.upload(t, user, "site", siteZip(t))
+	ts.waitForStatus(t, user, project.ID)
+
+	var users []adminUser
+	ts.do(t, "GET", "/api/admin/users", admin, nil, "", &users)
+	adaID, rootID := users[0].ID, users[1].ID
+
+	path := func(id int) string { return fmt.Sprintf("/api/admin/users/%d/impersonate", id) }
+	if resp := ts.postJSON(t, path(adaID), admin, map[string]string{}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("without a reason: status %d, want 400", resp.StatusCode)
+	}
+	if resp := ts.postJSON(t, path(rootID), admin, map[string]string{"reason": "test"}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("impersonating an admin: status %d, want 403", resp.StatusCode)
+	}
+	if resp := ts.postJSON(t, path(adaID), user, map[string]string{"reason": "test"}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("non-admin impersonating: status %d, want 403", resp.StatusCode)
+	}
+
+	var imp struct {
+		Token string `json:"token"`
+		ID    int    `json:"impersonation_id"`
+	}
+	if resp := ts.postJSON(t, path(adaID), admin, map[string]string{"reason": "ticket 42"}, &imp); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("impersonate: status %d", resp.StatusCode)
+	}
+
+	var projects []Project
+	if resp := ts.do(t, "GET", "/api/projects", imp.Token, nil, "", &projects); resp.StatusCode != http.StatusOK || len(projects) != 1 {
+		t.Fatalf("projects as the user: status %d, %d projects", resp.StatusCode, len(projects))
+	}
+	if resp := ts.do(t, "GET", "/api/projects/"+project.ID+"/logs", imp.Token, nil, "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("logs as the user: status %d", resp.StatusCode)
+	}
+	if resp := ts.do(t, "DELETE", "/api/projects/"+project.ID, imp.Token, nil, "", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("deleting while impersonating: status %d, want 403", resp.StatusCode)
+	}
+	for _, p := range []string{"/api/me/webhook-secret", "/api/tokens", "/api/keys", "/api/sessions", "/api/me/devices"} {
+		if resp := ts.do(t, "GET", p, imp.Token, nil, "", nil); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("GET %s while impersonating: status %d, want 403", p, resp.StatusCode)
+		}
+	}
+	var secrets int
+	ts.db.QueryRow("SELECT COUNT(*) FROM users WHERE webhook_secret != ''").Scan(&secrets)
+	if secrets != 0 {
+		t.Errorf("impersonation created %d webhook secrets", secrets)
+	}
+
+	var audit []Impersonation
+	ts.do(t, "GET", fmt.Sprintf("/api/admin/impersonations?user_id=%d", adaID), admin, nil, "", &audit)
+	if len(audit) != 1 || audit[0].AdminID != rootID || audit[0].Reason != "ticket 42" || audit[0].Requests != 2 {
+		t.Errorf("audit log = %+v", audit)
+	}
+	var requests []impersonationRequest
+	ts.do(t, "GET", fmt.Sprintf("/api/admin/impersonations/%d/requests", imp.ID), admin, nil, "", &requests)
+	if len(requests) != 2 || requests[0].Path != "/api/projects" {
+		t.Errorf("requests = %+v", requests)
+	}
+
+	if _, err := ts.db.Exec("UPDATE users SET is_admin = 0 WHERE id = ?", rootID); err != nil {
+		t.Fatal(err)
+	}
+	if resp := ts.do(t, "GET", "/api/projects", imp.Token, nil, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token of a demoted admin: status %d, want 401", resp.StatusCode)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// An alias is a name for one of a project's deployments, served at
+// {alias}.{project}.{baseDomain}: e.g. staging.myapp.grape.ai. Rebuilding
+// with an alias promotes the build there instead of making it live, so a
+// project can run a staging track next to production. "production" names
+// the live deployment itself; pointing it elsewhere is a rollback.
+
+const productionAlias = "production"
+
+var validAlias = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,28}[a-z0-9])?$`)
+
+type DeploymentAlias struct {
+	Name         string `json:"name"`
+	DeploymentID string `json:"deployment_id"`
+	URL          string `json:"url"`
+	UpdatedBy    int    `json:"updated_by,omitempty"`
+	UpdatedAt    int64  `json:"updated_at,omitempty"`
+}
+
+func validateAlias(name string) error {
+	if !validAlias.MatchString(name) {
+		return errors.New("alias must be 1-30 lowercase letters, digits and hyphens, not starting or ending with a hyphen")
+	}
+	return nil
+}
+
+// aliasHost is where the alias of a project served at subdomain lives.
+func aliasHost(name, subdomain string) string {
+	return name + "." + subdomain
+}
+
+// aliasForHost returns the project and deployment an alias host names, if
+// any. The production alias is left to siteForHost.
+func (s *Server) aliasForHost(host string) (projectID, deploymentID string) {
+	name, project, ok := strings.Cut(strings.TrimSuffix(host, "."+baseDomain), ".")
+	if !ok || strings.Contains(project, ".") {
+		return "", ""
+	}
+	if name == productionAlias {
+		return s.siteForHost(project + "." + baseDomain), ""
+	}
+	s.db.QueryRow(`
+		SELECT p.id, a.deployment_id FROM project_aliases a JOIN projects p ON p.id = a.project_id
+		WHERE a.name = ? AND (p.subdomain = ? OR p.id = ?) AND p.status != 'archived'
+	`, name, project+"."+baseDomain, project).Scan(&projectID, &deploymentID)
+	if deploymentID == "" {
+		return "", ""
+	}
+	return projectID, deploymentID
+}
+
+// switchAlias points the alias at a freshly published deployment.
+func (s *Server) switchAlias(projectID, name, deploymentID string, size int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE deployments SET size = ? WHERE id = ?", size, deploymentID); err != nil {
+		return err
+	}
+	var triggeredBy int
+	tx.QueryRow("SELECT triggered_by FROM deployments WHERE id = ?", deploymentID).Scan(&triggeredBy)
+	if _, err := tx.Exec(upsertAlias, projectID, name, deploymentID, triggeredBy, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const upsertAlias = `
+	INSERT INTO project_aliases (project_id, name, deployment_id, updated_by, updated_at) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT (project_id, name) DO UPDATE SET deployment_id = excluded.deployment_id,
+		updated_by = excluded.updated_by, updated_at = excluded.updated_at`
+
+// handleListAliases returns the project's aliases, production first.
+func (s *Server) handleListAliases(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleViewer)
+	if !ok {
+		return
+	}
+	var subdomain, live string
+	if err := s.db.QueryRow("SELECT subdomain, live_deployment FROM projects WHERE id = ?", projectID).Scan(&subdomain, &live); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+
+	aliases := []DeploymentAlias{{Name: productionAlias, DeploymentID: live, URL: "https://" + subdomain}}
+	rows, err := s.db.Query("SELECT name, deployment_id, updated_by, updated_at FROM project_aliases WHERE project_id = ? ORDER BY name", projectID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a DeploymentAlias
+		if err := rows.Scan(&a.Name, &a.DeploymentID, &a.UpdatedBy, &a.UpdatedAt); err != nil {
+			continue
+		}
+		a.URL = "https://" + aliasHost(a.Name, subdomain)
+		aliases = append(aliases, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aliases)
+}
+
+// handleSetAlias points an alias at a successful deployment, by default the
+// newest one not built from another branch, creating the alias if needed.
+// Promoting to production makes the deployment live, which needs it to be
+// approved if it was held for approval. Deployers and above only.
+func (s *Server) handleSetAlias(w http.ResponseWriter, r *http.Request) {
+	projectID, userID, ok := s.authorizeProject(w, r, roleDeployer)
+	if !ok {
+		return
+	}
+	var req struct {
+		Name         string `json:"name"`
+		DeploymentID string `json:"deployment_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	if err := validateAlias(req.Name); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_alias", err.Error())
+		return
+	}
+
+	var (
+		ownerID           int
+		status, subdomain string
+	)
+	if err := s.db.QueryRow("SELECT user_id, status, subdomain FROM projects WHERE id = ?", projectID).Scan(&ownerID, &status, &subdomain); err != nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Project not found")
+		return
+	}
+	if status == "archived" {
+		writeJSONError(w, http.StatusConflict, "project_archived", "Archived projects have no deployments")
+		return
+	}
+
+	target := req.DeploymentID
+	approved := ""
+	if req.Name == productionAlias {
+		approved = " AND " + approvedDeployment
+	}
+	var err error
+	if target == "" {
+		err = s.db.QueryRow("SELECT id FROM deployments WHERE project_id = ? AND status = ? AND branch = ''"+approved+" ORDER BY rowid DESC LIMIT 1",
+			projectID, deploySucceeded).Scan(&target)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusConflict, "no_deployment", "The project has no successful deployment yet")
+			return
+		}
+	} else {
+		var status, approval string
+		err = s.db.QueryRow("SELECT status, approval FROM deployments WHERE id = ? AND project_id = ?", target, projectID).Scan(&status, &approval)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "deployment_not_found", "Deployment not found")
+			return
+		}
+		if err == nil && status != deploySucceeded {
+			writeJSONError(w, http.StatusConflict, "deployment_unsuccessful", "Only successful deployments can be served")
+			return
+		}
+		if err == nil && approved != "" && approval != "" && approval != approvalApproved {
+			writeJSONError(w, http.StatusConflict, "deployment_not_approved", "Only approved deployments can go live")
+			return
+		}
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+
+	alias := DeploymentAlias{Name: req.Name, DeploymentID: target, URL: "https://" + aliasHost(req.Name, subdomain), UpdatedBy: userID, UpdatedAt: time.Now().Unix()}
+	if req.Name == productionAlias {
+		// Conditional on the status so a build that started meanwhile wins
+		res, err := s.execWithRetry("UPDATE projects SET live_deployment = ? WHERE id = ? AND status NOT IN ('queued', 'building', 'archived')", target, projectID)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeJSONError(w, http.StatusConflict, "build_in_progress", "Wait for the build to finish before promoting to production")
+			return
+		}
+		alias.URL = "https://" + subdomain
+		s.setDeploymentExpiry(projectID, target, false)
+		s.invalidateProjectLists(projectID, ownerID)
+	} else {
+		if _, err := s.execWithRetry(upsertAlias, projectID, req.Name, target, userID, alias.UpdatedAt); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+			return
+		}
+	}
+	log.Printf("project %s: alias %s now points at deployment %s (user %d)", projectID, req.Name, target, userID)
+	s.recordHistory(projectID, "alias", req.Name, target)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alias)
+}
+
+// handleDeleteAlias removes an alias; its deployment stays. Deployers and
+// above only.
+func (s *Server) handleDeleteAlias(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleDeployer)
+	if !ok {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if name == productionAlias {
+		writeJSONError(w, http.StatusBadRequest, "invalid_alias", "The production alias can't be removed")
+		return
+	}
+	res, err := s.db.Exec("DELETE FROM project_aliases WHERE project_id = ? AND name = ?", projectID, name)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeJSONError(w, http.StatusNotFound, "alias_not_found", "Alias not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rebuildAlias reads the optional {"alias": "staging"} body of a rebuild.
+// Production, like no alias, means the build goes live.
+func rebuildAlias(r *http.Request) (string, error) {
+	var req struct {
+		Alias string `json:"alias"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return "", errors.New("Invalid JSON")
+	}
+	if req.Alias == "" || req.Alias == productionAlias {
+		return "", nil
+	}
+	return req.Alias, validateAlias(req.Alias)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDeploymentAliases(t *testing.T) {
+	ts := newTestServer(t, countingRunner{n: new(atomic.Int32)})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID
+
+	get := func(host string) (int, string) {
+		req, _ := http.NewRequest("GET", ts.http.URL+"/", nil)
+		req.Host = host
+		resp, err := ts.http.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	staging := "staging." + project.Subdomain
+
+	if resp := ts.postJSON(t, path+"/rebuild", token, map[string]string{"alias": "-bad"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("rebuild for an invalid alias: status %d, want 400", resp.StatusCode)
+	}
+	ts.postJSON(t, path+"/rebuild", token, map[string]string{"alias": "staging"}, nil)
+	ts.waitForStatus(t, token, project.ID)
+	if got := ts.livePage(t, project.ID); got != "build 1" {
+		t.Errorf("staging build went live: %q", got)
+	}
+	if status, body := get(staging); status != http.StatusOK || body != "build 2" {
+		t.Errorf("staging host: %d %q", status, body)
+	}
+
+	var aliases []DeploymentAlias
+	ts.do(t, "GET", path+"/aliases", token, nil, "", &aliases)
+	if len(aliases) != 2 || aliases[0].Name != productionAlias || aliases[1].Name != "staging" || aliases[1].URL != "https://"+staging {
+		t.Fatalf("aliases %+v", aliases)
+	}
+	var deployments []Deployment
+	ts.do(t, "GET", path+"/deployments", token, nil, "", &deployments)
+	if deployments[0].Alias != "staging" || deployments[0].Live {
+		t.Errorf("staging deployment %+v", deployments[0])
+	}
+
+	var promoted DeploymentAlias
+	if resp := ts.postJSON(t, path+"/aliases", token, map[string]string{"name": productionAlias, "deployment_id": aliases[1].DeploymentID}, &promoted); resp.StatusCode != http.StatusOK {
+		t.Fatalf("promote: status %d", resp.StatusCode)
+	}
+	if got := ts.livePage(t, project.ID); got != "build 2" {
+		t.Errorf("after promoting staging, live page %q", got)
+	}
+	if resp := ts.postJSON(t, path+"/aliases", token, map[string]string{"name": "qa", "deployment_id": aliases[0].DeploymentID}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("new alias: status %d", resp.StatusCode)
+	}
+	if _, body := get("qa." + project.Subdomain); body != "build 1" {
+		t.Errorf("qa host served %q", body)
+	}
+	if resp := ts.postJSON(t, path+"/aliases", token, map[string]string{"name": "qa", "deployment_id": "nope"}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("alias to an unknown deployment: status %d, want 404", resp.StatusCode)
+	}
+
+	viewer := ts.signUp(t, "bob@example.com", "correct horse battery 1")
+	ts.do(t, "PUT", path+"/members", token, jsonBody(map[string]string{"email": "bob@example.com", "role": "viewer"}), "application/json", nil)
+	if resp := ts.postJSON(t, path+"/aliases", viewer, map[string]string{"name": "mine"}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("viewer setting an alias: status %d, want 403", resp.StatusCode)
+	}
+
+	if resp := ts.do(t, "DELETE", path+"/aliases/"+productionAlias, token, nil, "", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("deleting production: status %d, want 400", resp.StatusCode)
+	}
+	if resp := ts.do(t, "DELETE", path+"/aliases/staging", token, nil, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: status %d", resp.StatusCode)
+	}
+	if _, body := get(staging); body == "build 2" {
+		t.Error("deleted alias still served")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Users can restrict their account to a set of CIDR ranges. In "writes" mode
+// only requests that change something (uploads, deletes and the like) are
+// restricted; in "all" mode every authenticated request is. An empty list
+// turns the restriction off. Admin impersonation tokens are exempt, since
+// they are read-only and come from the admin's network.
+
+const (
+	allowlistWrites = "writes"
+	allowlistAll    = "all"
+)
+
+const maxAllowlistEntries = 50
+
+type IPAllowlist struct {
+	Mode  string   `json:"mode"`
+	CIDRs []string `json:"cidrs"`
+}
+
+func (s *Server) ipAllowlist(userID int) (IPAllowlist, error) {
+	list := IPAllowlist{CIDRs: []string{}}
+	if err := s.db.QueryRow("SELECT ip_allowlist_mode FROM users WHERE id = ?", userID).Scan(&list.Mode); err != nil {
+		return list, err
+	}
+	rows, err := s.db.Query("SELECT cidr FROM ip_allowlist WHERE user_id = ? ORDER BY created_at, cidr", userID)
+	if err != nil {
+		return list, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cidr string
+		if err := rows.Scan(&cidr); err != nil {
+			return list, err
+		}
+		list.CIDRs = append(list.CIDRs, cidr)
+	}
+	return list, rows.Err()
+}
+
+// parseCIDRs normalizes entries to CIDR notation; a bare address stands for
+// itself alone.
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR range", entry)
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func ipAllowed(ip string, nets []*net.IPNet) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIPAllowlist enforces the user's allowlist on r. It writes the error
+// response itself and reports whether to go on.
+func (s *Server) checkIPAllowlist(w http.ResponseWriter, r *http.Request, userID int) bool {
+	list, err := s.ipAllowlist(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if len(list.CIDRs) == 0 {
+		return true
+	}
+	if list.Mode != allowlistAll && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		return true
+	}
+	nets, _ := parseCIDRs(list.CIDRs)
+	if !ipAllowed(clientIP(r), nets) {
+		writeJSONError(w, http.StatusForbidden, "ip_not_allowed", "This account does not allow requests from your IP address")
+		return false
+	}
+	return true
+}
+
+func (s *Server) handleGetIPAllowlist(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	list, err := s.ipAllowlist(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleSetIPAllowlist replaces the allowlist. A list that would shut out
+// the address making the change is refused, so users can't lock themselves
+// out by mistake.
+func (s *Server) handleSetIPAllowlist(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	var req IPAllowlist
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = allowlistWrites
+	}
+	if req.Mode != allowlistWrites && req.Mode != allowlistAll {
+		writeJSONError(w, http.StatusBadRequest, "invalid_mode", `mode must be "writes" or "all"`)
+		return
+	}
+	if len(req.CIDRs) > maxAllowlistEntries {
+		writeJSONError(w, http.StatusBadRequest, "too_many_entries", fmt.Sprintf("At most %d ranges are allowed", maxAllowlistEntries))
+		return
+	}
+	nets, err := parseCIDRs(req.CIDRs)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_cidr", err.Error())
+		return
+	}
+	if len(nets) > 0 && !ipAllowed(clientIP(r), nets) {
+		writeJSONError(w, http.StatusConflict, "would_lock_out", "The list must include your current IP address, "+clientIP(r))
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE users SET ip_allowlist_mode = ? WHERE id = ?", req.Mode, userID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM ip_allowlist WHERE user_id = ?", userID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().Unix()
+	list := IPAllowlist{Mode: req.Mode, CIDRs: []string{}}
+	for _, n := range nets {
+		res, err := tx.Exec("INSERT OR IGNORE INTO ip_allowlist (user_id, cidr, created_at) VALUES (?, ?, ?)", userID, n.String(), now)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if added, _ := res.RowsAffected(); added > 0 {
+			list.CIDRs = append(list.CIDRs, n.String())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
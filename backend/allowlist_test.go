@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIPAllowlist(t *testing.T) {
+	trustedProxies = parseTrustedProxies("127.0.0.1")
+	t.Cleanup(func() { trustedProxies = nil })
+	ts := newTestServer(t, stubRunner{})
+	session := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	_, key := ts.createToken(t, session)
+	project, _ := ts.upload(t, session, "site", siteZip(t))
+	ts.waitForStatus(t, session, project.ID)
+
+	from := func(ip string) http.Header {
+		return http.Header{"X-Forwarded-For": {ip}, "Content-Type": {"application/json"}}
+	}
+	set := func(ip string, list IPAllowlist) *http.Response {
+		return ts.send(t, "PUT", "/api/me/ip-allowlist", session, jsonBody(list), from(ip), nil)
+	}
+
+	if resp := set("203.0.113.9", IPAllowlist{CIDRs: []string{"198.51.100.0/24"}}); resp.StatusCode != http.StatusConflict {
+		t.Errorf("list excluding the caller: status %d, want 409", resp.StatusCode)
+	}
+	if resp := set("203.0.113.9", IPAllowlist{CIDRs: []string{"not-an-ip"}}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid entry: status %d, want 400", resp.StatusCode)
+	}
+	if resp := set("203.0.113.9", IPAllowlist{CIDRs: []string{"203.0.113.0/24", "2001:db8::1"}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("set allowlist: status %d", resp.StatusCode)
+	}
+
+	// Writes mode: reads go through from anywhere, changes only from the list
+	if resp := ts.send(t, "GET", "/api/projects", key, nil, from("198.51.100.7"), nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("read from outside: status %d", resp.StatusCode)
+	}
+	if resp := ts.send(t, "DELETE", "/api/projects/"+project.ID, key, nil, from("198.51.100.7"), nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("API key delete from outside: status %d, want 403", resp.StatusCode)
+	}
+	if resp := ts.send(t, "POST", "/api/projects/"+project.ID+"/rebuild", session, nil, from("198.51.100.7"), nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("session rebuild from outside: status %d, want 403", resp.StatusCode)
+	}
+
+	if resp := set("203.0.113.9", IPAllowlist{Mode: allowlistAll, CIDRs: []string{"203.0.113.0/24"}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("set all mode: status %d", resp.StatusCode)
+	}
+	if resp := ts.send(t, "GET", "/api/projects", session, nil, from("198.51.100.7"), nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("read from outside in all mode: status %d, want 403", resp.StatusCode)
+	}
+	if resp := ts.send(t, "DELETE", "/api/projects/"+project.ID, key, nil, from("203.0.113.50"), nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("delete from inside: status %d", resp.StatusCode)
+	}
+
+	if resp := set("203.0.113.9", IPAllowlist{CIDRs: nil}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("clear allowlist: status %d", resp.StatusCode)
+	}
+	if resp := ts.send(t, "GET", "/api/projects", session, nil, from("198.51.100.7"), nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("after clearing: status %d", resp.StatusCode)
+	}
+}
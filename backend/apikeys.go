@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// API keys are long-lived credentials for scripts and CI. Only a hash is
+// stored; the prefix lets users tell their keys apart.
+const (
+	apiKeyPrefix    = "grape_"
+	apiKeyPrefixLen = len(apiKeyPrefix) + 8
+)
+
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// Scopes limit what a key can do. Routes name the scope they need; routes
+// that name none, such as account and key management, need a signed-in
+// session.
+const (
+	scopeProjectsRead  = "projects:read"
+	scopeProjectsWrite = "projects:write"
+	scopeDeployWrite   = "deploy:write"
+	// scopeStatusRead is for dashboards and status pages: it reads project
+	// status and logs, but not build output, variables or members.
+	scopeStatusRead = "status:read"
+)
+
+var allScopes = []string{scopeProjectsRead, scopeProjectsWrite, scopeDeployWrite, scopeStatusRead}
+
+// defaultScopes are granted to keys created without any; status:read is
+// left out since projects:read covers it.
+var defaultScopes = []string{scopeProjectsRead, scopeProjectsWrite, scopeDeployWrite}
+
+type APIKey struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  int64    `json:"created_at"`
+	LastUsedAt int64    `json:"last_used_at,omitempty"`
+	// Key is only set when the key is created
+	Key string `json:"key,omitempty"`
+}
+
+// validateScopes checks requested scopes, defaulting to defaultScopes.
+func validateScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return defaultScopes, nil
+	}
+	seen := map[string]bool{}
+	var out []string
+	for _, scope := range scopes {
+		if !hasScope(allScopes, scope) {
+			return nil, errors.New("unknown scope " + scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			out = append(out, scope)
+		}
+	}
+	return out, nil
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAPIKey resolves a key to its owner and the scopes it grants.
+func (s *Server) validateAPIKey(key string) (userID int, isAdmin bool, scopes []string, err error) {
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return 0, false, nil, errInvalidAPIKey
+	}
+	var (
+		keyID     int
+		scopeList string
+	)
+	err = s.db.QueryRow(`
+		SELECT k.id, k.scopes, u.id, u.is_admin FROM api_keys k JOIN users u ON u.id = k.user_id
+		WHERE k.key_hash = ?
+	`, hashToken(key)).Scan(&keyID, &scopeList, &userID, &isAdmin)
+	if err == sql.ErrNoRows {
+		return 0, false, nil, errInvalidAPIKey
+	}
+	if err != nil {
+		return 0, false, nil, err
+	}
+	s.db.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", time.Now().Unix(), keyID)
+	return userID, isAdmin, strings.Fields(scopeList), nil
+}
+
+// handleCreateAPIKey issues a key. The key itself is only ever shown in this
+// response.
+func (s *Server) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	var req struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Name == "" {
+		req.Name = "API key"
+	}
+	scopes, err := validateScopes(req.Scopes)
+	if err != nil {
+		http.Error(w, "Invalid scopes: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	apiKey, err := s.createAPIKey(userID, req.Name, scopes)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(apiKey)
+}
+
+// createAPIKey stores a new key for userID. The returned APIKey carries the
+// key itself, which can't be recovered later.
+func (s *Server) createAPIKey(userID int, name string, scopes []string) (APIKey, error) {
+	key := apiKeyPrefix + randomToken()
+	apiKey := APIKey{Name: name, Prefix: key[:apiKeyPrefixLen], Scopes: scopes, CreatedAt: time.Now().Unix(), Key: key}
+	res, err := s.db.Exec("INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, name, apiKey.Prefix, hashToken(key), strings.Join(scopes, " "), apiKey.CreatedAt)
+	if err != nil {
+		return APIKey{}, err
+	}
+	id, _ := res.LastInsertId()
+	apiKey.ID = int(id)
+	return apiKey, nil
+}
+
+func (s *Server) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	keys, err := s.listAPIKeys(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func (s *Server) listAPIKeys(userID int) ([]APIKey, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, prefix, scopes, created_at, COALESCE(last_used_at, 0)
+		FROM api_keys WHERE user_id = ? ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var (
+			k      APIKey
+			scopes string
+		)
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &scopes, &k.CreatedAt, &k.LastUsedAt); err != nil {
+			continue
+		}
+		k.Scopes = strings.Fields(scopes)
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *Server) handleDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	keyID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	res, err := s.db.Exec("DELETE FROM api_keys WHERE id = ? AND user_id = ?", keyID, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// createToken returns the new token and its secret.
+func (ts *testServer) createToken(t *testing.T, session string, scopes ...string) (APIKey, string) {
+	t.Helper()
+	var created struct {
+		APIKey
+		Key string `json:"key"`
+	}
+	resp := ts.postJSON(t, "/api/tokens", session, map[string]interface{}{"name": "ci", "scopes": scopes}, &created)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create token: status %d", resp.StatusCode)
+	}
+	return created.APIKey, created.Key
+}
+
+func TestScopedTokens(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	session := ts.signUp(t, "ada@example.com", "correct horse battery")
+
+	_, read := ts.createToken(t, session, scopeProjectsRead)
+	_, deploy := ts.createToken(t, session, scopeDeployWrite)
+
+	if resp := ts.do(t, "GET", "/api/projects", read, nil, "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("read token listing projects: status %d", resp.StatusCode)
+	}
+	if _, resp := ts.upload(t, read, "site", siteZip(t)); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("read token uploading: status %d, want 403", resp.StatusCode)
+	}
+
+	project, resp := ts.upload(t, deploy, "site", siteZip(t))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("deploy token uploading: status %d", resp.StatusCode)
+	}
+	ts.waitForStatus(t, session, project.ID)
+	if resp := ts.do(t, "GET", "/api/projects", deploy, nil, "", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("deploy token listing projects: status %d, want 403", resp.StatusCode)
+	}
+
+	// X-API-Key works as well as a bearer token
+	h := http.Header{}
+	h.Set("X-API-Key", read)
+	if resp := ts.send(t, "GET", "/api/projects/"+project.ID, "", nil, h, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("X-API-Key: status %d", resp.StatusCode)
+	}
+}
+
+func TestStatusReadToken(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	session := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, session, "site", siteZip(t))
+	ts.waitForStatus(t, session, project.ID)
+	_, status := ts.createToken(t, session, scopeStatusRead)
+
+	for _, path := range []string{"/api/projects", "/api/projects/" + project.ID, "/api/projects/" + project.ID + "/logs"} {
+		if resp := ts.do(t, "GET", path, status, nil, "", nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: status %d", path, resp.StatusCode)
+		}
+	}
+	for _, path := range []string{"/api/projects/" + project.ID + "/download", "/api/projects/" + project.ID + "/env"} {
+		if resp := ts.do(t, "GET", path, status, nil, "", nil); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("GET %s: status %d, want 403", path, resp.StatusCode)
+		}
+	}
+	if resp := ts.do(t, "POST", "/api/projects/"+project.ID+"/rebuild", status, nil, "", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("rebuild: status %d, want 403", resp.StatusCode)
+	}
+	if resp := ts.do(t, "DELETE", "/api/projects/"+project.ID, status, nil, "", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("delete: status %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestTokensCannotManageAccount(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	session := ts.signUp(t, "ada@example.com", "correct horse battery")
+	_, token := ts.createToken(t, session)
+
+	for _, path := range []string{"/api/tokens", "/api/me/webhook-secret"} {
+		if resp := ts.do(t, "GET", path, token, nil, "", nil); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("GET %s with a token: status %d, want 403", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestTokenDefaultsAndRevocation(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	session := ts.signUp(t, "ada@example.com", "correct horse battery")
+
+	if resp := ts.postJSON(t, "/api/tokens", session, map[string]interface{}{"scopes": []string{"root"}}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown scope: status %d, want 400", resp.StatusCode)
+	}
+
+	key, secret := ts.createToken(t, session)
+	var keys []APIKey
+	ts.do(t, "GET", "/api/tokens", session, nil, "", &keys)
+	if len(keys) != 1 || len(keys[0].Scopes) != len(defaultScopes) {
+		t.Fatalf("tokens = %+v, want one with the default scopes", keys)
+	}
+
+	if resp := ts.do(t, "DELETE", fmt.Sprintf("/api/tokens/%d", key.ID), session, nil, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("revoke: status %d", resp.StatusCode)
+	}
+	if resp := ts.do(t, "GET", "/api/projects", secret, nil, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("revoked token: status %d, want 401", resp.StatusCode)
+	}
+}
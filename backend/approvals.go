@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Protected projects (require_approval) don't put production builds live on
+// their own. A successful build is published and can be previewed, but waits
+// in the project's pending_deployment until an admin approves it, which makes
+// it live, or rejects it. A newer build replaces the one waiting. Alias and
+// branch builds aren't live, so they are never held.
+
+// Approval states of a deployment. Deployments that were never held have
+// none.
+const (
+	approvalPending    = "pending"
+	approvalApproved   = "approved"
+	approvalRejected   = "rejected"
+	approvalSuperseded = "superseded"
+)
+
+// approvedDeployment is the SQL condition for deployments that may be made
+// live by a rollback or a production alias: those never held or approved.
+const approvedDeployment = "approval IN ('', 'approved')"
+
+// holdForApproval makes a freshly published build the project's pending
+// deployment, superseding any build still waiting.
+func (s *Server) holdForApproval(projectID, deploymentID string, size int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`
+		UPDATE deployments SET approval = ?
+		WHERE project_id = ? AND id = (SELECT pending_deployment FROM projects WHERE id = ?)
+	`, approvalSuperseded, projectID, projectID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE deployments SET size = ?, approval = ? WHERE id = ?", size, approvalPending, deploymentID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE projects SET pending_deployment = ? WHERE id = ?", deploymentID, projectID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// awaitingApproval reports whether the deployment is the one the project
+// holds for approval.
+func (s *Server) awaitingApproval(projectID, deploymentID string) bool {
+	var pending string
+	s.db.QueryRow("SELECT pending_deployment FROM projects WHERE id = ?", projectID).Scan(&pending)
+	return pending != "" && pending == deploymentID
+}
+
+// handleApproveDeployment makes the pending deployment live. Admins only.
+func (s *Server) handleApproveDeployment(w http.ResponseWriter, r *http.Request) {
+	s.reviewDeployment(w, r, approvalApproved)
+}
+
+// handleRejectDeployment drops the pending deployment; the live site stays
+// as it is. Admins only.
+func (s *Server) handleRejectDeployment(w http.ResponseWriter, r *http.Request) {
+	s.reviewDeployment(w, r, approvalRejected)
+}
+
+// reviewDeployment records the decision on the project's pending deployment.
+// An optional deployment_id guards against deciding on a build that was
+// superseded meanwhile.
+func (s *Server) reviewDeployment(w http.ResponseWriter, r *http.Request, decision string) {
+	projectID, userID, ok := s.authorizeProject(w, r, roleAdmin)
+	if !ok {
+		return
+	}
+	var req struct {
+		DeploymentID string `json:"deployment_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+
+	var (
+		ownerID               int
+		status, live, pending string
+	)
+	if err := s.db.QueryRow("SELECT user_id, status, live_deployment, pending_deployment FROM projects WHERE id = ?", projectID).
+		Scan(&ownerID, &status, &live, &pending); err != nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Project not found")
+		return
+	}
+	if status == "archived" {
+		writeJSONError(w, http.StatusConflict, "project_archived", "Archived projects have no deployments")
+		return
+	}
+	if pending == "" {
+		writeJSONError(w, http.StatusConflict, "nothing_pending", "No deployment is waiting for approval")
+		return
+	}
+	if req.DeploymentID != "" && req.DeploymentID != pending {
+		writeJSONError(w, http.StatusConflict, "deployment_not_pending", "That deployment is not the one waiting for approval")
+		return
+	}
+
+	err := s.decideApproval(projectID, pending, userID, decision)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusConflict, "deployment_not_pending", "That deployment is not the one waiting for approval")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if decision == approvalApproved && live == "" {
+		if err := s.dropLegacyDeploy(projectID); err != nil {
+			log.Printf("project %s: cannot remove unversioned deploy: %v", projectID, err)
+		}
+	}
+	log.Printf("project %s: deployment %s %s by user %d", projectID, pending, decision, userID)
+	s.recordHistory(projectID, "approval", decision, pending)
+	s.invalidateProjectLists(projectID, ownerID)
+
+	d, err := s.getDeployment(projectID, pending)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// decideApproval clears the pending deployment, making it live if approved.
+// sql.ErrNoRows if it is no longer pending.
+func (s *Server) decideApproval(projectID, deploymentID string, userID int, decision string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	update := "UPDATE projects SET pending_deployment = '' WHERE id = ? AND pending_deployment = ? AND status != 'archived'"
+	if decision == approvalApproved {
+		update = "UPDATE projects SET live_deployment = pending_deployment, pending_deployment = '' WHERE id = ? AND pending_deployment = ? AND status != 'archived'"
+	}
+	res, err := tx.Exec(update, projectID, deploymentID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec("UPDATE deployments SET approval = ?, reviewed_by = ?, reviewed_at = ? WHERE id = ?",
+		decision, userID, time.Now().Unix(), deploymentID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDeploymentApprovals(t *testing.T) {
+	ts := newTestServer(t, countingRunner{n: new(atomic.Int32)})
+	alice := ts.signUp(t, "alice@example.com", "correct horse battery 0")
+	bob := ts.signUp(t, "bob@example.com", "correct horse battery 1")
+	project, _ := ts.upload(t, alice, "site", siteZip(t))
+	ts.waitForStatus(t, alice, project.ID)
+	path := "/api/projects/" + project.ID
+	ts.do(t, "PUT", path+"/members", alice, jsonBody(map[string]string{"email": "bob@example.com", "role": "deployer"}), "application/json", nil)
+
+	protect := map[string]bool{"require_approval": true}
+	if resp := ts.do(t, "PATCH", path, bob, jsonBody(protect), "application/json", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("deployer protecting the project: status %d, want 403", resp.StatusCode)
+	}
+	var updated Project
+	ts.do(t, "PATCH", path, alice, jsonBody(protect), "application/json", &updated)
+	if !updated.RequireApproval {
+		t.Fatalf("updated %+v", updated)
+	}
+
+	rebuild := func() Project {
+		ts.do(t, "POST", path+"/rebuild", bob, nil, "", nil)
+		return ts.waitForStatus(t, alice, project.ID)
+	}
+	deployments := func() []Deployment {
+		var list []Deployment
+		ts.do(t, "GET", path+"/deployments", alice, nil, "", &list)
+		return list
+	}
+
+	p := rebuild()
+	if p.Status != "live" || p.PendingDeployment == "" || !strings.Contains(p.BuildLog, "Waiting for approval") {
+		t.Fatalf("held build: %+v", p)
+	}
+	if got := ts.livePage(t, project.ID); got != "build 1" {
+		t.Errorf("held build went live: %q", got)
+	}
+	held := p.PendingDeployment
+	if d := deployments()[0]; d.ID != held || d.Approval != approvalPending || d.Live {
+		t.Errorf("held deployment %+v", d)
+	}
+
+	// Deployers can't approve, nor get around the gate
+	if resp := ts.postJSON(t, path+"/approve", bob, nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("deployer approving: status %d, want 403", resp.StatusCode)
+	}
+	if resp := ts.postJSON(t, path+"/rollback", bob, map[string]string{"deployment_id": held}, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("rolling back to a held build: status %d, want 409", resp.StatusCode)
+	}
+	if resp := ts.postJSON(t, path+"/aliases", bob, map[string]string{"name": productionAlias, "deployment_id": held}, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("promoting a held build: status %d, want 409", resp.StatusCode)
+	}
+	if resp := ts.do(t, "DELETE", path+"/deployments/"+held, bob, nil, "", nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("deleting a held build: status %d, want 409", resp.StatusCode)
+	}
+
+	// A newer build takes its place
+	p = rebuild()
+	if p.PendingDeployment == held || deployments()[1].Approval != approvalSuperseded {
+		t.Errorf("second held build: %+v", p)
+	}
+	if resp := ts.postJSON(t, path+"/approve", alice, map[string]string{"deployment_id": held}, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("approving a superseded build: status %d, want 409", resp.StatusCode)
+	}
+	var approved Deployment
+	if resp := ts.postJSON(t, path+"/approve", alice, nil, &approved); resp.StatusCode != http.StatusOK {
+		t.Fatalf("approve: status %d", resp.StatusCode)
+	}
+	if approved.ID != p.PendingDeployment || !approved.Live || approved.Approval != approvalApproved || approved.ReviewedBy == 0 {
+		t.Errorf("approved %+v", approved)
+	}
+	if got := ts.livePage(t, project.ID); got != "build 3" {
+		t.Errorf("after approval, live page %q", got)
+	}
+
+	p = rebuild()
+	var rejected Deployment
+	ts.postJSON(t, path+"/reject", alice, nil, &rejected)
+	if rejected.ID != p.PendingDeployment || rejected.Approval != approvalRejected || rejected.Live {
+		t.Errorf("rejected %+v", rejected)
+	}
+	if got := ts.livePage(t, project.ID); got != "build 3" {
+		t.Errorf("after rejection, live page %q", got)
+	}
+	if resp := ts.postJSON(t, path+"/approve", alice, nil, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("approving with nothing pending: status %d, want 409", resp.StatusCode)
+	}
+	var status Project
+	ts.do(t, "GET", path, alice, nil, "", &status)
+	if status.PendingDeployment != "" {
+		t.Errorf("status after rejection %+v", status)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	formatZip    = "zip"
+	formatTarGz  = "tar.gz"
+	formatTarZst = "tar.zst"
+)
+
+// archiveFormats lists the supported formats with the extension their uploads
+// are stored under.
+var archiveFormats = []struct {
+	format string
+	ext    string
+}{
+	{formatZip, ".zip"},
+	{formatTarGz, ".tar.gz"},
+	{formatTarZst, ".tar.zst"},
+}
+
+func archiveExt(format string) string {
+	for _, f := range archiveFormats {
+		if f.format == format {
+			return f.ext
+		}
+	}
+	return ""
+}
+
+func hasArchiveExtension(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar.gz", ".tgz", ".tar.zst", ".tzst"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+var maxZipRatio = envInt("GRAPE_MAX_ZIP_RATIO", 100)
+
+// Huge numbers of tiny files or absurdly deep trees slow down both the worker
+// and the static server.
+var (
+	maxArchiveFiles = envInt("GRAPE_MAX_ARCHIVE_FILES", 10000)
+	maxArchiveDepth = envInt("GRAPE_MAX_ARCHIVE_DEPTH", 32)
+)
+
+func checkEntryDepth(name string) error {
+	clean := strings.Trim(path.Clean("/"+name), "/")
+	if depth := strings.Count(clean, "/") + 1; clean != "" && depth > maxArchiveDepth {
+		return fmt.Errorf("%s is nested %d levels deep, more than the allowed %d", clean, depth, maxArchiveDepth)
+	}
+	return nil
+}
+
+var zipMagic = [][]byte{
+	[]byte("PK\x03\x04"),
+	[]byte("PK\x05\x06"), // empty archive
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// maxZstdWindow caps the memory a zstd stream may ask for to decompress;
+// zstd -19 and below stay within 8 MB, --long=25 within 32 MB.
+const maxZstdWindow = 32 << 20
+
+// sniffArchive identifies an upload's format from its content, whatever its
+// file name says.
+func sniffArchive(r io.ReaderAt) (string, error) {
+	head := make([]byte, 4)
+	if _, err := r.ReadAt(head, 0); err != nil {
+		return "", errors.New("file is too small to be an archive")
+	}
+	for _, magic := range zipMagic {
+		if bytes.Equal(head, magic) {
+			return formatZip, nil
+		}
+	}
+	if bytes.HasPrefix(head, gzipMagic) {
+		return formatTarGz, nil
+	}
+	if bytes.Equal(head, zstdMagic) {
+		return formatTarZst, nil
+	}
+	return "", errors.New("file is not a zip, tar.gz or tar.zst archive")
+}
+
+// decompressTar unwraps the compression around a tar stream.
+func decompressTar(r io.Reader, format string) (io.ReadCloser, error) {
+	switch format {
+	case formatTarGz:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt gzip stream: %v", err)
+		}
+		return gz, nil
+	case formatTarZst:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(maxZstdWindow))
+		if err != nil {
+			return nil, fmt.Errorf("corrupt zstd stream: %v", err)
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported archive format %q", format)
+}
+
+func validateArchive(r io.ReaderAt, size int64, format string) error {
+	switch format {
+	case formatZip:
+		return validateZip(r, size)
+	case formatTarGz, formatTarZst:
+		return validateTar(io.NewSectionReader(r, 0, size), size, format)
+	}
+	return fmt.Errorf("unsupported archive format %q", format)
+}
+
+// validateZip checks that a zip archive, as identified by sniffArchive, is
+// readable, that its declared sizes don't look like a decompression bomb and
+// that it stays within the file count and depth limits.
+func validateZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("corrupt zip archive: %v", err)
+	}
+
+	var compressed, uncompressed uint64
+	var files int
+	for _, f := range zr.File {
+		compressed += f.CompressedSize64
+		uncompressed += f.UncompressedSize64
+		if !f.FileInfo().IsDir() {
+			files++
+		}
+		if err := checkEntryDepth(f.Name); err != nil {
+			return err
+		}
+	}
+	if files > maxArchiveFiles {
+		return fmt.Errorf("archive contains %d files, more than the allowed %d", files, maxArchiveFiles)
+	}
+	if compressed > 0 && uncompressed/compressed > uint64(maxZipRatio) {
+		return fmt.Errorf("archive expands %dx, more than the allowed %dx", uncompressed/compressed, maxZipRatio)
+	}
+	return checkProjectSize("unpacked archive", int64(min(uncompressed, 1<<62)))
+}
+
+// validateTar applies the same limits as validateZip. Tar has no central
+// directory, so the headers are read by streaming through the archive, and
+// the scan stops as soon as the declared sizes exceed the allowed ratio.
+func validateTar(r io.Reader, size int64, format string) error {
+	stream, err := decompressTar(r, format)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	tr := tar.NewReader(stream)
+
+	maxSize := uint64(size) * uint64(maxZipRatio)
+	var files int
+	var uncompressed uint64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("corrupt tar archive: %v", err)
+		}
+		if err := checkEntryDepth(hdr.Name); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		files++
+		if files > maxArchiveFiles {
+			return fmt.Errorf("archive contains more than the allowed %d files", maxArchiveFiles)
+		}
+		uncompressed += uint64(hdr.Size)
+		if uncompressed > maxSize {
+			return fmt.Errorf("archive expands more than the allowed %dx", maxZipRatio)
+		}
+		if err := checkProjectSize("unpacked archive", int64(uncompressed)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractArchive unpacks src into dest. Entries that would land outside dest
+// are rejected, and so are archives unpacking to more than maxProjectSize.
+func extractArchive(src, dest, format string) error {
+	switch format {
+	case formatZip:
+		return extractZip(src, dest)
+	case formatTarGz, formatTarZst:
+		return extractTar(src, dest, format)
+	}
+	return fmt.Errorf("unsupported archive format %q", format)
+}
+
+func extractZip(src, dest string) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var budget extractBudget
+	for _, f := range r.File {
+		fpath := filepath.Join(dest, f.Name)
+		if !strings.HasPrefix(fpath, filepath.Clean(dest)+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid file path: %s", f.Name)
+		}
+
+		if f.FileInfo().IsDir() {
+			os.MkdirAll(fpath, 0755)
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			return err
+		}
+
+		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+		if err != nil {
+			return err
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			outFile.Close()
+			return err
+		}
+
+		err = budget.copy(outFile, rc)
+		outFile.Close()
+		rc.Close()
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTar(src, dest, format string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stream, err := decompressTar(f, format)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	tr := tar.NewReader(stream)
+
+	var budget extractBudget
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fpath := filepath.Join(dest, hdr.Name)
+		if fpath == filepath.Clean(dest) {
+			continue
+		}
+		if !strings.HasPrefix(fpath, filepath.Clean(dest)+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid file path: %s", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(fpath, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+				return err
+			}
+			outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			err = budget.copy(outFile, io.LimitReader(tr, hdr.Size))
+			outFile.Close()
+			if err != nil {
+				return err
+			}
+		}
+		// Links and special files are skipped
+	}
+}
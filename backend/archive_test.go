@@ -0,0 +1,83 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// tarArchive packs files into a tar stream compressed for format.
+func tarArchive(t *testing.T, format string, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch format {
+	case formatTarGz:
+		w = gzip.NewWriter(&buf)
+	case formatTarZst:
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	for name, body := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(body)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTarUploads(t *testing.T) {
+	ts := newTestServer(t, sourceRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+
+	for _, tt := range []struct{ format, filename string }{
+		{formatTarGz, "site.tgz"},
+		{formatTarZst, "site.tar.zst"},
+	} {
+		archive := tarArchive(t, tt.format, map[string][]byte{"index.html": []byte("<h1>" + tt.format + "</h1>")})
+		if format, err := sniffArchive(bytes.NewReader(archive)); err != nil || format != tt.format {
+			t.Fatalf("%s sniffed as %q, %v", tt.filename, format, err)
+		}
+
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("project", tt.filename)
+		part.Write(archive)
+		mw.Close()
+		var project Project
+		if resp := ts.do(t, "POST", "/api/upload", token, &body, mw.FormDataContentType(), &project); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d", tt.filename, resp.StatusCode)
+		}
+		if p := ts.waitForStatus(t, token, project.ID); p.Status != "live" {
+			t.Fatalf("%s: build %s: %s", tt.filename, p.Status, p.BuildLog)
+		}
+		if got := ts.livePage(t, project.ID); got != "<h1>"+tt.format+"</h1>" {
+			t.Errorf("%s: live page %q", tt.filename, got)
+		}
+	}
+
+	bomb := tarArchive(t, formatTarZst, map[string][]byte{"zeros.bin": make([]byte, 8<<20)})
+	if err := validateArchive(bytes.NewReader(bomb), int64(len(bomb)), formatTarZst); err == nil {
+		t.Error("highly compressed tar.zst accepted")
+	}
+	if !hasArchiveExtension("SITE.TZST") || hasArchiveExtension("site.tar") {
+		t.Error("archive extensions")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// With branch deploys on, a project linked to Git also builds pushes to its
+// other branches, each into its own host: feature/x of myapp is served at
+// feature-x--myapp.grape.ai. Branch builds use the project's settings and
+// leave its live site and stored source alone. Deleting the branch removes
+// its deploy.
+
+// maxBranchLabel leaves room in a DNS label for "--" and the project.
+const maxBranchLabel = 30
+
+var branchLabelSeparators = regexp.MustCompile(`[^a-z0-9]+`)
+
+type BranchDeploy struct {
+	Branch       string `json:"branch"`
+	URL          string `json:"url"`
+	DeploymentID string `json:"deployment_id"`
+	UpdatedAt    int64  `json:"updated_at"`
+}
+
+// branchLabel turns a branch name into its part of the host. Names that
+// had to be shortened, or that clash with another branch's label, get a
+// hash of the branch name appended.
+func branchLabel(branch string, taken func(string) bool) string {
+	label := strings.Trim(branchLabelSeparators.ReplaceAllString(strings.ToLower(branch), "-"), "-")
+	if label == "" {
+		label = "branch"
+	}
+	if len(label) <= maxBranchLabel && !taken(label) {
+		return label
+	}
+	sum := sha1.Sum([]byte(branch))
+	if len(label) > maxBranchLabel-7 {
+		label = strings.TrimRight(label[:maxBranchLabel-7], "-")
+	}
+	return label + "-" + hex.EncodeToString(sum[:])[:6]
+}
+
+// branchHost is where a branch of the project served at subdomain lives.
+// Branches of projects whose slug is too long to share one label are named
+// after the project ID instead.
+func branchHost(projectID, subdomain, label string) string {
+	host := label + "--" + strings.TrimSuffix(subdomain, "."+baseDomain)
+	if len(host) > maxLabelLength {
+		host = label + "--" + projectID
+	}
+	return host + "." + baseDomain
+}
+
+// branchForHost returns the project and deployment a branch host names, if
+// any.
+func (s *Server) branchForHost(host string) (projectID, deploymentID string) {
+	label, project, ok := strings.Cut(strings.TrimSuffix(host, "."+baseDomain), "--")
+	if !ok || strings.Contains(project, ".") {
+		return "", ""
+	}
+	s.db.QueryRow(`
+		SELECT p.id, b.deployment_id FROM branch_deploys b JOIN projects p ON p.id = b.project_id
+		WHERE b.label = ? AND (p.subdomain = ? OR p.id = ?) AND p.status != 'archived'
+	`, label, project+"."+baseDomain, project).Scan(&projectID, &deploymentID)
+	if deploymentID == "" {
+		return "", ""
+	}
+	return projectID, deploymentID
+}
+
+// switchBranch serves a freshly published deployment for its branch.
+func (s *Server) switchBranch(projectID, branch, deploymentID string, size int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE deployments SET size = ? WHERE id = ?", size, deploymentID); err != nil {
+		return err
+	}
+	var label string
+	tx.QueryRow("SELECT label FROM branch_deploys WHERE project_id = ? AND branch = ?", projectID, branch).Scan(&label)
+	if label == "" {
+		label = branchLabel(branch, func(label string) bool {
+			var taken bool
+			tx.QueryRow("SELECT EXISTS (SELECT 1 FROM branch_deploys WHERE project_id = ? AND label = ?)", projectID, label).Scan(&taken)
+			return taken
+		})
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO branch_deploys (project_id, branch, label, deployment_id, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (project_id, branch) DO UPDATE SET deployment_id = excluded.deployment_id, updated_at = excluded.updated_at
+	`, projectID, branch, label, deploymentID, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// removeBranchDeploy stops serving a deleted branch and drops its builds,
+// except any that went live or that an alias points at.
+func (s *Server) removeBranchDeploy(projectID, branch string) error {
+	if _, err := s.execWithRetry("DELETE FROM branch_deploys WHERE project_id = ? AND branch = ?", projectID, branch); err != nil {
+		return err
+	}
+	rows, err := s.db.Query(`
+		SELECT id FROM deployments WHERE project_id = ? AND branch = ?
+			AND id != (SELECT live_deployment FROM projects WHERE id = ?)
+			AND id NOT IN (SELECT deployment_id FROM project_aliases WHERE project_id = ?)
+			AND status NOT IN ('queued', 'building')
+	`, projectID, branch, projectID, projectID)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	for _, id := range ids {
+		if err := s.storage.Delete(deploymentPrefix(projectID, id)); err != nil {
+			log.Printf("project %s: cannot remove deployment %s: %v", projectID, id, err)
+			continue
+		}
+		if _, err := s.execWithRetry("DELETE FROM deployments WHERE id = ?", id); err != nil {
+			return err
+		}
+	}
+	log.Printf("project %s: removed the deploy of deleted branch %s", projectID, branch)
+	return nil
+}
+
+// handleListBranchDeploys lists the project's branch deploys, most recently
+// updated first.
+func (s *Server) handleListBranchDeploys(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleViewer)
+	if !ok {
+		return
+	}
+	var subdomain string
+	if err := s.db.QueryRow("SELECT subdomain FROM projects WHERE id = ?", projectID).Scan(&subdomain); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	branches, err := s.branchDeploys(projectID, subdomain)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(branches)
+}
+
+func (s *Server) branchDeploys(projectID, subdomain string) ([]BranchDeploy, error) {
+	rows, err := s.db.Query("SELECT branch, label, deployment_id, updated_at FROM branch_deploys WHERE project_id = ? ORDER BY updated_at DESC, branch",
+		projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	branches := []BranchDeploy{}
+	for rows.Next() {
+		var b BranchDeploy
+		var label string
+		if err := rows.Scan(&b.Branch, &label, &b.DeploymentID, &b.UpdatedAt); err != nil {
+			return nil, err
+		}
+		b.URL = "https://" + branchHost(projectID, subdomain, label)
+		branches = append(branches, b)
+	}
+	return branches, rows.Err()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBranchLabel(t *testing.T) {
+	free := func(string) bool { return false }
+	for branch, want := range map[string]string{
+		"feature/x":   "feature-x",
+		"Fix_Login!!": "fix-login",
+		"///":         "branch",
+	} {
+		if got := branchLabel(branch, free); got != want {
+			t.Errorf("branchLabel(%q) = %q, want %q", branch, got, want)
+		}
+	}
+	long := branchLabel(strings.Repeat("a", 40), free)
+	if len(long) > maxBranchLabel || !strings.HasPrefix(long, "aaaa") {
+		t.Errorf("long branch label %q", long)
+	}
+	taken := branchLabel("feature-x", func(label string) bool { return label == "feature-x" })
+	if taken == "feature-x" || !strings.HasPrefix(taken, "feature-x-") {
+		t.Errorf("clashing label %q", taken)
+	}
+}
+
+func TestBranchDeploys(t *testing.T) {
+	repo := gitRepo(t)
+	ts := newTestServer(t, sourceRunner{})
+	remote := ts.gitRemote(t, repo)
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID
+
+	var link gitLink
+	ts.do(t, "PUT", path+"/git", token, jsonBody(map[string]interface{}{"repo_url": remote, "branch_deploys": true}), "application/json", &link)
+	if !link.BranchDeploys {
+		t.Fatalf("link %+v", link)
+	}
+
+	git := func(args ...string) string {
+		out, err := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=Ada", "-c", "user.email=ada@example.com"}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("checkout", "-qb", "feature/x")
+	os.WriteFile(filepath.Join(repo, "index.html"), []byte("<h1>feature</h1>"), 0644)
+	git("commit", "-qam", "Try a new home page")
+	sha := git("rev-parse", "HEAD")
+	git("checkout", "-q", "main")
+
+	deliver := func(payload string) {
+		body := []byte(payload)
+		req, _ := http.NewRequest("POST", ts.http.URL+"/api/hooks/github", bytes.NewReader(body))
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-Hub-Signature-256", signWebhook(link.Secret, body))
+		resp, err := ts.http.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("push: status %d", resp.StatusCode)
+		}
+	}
+	deliver(`{"ref": "refs/heads/feature/x", "after": "` + sha + `", "repository": {"clone_url": "` + remote + `"}}`)
+	if p := ts.waitForStatus(t, token, project.ID); p.Status != "live" {
+		t.Fatalf("branch build %s: %s", p.Status, p.BuildLog)
+	}
+	if got := ts.livePage(t, project.ID); got != "<h1>hello</h1>" {
+		t.Errorf("branch build went live: %q", got)
+	}
+
+	var branches []BranchDeploy
+	ts.do(t, "GET", path+"/branches", token, nil, "", &branches)
+	host := "feature-x--" + project.Subdomain
+	if len(branches) != 1 || branches[0].Branch != "feature/x" || branches[0].URL != "https://"+host {
+		t.Fatalf("branches %+v", branches)
+	}
+	get := func() (int, string) {
+		req, _ := http.NewRequest("GET", ts.http.URL+"/", nil)
+		req.Host = host
+		resp, err := ts.http.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if status, body := get(); status != http.StatusOK || body != "<h1>feature</h1>" {
+		t.Errorf("branch host: %d %q", status, body)
+	}
+
+	var deployments []Deployment
+	ts.do(t, "GET", path+"/deployments", token, nil, "", &deployments)
+	if len(deployments) != 2 || deployments[0].Branch != "feature/x" || deployments[0].Commit != sha {
+		t.Errorf("deployments %+v", deployments)
+	}
+	resp := ts.do(t, "POST", path+"/rebuild", token, nil, "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("rebuild: status %d", resp.StatusCode)
+	}
+	ts.waitForStatus(t, token, project.ID)
+	if got := ts.livePage(t, project.ID); got != "<h1>hello</h1>" {
+		t.Errorf("rebuild after a branch deploy built %q", got)
+	}
+
+	deliver(`{"ref": "refs/heads/feature/x", "after": "` + zeroCommit + `", "deleted": true, "repository": {"clone_url": "` + remote + `"}}`)
+	if status, _ := get(); status == http.StatusOK {
+		t.Error("deleted branch still served")
+	}
+	deployments = nil
+	ts.do(t, "GET", path+"/deployments", token, nil, "", &deployments)
+	if len(deployments) != 2 {
+		t.Errorf("deployments after deleting the branch %+v", deployments)
+	}
+	for _, d := range deployments {
+		if d.Branch != "" {
+			t.Errorf("deleted branch's deployment kept: %+v", d)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// A breach filter is a Bloom filter of the SHA-1 hashes of breached
+// passwords, built from the Have I Been Pwned password list so lookups stay
+// local. The file is a header (magic, hash count k, bit count m) followed by
+// the m bits. It is read in place, a few bytes per lookup, so even a filter
+// of the full list costs no memory.
+
+const breachFilterMagic = "GRAPEBF1"
+
+const breachFilterHeaderLen = len(breachFilterMagic) + 4 + 8
+
+type breachFilter struct {
+	f *os.File
+	k uint32
+	m uint64
+}
+
+func openBreachFilter(path string) (*breachFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, breachFilterHeaderLen)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:len(breachFilterMagic)]) != breachFilterMagic {
+		f.Close()
+		return nil, errors.New("not a breach filter file")
+	}
+	bf := &breachFilter{
+		f: f,
+		k: binary.BigEndian.Uint32(header[len(breachFilterMagic):]),
+		m: binary.BigEndian.Uint64(header[len(breachFilterMagic)+4:]),
+	}
+	if bf.k == 0 || bf.m == 0 {
+		f.Close()
+		return nil, errors.New("breach filter has no bits or hashes")
+	}
+	return bf, nil
+}
+
+// breachFilterBits returns the k bit positions for a SHA-1 digest, by
+// double hashing its two leading 64-bit words.
+func breachFilterBits(sum []byte, k uint32, m uint64) []uint64 {
+	h1 := binary.BigEndian.Uint64(sum[0:8])
+	h2 := binary.BigEndian.Uint64(sum[8:16]) | 1
+	bits := make([]uint64, k)
+	for i := range bits {
+		bits[i] = (h1 + uint64(i)*h2) % m
+	}
+	return bits
+}
+
+// contains reports whether password is probably in the breach list.
+func (bf *breachFilter) contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	var b [1]byte
+	for _, bit := range breachFilterBits(sum[:], bf.k, bf.m) {
+		if _, err := bf.f.ReadAt(b[:], int64(breachFilterHeaderLen)+int64(bit/8)); err != nil {
+			return false, err
+		}
+		if b[0]&(1<<(bit%8)) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// buildBreachFilter writes a filter for the hashes in src, one hex SHA-1 per
+// line as in the HIBP downloads ("HASH:COUNT"), sized for a false positive
+// rate of 1 in 1000.
+func buildBreachFilter(src, dst string) (int, error) {
+	readHashes := func(fn func([]byte)) (int, error) {
+		f, err := os.Open(src)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		n := 0
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			hash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+			sum, err := hex.DecodeString(hash)
+			if err != nil || len(sum) != sha1.Size {
+				continue
+			}
+			fn(sum)
+			n++
+		}
+		return n, scanner.Err()
+	}
+
+	n, err := readHashes(func([]byte) {})
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("no SHA-1 hashes in %s", src)
+	}
+	const falsePositiveRate = 0.001
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	bitset := make([]byte, (m+7)/8)
+	if _, err := readHashes(func(sum []byte) {
+		for _, bit := range breachFilterBits(sum, k, m) {
+			bitset[bit/8] |= 1 << (bit % 8)
+		}
+	}); err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, breachFilterHeaderLen)
+	copy(header, breachFilterMagic)
+	binary.BigEndian.PutUint32(header[len(breachFilterMagic):], k)
+	binary.BigEndian.PutUint64(header[len(breachFilterMagic)+4:], m)
+	tmp := dst + ".tmp"
+	if err := os.WriteFile(tmp, append(header, bitset...), 0644); err != nil {
+		return 0, err
+	}
+	return n, os.Rename(tmp, dst)
+}
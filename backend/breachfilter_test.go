@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeBreachFilter(t *testing.T, passwords ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	var list strings.Builder
+	for _, p := range passwords {
+		fmt.Fprintf(&list, "%X:42\r\n", sha1.Sum([]byte(p)))
+	}
+	src := filepath.Join(dir, "pwned.txt")
+	if err := os.WriteFile(src, []byte(list.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "breached.bf")
+	if n, err := buildBreachFilter(src, dst); err != nil || n != len(passwords) {
+		t.Fatalf("buildBreachFilter = %d, %v", n, err)
+	}
+	return dst
+}
+
+func TestBreachFilter(t *testing.T) {
+	bf, err := openBreachFilter(writeBreachFilter(t, "password1", "letmein99", "qwerty123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"password1", "letmein99", "qwerty123"} {
+		if ok, err := bf.contains(p); !ok || err != nil {
+			t.Errorf("contains(%q) = %v, %v; want true", p, ok, err)
+		}
+	}
+	if ok, _ := bf.contains("correct horse battery 0"); ok {
+		t.Error("filter contains a password that was never added")
+	}
+
+	if _, err := openBreachFilter(filepath.Join("testdata", "missing.bf")); err == nil {
+		t.Error("opened a missing filter")
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	t.Setenv("GRAPE_PASSWORD_MIN_LENGTH", "12")
+	t.Setenv("GRAPE_PASSWORD_REQUIRE_MIXED", "false")
+	t.Setenv("GRAPE_PASSWORD_BREACH_FILTER", writeBreachFilter(t, "correct horse battery"))
+	ts := newTestServer(t, stubRunner{})
+
+	for _, tc := range []struct {
+		password string
+		status   int
+		code     string
+	}{
+		{"short pass", http.StatusBadRequest, "password_too_short"},
+		{strings.Repeat("a", 73), http.StatusBadRequest, "password_too_long"},
+		{"correct horse battery", http.StatusBadRequest, "password_breached"},
+		{"correct horse staple", http.StatusOK, ""},
+	} {
+		resp, err := ts.http.Client().Post(ts.http.URL+"/api/register", "application/json",
+			jsonBody(map[string]string{"email": "ada@example.com", "password": tc.password}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || out.Error != tc.code {
+			t.Errorf("register with %q: status %d %q, want %d %q", tc.password, resp.StatusCode, out.Error, tc.status, tc.code)
+		}
+	}
+}
+
+func TestPasswordPolicyRequireMixed(t *testing.T) {
+	t.Setenv("GRAPE_PASSWORD_REQUIRE_MIXED", "true")
+	ts := newTestServer(t, stubRunner{})
+
+	if resp := ts.postJSON(t, "/api/register", "", map[string]string{"email": "ada@example.com", "password": "correct horse battery"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("letters only: status %d, want 400", resp.StatusCode)
+	}
+	if resp := ts.postJSON(t, "/api/register", "", map[string]string{"email": "ada@example.com", "password": "correct horse battery 0"}, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("letters and digits: status %d", resp.StatusCode)
+	}
+}
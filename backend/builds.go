@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buildTracker keeps track of in-flight builds so they can be cancelled
+// individually or drained on shutdown.
+type buildTracker struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	running map[string]*runningBuild
+}
+
+type runningBuild struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newBuildTracker() *buildTracker {
+	return &buildTracker{running: make(map[string]*runningBuild)}
+}
+
+var (
+	defaultBuildTimeout = envDuration("GRAPE_BUILD_TIMEOUT", 10*time.Minute)
+	maxBuildTimeout     = envDuration("GRAPE_BUILD_TIMEOUT_MAX", 30*time.Minute)
+)
+
+var (
+	buildRetries      = envInt("GRAPE_BUILD_RETRIES", 2)
+	buildRetryBackoff = envDuration("GRAPE_BUILD_RETRY_BACKOFF", 10*time.Second)
+)
+
+// The worker exits with EX_TEMPFAIL when it knows a failure is worth retrying.
+const workerTransientExitCode = 75
+
+// Output that points at the network rather than the project itself.
+var transientFailurePattern = regexp.MustCompile(
+	`(?i)ETIMEDOUT|ECONNRESET|ECONNREFUSED|ENOTFOUND|EAI_AGAIN|socket hang up|network timeout|` +
+		`503 Service Unavailable|502 Bad Gateway|429 Too Many Requests`)
+
+func isTransientFailure(err error, output string) bool {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == workerTransientExitCode {
+		return true
+	}
+	return transientFailurePattern.MatchString(output)
+}
+
+// Worker output lines of the form "::stage:<name>" report progress instead of
+// going to the build log.
+var stageMarker = regexp.MustCompile(`^::stage:([a-z0-9_-]{1,32})\s*$`)
+
+// BuildRunner builds the project at projectPath into stagePath and returns
+// the build output, calling onStage as the build reports progress.
+type BuildRunner interface {
+	Run(ctx context.Context, projectPath, stagePath string, timeout time.Duration, env []string, onStage func(string)) (string, error)
+}
+
+// workerRunner runs builds with the Python worker script.
+type workerRunner struct {
+	script string
+}
+
+// Run runs the build worker and returns its combined output, calling onStage
+// for each stage marker as it is printed.
+func (wr workerRunner) Run(ctx context.Context, projectPath, stagePath string, timeout time.Duration, env []string, onStage func(string)) (string, error) {
+	pythonExec := "python3"
+	if runtime.GOOS == "windows" {
+		pythonExec = "python"
+	}
+
+	cmd := exec.CommandContext(ctx, pythonExec, wr.script, projectPath, stagePath)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("GRAPE_BUILD_TIMEOUT=%d", int(timeout.Seconds())))
+	// Don't wait forever on output pipes held open by orphaned grandchildren
+	cmd.WaitDelay = 5 * time.Second
+
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	var output strings.Builder
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		br := bufio.NewReader(pr)
+		for {
+			line, err := br.ReadString('\n')
+			if m := stageMarker.FindStringSubmatch(line); m != nil {
+				onStage(m[1])
+			} else {
+				output.WriteString(line)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	pw.Close()
+	<-done
+	return output.String(), err
+}
+
+// parseBuildTimeout validates a per-upload timeout override, clamping it to
+// maxBuildTimeout. An empty value means the global default.
+func parseBuildTimeout(v string) (time.Duration, error) {
+	if v == "" {
+		return defaultBuildTimeout, nil
+	}
+	d, err := parseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	if d < time.Second {
+		return 0, errors.New("must be at least 1s")
+	}
+	if d > maxBuildTimeout {
+		d = maxBuildTimeout
+	}
+	return d, nil
+}
+
+// startBuild records a new deployment of the project and builds it in the
+// background.
+func (s *Server) startBuild(projectID, projectPath string, src deploySource) {
+	deploymentID, err := s.createDeployment(projectID, src)
+	if err != nil {
+		log.Printf("project %s: cannot record deployment: %v", projectID, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rb := &runningBuild{cancel: cancel, done: make(chan struct{})}
+
+	s.builds.mu.Lock()
+	s.builds.running[projectID] = rb
+	s.builds.mu.Unlock()
+
+	s.counters.QueuedBuilds.Add(1)
+	s.builds.wg.Add(1)
+	go func() {
+		defer s.builds.wg.Done()
+		defer func() {
+			s.builds.mu.Lock()
+			if s.builds.running[projectID] == rb {
+				delete(s.builds.running, projectID)
+			}
+			s.builds.mu.Unlock()
+			cancel()
+			close(rb.done)
+		}()
+		s.runBuild(ctx, projectID, projectPath, deploymentID)
+	}()
+}
+
+// cancel stops the project's in-flight build, if any, and returns a channel
+// that is closed once it has finished cleaning up.
+func (b *buildTracker) cancel(projectID string) <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rb, ok := b.running[projectID]
+	if !ok {
+		return nil
+	}
+	rb.cancel()
+	return rb.done
+}
+
+// cancelAndWait cancels the given projects' builds and waits up to timeout
+// for them to stop.
+func (b *buildTracker) cancelAndWait(projectIDs []string, timeout time.Duration) {
+	var pending []<-chan struct{}
+	for _, id := range projectIDs {
+		if done := b.cancel(id); done != nil {
+			pending = append(pending, done)
+		}
+	}
+	deadline := time.After(timeout)
+	for _, done := range pending {
+		select {
+		case <-done:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+func (b *buildTracker) cancelAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, rb := range b.running {
+		rb.cancel()
+	}
+}
+
+// wait blocks until every tracked build has returned or ctx is done.
+func (b *buildTracker) wait(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// drainBuilds waits for in-flight builds until ctx expires, then cancels the
+// stragglers and marks anything still building as failed.
+func (s *Server) drainBuilds(ctx context.Context) {
+	if s.builds.wait(ctx) {
+		return
+	}
+
+	log.Println("Grace period expired, cancelling in-flight builds")
+	s.builds.cancelAll()
+
+	settle, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.builds.wait(settle)
+
+	if _, err := s.failProjectsIn("\nError: build interrupted by server shutdown", "building"); err != nil {
+		log.Printf("cannot fail interrupted builds: %v", err)
+	}
+}
+
+// recoverInterruptedBuilds fails projects left queued or building by a
+// previous process that exited without draining them.
+func (s *Server) recoverInterruptedBuilds() {
+	n, err := s.failProjectsIn("\nError: build interrupted by server restart, please upload again", "queued", "building")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if n > 0 {
+		log.Printf("Marked %d interrupted builds as failed", n)
+	}
+}
+
+// restoreSource re-extracts the stored upload when the project's source is
+// missing locally, e.g. on an instance other than the one that took the upload.
+func (s *Server) restoreSource(projectID, projectPath string) error {
+	if _, err := os.Stat(projectPath); err == nil {
+		return nil
+	}
+	key, format, err := s.findUpload(projectID)
+	if err != nil {
+		return err
+	}
+	archive := filepath.Join(s.cfg.StagingDir, projectID+archiveExt(format))
+	defer os.Remove(archive)
+	if err := fetchFile(s.storage, key, archive); err != nil {
+		return err
+	}
+	if err := extractArchive(archive, projectPath, format); err != nil {
+		os.RemoveAll(projectPath)
+		return err
+	}
+	return nil
+}
+
+// handleRebuild re-runs the build from the uploaded source. With an alias in
+// the body the build is promoted to that alias instead of going live.
+func (s *Server) handleRebuild(w http.ResponseWriter, r *http.Request) {
+	projectID, userID, ok := s.authorizeProject(w, r, roleDeployer)
+	if !ok {
+		return
+	}
+	alias, err := rebuildAlias(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var project Project
+	err = s.db.QueryRow("SELECT id, user_id, name, status, subdomain, created_at FROM projects WHERE id = ?", projectID).
+		Scan(&project.ID, &project.UserID, &project.Name, &project.Status, &project.Subdomain, &project.CreatedAt)
+	if err != nil {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+
+	switch project.Status {
+	case "queued", "building":
+		http.Error(w, "A build is already in progress", http.StatusConflict)
+		return
+	case "archived":
+		http.Error(w, "Archived projects cannot be rebuilt", http.StatusConflict)
+		return
+	}
+
+	projectPath := filepath.Join(s.cfg.ProjectsDir, projectID)
+	if _, _, err := s.findUpload(projectID); err != nil {
+		http.Error(w, "Project source is no longer available, please upload again", http.StatusGone)
+		return
+	}
+
+	queued, err := s.updateProjectStatusLog(projectID, project.Status, "queued", "")
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !queued {
+		http.Error(w, "A build is already in progress", http.StatusConflict)
+		return
+	}
+
+	s.publishStatus(projectID, project.UserID, "queued")
+	src := s.lastDeploySource(projectID)
+	src.Trigger, src.UserID, src.Alias = "rebuild", userID, alias
+	s.startBuild(projectID, projectPath, src)
+
+	project.Status = "queued"
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// projectListCache holds each user's GET /api/projects result for a few
+// seconds. Anything that changes a user's projects must invalidate it.
+type projectListCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	entries  map[int]projectListEntry
+	counters *serverCounters
+}
+
+type projectListEntry struct {
+	projects []Project
+	expires  time.Time
+}
+
+// GRAPE_PROJECTS_CACHE_TTL=0 disables the cache.
+func newProjectListCache(counters *serverCounters) *projectListCache {
+	return &projectListCache{
+		ttl:      envDuration("GRAPE_PROJECTS_CACHE_TTL", 5*time.Second),
+		entries:  make(map[int]projectListEntry),
+		counters: counters,
+	}
+}
+
+func (c *projectListCache) get(userID int) ([]Project, bool) {
+	if c.ttl <= 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[userID]
+	if !ok || time.Now().After(e.expires) {
+		delete(c.entries, userID)
+		c.counters.CacheMisses.Add(1)
+		return nil, false
+	}
+	c.counters.CacheHits.Add(1)
+	return e.projects, true
+}
+
+func (c *projectListCache) set(userID int, projects []Project) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[userID] = projectListEntry{projects: projects, expires: time.Now().Add(c.ttl)}
+}
+
+func (c *projectListCache) invalidate(userID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, userID)
+}
+
+// clear drops every entry, for bulk updates that span users.
+func (c *projectListCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[int]projectListEntry)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Public instances can make registration prove a human (or at least some
+// work) is behind it. GRAPE_CAPTCHA picks the check: "hcaptcha" or
+// "turnstile" verify a widget token with the provider, "pow" has the client
+// solve a proof-of-work challenge from /api/auth/captcha. The answer goes in
+// the captcha field of /api/register.
+
+const powChallengeTTL = 10 * time.Minute
+
+var (
+	errCaptchaRequired = errors.New("captcha required")
+	errCaptchaFailed   = errors.New("captcha failed")
+)
+
+type captchaVerifier interface {
+	// Config is what a client needs to show the challenge.
+	Config(s *Server) (map[string]interface{}, error)
+	Verify(ctx context.Context, s *Server, r *http.Request, answer string) error
+}
+
+// siteVerifyCaptcha is a widget-based provider with the siteverify API
+// shared by hCaptcha and Turnstile.
+type siteVerifyCaptcha struct {
+	name      string
+	siteKey   string
+	secret    string
+	verifyURL string
+	client    *http.Client
+}
+
+func (c siteVerifyCaptcha) Config(*Server) (map[string]interface{}, error) {
+	return map[string]interface{}{"provider": c.name, "site_key": c.siteKey}, nil
+}
+
+func (c siteVerifyCaptcha) Verify(ctx context.Context, s *Server, r *http.Request, answer string) error {
+	if answer == "" {
+		return errCaptchaRequired
+	}
+	form := url.Values{"secret": {c.secret}, "response": {answer}, "remoteip": {clientIP(r)}}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("%s siteverify: %w", c.name, err)
+	}
+	if !result.Success {
+		return fmt.Errorf("%w: %s", errCaptchaFailed, strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
+
+// powCaptcha issues random challenges; an answer is "challenge:nonce" where
+// the SHA-256 of that string starts with difficulty zero bits. Each
+// challenge works once.
+type powCaptcha struct {
+	difficulty int
+}
+
+func (c powCaptcha) Config(s *Server) (map[string]interface{}, error) {
+	challenge := randomToken()
+	now := time.Now()
+	s.db.Exec("DELETE FROM pow_challenges WHERE expires_at <= ?", now.Unix())
+	if _, err := s.db.Exec("INSERT INTO pow_challenges (challenge, difficulty, expires_at) VALUES (?, ?, ?)",
+		challenge, c.difficulty, now.Add(powChallengeTTL).Unix()); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"provider": "pow", "challenge": challenge, "difficulty": c.difficulty}, nil
+}
+
+func (c powCaptcha) Verify(ctx context.Context, s *Server, r *http.Request, answer string) error {
+	if answer == "" {
+		return errCaptchaRequired
+	}
+	challenge, _, ok := strings.Cut(answer, ":")
+	if !ok {
+		return errCaptchaFailed
+	}
+	var difficulty int
+	err := s.db.QueryRow("SELECT difficulty FROM pow_challenges WHERE challenge = ? AND expires_at > ?", challenge, time.Now().Unix()).Scan(&difficulty)
+	if err != nil || leadingZeroBits(sha256.Sum256([]byte(answer))) < difficulty {
+		return errCaptchaFailed
+	}
+	res, err := s.db.Exec("DELETE FROM pow_challenges WHERE challenge = ?", challenge)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errCaptchaFailed
+	}
+	return nil
+}
+
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// initCaptcha sets up the configured check; a misconfigured one stops the
+// server rather than leaving registration open.
+func (s *Server) initCaptcha() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	switch provider := envString("GRAPE_CAPTCHA", "none"); provider {
+	case "none":
+	case "hcaptcha", "turnstile":
+		verifyURL := "https://api.hcaptcha.com/siteverify"
+		if provider == "turnstile" {
+			verifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+		}
+		c := siteVerifyCaptcha{
+			name:      provider,
+			siteKey:   envString("GRAPE_CAPTCHA_SITE_KEY", ""),
+			secret:    envString("GRAPE_CAPTCHA_SECRET", ""),
+			verifyURL: envString("GRAPE_CAPTCHA_VERIFY_URL", verifyURL),
+			client:    client,
+		}
+		if c.siteKey == "" || c.secret == "" {
+			log.Fatalf("GRAPE_CAPTCHA=%s needs GRAPE_CAPTCHA_SITE_KEY and GRAPE_CAPTCHA_SECRET", provider)
+		}
+		s.captcha = c
+	case "pow":
+		difficulty := envInt("GRAPE_POW_DIFFICULTY", 20)
+		if difficulty < 1 || difficulty > 32 {
+			log.Fatalf("GRAPE_POW_DIFFICULTY must be 1-32")
+		}
+		s.captcha = powCaptcha{difficulty: difficulty}
+	default:
+		log.Fatalf("unknown GRAPE_CAPTCHA %q", provider)
+	}
+}
+
+// checkCaptcha enforces the configured check, writing the error response
+// itself and reporting whether to go on.
+func (s *Server) checkCaptcha(w http.ResponseWriter, r *http.Request, answer string) bool {
+	if s.captcha == nil {
+		return true
+	}
+	switch err := s.captcha.Verify(r.Context(), s, r, strings.TrimSpace(answer)); {
+	case err == nil:
+		return true
+	case errors.Is(err, errCaptchaRequired):
+		writeJSONError(w, http.StatusBadRequest, "captcha_required", "Complete the captcha; see /api/auth/captcha")
+	case errors.Is(err, errCaptchaFailed):
+		writeJSONError(w, http.StatusBadRequest, "captcha_failed", "Captcha verification failed; try again")
+	default:
+		log.Printf("captcha verification error: %v", err)
+		writeJSONError(w, http.StatusServiceUnavailable, "captcha_unavailable", "Captcha verification is unavailable; try again later")
+	}
+	return false
+}
+
+// handleCaptchaConfig tells clients which check registration needs; for
+// proof-of-work it hands out a fresh challenge.
+func (s *Server) handleCaptchaConfig(w http.ResponseWriter, r *http.Request) {
+	config := map[string]interface{}{"provider": "none"}
+	if s.captcha != nil {
+		var err error
+		if config, err = s.captcha.Config(s); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func solvePoW(challenge string, difficulty int) string {
+	for nonce := 0; ; nonce++ {
+		answer := fmt.Sprintf("%s:%d", challenge, nonce)
+		if leadingZeroBits(sha256.Sum256([]byte(answer))) >= difficulty {
+			return answer
+		}
+	}
+}
+
+func TestRegisterWithProofOfWork(t *testing.T) {
+	t.Setenv("GRAPE_CAPTCHA", "pow")
+	t.Setenv("GRAPE_POW_DIFFICULTY", "8")
+	ts := newTestServer(t, stubRunner{})
+	creds := map[string]string{"email": "ada@example.com", "password": "correct horse battery"}
+
+	if resp := ts.postJSON(t, "/api/register", "", creds, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("register without a captcha: status %d, want 400", resp.StatusCode)
+	}
+
+	var config struct {
+		Provider   string `json:"provider"`
+		Challenge  string `json:"challenge"`
+		Difficulty int    `json:"difficulty"`
+	}
+	ts.do(t, "GET", "/api/auth/captcha", "", nil, "", &config)
+	if config.Provider != "pow" || config.Challenge == "" || config.Difficulty != 8 {
+		t.Fatalf("captcha config = %+v", config)
+	}
+
+	creds["captcha"] = config.Challenge + ":wrong"
+	if leadingZeroBits(sha256.Sum256([]byte(creds["captcha"]))) < 8 {
+		if resp := ts.postJSON(t, "/api/register", "", creds, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("register with a wrong answer: status %d, want 400", resp.StatusCode)
+		}
+	}
+	creds["captcha"] = solvePoW(config.Challenge, config.Difficulty)
+	if resp := ts.postJSON(t, "/api/register", "", creds, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("register with a solved challenge: status %d", resp.StatusCode)
+	}
+	creds["email"] = "grace@example.com"
+	if resp := ts.postJSON(t, "/api/register", "", creds, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("reusing a solved challenge: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestRegisterWithTurnstile(t *testing.T) {
+	siteverify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		ok := r.PostForm.Get("secret") == "shh" && r.PostForm.Get("response") == "human"
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": ok})
+	}))
+	defer siteverify.Close()
+	t.Setenv("GRAPE_CAPTCHA", "turnstile")
+	t.Setenv("GRAPE_CAPTCHA_SITE_KEY", "site")
+	t.Setenv("GRAPE_CAPTCHA_SECRET", "shh")
+	t.Setenv("GRAPE_CAPTCHA_VERIFY_URL", siteverify.URL)
+	ts := newTestServer(t, stubRunner{})
+
+	var config struct {
+		Provider string `json:"provider"`
+		SiteKey  string `json:"site_key"`
+	}
+	ts.do(t, "GET", "/api/auth/captcha", "", nil, "", &config)
+	if config.Provider != "turnstile" || config.SiteKey != "site" {
+		t.Errorf("captcha config = %+v", config)
+	}
+
+	creds := map[string]string{"email": "ada@example.com", "password": "correct horse battery", "captcha": "bot"}
+	if resp := ts.postJSON(t, "/api/register", "", creds, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("register with a rejected token: status %d, want 400", resp.StatusCode)
+	}
+	creds["captcha"] = "human"
+	if resp := ts.postJSON(t, "/api/register", "", creds, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("register with an accepted token: status %d", resp.StatusCode)
+	}
+}
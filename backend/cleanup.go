@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Deleted projects' files are removed in the background. The project IDs are
+// queued in file_cleanup in the same transaction that deletes their rows, so
+// work interrupted by a restart or a storage outage is picked up again.
+
+// cleanupRetryInterval is how often failed removals are retried.
+const cleanupRetryInterval = time.Minute
+
+// queueFileCleanup schedules removal of the project's files once tx commits.
+func queueFileCleanup(tx *sql.Tx, projectID string) error {
+	_, err := tx.Exec("INSERT OR IGNORE INTO file_cleanup (project_id, queued_at) VALUES (?, ?)", projectID, time.Now().Unix())
+	return err
+}
+
+// wakeCleanup tells the cleanup worker there is new work.
+func (s *Server) wakeCleanup() {
+	select {
+	case s.cleanupWake <- struct{}{}:
+	default:
+	}
+}
+
+// runFileCleanup works through the queue until ctx is cancelled.
+func (s *Server) runFileCleanup(ctx context.Context) {
+	ticker := time.NewTicker(cleanupRetryInterval)
+	defer ticker.Stop()
+	for {
+		s.cleanupFiles(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.cleanupWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) cleanupFiles(ctx context.Context) {
+	rows, err := s.db.Query("SELECT project_id FROM file_cleanup ORDER BY queued_at")
+	if err != nil {
+		log.Printf("file cleanup: %v", err)
+		return
+	}
+	var projectIDs []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			projectIDs = append(projectIDs, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range projectIDs {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := s.deleteProjectFiles(id); err != nil {
+			log.Printf("project %s: file cleanup failed, will retry: %v", id, err)
+			s.db.Exec("UPDATE file_cleanup SET attempts = attempts + 1 WHERE project_id = ?", id)
+			continue
+		}
+		s.db.Exec("DELETE FROM file_cleanup WHERE project_id = ?", id)
+	}
+}
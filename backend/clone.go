@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Cloning a project copies its stored source, build and serving settings,
+// tags and environment variables into a new project, which is built like a
+// fresh upload. Deployments, history, members, the Git link and the webhook
+// stay with the original.
+
+// projectSettingColumns are the projects columns a clone inherits.
+const projectSettingColumns = "description, health_check_path, url_preset, root_dir, header_rules, redirect_rules, build_config, build_timeout, force_https, keep_deployments, require_approval"
+
+type cloneRequest struct {
+	Name      string `json:"name"`
+	Subdomain string `json:"subdomain"`
+	OrgID     *int   `json:"org_id"`
+	// SkipEnv leaves the environment variables behind, e.g. for a template
+	// whose copies get their own keys
+	SkipEnv bool `json:"skip_env"`
+}
+
+// handleCloneProject copies the project into a new one owned by the caller,
+// in the same organization if they belong to it unless org_id says
+// otherwise (0 for none). Deployers and above only, as the copy carries the
+// environment variables.
+func (s *Server) handleCloneProject(w http.ResponseWriter, r *http.Request) {
+	sourceID, userID, ok := s.authorizeProject(w, r, roleDeployer)
+	if !ok {
+		return
+	}
+	var req cloneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	if !s.isVerified(userID) {
+		writeJSONError(w, http.StatusForbidden, "email_unverified", "Verify your email address before creating projects")
+		return
+	}
+
+	source, err := s.loadProject(sourceID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if source.Status == "archived" {
+		writeJSONError(w, http.StatusConflict, "project_archived", "Archived projects have no source to copy")
+		return
+	}
+	key, format, err := s.findUpload(sourceID)
+	if err != nil {
+		writeJSONError(w, http.StatusGone, "source_unavailable", "Project source is no longer available, please upload again")
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = source.Name + " (copy)"
+	}
+	if utf8.RuneCountInString(name) > maxProjectNameLength {
+		writeJSONError(w, http.StatusBadRequest, "invalid_name", fmt.Sprintf("Name must be 1-%d characters", maxProjectNameLength))
+		return
+	}
+
+	orgID := source.OrgID
+	if req.OrgID != nil {
+		orgID = *req.OrgID
+	}
+	if orgID != 0 {
+		role, err := s.orgRole(orgID, userID)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+			return
+		}
+		if role == "" && req.OrgID != nil {
+			writeJSONError(w, http.StatusForbidden, "not_org_member", "You are not a member of that organization")
+			return
+		}
+		if role == "" {
+			orgID = 0
+		}
+	}
+
+	projectID := generateID()
+	subdomain := projectID + "." + baseDomain
+	if slug := strings.ToLower(strings.TrimSpace(req.Subdomain)); slug != "" {
+		if err := validateSubdomain(slug); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_subdomain", "Invalid subdomain: "+err.Error())
+			return
+		}
+		subdomain = slug + "." + baseDomain
+		if s.subdomainTaken(subdomain, projectID) {
+			writeJSONError(w, http.StatusConflict, "subdomain_taken", "Subdomain "+subdomain+" is already taken")
+			return
+		}
+	}
+
+	quota, err := s.userQuota(userID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if ok, reason := quota.canUpload(); !ok {
+		writeQuotaError(w, quota, reason)
+		return
+	}
+
+	// The source goes first so the clone never exists without one
+	if err := s.copyObject(key, uploadKey(projectID, format)); err != nil {
+		log.Printf("project %s: cannot copy source to %s: %v", sourceID, projectID, err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Cannot copy the project source")
+		return
+	}
+	if err := s.cloneProjectRows(sourceID, projectID, userID, orgID, name, subdomain, !req.SkipEnv); err != nil {
+		s.storage.Delete(uploadKey(projectID, format))
+		if strings.Contains(err.Error(), "UNIQUE constraint failed: projects.subdomain") {
+			writeJSONError(w, http.StatusConflict, "subdomain_taken", "Subdomain "+subdomain+" is already taken")
+			return
+		}
+		log.Printf("project %s: cannot clone into %s: %v", sourceID, projectID, err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	log.Printf("project %s cloned into %s by user %d", sourceID, projectID, userID)
+	s.recordHistory(projectID, "clone", "created", "cloned from "+sourceID)
+
+	src := s.lastDeploySource(sourceID)
+	src.Trigger, src.UserID, src.Format = "clone", userID, format
+	s.publishStatus(projectID, userID, "queued")
+	s.startBuild(projectID, filepath.Join(s.cfg.ProjectsDir, projectID), src)
+
+	project, err := s.loadProject(projectID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	s.invalidateProjectLists(projectID, userID)
+	project.Role = roleAdmin.String()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(project)
+}
+
+// cloneProjectRows creates the clone's project row from the source's
+// settings, with its tags and, if withEnv, its variables sealed anew for
+// the clone.
+func (s *Server) cloneProjectRows(sourceID, projectID string, userID, orgID int, name, subdomain string, withEnv bool) error {
+	var vars []envVar
+	if withEnv {
+		var err error
+		if vars, err = s.projectEnv(sourceID); err != nil {
+			return err
+		}
+	}
+	tags, err := s.projectTags(sourceID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().Unix()
+	if _, err := tx.Exec(`
+		INSERT INTO projects (id, user_id, org_id, name, status, subdomain, created_at, `+projectSettingColumns+`)
+		SELECT ?, ?, ?, ?, 'queued', ?, ?, `+projectSettingColumns+` FROM projects WHERE id = ?
+	`, projectID, userID, sql.NullInt64{Int64: int64(orgID), Valid: orgID != 0}, name, subdomain, now, sourceID); err != nil {
+		return err
+	}
+	if err := setProjectTags(tx, projectID, tags); err != nil {
+		return err
+	}
+	for _, v := range vars {
+		if _, err := tx.Exec("INSERT INTO project_env (project_id, key, value, encrypted, secret, updated_at) VALUES (?, ?, ?, 1, ?, ?)",
+			projectID, v.Key, s.sealEnv(projectID, v.Key, v.Value), v.Secret, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// copyObject copies a stored object to another key.
+func (s *Server) copyObject(from, to string) error {
+	rc, _, err := s.storage.Get(from)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return s.storage.Put(to, rc)
+}
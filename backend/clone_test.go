@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestCloneProject(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	alice := ts.signUp(t, "alice@example.com", "correct horse battery 0")
+	bob := ts.signUp(t, "bob@example.com", "correct horse battery 1")
+	project, _ := ts.upload(t, alice, "shop", siteZip(t))
+	ts.waitForStatus(t, alice, project.ID)
+	path := "/api/projects/" + project.ID
+
+	settings := map[string]interface{}{"description": "Storefront", "build_timeout": "2m", "tags": []string{"client-x"}}
+	ts.do(t, "PATCH", path, alice, jsonBody(settings), "application/json", nil)
+	ts.postJSON(t, path+"/env", alice, map[string]interface{}{"key": "API_URL", "value": "https://api.example.com"}, nil)
+	ts.postJSON(t, path+"/env", alice, map[string]interface{}{"key": "STRIPE_KEY", "value": "sk_live_abcdef123456", "secret": true}, nil)
+
+	ts.do(t, "PUT", path+"/members", alice, jsonBody(map[string]string{"email": "bob@example.com", "role": "viewer"}), "application/json", nil)
+	if resp := ts.postJSON(t, path+"/clone", bob, map[string]string{}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("viewer clone: status %d, want 403", resp.StatusCode)
+	}
+
+	var clone Project
+	if resp := ts.postJSON(t, path+"/clone", alice, map[string]string{"subdomain": "shop-staging"}, &clone); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("clone: status %d", resp.StatusCode)
+	}
+	if clone.ID == project.ID || clone.Name != "shop (copy)" || clone.Subdomain != "shop-staging."+baseDomain || clone.Role != "admin" {
+		t.Errorf("clone %+v", clone)
+	}
+	if clone.Description != "Storefront" || clone.Preset != project.Preset || !reflect.DeepEqual(clone.Tags, []string{"client-x"}) {
+		t.Errorf("settings not copied: %+v", clone)
+	}
+	var timeout int
+	ts.db.QueryRow("SELECT build_timeout FROM projects WHERE id = ?", clone.ID).Scan(&timeout)
+	if timeout != 120 {
+		t.Errorf("clone build_timeout %d, want 120", timeout)
+	}
+	if p := ts.waitForStatus(t, alice, clone.ID); p.Status != "live" {
+		t.Fatalf("clone build %s: %s", p.Status, p.BuildLog)
+	}
+	if got := ts.livePage(t, clone.ID); got != "<h1>hello</h1>" {
+		t.Errorf("clone live page %q", got)
+	}
+
+	vars, err := ts.projectEnv(clone.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, v := range vars {
+		got[v.Key] = v.Value
+	}
+	if got["API_URL"] != "https://api.example.com" || got["STRIPE_KEY"] != "sk_live_abcdef123456" {
+		t.Errorf("clone env %v", got)
+	}
+
+	if resp := ts.postJSON(t, path+"/clone", alice, map[string]string{"subdomain": "shop-staging"}, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("taken subdomain: status %d, want 409", resp.StatusCode)
+	}
+	var bare Project
+	ts.postJSON(t, path+"/clone", alice, map[string]interface{}{"name": "template", "skip_env": true}, &bare)
+	if vars, _ := ts.projectEnv(bare.ID); bare.Name != "template" || len(vars) != 0 {
+		t.Errorf("skip_env clone %+v has %d variables", bare, len(vars))
+	}
+	ts.waitForStatus(t, alice, bare.ID)
+}
+
+func TestCloneKeepsRequireApproval(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	alice := ts.signUp(t, "alice@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, alice, "shop", siteZip(t))
+	ts.waitForStatus(t, alice, project.ID)
+	path := "/api/projects/" + project.ID
+	ts.do(t, "PATCH", path, alice, jsonBody(map[string]bool{"require_approval": true}), "application/json", nil)
+
+	var clone Project
+	if resp := ts.postJSON(t, path+"/clone", alice, map[string]string{}, &clone); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("clone: status %d", resp.StatusCode)
+	}
+	if !clone.RequireApproval {
+		t.Errorf("clone %+v lost require_approval", clone)
+	}
+	// The copy's first build is held like any other production build
+	if p := ts.waitForStatus(t, alice, clone.ID); p.PendingDeployment == "" {
+		t.Errorf("clone build not held for approval: %+v", p)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseDuration accepts Go durations such as "90s" or "5m" as well as a bare
+// number of seconds, and rejects anything that isn't positive.
+func parseDuration(v string) (time.Duration, error) {
+	v = strings.TrimSpace(v)
+	d, err := time.ParseDuration(v)
+	if secs, convErr := strconv.Atoi(v); convErr == nil {
+		d, err = time.Duration(secs)*time.Second, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("duration must be positive")
+	}
+	return d, nil
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	d, err := parseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+func envInt(key string, def int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// legacyJWTSecret is the HS256 secret older versions shipped with.
+const legacyJWTSecret = "grape-ai-secret-key-change-in-production"
+
+// productionMode is set with GRAPE_ENV=production. It turns the problems
+// validateConfig finds from warnings into a refusal to start.
+func productionMode() bool {
+	return os.Getenv("GRAPE_ENV") == "production"
+}
+
+// validateConfig looks for insecure defaults and settings that can't work,
+// returning one message per problem.
+func validateConfig(cfg Config) []string {
+	var problems []string
+
+	switch secret := os.Getenv("JWT_SECRET"); {
+	case secret == legacyJWTSecret:
+		problems = append(problems, "JWT_SECRET is the published default; unset it, access tokens are now signed with the keys in GRAPE_JWT_KEYS_DIR")
+	case secret != "":
+		problems = append(problems, "JWT_SECRET is no longer used; unset it, access tokens are now signed with the keys in GRAPE_JWT_KEYS_DIR")
+	}
+
+	if os.Getenv("GRAPE_ADMIN_TOKEN") != "" {
+		problems = append(problems, "GRAPE_ADMIN_TOKEN is no longer used; unset it, admin routes now need a login with the admin role (-promote-admin)")
+	}
+
+	for _, setting := range []struct{ key, value string }{
+		{"GRAPE_PUBLIC_URL", publicURL},
+		{"GRAPE_APP_URL", appURL},
+	} {
+		u, err := url.Parse(setting.value)
+		switch {
+		case err != nil || u.Host == "":
+			problems = append(problems, fmt.Sprintf("%s %q is not an absolute URL", setting.key, setting.value))
+		case productionMode() && (u.Scheme != "https" || u.Hostname() == "localhost"):
+			problems = append(problems, fmt.Sprintf("%s must be a public https URL in production, not %q", setting.key, setting.value))
+		}
+	}
+
+	if entries, err := os.ReadDir(cfg.KeysDir); err == nil {
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || e.IsDir() || (!strings.HasSuffix(e.Name(), ".pem") && e.Name() != envKeyFile) {
+				continue
+			}
+			if info.Mode().Perm()&0077 != 0 {
+				problems = append(problems, fmt.Sprintf("signing key %s is readable by other users; chmod 600 it", filepath.Join(cfg.KeysDir, e.Name())))
+			}
+		}
+	}
+
+	if os.Getenv("GRAPE_OIDC_ISSUER") != "" && os.Getenv("GRAPE_OIDC_CLIENT_ID") == "" {
+		problems = append(problems, "GRAPE_OIDC_ISSUER is set without GRAPE_OIDC_CLIENT_ID")
+	}
+	if envString("GRAPE_STORAGE", "local") == "s3" && (os.Getenv("GRAPE_S3_ACCESS_KEY") == "" || os.Getenv("GRAPE_S3_SECRET_KEY") == "") {
+		problems = append(problems, "GRAPE_STORAGE=s3 needs GRAPE_S3_ACCESS_KEY and GRAPE_S3_SECRET_KEY")
+	}
+	return problems
+}
+
+// enforceConfig logs what validateConfig finds and, in production, refuses
+// to start.
+func enforceConfig(cfg Config) {
+	problems := validateConfig(cfg)
+	for _, p := range problems {
+		log.Printf("config: %s", p)
+	}
+	if len(problems) > 0 && productionMode() {
+		log.Fatalf("refusing to start in production with %d configuration problem(s)", len(problems))
+	}
+}
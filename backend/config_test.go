@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.KeysDir = t.TempDir()
+	if _, err := rotateSigningKey(cfg.KeysDir, "EdDSA"); err != nil {
+		t.Fatal(err)
+	}
+	if problems := validateConfig(cfg); len(problems) != 0 {
+		t.Fatalf("defaults in development: %q", problems)
+	}
+
+	t.Setenv("GRAPE_ENV", "production")
+	if problems := validateConfig(cfg); len(problems) != 2 {
+		t.Errorf("localhost URLs in production: %q, want two problems", problems)
+	}
+
+	savedPublic, savedApp := publicURL, appURL
+	t.Cleanup(func() { publicURL, appURL = savedPublic, savedApp })
+	publicURL, appURL = "https://api.grape.example", "https://grape.example"
+	if problems := validateConfig(cfg); len(problems) != 0 {
+		t.Fatalf("production with https URLs: %q", problems)
+	}
+
+	t.Setenv("GRAPE_ADMIN_TOKEN", "change-me")
+	t.Setenv("JWT_SECRET", legacyJWTSecret)
+	entries, _ := os.ReadDir(cfg.KeysDir)
+	os.Chmod(filepath.Join(cfg.KeysDir, entries[0].Name()), 0644)
+	problems := strings.Join(validateConfig(cfg), "\n")
+	for _, want := range []string{"JWT_SECRET", "GRAPE_ADMIN_TOKEN", "readable by other users"} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("problems %q do not mention %s", problems, want)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// serverCounters are cheap in-process gauges for incident debugging; they
+// reset on restart and are not a substitute for real metrics.
+type serverCounters struct {
+	ActiveBuilds      atomic.Int64
+	QueuedBuilds      atomic.Int64
+	StreamSubscribers atomic.Int64
+	CacheHits         atomic.Int64
+	CacheMisses       atomic.Int64
+	RateLimited       atomic.Int64
+}
+
+func (s *Server) countersSnapshot() map[string]int64 {
+	return map[string]int64{
+		"active_builds":      s.counters.ActiveBuilds.Load(),
+		"queued_builds":      s.counters.QueuedBuilds.Load(),
+		"stream_subscribers": s.counters.StreamSubscribers.Load(),
+		"cache_hits":         s.counters.CacheHits.Load(),
+		"cache_misses":       s.counters.CacheMisses.Load(),
+		"rate_limited":       s.counters.RateLimited.Load(),
+		"build_limit":        int64(s.buildSlots.currentLimit()),
+	}
+}
+
+func (s *Server) handleAdminCounters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.countersSnapshot())
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// gateRunner holds every build until release is closed.
+type gateRunner struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r gateRunner) Run(ctx context.Context, projectPath, stagePath string, timeout time.Duration, env []string, onStage func(string)) (string, error) {
+	r.started <- struct{}{}
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	if err := os.MkdirAll(stagePath, 0755); err != nil {
+		return "", err
+	}
+	return "", os.WriteFile(filepath.Join(stagePath, "index.html"), []byte("<h1>hello</h1>"), 0644)
+}
+
+func TestAdminCounters(t *testing.T) {
+	t.Setenv("GRAPE_RATE_LIMIT_AUTH", "5/1m")
+	runner := gateRunner{started: make(chan struct{}, 1), release: make(chan struct{})}
+	ts := newTestServer(t, runner)
+	user := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	admin := ts.signUpAdmin(t, "root@example.com", "correct horse battery 1")
+	read := func() map[string]int64 {
+		t.Helper()
+		var got map[string]int64
+		if resp := ts.do(t, "GET", "/api/admin/debug/counters", admin, nil, "", &got); resp.StatusCode != http.StatusOK {
+			t.Fatalf("counters: status %d", resp.StatusCode)
+		}
+		return got
+	}
+	if resp := ts.do(t, "GET", "/api/admin/debug/counters", user, nil, "", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("non-admin counters: status %d, want 403", resp.StatusCode)
+	}
+
+	project, _ := ts.upload(t, user, "site", siteZip(t))
+	select {
+	case <-runner.started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("build did not start")
+	}
+	if got := read(); got["active_builds"] != 1 || got["queued_builds"] != 0 || got["build_limit"] < 1 {
+		t.Errorf("during the build %v", got)
+	}
+	close(runner.release)
+	ts.waitForStatus(t, user, project.ID)
+	// The build gives its slot back just after its status is published
+	got := read()
+	for deadline := time.Now().Add(5 * time.Second); got["active_builds"] != 0 && time.Now().Before(deadline); got = read() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got["active_builds"] != 0 || got["queued_builds"] != 0 {
+		t.Errorf("after the build %v", got)
+	}
+
+	creds := map[string]string{"email": "ada@example.com", "password": "wrong password 1"}
+	before := read()["rate_limited"]
+	var rejected int64
+	for i := 0; i < 8; i++ {
+		if resp := ts.postJSON(t, "/api/login", "", creds, nil); resp.StatusCode == http.StatusTooManyRequests {
+			rejected++
+		}
+	}
+	if rejected == 0 {
+		t.Fatal("sign-ins were never rate limited")
+	}
+	if got := read(); got["rate_limited"] != before+rejected {
+		t.Errorf("after %d rate-limited requests %v", rejected, got)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2026, 3, 4, 10, 17, 30, 0, time.UTC)
+	for expr, want := range map[string]string{
+		"* * * * *":         "2026-03-04 10:18",
+		"0 3 * * *":         "2026-03-05 03:00",
+		"@daily":            "2026-03-05 00:00",
+		"@hourly":           "2026-03-04 11:00",
+		"*/15 * * * *":      "2026-03-04 10:30",
+		"30 9 * * mon-fri":  "2026-03-05 09:30",
+		"0 12 * * 0":        "2026-03-08 12:00",
+		"0 12 * * 7":        "2026-03-08 12:00",
+		"0 0 1 jan,jul *":   "2026-07-01 00:00",
+		"0 0 13 * fri":      "2026-03-06 00:00",
+		"0 0 29 2 *":        "2028-02-29 00:00",
+		"5/20 10 * * *":     "2026-03-04 10:25",
+		" 0  6  *  *  sat ": "2026-03-07 06:00",
+		"0 0,12 1-7 * *":    "2026-03-04 12:00",
+		"45 23 31 dec *":    "2026-12-31 23:45",
+		"0 9-17/4 * * *":    "2026-03-04 13:00",
+		"0 0 * * MON":       "2026-03-09 00:00",
+		"@weekly":           "2026-03-08 00:00",
+		"@monthly":          "2026-04-01 00:00",
+		"0 4 * * 1,3,5":     "2026-03-06 04:00",
+		"0 0 1 * *":         "2026-04-01 00:00",
+		"59 10 4 3 *":       "2026-03-04 10:59",
+		"0 10 4 3 *":        "2027-03-04 10:00",
+		"0 0 31 * *":        "2026-03-31 00:00",
+		"0 0 30 2,4 *":      "2026-04-30 00:00",
+		"0 0 * * 3":         "2026-03-11 00:00",
+		"0 0 4 * 3":         "2026-03-11 00:00",
+		"20 10 * * *":       "2026-03-04 10:20",
+		"17 10 * * *":       "2026-03-05 10:17",
+	} {
+		c, err := parseCron(expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", expr, err)
+			continue
+		}
+		if got := c.next(from).Format("2006-01-02 15:04"); got != want {
+			t.Errorf("next(%q) = %s, want %s", expr, got, want)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "0 0 0 * *", "0 0 * 13 *", "0 0 * * 8", "5-1 * * * *", "*/0 * * * *", "0 0 * foo *", "@reboot"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) accepted", expr)
+		}
+	}
+	if c, _ := parseCron("0 0 30 2 *"); !c.next(from).IsZero() {
+		t.Error("February 30th matched")
+	}
+}
+
+func TestCronNextInTimezone(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no timezone data")
+	}
+	c, _ := parseCron("30 2 * * *")
+	// Clocks go from 2:00 to 3:00 on March 8th, so that night is skipped
+	next := c.next(time.Date(2026, 3, 7, 12, 0, 0, 0, loc))
+	if want := time.Date(2026, 3, 9, 2, 30, 0, 0, loc); !next.Equal(want) {
+		t.Errorf("next across the spring DST change = %s, want %s", next, want)
+	}
+	// and from 2:00 to 1:00 on November 1st, when 1:30 runs once
+	c, _ = parseCron("30 1 * * *")
+	first := c.next(time.Date(2026, 11, 1, 0, 0, 0, 0, loc))
+	if second := c.next(first); second.Day() != 2 || second.Hour() != 1 || second.Minute() != 30 {
+		t.Errorf("runs across the autumn DST change: %s, then %s", first, second)
+	}
+	midnight, _ := parseCron("@daily")
+	if next := midnight.next(time.Date(2026, 3, 7, 12, 0, 0, 0, loc)); next.Day() != 8 || next.Hour() != 0 {
+		t.Errorf("next midnight %s", next)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	dbRetryAttempts = envInt("GRAPE_DB_RETRY_ATTEMPTS", 5)
+	dbRetryBackoff  = envDuration("GRAPE_DB_RETRY_BACKOFF", 50*time.Millisecond)
+)
+
+func isDBLocked(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked")
+}
+
+// execWithRetry runs a write, retrying with exponential backoff while SQLite
+// reports the database as busy or locked.
+func (s *Server) execWithRetry(query string, args ...interface{}) (sql.Result, error) {
+	backoff := dbRetryBackoff
+	for attempt := 1; ; attempt++ {
+		res, err := s.db.Exec(query, args...)
+		if err == nil || !isDBLocked(err) || attempt >= dbRetryAttempts {
+			return res, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
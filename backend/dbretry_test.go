@@ -0,0 +1,67 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExecWithRetryWaitsOutLocks(t *testing.T) {
+	savedAttempts, savedBackoff := dbRetryAttempts, dbRetryBackoff
+	dbRetryAttempts, dbRetryBackoff = 8, 10*time.Millisecond
+	t.Cleanup(func() { dbRetryAttempts, dbRetryBackoff = savedAttempts, savedBackoff })
+
+	// No busy timeout, so SQLite reports the lock at once instead of waiting
+	path := filepath.Join(t.TempDir(), "grape.db")
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE notes (body TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{db: db}
+
+	holder, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Close()
+	lock := func() *sql.Tx {
+		tx, err := holder.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec("INSERT INTO notes (body) VALUES ('holder')"); err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+
+	// Held for longer than every attempt takes: the error comes back
+	dbRetryAttempts = 2
+	tx := lock()
+	if _, err := s.execWithRetry("INSERT INTO notes (body) VALUES ('writer')"); err == nil || !isDBLocked(err) {
+		t.Errorf("write while locked: %v, want database is locked", err)
+	}
+	tx.Rollback()
+
+	// Released after a few attempts: the write goes through
+	dbRetryAttempts = 8
+	tx = lock()
+	time.AfterFunc(100*time.Millisecond, func() { tx.Commit() })
+	start := time.Now()
+	if _, err := s.execWithRetry("INSERT INTO notes (body) VALUES ('writer')"); err != nil {
+		t.Fatalf("write after the lock was released: %v", err)
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Errorf("write succeeded after %s, before the lock was released", waited)
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM notes").Scan(&n)
+	if n != 2 {
+		t.Errorf("%d rows, want the holder's and the writer's", n)
+	}
+}
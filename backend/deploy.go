@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Types Go's built-in table or the host's mime.types may get wrong or lack.
+var modernMIMETypes = map[string]string{
+	".avif":        "image/avif",
+	".js":          "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".mjs":         "text/javascript; charset=utf-8",
+	".svg":         "image/svg+xml",
+	".wasm":        "application/wasm",
+	".webmanifest": "application/manifest+json",
+	".webp":        "image/webp",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+}
+
+func init() {
+	for ext, typ := range modernMIMETypes {
+		mime.AddExtensionType(ext, typ)
+	}
+}
+
+// A build-tool content hash in the file name, e.g. main.3f9a1c2b.js or
+// index-BXa9_3kD.css. Requiring a digit keeps words like "-progress" out.
+var fingerprintPattern = regexp.MustCompile(`[.-]([A-Za-z0-9_]*[0-9][A-Za-z0-9_]*)\.[a-z0-9]+$`)
+
+// cacheControlFor lets fingerprinted assets be cached forever, makes HTML
+// revalidate so new deploys show up immediately, and gives everything else
+// a short lifetime.
+func cacheControlFor(urlPath, file string) string {
+	switch {
+	case strings.HasSuffix(file, ".html"):
+		return "no-cache"
+	case strings.HasPrefix(urlPath, "/_next/static/"):
+		return "public, max-age=31536000, immutable"
+	}
+	if m := fingerprintPattern.FindStringSubmatch(filepath.Base(file)); m != nil && len(m[1]) >= 8 {
+		return "public, max-age=31536000, immutable"
+	}
+	return "public, max-age=3600"
+}
+
+// urlPreset describes how a framework's static output maps request paths to
+// files.
+type urlPreset struct {
+	// CleanURLs serves /about from /about.html and redirects /about.html to /about.
+	CleanURLs bool
+	// TrailingSlash redirects /about to /about/ when it is a directory.
+	TrailingSlash bool
+	// SPAFallback serves /index.html for unknown paths that don't look like files.
+	SPAFallback bool
+}
+
+var urlPresets = map[string]urlPreset{
+	"static":    {SPAFallback: true},
+	"spa":       {SPAFallback: true},
+	"nextjs":    {CleanURLs: true},
+	"sveltekit": {CleanURLs: true},
+	"gatsby":    {TrailingSlash: true},
+	"astro":     {},
+	"nuxt":      {},
+}
+
+// Checked in order, so meta-frameworks win over the bundlers they depend on.
+var presetDependencies = []struct {
+	dep    string
+	preset string
+}{
+	{"next", "nextjs"},
+	{"gatsby", "gatsby"},
+	{"@sveltejs/kit", "sveltekit"},
+	{"astro", "astro"},
+	{"nuxt", "nuxt"},
+	{"vite", "spa"},
+	{"react-scripts", "spa"},
+	{"@vue/cli-service", "spa"},
+	{"@angular/core", "spa"},
+}
+
+// detectPreset picks a URL preset from the dependencies in package.json.
+func detectPreset(projectPath string) string {
+	data, err := os.ReadFile(filepath.Join(projectPath, "package.json"))
+	if err != nil {
+		return "static"
+	}
+	var pkg struct {
+		Dependencies    map[string]string `json:"dependencies"`
+		DevDependencies map[string]string `json:"devDependencies"`
+	}
+	if json.Unmarshal(data, &pkg) != nil {
+		return "static"
+	}
+	for _, pd := range presetDependencies {
+		_, dep := pkg.Dependencies[pd.dep]
+		_, devDep := pkg.DevDependencies[pd.dep]
+		if dep || devDep {
+			return pd.preset
+		}
+	}
+	return "static"
+}
+
+// resolveDeployFile maps a request path to a file of the site. When the
+// preset wants the client to use a canonical URL instead, redirect is set.
+func resolveDeployFile(files siteFiles, urlPath string, preset urlPreset) (file, redirect string) {
+	clean := path.Clean("/" + urlPath)
+
+	if clean != "/" && files.exists(clean) {
+		if preset.CleanURLs && strings.HasSuffix(clean, ".html") {
+			stripped := strings.TrimSuffix(clean, ".html")
+			if stripped == "/index" {
+				stripped = "/"
+			}
+			return "", stripped
+		}
+		return clean, ""
+	}
+
+	if index := path.Join(clean, "index.html"); files.exists(index) {
+		if preset.TrailingSlash && clean != "/" && !strings.HasSuffix(urlPath, "/") {
+			return "", clean + "/"
+		}
+		return index, ""
+	}
+
+	if preset.CleanURLs && clean != "/" && files.exists(clean+".html") {
+		return clean + ".html", ""
+	}
+
+	if preset.SPAFallback && path.Ext(clean) == "" && files.exists("/index.html") {
+		return "/index.html", ""
+	}
+	return "", ""
+}
+
+// siteConfig is the per-project serving configuration.
+type siteConfig struct {
+	Preset     urlPreset
+	Headers    []headerRule
+	Redirects  []redirectRule
+	ForceHTTPS bool
+	Paused     bool
+}
+
+func (s *Server) loadSiteConfig(projectID string) siteConfig {
+	var (
+		presetName, headerRules, redirectRules string
+		forceHTTPS, paused                     bool
+	)
+	s.db.QueryRow("SELECT url_preset, header_rules, redirect_rules, force_https, paused_at != 0 FROM projects WHERE id = ?", projectID).
+		Scan(&presetName, &headerRules, &redirectRules, &forceHTTPS, &paused)
+
+	site := siteConfig{Preset: urlPresets[presetName], ForceHTTPS: forceHTTPS, Paused: paused}
+	if headerRules != "" {
+		json.Unmarshal([]byte(headerRules), &site.Headers)
+	}
+	if redirectRules != "" {
+		json.Unmarshal([]byte(redirectRules), &site.Redirects)
+	}
+	return site
+}
+
+// deployFileHandler serves a site's files using its URL, redirect and header
+// rules. Redirects are issued relative to prefix, the URL the site is mounted
+// at.
+func deployFileHandler(files siteFiles, prefix string, site siteConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		urlPath := path.Clean("/" + r.URL.Path)
+		for _, rule := range site.Redirects {
+			if to := rule.target(urlPath); to != "" {
+				if strings.HasPrefix(to, "/") {
+					to = strings.TrimSuffix(prefix, "/") + to
+				}
+				http.Redirect(w, r, to, rule.Status)
+				return
+			}
+		}
+
+		file, redirect := resolveDeployFile(files, r.URL.Path, site.Preset)
+		if redirect != "" {
+			http.Redirect(w, r, strings.TrimSuffix(prefix, "/")+redirect, http.StatusMovedPermanently)
+			return
+		}
+		if file == "" {
+			serveNotFound(w, r, files)
+			return
+		}
+
+		f, info, err := files.open(file)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Cache-Control", cacheControlFor(r.URL.Path, file))
+		applyHeaderRules(w, site.Headers, path.Clean("/"+r.URL.Path))
+		http.ServeContent(w, r, path.Base(file), info.ModTime, f)
+	})
+}
+
+// serveNotFound uses the project's own 404.html when it has one.
+func serveNotFound(w http.ResponseWriter, r *http.Request, files siteFiles) {
+	page, _, err := files.open("/404.html")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer page.Close()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusNotFound)
+	io.Copy(w, page)
+}
+
+var validProjectID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// handleDeploy serves /deploy/{id}/... from the project's live output.
+func (s *Server) handleDeploy(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/deploy/")
+	projectID, sub, hasSlash := strings.Cut(rest, "/")
+	if !validProjectID.MatchString(projectID) {
+		http.NotFound(w, r)
+		return
+	}
+	if !hasSlash {
+		http.Redirect(w, r, "/deploy/"+projectID+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = "/" + sub
+	s.serveSite(w, r2, projectID, s.liveSiteFiles(projectID), "/deploy/"+projectID)
+}
+
+// serveSite serves one of the project's deployments mounted at prefix.
+func (s *Server) serveSite(w http.ResponseWriter, r *http.Request, projectID string, files siteFiles, prefix string) {
+	site := s.loadSiteConfig(projectID)
+	if site.Paused {
+		servePaused(w)
+		return
+	}
+	if site.ForceHTTPS && requestScheme(r) != "https" {
+		http.Redirect(w, r, "https://"+r.Host+strings.TrimSuffix(prefix, "/")+r.URL.RequestURI(), http.StatusMovedPermanently)
+		return
+	}
+	deployFileHandler(files, prefix, site).ServeHTTP(w, r)
+}
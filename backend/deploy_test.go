@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestResolveDeployFile(t *testing.T) {
+	dir := t.TempDir()
+	writeSite(t, dir, "index.html", "about.html", "blog/index.html", "assets/app.js")
+	files := localSiteFiles(dir)
+
+	for _, tc := range []struct {
+		preset, path   string
+		file, redirect string
+	}{
+		// Clean URLs: /about is served from about.html, which redirects to it
+		{"nextjs", "/about", "/about.html", ""},
+		{"nextjs", "/about.html", "", "/about"},
+		{"nextjs", "/index.html", "", "/"},
+		{"nextjs", "/blog", "/blog/index.html", ""},
+		{"nextjs", "/missing", "", ""},
+
+		// Trailing slash: directories get one, files don't
+		{"gatsby", "/blog", "", "/blog/"},
+		{"gatsby", "/blog/", "/blog/index.html", ""},
+		{"gatsby", "/about.html", "/about.html", ""},
+		{"gatsby", "/about", "", ""},
+
+		// SPA fallback: unknown routes get the app, unknown files don't
+		{"spa", "/", "/index.html", ""},
+		{"spa", "/dashboard/settings", "/index.html", ""},
+		{"spa", "/assets/app.js", "/assets/app.js", ""},
+		{"spa", "/assets/missing.js", "", ""},
+		{"spa", "/blog", "/blog/index.html", ""},
+
+		// No preset rules: only exact files and directory indexes
+		{"astro", "/about", "", ""},
+		{"astro", "/blog/", "/blog/index.html", ""},
+		{"astro", "/../about.html", "/about.html", ""},
+	} {
+		file, redirect := resolveDeployFile(files, tc.path, urlPresets[tc.preset])
+		if file != tc.file || redirect != tc.redirect {
+			t.Errorf("%s %s: file %q, redirect %q; want %q, %q", tc.preset, tc.path, file, redirect, tc.file, tc.redirect)
+		}
+	}
+}
+
+func TestForceHTTPSRedirect(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	if _, err := ts.db.Exec("UPDATE projects SET force_https = 1 WHERE id = ?", project.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	get := func(host, path string, header http.Header) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", ts.http.URL+path, nil)
+		req.Host = host
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	siteHost := project.ID + "." + baseDomain
+	apiHost := strings.TrimPrefix(ts.http.URL, "http://")
+
+	for _, tc := range []struct {
+		host, path, location string
+	}{
+		{siteHost, "/about?ref=mail", "https://" + siteHost + "/about?ref=mail"},
+		{siteHost, "/", "https://" + siteHost + "/"},
+		{apiHost, "/deploy/" + project.ID + "/docs/intro?x=1", "https://" + apiHost + "/deploy/" + project.ID + "/docs/intro?x=1"},
+	} {
+		resp := get(tc.host, tc.path, nil)
+		if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != tc.location {
+			t.Errorf("http://%s%s: status %d, Location %q; want 301 to %s", tc.host, tc.path, resp.StatusCode, resp.Header.Get("Location"), tc.location)
+		}
+	}
+
+	// Behind a TLS-terminating proxy the original scheme comes in a header,
+	// which is only believed from a trusted proxy
+	https := http.Header{"X-Forwarded-Proto": {"https"}}
+	if resp := get(siteHost, "/", https); resp.StatusCode != http.StatusMovedPermanently {
+		t.Errorf("X-Forwarded-Proto from an untrusted client: status %d, want 301", resp.StatusCode)
+	}
+	trustedProxies = parseTrustedProxies("127.0.0.1")
+	t.Cleanup(func() { trustedProxies = nil })
+	if resp := get(siteHost, "/", https); resp.StatusCode != http.StatusOK {
+		t.Errorf("https via a trusted proxy: status %d, want 200", resp.StatusCode)
+	}
+	if resp := get(siteHost, "/", http.Header{"X-Forwarded-Proto": {"http"}}); resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "https://"+siteHost+"/" {
+		t.Errorf("http via a trusted proxy: status %d, Location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Deployment is one build of a project and, if it succeeded, its output.
+// Every successful deployment is kept under its own prefix and served at its
+// preview URL; the project's live_deployment says which one is served on the
+// project's own hosts.
+type Deployment struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	Trigger       string `json:"trigger,omitempty"`
+	TriggeredBy   int    `json:"triggered_by,omitempty"`
+	SourceName    string `json:"source_name,omitempty"`
+	SourceSize    int64  `json:"source_size,omitempty"`
+	SourceFormat  string `json:"source_format,omitempty"`
+	Commit        string `json:"commit,omitempty"`
+	CommitMessage string `json:"commit_message,omitempty"`
+	Alias         string `json:"alias,omitempty"`
+	Branch        string `json:"branch,omitempty"`
+	Approval      string `json:"approval,omitempty"`
+	ReviewedBy    int    `json:"reviewed_by,omitempty"`
+	Size          int64  `json:"size"`
+	CreatedAt     int64  `json:"created_at"`
+	StartedAt     int64  `json:"started_at,omitempty"`
+	FinishedAt    int64  `json:"finished_at,omitempty"`
+	ExpiresAt     int64  `json:"expires_at,omitempty"`
+	Duration      int64  `json:"duration,omitempty"`
+	Live          bool   `json:"live"`
+	LogsURL       string `json:"logs_url"`
+	PreviewURL    string `json:"preview_url,omitempty"`
+}
+
+// Deployment statuses follow the project's, except that a build that went
+// live is "succeeded": whether it is still served is Live.
+const deploySucceeded = "succeeded"
+
+// deploySource describes what a build was started from.
+type deploySource struct {
+	Trigger       string // "upload" or "rebuild"
+	UserID        int
+	Name          string
+	Size          int64
+	Format        string
+	Commit        string
+	CommitMessage string
+	// Alias, if set, is where a successful build is promoted to instead of
+	// going live
+	Alias string
+	// Branch, if set, is the pushed branch whose own host the build is
+	// served at instead
+	Branch string
+}
+
+// Longest accepted commit and commit_message upload fields.
+const (
+	maxCommitLength        = 64
+	maxCommitMessageLength = 1000
+)
+
+func deploymentPrefix(projectID, deploymentID string) string {
+	return deployPrefix(projectID) + deploymentID + "/"
+}
+
+// liveDeployPrefix is where the project's live files are stored. Sites
+// published before deployments were versioned sit directly under deployPrefix.
+func (s *Server) liveDeployPrefix(projectID string) string {
+	var id string
+	s.db.QueryRow("SELECT live_deployment FROM projects WHERE id = ?", projectID).Scan(&id)
+	if id == "" {
+		return deployPrefix(projectID)
+	}
+	return deploymentPrefix(projectID, id)
+}
+
+// createDeployment records a queued build of the project and returns its ID.
+func (s *Server) createDeployment(projectID string, src deploySource) (string, error) {
+	id := generateID()
+	_, err := s.execWithRetry(`
+		INSERT INTO deployments (id, project_id, status, trigger_type, triggered_by, source_name, source_size, source_format, commit_sha, commit_message, alias, branch, created_at)
+		VALUES (?, ?, 'queued', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, id, projectID, src.Trigger, src.UserID, src.Name, src.Size, src.Format, src.Commit, src.CommitMessage, src.Alias, src.Branch, time.Now().Unix())
+	return id, err
+}
+
+// copyDeployment records a successful deployment carrying over the source
+// details and build log of from, for output reprocessed outside a build. With
+// from empty (output published before deployments were versioned) only the
+// trigger is recorded. Returns the new deployment's ID.
+func (s *Server) copyDeployment(projectID, from, trigger string, userID int) (string, error) {
+	id := generateID()
+	now := time.Now().Unix()
+	var err error
+	if from == "" {
+		_, err = s.execWithRetry(`
+			INSERT INTO deployments (id, project_id, status, trigger_type, triggered_by, created_at, started_at, finished_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, id, projectID, deploySucceeded, trigger, userID, now, now, now)
+		return id, err
+	}
+	res, err := s.execWithRetry(`
+		INSERT INTO deployments (id, project_id, status, trigger_type, triggered_by, source_name, source_size, source_format,
+			commit_sha, commit_message, build_log, created_at, started_at, finished_at)
+		SELECT ?, project_id, ?, ?, ?, source_name, source_size, source_format, commit_sha, commit_message, build_log, ?, ?, ?
+		FROM deployments WHERE id = ? AND project_id = ?
+	`, id, deploySucceeded, trigger, userID, now, now, now, from, projectID)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", sql.ErrNoRows
+	}
+	return id, nil
+}
+
+// lastDeploySource is what the project's latest build was started from, for
+// rebuilds of the same upload.
+func (s *Server) lastDeploySource(projectID string) deploySource {
+	var src deploySource
+	s.db.QueryRow(`
+		SELECT source_name, source_size, source_format, commit_sha, commit_message
+		FROM deployments WHERE project_id = ? AND branch = '' ORDER BY rowid DESC LIMIT 1
+	`, projectID).Scan(&src.Name, &src.Size, &src.Format, &src.Commit, &src.CommitMessage)
+	return src
+}
+
+// syncDeployment mirrors a project status change onto the build in progress,
+// so every way a build can end (including shutdowns and admins) is recorded.
+func (s *Server) syncDeployment(projectID, status string) {
+	now := time.Now().Unix()
+	var err error
+	switch status {
+	case "building":
+		_, err = s.execWithRetry("UPDATE deployments SET status = ?, started_at = ? WHERE project_id = ? AND status = 'queued'",
+			status, now, projectID)
+	case "live", "failed", "cancelled", "archived":
+		switch status {
+		case "live":
+			status = deploySucceeded
+		case "archived":
+			status = "cancelled"
+		}
+		_, err = s.execWithRetry("UPDATE deployments SET status = ?, finished_at = ? WHERE project_id = ? AND status IN ('queued', 'building')",
+			status, now, projectID)
+	}
+	if err != nil {
+		log.Printf("project %s: cannot record deployment status: %v", projectID, err)
+	}
+}
+
+// setDeploymentLog stores the build log of the build in progress.
+func (s *Server) setDeploymentLog(projectID, buildLog string) {
+	if _, err := s.execWithRetry("UPDATE deployments SET build_log = ? WHERE project_id = ? AND status IN ('queued', 'building')",
+		buildLog, projectID); err != nil {
+		log.Printf("project %s: cannot record deployment log: %v", projectID, err)
+	}
+}
+
+// promoteDeploy publishes the staged build as the deployment's output and
+// makes it the live one, or points the alias or branch it was built for at
+// it. Protected projects hold it for approval instead of making it live.
+// Switching is a single row update, so visitors see either the old version
+// or the new one.
+func (s *Server) promoteDeploy(projectID, deploymentID string) error {
+	staged := filepath.Join(s.cfg.StagingDir, projectID)
+	size := dirSize(staged)
+	if err := publishDir(s.storage, staged, deploymentPrefix(projectID, deploymentID)); err != nil {
+		return err
+	}
+
+	var previous, alias, branch string
+	var requireApproval bool
+	err := s.db.QueryRow(`
+		SELECT p.live_deployment, p.require_approval, COALESCE(d.alias, ''), COALESCE(d.branch, '') FROM projects p
+		LEFT JOIN deployments d ON d.id = ? AND d.project_id = p.id WHERE p.id = ?
+	`, deploymentID, projectID).Scan(&previous, &requireApproval, &alias, &branch)
+	if err == nil && (alias != "" || branch != "") {
+		if alias != "" {
+			err = s.switchAlias(projectID, alias, deploymentID, size)
+		} else {
+			err = s.switchBranch(projectID, branch, deploymentID, size)
+		}
+		if err != nil {
+			s.storage.Delete(deploymentPrefix(projectID, deploymentID))
+			return err
+		}
+		s.setDeploymentExpiry(projectID, deploymentID, true)
+		return nil
+	}
+	if err == nil && requireApproval {
+		if err = s.holdForApproval(projectID, deploymentID, size); err != nil {
+			s.storage.Delete(deploymentPrefix(projectID, deploymentID))
+			return err
+		}
+		s.setDeploymentExpiry(projectID, deploymentID, false)
+		return nil
+	}
+	if err == nil {
+		err = s.switchLive(projectID, deploymentID, size)
+	}
+	if err != nil {
+		s.storage.Delete(deploymentPrefix(projectID, deploymentID))
+		return err
+	}
+	s.setDeploymentExpiry(projectID, deploymentID, false)
+	if previous == "" {
+		if err := s.dropLegacyDeploy(projectID); err != nil {
+			log.Printf("project %s: cannot remove unversioned deploy: %v", projectID, err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) switchLive(projectID, deploymentID string, size int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE deployments SET size = ? WHERE id = ?", size, deploymentID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE projects SET live_deployment = ? WHERE id = ?", deploymentID, projectID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// dropLegacyDeploy removes files published before deployments were versioned,
+// i.e. everything under deployPrefix that belongs to no deployment.
+func (s *Server) dropLegacyDeploy(projectID string) error {
+	known := map[string]bool{}
+	rows, err := s.db.Query("SELECT id FROM deployments WHERE project_id = ?", projectID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			known[id] = true
+		}
+	}
+	rows.Close()
+
+	prefix := deployPrefix(projectID)
+	objects, err := s.storage.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		dir, _, nested := strings.Cut(strings.TrimPrefix(obj.Key, prefix), "/")
+		if nested && known[dir] {
+			continue
+		}
+		if err := s.storage.Delete(obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetDeployments drops the project's deployment records, e.g. once its
+// files are gone because it was archived.
+func (s *Server) forgetDeployments(projectID string) error {
+	_, err := s.execWithRetry("UPDATE projects SET live_deployment = '', pending_deployment = '' WHERE id = ?", projectID)
+	if err == nil {
+		_, err = s.execWithRetry("DELETE FROM project_aliases WHERE project_id = ?", projectID)
+	}
+	if err == nil {
+		_, err = s.execWithRetry("DELETE FROM branch_deploys WHERE project_id = ?", projectID)
+	}
+	if err == nil {
+		_, err = s.execWithRetry("DELETE FROM deployments WHERE project_id = ?", projectID)
+	}
+	return err
+}
+
+const deploymentColumns = `d.id, d.status, d.trigger_type, d.triggered_by, d.source_name, d.source_size, d.source_format,
+	d.commit_sha, d.commit_message, d.alias, d.branch, d.approval, d.reviewed_by, d.size, d.created_at, d.started_at, d.finished_at, d.expires_at, d.id = p.live_deployment, p.subdomain`
+
+func scanDeployment(scan func(...interface{}) error, projectID string) (Deployment, error) {
+	var d Deployment
+	var subdomain string
+	err := scan(&d.ID, &d.Status, &d.Trigger, &d.TriggeredBy, &d.SourceName, &d.SourceSize, &d.SourceFormat,
+		&d.Commit, &d.CommitMessage, &d.Alias, &d.Branch, &d.Approval, &d.ReviewedBy, &d.Size, &d.CreatedAt, &d.StartedAt, &d.FinishedAt, &d.ExpiresAt, &d.Live, &subdomain)
+	if d.StartedAt > 0 && d.FinishedAt >= d.StartedAt {
+		d.Duration = d.FinishedAt - d.StartedAt
+	}
+	d.LogsURL = "/api/projects/" + projectID + "/deployments/" + d.ID + "/logs"
+	if d.Status == deploySucceeded {
+		d.PreviewURL = "https://" + previewHost(projectID, subdomain, d.ID)
+	}
+	return d, err
+}
+
+// handleListDeployments lists every build of the project, newest first.
+func (s *Server) handleListDeployments(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleViewer)
+	if !ok {
+		return
+	}
+
+	rows, err := s.db.Query(`
+		SELECT `+deploymentColumns+`
+		FROM deployments d JOIN projects p ON p.id = d.project_id
+		WHERE d.project_id = ? ORDER BY d.rowid DESC
+	`, projectID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	defer rows.Close()
+
+	deployments := []Deployment{}
+	for rows.Next() {
+		d, err := scanDeployment(rows.Scan, projectID)
+		if err != nil {
+			continue
+		}
+		deployments = append(deployments, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deployments)
+}
+
+func (s *Server) getDeployment(projectID, deploymentID string) (Deployment, error) {
+	row := s.db.QueryRow(`
+		SELECT `+deploymentColumns+`
+		FROM deployments d JOIN projects p ON p.id = d.project_id
+		WHERE d.id = ? AND d.project_id = ?
+	`, deploymentID, projectID)
+	return scanDeployment(row.Scan, projectID)
+}
+
+// handleDeploymentLogs returns one build's log. The project's own logs route
+// follows the latest build as it runs; this one is filled in when it ends.
+func (s *Server) handleDeploymentLogs(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleViewer)
+	if !ok {
+		return
+	}
+
+	var status, buildLog string
+	err := s.db.QueryRow("SELECT status, build_log FROM deployments WHERE id = ? AND project_id = ?",
+		mux.Vars(r)["deploymentID"], projectID).Scan(&status, &buildLog)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound, "deployment_not_found", "Deployment not found")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"log": buildLog, "status": status})
+}
+
+// handleRollback points the live site back at an earlier successful
+// deployment: the one named by deployment_id, or else the last one before the
+// live deployment.
+func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request) {
+	projectID, userID, ok := s.authorizeProject(w, r, roleDeployer)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		DeploymentID string `json:"deployment_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+
+	var (
+		ownerID      int
+		status, live string
+	)
+	if err := s.db.QueryRow("SELECT user_id, status, live_deployment FROM projects WHERE id = ?", projectID).
+		Scan(&ownerID, &status, &live); err != nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Project not found")
+		return
+	}
+	switch status {
+	case "queued", "building":
+		writeJSONError(w, http.StatusConflict, "build_in_progress", "Wait for the build to finish before rolling back")
+		return
+	case "archived":
+		writeJSONError(w, http.StatusConflict, "project_archived", "Archived projects have no deployments")
+		return
+	}
+
+	target := req.DeploymentID
+	var err error
+	if target == "" {
+		err = s.db.QueryRow(`
+			SELECT id FROM deployments WHERE project_id = ? AND status = 'succeeded' AND alias = '' AND branch = '' AND `+approvedDeployment+`
+				AND rowid < COALESCE((SELECT rowid FROM deployments WHERE id = ?), -1)
+			ORDER BY rowid DESC LIMIT 1
+		`, projectID, live).Scan(&target)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusConflict, "no_previous_deployment", "There is no earlier deployment to roll back to")
+			return
+		}
+	} else {
+		var status, approval string
+		err = s.db.QueryRow("SELECT status, approval FROM deployments WHERE id = ? AND project_id = ?", target, projectID).Scan(&status, &approval)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "deployment_not_found", "Deployment not found")
+			return
+		}
+		if err == nil && status != deploySucceeded {
+			writeJSONError(w, http.StatusConflict, "deployment_unsuccessful", "Only successful deployments can be served")
+			return
+		}
+		if err == nil && approval != "" && approval != approvalApproved {
+			writeJSONError(w, http.StatusConflict, "deployment_not_approved", "Only approved deployments can be served")
+			return
+		}
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+
+	// Conditional on the status so a build that started meanwhile wins
+	res, err := s.execWithRetry(
+		"UPDATE projects SET live_deployment = ? WHERE id = ? AND status NOT IN ('queued', 'building', 'archived')",
+		target, projectID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeJSONError(w, http.StatusConflict, "build_in_progress", "Wait for the build to finish before rolling back")
+		return
+	}
+	s.setDeploymentExpiry(projectID, target, false)
+	log.Printf("project %s rolled back from deployment %q to %s by user %d", projectID, live, target, userID)
+	s.recordHistory(projectID, "rollback", "succeeded", target)
+	s.invalidateProjectLists(projectID, ownerID)
+
+	d, err := s.getDeployment(projectID, target)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingRunner builds a page naming the build's sequence number, so each
+// deployment can be told apart. Build number failOn fails.
+type countingRunner struct {
+	n      *atomic.Int32
+	failOn int32
+}
+
+func (r countingRunner) Run(ctx context.Context, projectPath, stagePath string, timeout time.Duration, env []string, onStage func(string)) (string, error) {
+	n := r.n.Add(1)
+	if n == r.failOn {
+		return "npm ERR! missing script: build\n", errors.New("exit status 1")
+	}
+	if err := os.MkdirAll(stagePath, 0755); err != nil {
+		return "", err
+	}
+	page := fmt.Sprintf("build %d", n)
+	return "", os.WriteFile(filepath.Join(stagePath, "index.html"), []byte(page), 0644)
+}
+
+func (ts *testServer) livePage(t *testing.T, projectID string) string {
+	t.Helper()
+	resp, err := ts.http.Client().Get(ts.http.URL + "/deploy/" + projectID + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestRollback(t *testing.T) {
+	ts := newTestServer(t, countingRunner{n: new(atomic.Int32)})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID
+
+	if resp := ts.postJSON(t, path+"/rollback", token, nil, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("rollback with a single deployment: status %d, want 409", resp.StatusCode)
+	}
+	for i := 0; i < 2; i++ {
+		ts.do(t, "POST", path+"/rebuild", token, nil, "", nil)
+		ts.waitForStatus(t, token, project.ID)
+	}
+	if got := ts.livePage(t, project.ID); got != "build 3" {
+		t.Fatalf("live page %q, want build 3", got)
+	}
+
+	var deployments []Deployment
+	ts.do(t, "GET", path+"/deployments", token, nil, "", &deployments)
+	if len(deployments) != 3 || !deployments[0].Live || deployments[1].Live {
+		t.Fatalf("deployments %+v", deployments)
+	}
+	if d := deployments[2]; d.Trigger != "upload" || d.SourceName != "site.zip" || deployments[0].Trigger != "rebuild" || deployments[0].SourceName != "site.zip" {
+		t.Errorf("deployment sources: first %+v, last %+v", d, deployments[0])
+	}
+
+	var rolled Deployment
+	if resp := ts.postJSON(t, path+"/rollback", token, nil, &rolled); resp.StatusCode != http.StatusOK {
+		t.Fatalf("rollback: status %d", resp.StatusCode)
+	}
+	if rolled.ID != deployments[1].ID || ts.livePage(t, project.ID) != "build 2" {
+		t.Errorf("rolled back to %s, serving %q", rolled.ID, ts.livePage(t, project.ID))
+	}
+
+	if resp := ts.postJSON(t, path+"/rollback", token, map[string]string{"deployment_id": deployments[0].ID}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("roll forward: status %d", resp.StatusCode)
+	}
+	if got := ts.livePage(t, project.ID); got != "build 3" {
+		t.Errorf("after rolling forward, live page %q", got)
+	}
+	if resp := ts.postJSON(t, path+"/rollback", token, map[string]string{"deployment_id": "nope"}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("rollback to an unknown deployment: status %d, want 404", resp.StatusCode)
+	}
+
+	other := ts.signUp(t, "bob@example.com", "correct horse battery 1")
+	if resp := ts.postJSON(t, path+"/rollback", other, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("stranger rolling back: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestDeploymentHistory(t *testing.T) {
+	ts := newTestServer(t, countingRunner{n: new(atomic.Int32), failOn: 2})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("name", "site")
+	mw.WriteField("commit", "3f9a1c2b")
+	mw.WriteField("commit_message", "Fix the footer")
+	part, _ := mw.CreateFormFile("project", "site.zip")
+	part.Write(siteZip(t))
+	mw.Close()
+	var project Project
+	if resp := ts.do(t, "POST", "/api/upload", token, &body, mw.FormDataContentType(), &project); resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: status %d", resp.StatusCode)
+	}
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID
+
+	ts.do(t, "POST", path+"/rebuild", token, nil, "", nil)
+	if p := ts.waitForStatus(t, token, project.ID); p.Status != "failed" {
+		t.Fatalf("second build: %s", p.Status)
+	}
+
+	var deployments []Deployment
+	ts.do(t, "GET", path+"/deployments", token, nil, "", &deployments)
+	if len(deployments) != 2 {
+		t.Fatalf("got %d deployments", len(deployments))
+	}
+	failed, first := deployments[0], deployments[1]
+	if failed.Status != "failed" || failed.Live || failed.Commit != "3f9a1c2b" || failed.FinishedAt == 0 {
+		t.Errorf("failed build: %+v", failed)
+	}
+	if first.Status != "succeeded" || !first.Live || first.CommitMessage != "Fix the footer" || first.SourceFormat != "zip" {
+		t.Errorf("first build: %+v", first)
+	}
+
+	var logs struct{ Log, Status string }
+	if resp := ts.do(t, "GET", failed.LogsURL, token, nil, "", &logs); resp.StatusCode != http.StatusOK {
+		t.Fatalf("deployment logs: status %d", resp.StatusCode)
+	}
+	if logs.Status != "failed" || !strings.Contains(logs.Log, "missing script") {
+		t.Errorf("deployment logs %+v", logs)
+	}
+	if got := ts.livePage(t, project.ID); got != "build 1" {
+		t.Errorf("live page after a failed build %q", got)
+	}
+	if resp := ts.postJSON(t, path+"/rollback", token, map[string]string{"deployment_id": failed.ID}, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("rollback to a failed build: status %d, want 409", resp.StatusCode)
+	}
+}
+
+func TestPreviewDeployments(t *testing.T) {
+	ts := newTestServer(t, countingRunner{n: new(atomic.Int32), failOn: 3})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID
+	for i := 0; i < 2; i++ {
+		ts.do(t, "POST", path+"/rebuild", token, nil, "", nil)
+		ts.waitForStatus(t, token, project.ID)
+	}
+
+	var deployments []Deployment
+	ts.do(t, "GET", path+"/deployments", token, nil, "", &deployments)
+	if len(deployments) != 3 || deployments[0].PreviewURL != "" {
+		t.Fatalf("deployments %+v", deployments)
+	}
+	first := deployments[2]
+	if want := "https://" + first.ID + "-" + project.Subdomain; first.PreviewURL != want {
+		t.Errorf("preview URL %q, want %q", first.PreviewURL, want)
+	}
+
+	get := func(host string) (int, string) {
+		req, _ := http.NewRequest("GET", ts.http.URL+"/", nil)
+		req.Host = host
+		resp, err := ts.http.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if status, body := get(strings.TrimPrefix(first.PreviewURL, "https://")); status != http.StatusOK || body != "build 1" {
+		t.Errorf("preview of the first build: %d %q", status, body)
+	}
+	if _, body := get(deployments[1].ID + "-" + project.ID + "." + baseDomain); body != "build 2" {
+		t.Errorf("preview by project ID served %q", body)
+	}
+	if _, body := get(project.Subdomain); body != "build 2" {
+		t.Errorf("live site served %q", body)
+	}
+	for _, host := range []string{
+		deployments[0].ID + "-" + project.Subdomain,
+		"0123456789abcdef-" + project.Subdomain,
+	} {
+		if status, _ := get(host); status != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", host, status)
+		}
+	}
+	if err := validateSubdomain(first.ID + "-x"); err == nil {
+		t.Error("slug shaped like a preview label accepted")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Devices are told apart by their User-Agent. The first successful sign-in
+// from a device the account hasn't used before is emailed to the user, who
+// can review devices and sign one out. An account's very first device is
+// recorded without an email, since there is nothing to compare it with.
+
+type Device struct {
+	ID          int    `json:"id"`
+	Device      string `json:"device"`
+	LastIP      string `json:"last_ip"`
+	FirstSeenAt int64  `json:"first_seen_at"`
+	LastSeenAt  int64  `json:"last_seen_at"`
+	Current     bool   `json:"current"`
+}
+
+func deviceFingerprint(userAgent string) string {
+	return hashToken(userAgent)
+}
+
+// noteDevice records a successful sign-in from device and ip, and emails
+// the user if the device is new to the account.
+func (s *Server) noteDevice(userID int, email, device, ip string, now time.Time) {
+	var known int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM known_devices WHERE user_id = ?", userID).Scan(&known); err != nil {
+		log.Printf("user %d: cannot look up devices: %v", userID, err)
+		return
+	}
+	res, err := s.db.Exec(`
+		INSERT INTO known_devices (user_id, fingerprint, user_agent, last_ip, first_seen_at, last_seen_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, fingerprint) DO NOTHING
+	`, userID, deviceFingerprint(device), device, ip, now.Unix(), now.Unix())
+	if err != nil {
+		log.Printf("user %d: cannot record device: %v", userID, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		s.db.Exec("UPDATE known_devices SET last_ip = ?, last_seen_at = ? WHERE user_id = ? AND fingerprint = ?",
+			ip, now.Unix(), userID, deviceFingerprint(device))
+		return
+	}
+	if known == 0 {
+		return
+	}
+
+	if device == "" {
+		device = "an unknown device"
+	}
+	err = s.mailer.Send(email, "New sign-in to your Grape.ai account",
+		fmt.Sprintf("Your account was just signed in to from a new device:\n\n%s\nIP address %s, at %s\n\nIf this was you, there's nothing to do. If it wasn't, sign the device out at %s/settings/devices and change your password.",
+			device, ip, now.UTC().Format(time.RFC1123), appURL))
+	if err != nil {
+		log.Printf("user %d: cannot send new device notice: %v", userID, err)
+	}
+}
+
+// handleListDevices lists the devices the user has signed in from, most
+// recently used first.
+func (s *Server) handleListDevices(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	sessionID, _ := r.Context().Value("sessionID").(string)
+
+	var current string
+	s.db.QueryRow("SELECT user_agent FROM sessions WHERE id = ? AND user_id = ?", sessionID, userID).Scan(&current)
+
+	rows, err := s.db.Query(`
+		SELECT id, user_agent, last_ip, first_seen_at, last_seen_at FROM known_devices
+		WHERE user_id = ? ORDER BY last_seen_at DESC, id DESC
+	`, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var d Device
+		if err := rows.Scan(&d.ID, &d.Device, &d.LastIP, &d.FirstSeenAt, &d.LastSeenAt); err != nil {
+			continue
+		}
+		d.Current = sessionID != "" && d.Device == current
+		devices = append(devices, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
+}
+
+// handleSignOutDevice revokes every session on a device and forgets it, so
+// signing in from it again is reported like a new device.
+func (s *Server) handleSignOutDevice(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	deviceID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var device string
+	err = tx.QueryRow("SELECT user_agent FROM known_devices WHERE id = ? AND user_id = ?", deviceID, userID).Scan(&device)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := tx.Query("SELECT id FROM sessions WHERE user_id = ? AND user_agent = ? AND revoked_at = 0", userID, device)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	now := time.Now().Unix()
+	for _, id := range ids {
+		if err := revokeSession(tx, id, now); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM known_devices WHERE id = ?", deviceID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"revoked": len(ids)})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNewDeviceNotification(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	ts.signUp(t, "ada@example.com", "correct horse battery 1")
+	laptop := ts.loginFrom(t, "Laptop/1.0")
+	mails := len(ts.mailer.sent)
+
+	ts.loginFrom(t, "Laptop/1.0")
+	if len(ts.mailer.sent) != mails {
+		t.Errorf("known device sent a notice: %q", ts.mailer.last())
+	}
+	phone := ts.loginFrom(t, "Phone/2.0")
+	if len(ts.mailer.sent) != mails+1 || !strings.Contains(ts.mailer.last(), "Phone/2.0") {
+		t.Fatalf("no notice naming the new device; last mail %q", ts.mailer.last())
+	}
+
+	var devices []Device
+	if resp := ts.do(t, "GET", "/api/me/devices", laptop.Token, nil, "", &devices); resp.StatusCode != http.StatusOK {
+		t.Fatalf("devices: status %d", resp.StatusCode)
+	}
+	var phoneID int
+	for _, d := range devices {
+		if d.Device == "Phone/2.0" {
+			phoneID = d.ID
+			if d.Current {
+				t.Error("phone listed as the current device")
+			}
+		}
+		if d.Device == "Laptop/1.0" && !d.Current {
+			t.Error("laptop not listed as the current device")
+		}
+	}
+	if phoneID == 0 {
+		t.Fatalf("phone missing from %+v", devices)
+	}
+
+	if resp := ts.do(t, "DELETE", fmt.Sprintf("/api/me/devices/%d", phoneID), laptop.Token, nil, "", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("sign out device: status %d", resp.StatusCode)
+	}
+	if resp := ts.do(t, "GET", "/api/projects", phone.Token, nil, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("signed-out device: status %d, want 401", resp.StatusCode)
+	}
+	if resp := ts.do(t, "GET", "/api/projects", laptop.Token, nil, "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("other device: status %d", resp.StatusCode)
+	}
+	if resp := ts.do(t, "DELETE", fmt.Sprintf("/api/me/devices/%d", phoneID), laptop.Token, nil, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("signing out a forgotten device: status %d, want 404", resp.StatusCode)
+	}
+
+	ts.loginFrom(t, "Phone/2.0")
+	if len(ts.mailer.sent) != mails+2 {
+		t.Error("a forgotten device signing in again was not reported")
+	}
+}
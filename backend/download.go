@@ -0,0 +1,74 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleViewer)
+	if !ok {
+		return
+	}
+
+	var name string
+	err := s.db.QueryRow("SELECT name FROM projects WHERE id = ?", projectID).Scan(&name)
+	if err != nil {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+
+	prefix := s.liveDeployPrefix(projectID)
+	objects, err := s.storage.List(prefix)
+	if err != nil || len(objects) == 0 {
+		http.Error(w, "Project has no deploy output yet", http.StatusNotFound)
+		return
+	}
+
+	filename := unsafeFilenameChars.ReplaceAllString(name, "-")
+	if filename == "" || filename == "-" {
+		filename = "project"
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, filename))
+
+	// Headers are already sent, so a failure here can only truncate the stream
+	if err := s.zipObjects(w, prefix, objects); err != nil {
+		log.Printf("project %s: download aborted: %v", projectID, err)
+	}
+}
+
+// zipObjects streams the given stored objects into a zip archive written to w,
+// naming each entry by its key relative to prefix.
+func (s *Server) zipObjects(w io.Writer, prefix string, objects []ObjectInfo) error {
+	zw := zip.NewWriter(w)
+	for _, obj := range objects {
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     strings.TrimPrefix(obj.Key, prefix),
+			Method:   zip.Deflate,
+			Modified: obj.ModTime,
+		})
+		if err != nil {
+			return err
+		}
+
+		rc, _, err := s.storage.Get(obj.Key)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type dryRunReport struct {
+	DryRun    bool     `json:"dry_run"`
+	Format    string   `json:"format"`
+	Preset    string   `json:"preset"`
+	FileCount int      `json:"file_count"`
+	TotalSize int64    `json:"total_size"`
+	Warnings  []string `json:"warnings"`
+}
+
+// inspectProject summarizes an extracted project and flags things that are
+// likely to make its deploy disappointing.
+func inspectProject(dir string) dryRunReport {
+	report := dryRunReport{DryRun: true, Preset: detectPreset(dir), Warnings: []string{}}
+
+	var hasNodeModules bool
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && info.Name() == "node_modules" {
+			hasNodeModules = true
+		}
+		if info.Mode().IsRegular() {
+			report.FileCount++
+			report.TotalSize += info.Size()
+		}
+		return nil
+	})
+
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+
+	if exists("package.json") {
+		var pkg struct {
+			Scripts map[string]string `json:"scripts"`
+		}
+		data, _ := os.ReadFile(filepath.Join(dir, "package.json"))
+		if err := json.Unmarshal(data, &pkg); err != nil {
+			report.Warnings = append(report.Warnings, "package.json is not valid JSON")
+		} else if _, ok := pkg.Scripts["build"]; !ok && !exists("index.html") {
+			report.Warnings = append(report.Warnings, "package.json has no build script and there is no index.html; the source files will be served as-is")
+		}
+	} else if !exists("index.html") {
+		report.Warnings = append(report.Warnings, "no index.html or package.json at the archive root; a placeholder page will be deployed")
+	}
+	if hasNodeModules {
+		report.Warnings = append(report.Warnings, "archive includes node_modules; dependencies are installed during the build, so leaving it out makes uploads much smaller")
+	}
+	if _, err := loadHeadersFile(dir); err != nil {
+		report.Warnings = append(report.Warnings, "invalid "+err.Error())
+	}
+	return report
+}
+
+// handleDryRun extracts an already validated upload to a scratch directory,
+// reports on it and removes it again. Nothing is recorded.
+func handleDryRun(w http.ResponseWriter, uploadPath, format, scratch string) {
+	defer os.RemoveAll(scratch)
+	if err := extractArchive(uploadPath, scratch, format); err != nil {
+		http.Error(w, "Cannot extract archive: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report := inspectProject(scratch)
+	report.Format = format
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func isDryRun(r *http.Request, form *uploadForm) bool {
+	v := r.URL.Query().Get("dryRun")
+	if form != nil && v == "" {
+		v = form.value("dryRun")
+	}
+	return strings.EqualFold(v, "true") || v == "1"
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var validEnvKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Names and values that are most likely credentials rather than plain config.
+var (
+	secretKeyPattern   = regexp.MustCompile(`(?i)SECRET|TOKEN|PASSW(OR)?D|PRIVATE|CREDENTIAL|API_?KEY|ACCESS_?KEY|AUTH|DSN`)
+	secretValuePattern = regexp.MustCompile(`^(sk|pk|rk)_(live|test)_|^gh[pousr]_|^glpat-|^xox[abpr]-|^AKIA[0-9A-Z]{16}$|-----BEGIN [A-Z ]*PRIVATE KEY-----`)
+)
+
+const redacted = "[redacted]"
+
+type envVar struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Secret    bool   `json:"secret"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+func isSecretEnv(key, value string) bool {
+	return secretKeyPattern.MatchString(key) || secretValuePattern.MatchString(value)
+}
+
+func validateEnvKey(key string) error {
+	switch {
+	case !validEnvKey.MatchString(key):
+		return errors.New("must contain only letters, digits and underscores and not start with a digit")
+	case strings.HasPrefix(strings.ToUpper(key), "GRAPE_"):
+		return errors.New("the GRAPE_ prefix is reserved")
+	}
+	return nil
+}
+
+func (s *Server) projectEnv(projectID string) ([]envVar, error) {
+	rows, err := s.db.Query("SELECT key, value, encrypted, secret, updated_at FROM project_env WHERE project_id = ? ORDER BY key", projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	vars := []envVar{}
+	for rows.Next() {
+		var (
+			v         envVar
+			encrypted bool
+		)
+		if err := rows.Scan(&v.Key, &v.Value, &encrypted, &v.Secret, &v.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if encrypted {
+			if v.Value, err = s.openEnv(projectID, v.Key, v.Value); err != nil {
+				return nil, err
+			}
+		}
+		v.Secret = v.Secret || isSecretEnv(v.Key, v.Value)
+		vars = append(vars, v)
+	}
+	return vars, rows.Err()
+}
+
+// buildEnv returns the project's variables as KEY=value pairs for the worker.
+func buildEnv(vars []envVar) []string {
+	env := make([]string, 0, len(vars))
+	for _, v := range vars {
+		env = append(env, v.Key+"="+v.Value)
+	}
+	return env
+}
+
+// redactSecrets replaces every secret value in text, longest first so a value
+// that contains another is not left half-scrubbed.
+func redactSecrets(text string, vars []envVar) string {
+	var secrets []string
+	for _, v := range vars {
+		if v.Secret && len(v.Value) >= 4 {
+			secrets = append(secrets, v.Value)
+		}
+	}
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	for _, s := range secrets {
+		text = strings.ReplaceAll(text, s, redacted)
+	}
+	return text
+}
+
+func redactedEnv(vars []envVar) []envVar {
+	out := make([]envVar, len(vars))
+	for i, v := range vars {
+		if v.Secret {
+			v.Value = redacted
+		}
+		out[i] = v
+	}
+	return out
+}
+
+func (s *Server) handleListEnv(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleDeployer)
+	if !ok {
+		return
+	}
+
+	vars, err := s.projectEnv(projectID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(redactedEnv(vars))
+}
+
+// handleSetEnv creates or replaces one variable. It takes effect on the next
+// build.
+func (s *Server) handleSetEnv(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleDeployer)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Key    string `json:"key"`
+		Value  string `json:"value"`
+		Secret bool   `json:"secret"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := validateEnvKey(req.Key); err != nil {
+		http.Error(w, "Invalid key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().Unix()
+	if _, err := s.db.Exec(`
+		INSERT INTO project_env (project_id, key, value, encrypted, secret, updated_at) VALUES (?, ?, ?, 1, ?, ?)
+		ON CONFLICT (project_id, key) DO UPDATE SET value = excluded.value, encrypted = 1, secret = excluded.secret, updated_at = excluded.updated_at
+	`, projectID, req.Key, s.sealEnv(projectID, req.Key, req.Value), req.Secret, now); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	v := envVar{Key: req.Key, Value: req.Value, Secret: req.Secret || isSecretEnv(req.Key, req.Value), UpdatedAt: now}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(redactedEnv([]envVar{v})[0])
+}
+
+func (s *Server) handleDeleteEnv(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleDeployer)
+	if !ok {
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	res, err := s.db.Exec("DELETE FROM project_env WHERE project_id = ? AND key = ?", projectID, key)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Variable not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
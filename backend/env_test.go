@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envEchoRunner prints the build environment it was given into the log.
+type envEchoRunner struct{}
+
+func (envEchoRunner) Run(ctx context.Context, projectPath, stagePath string, timeout time.Duration, env []string, onStage func(string)) (string, error) {
+	return stubRunner{output: strings.Join(env, "\n") + "\n"}.Run(ctx, projectPath, stagePath, timeout, env, onStage)
+}
+
+func TestProjectEnv(t *testing.T) {
+	ts := newTestServer(t, envEchoRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID
+
+	for _, v := range []map[string]interface{}{
+		{"key": "API_URL", "value": "https://api.example.com"},
+		{"key": "STRIPE_KEY", "value": "sk_live_abcdef123456"},
+		{"key": "CUSTOMER_ID", "value": "cust-8842", "secret": true},
+	} {
+		if resp := ts.postJSON(t, path+"/env", token, v, nil); resp.StatusCode != http.StatusOK {
+			t.Fatalf("set %s: status %d", v["key"], resp.StatusCode)
+		}
+	}
+
+	var stored string
+	ts.db.QueryRow("SELECT value FROM project_env WHERE project_id = ? AND key = 'API_URL'", project.ID).Scan(&stored)
+	if stored == "" || strings.Contains(stored, "example.com") {
+		t.Errorf("value stored as %q, want ciphertext", stored)
+	}
+
+	var vars []envVar
+	ts.do(t, "GET", path+"/env", token, nil, "", &vars)
+	got := map[string]string{}
+	for _, v := range vars {
+		got[v.Key] = v.Value
+	}
+	if got["API_URL"] != "https://api.example.com" || got["STRIPE_KEY"] != redacted || got["CUSTOMER_ID"] != redacted {
+		t.Errorf("listed %v", got)
+	}
+
+	ts.do(t, "POST", path+"/rebuild", token, nil, "", nil)
+	built := ts.waitForStatus(t, token, project.ID)
+	var logs struct{ Log string }
+	ts.do(t, "GET", path+"/logs", token, nil, "", &logs)
+	if !strings.Contains(logs.Log, "API_URL=https://api.example.com") {
+		t.Errorf("build did not get the decrypted variable: %q (%s)", logs.Log, built.Status)
+	}
+	for _, secret := range []string{"sk_live_abcdef123456", "cust-8842"} {
+		if strings.Contains(logs.Log, secret) {
+			t.Errorf("build log leaks %q", secret)
+		}
+	}
+}
+
+func TestEncryptPlainEnv(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	ts.db.Exec("INSERT INTO project_env (project_id, key, value, updated_at) VALUES ('p1', 'API_URL', 'https://api.example.com', 0)")
+	if err := ts.encryptPlainEnv(); err != nil {
+		t.Fatal(err)
+	}
+	vars, err := ts.projectEnv("p1")
+	if err != nil || len(vars) != 1 || vars[0].Value != "https://api.example.com" {
+		t.Fatalf("after encrypting: %+v, %v", vars, err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Project environment variables are stored encrypted with AES-256-GCM, bound
+// to their project and name so a value can't be moved to another row. The key
+// is GRAPE_ENV_KEY (32 bytes, base64) or else env.key in the keys directory,
+// generated on first start. Losing it loses every stored value.
+
+const envKeyFile = "env.key"
+
+func loadEnvKey(dir string) ([]byte, error) {
+	encoded := os.Getenv("GRAPE_ENV_KEY")
+	if encoded == "" {
+		path := filepath.Join(dir, envKeyFile)
+		data, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			key := make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return nil, err
+			}
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600); err != nil {
+				return nil, err
+			}
+			log.Printf("generated environment variable key %s", path)
+			return key, nil
+		case err != nil:
+			return nil, err
+		}
+		encoded = string(data)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("must be 32 bytes, base64-encoded")
+	}
+	return key, nil
+}
+
+func (s *Server) initEnvCipher() {
+	key, err := loadEnvKey(s.cfg.KeysDir)
+	if err != nil {
+		log.Fatalf("environment variable key: %v", err)
+	}
+	block, _ := aes.NewCipher(key)
+	s.envCipher, _ = cipher.NewGCM(block)
+	if err := s.encryptPlainEnv(); err != nil {
+		log.Fatalf("cannot encrypt environment variables: %v", err)
+	}
+}
+
+func envAssociatedData(projectID, key string) []byte {
+	return []byte(projectID + "/" + key)
+}
+
+func (s *Server) sealEnv(projectID, key, value string) string {
+	nonce := make([]byte, s.envCipher.NonceSize())
+	rand.Read(nonce)
+	sealed := s.envCipher.Seal(nonce, nonce, []byte(value), envAssociatedData(projectID, key))
+	return base64.StdEncoding.EncodeToString(sealed)
+}
+
+func (s *Server) openEnv(projectID, key, stored string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil || len(sealed) < s.envCipher.NonceSize() {
+		return "", fmt.Errorf("variable %s: malformed ciphertext", key)
+	}
+	n := s.envCipher.NonceSize()
+	plain, err := s.envCipher.Open(nil, sealed[:n], sealed[n:], envAssociatedData(projectID, key))
+	if err != nil {
+		return "", fmt.Errorf("variable %s: cannot decrypt, was GRAPE_ENV_KEY changed? %w", key, err)
+	}
+	return string(plain), nil
+}
+
+// encryptPlainEnv encrypts variables stored before encryption was added.
+func (s *Server) encryptPlainEnv() error {
+	type plainVar struct{ projectID, key, value string }
+	rows, err := s.db.Query("SELECT project_id, key, value FROM project_env WHERE encrypted = 0")
+	if err != nil {
+		return err
+	}
+	var pending []plainVar
+	for rows.Next() {
+		var v plainVar
+		if err := rows.Scan(&v.projectID, &v.key, &v.value); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, v)
+	}
+	rows.Close()
+
+	for _, v := range pending {
+		if _, err := s.db.Exec("UPDATE project_env SET value = ?, encrypted = 1 WHERE project_id = ? AND key = ? AND encrypted = 0",
+			s.sealEnv(v.projectID, v.key, v.value), v.projectID, v.key); err != nil {
+			return err
+		}
+	}
+	if len(pending) > 0 {
+		log.Printf("Encrypted %d stored environment variables", len(pending))
+	}
+	return nil
+}
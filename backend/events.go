@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type BuildEvent struct {
+	ProjectID string `json:"project_id"`
+	UserID    int    `json:"user_id"`
+	Status    string `json:"status"`
+	Time      int64  `json:"time"`
+}
+
+// eventBus fans build status transitions out to subscribers. Publishing never
+// blocks: a subscriber whose buffer is full simply misses the event.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan BuildEvent]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[chan BuildEvent]struct{})}
+}
+
+func (b *eventBus) subscribe() chan BuildEvent {
+	ch := make(chan BuildEvent, 64)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch chan BuildEvent) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+}
+
+func (b *eventBus) publish(ev BuildEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// publishStatus announces a build status change. Those changes go through
+// here, so it also drops the cached project lists that include the project.
+func (s *Server) publishStatus(projectID string, userID int, status string) {
+	s.invalidateProjectLists(projectID, userID)
+	s.events.publish(BuildEvent{ProjectID: projectID, UserID: userID, Status: status, Time: time.Now().Unix()})
+}
+
+// eventSourceToken lets EventSource clients, which can't set headers, pass
+// their access token as ?token= instead.
+func eventSourceToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("token"); token != "" && r.Header.Get("Authorization") == "" && !strings.HasPrefix(token, apiKeyPrefix) {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) handleAdminEventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+	s.counters.StreamSubscribers.Add(1)
+	defer s.counters.StreamSubscribers.Add(-1)
+
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			data, _ := json.Marshal(ev)
+			if _, err := fmt.Fprintf(w, "event: status\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
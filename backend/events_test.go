@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminEventStream(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	user := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	admin := ts.signUpAdmin(t, "root@example.com", "correct horse battery 1")
+
+	if resp := ts.do(t, "GET", "/api/admin/events/stream", user, nil, "", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("non-admin stream: status %d, want 403", resp.StatusCode)
+	}
+
+	// Like an EventSource, which can't set headers
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.http.URL+"/api/admin/events/stream?token="+admin, nil)
+	resp, err := ts.http.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("stream: status %d, type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	lines := bufio.NewScanner(resp.Body)
+	if !lines.Scan() || lines.Text() != ": connected" {
+		t.Fatalf("first line %q", lines.Text())
+	}
+
+	project, _ := ts.upload(t, user, "site", siteZip(t))
+	var seen []string
+	for lines.Scan() {
+		data, ok := strings.CutPrefix(lines.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var ev BuildEvent
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			t.Fatalf("event %q: %v", data, err)
+		}
+		if ev.ProjectID != project.ID {
+			continue
+		}
+		seen = append(seen, ev.Status)
+		if ev.Status == "live" {
+			break
+		}
+	}
+	if len(seen) == 0 || seen[len(seen)-1] != "live" {
+		t.Errorf("statuses %v, want the build going live", seen)
+	}
+}
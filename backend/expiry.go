@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Preview builds, those for an alias or a pushed branch, are served until
+// they are replaced, which for a branch nobody pushes to again is forever.
+// With GRAPE_PREVIEW_TTL set they carry an expires_at, and once it passes a
+// background janitor takes them offline: their alias or branch host stops
+// serving them, the deployment is marked expired and its output deleted.
+// A guest's deployments carry the guest account's expiry and go with it;
+// claiming the account lifts that. Live deployments never expire.
+
+// previewTTL is how long preview builds are served; 0 serves them until
+// they are replaced.
+var previewTTL = envDuration("GRAPE_PREVIEW_TTL", 0)
+
+// previewExpiryInterval is how often expired previews are looked for.
+const previewExpiryInterval = 10 * time.Minute
+
+// deployExpired is the status of a deployment whose output was deleted when
+// its preview expired.
+const deployExpired = "expired"
+
+// previewExpiry is when a preview built at now expires, or 0 if previews
+// don't.
+func previewExpiry(now time.Time) int64 {
+	if previewTTL <= 0 {
+		return 0
+	}
+	return now.Add(previewTTL).Unix()
+}
+
+// deploymentExpiry is when a deployment of the project published now
+// expires: a preview after previewTTL, and any deployment of a guest's
+// project with the guest, whichever comes first. 0 if never.
+func (s *Server) deploymentExpiry(projectID string, preview bool, now time.Time) int64 {
+	var expires int64
+	s.db.QueryRow("SELECT u.guest_expires_at FROM projects p JOIN users u ON u.id = p.user_id WHERE p.id = ?", projectID).Scan(&expires)
+	if preview {
+		if t := previewExpiry(now); t != 0 && (expires == 0 || t < expires) {
+			expires = t
+		}
+	}
+	return expires
+}
+
+// setDeploymentExpiry sets when the deployment expires, as a preview or,
+// when it goes live, as a production deployment.
+func (s *Server) setDeploymentExpiry(projectID, deploymentID string, preview bool) {
+	expires := s.deploymentExpiry(projectID, preview, time.Now())
+	if _, err := s.execWithRetry("UPDATE deployments SET expires_at = ? WHERE id = ? AND project_id = ?", expires, deploymentID, projectID); err != nil {
+		log.Printf("project %s: cannot set expiry of deployment %s: %v", projectID, deploymentID, err)
+	}
+}
+
+// expireDeployment takes an expired preview offline and deletes its output.
+// false if it went live or is waiting for approval meanwhile, or was already
+// expired.
+func (s *Server) expireDeployment(projectID, deploymentID string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`
+		UPDATE deployments SET status = ? WHERE id = ? AND project_id = ? AND status = ?
+			AND id NOT IN (SELECT live_deployment FROM projects WHERE id = ? UNION SELECT pending_deployment FROM projects WHERE id = ?)
+	`, deployExpired, deploymentID, projectID, deploySucceeded, projectID, projectID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec("DELETE FROM project_aliases WHERE project_id = ? AND deployment_id = ?", projectID, deploymentID); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM branch_deploys WHERE project_id = ? AND deployment_id = ?", projectID, deploymentID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, s.storage.Delete(deploymentPrefix(projectID, deploymentID))
+}
+
+// expirePreviews takes every deployment that expired by now offline. Live
+// guest deployments are left to the guest's own expiry.
+func (s *Server) expirePreviews(now time.Time) {
+	rows, err := s.db.Query("SELECT id, project_id FROM deployments WHERE expires_at != 0 AND expires_at <= ? AND status = ?",
+		now.Unix(), deploySucceeded)
+	if err != nil {
+		log.Printf("preview expiry: %v", err)
+		return
+	}
+	type expired struct{ id, projectID string }
+	var due []expired
+	for rows.Next() {
+		var e expired
+		if rows.Scan(&e.id, &e.projectID) == nil {
+			due = append(due, e)
+		}
+	}
+	rows.Close()
+
+	count := 0
+	for _, e := range due {
+		ok, err := s.expireDeployment(e.projectID, e.id)
+		if err != nil {
+			log.Printf("project %s: cannot expire deployment %s: %v", e.projectID, e.id, err)
+		}
+		if ok {
+			count++
+			s.recordHistory(e.projectID, "expiry", deployExpired, e.id)
+		}
+	}
+	if count > 0 {
+		log.Printf("Expired %d preview deployments", count)
+	}
+}
+
+// runPreviewExpiry takes expired previews offline until ctx is cancelled.
+func (s *Server) runPreviewExpiry(ctx context.Context) {
+	ticker := time.NewTicker(previewExpiryInterval)
+	defer ticker.Stop()
+	for {
+		s.expirePreviews(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPreviewExpiry(t *testing.T) {
+	previewTTL = time.Hour
+	t.Cleanup(func() { previewTTL = 0 })
+	ts := newTestServer(t, countingRunner{n: new(atomic.Int32)})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID
+	deployments := func() []Deployment {
+		var list []Deployment
+		ts.do(t, "GET", path+"/deployments", token, nil, "", &list)
+		return list
+	}
+
+	ts.postJSON(t, path+"/rebuild", token, map[string]string{"alias": "staging"}, nil)
+	ts.waitForStatus(t, token, project.ID)
+	list := deployments()
+	preview, live := list[0], list[1]
+	if preview.ExpiresAt < time.Now().Add(59*time.Minute).Unix() || live.ExpiresAt != 0 {
+		t.Fatalf("expiry of preview %d, of live deployment %d", preview.ExpiresAt, live.ExpiresAt)
+	}
+
+	ts.expirePreviews(time.Now())
+	if d := deployments()[0]; d.Status != deploySucceeded {
+		t.Fatalf("preview expired early: %+v", d)
+	}
+	ts.expirePreviews(time.Now().Add(2 * time.Hour))
+	if d := deployments()[0]; d.Status != deployExpired || d.PreviewURL != "" {
+		t.Errorf("expired preview %+v", d)
+	}
+	if objects, _ := ts.storage.List(deploymentPrefix(project.ID, preview.ID)); len(objects) != 0 {
+		t.Errorf("expired preview's files kept: %v", objects)
+	}
+	var aliases []DeploymentAlias
+	ts.do(t, "GET", path+"/aliases", token, nil, "", &aliases)
+	if len(aliases) != 1 {
+		t.Errorf("aliases after expiry %+v", aliases)
+	}
+	if resp := ts.postJSON(t, path+"/rollback", token, map[string]string{"deployment_id": preview.ID}, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("rolling back to an expired preview: status %d, want 409", resp.StatusCode)
+	}
+	if got := ts.livePage(t, project.ID); got != "build 1" {
+		t.Errorf("live page %q after expiry", got)
+	}
+
+	// A preview promoted to production stays
+	ts.postJSON(t, path+"/rebuild", token, map[string]string{"alias": "staging"}, nil)
+	ts.waitForStatus(t, token, project.ID)
+	promoted := deployments()[0]
+	ts.postJSON(t, path+"/aliases", token, map[string]string{"name": productionAlias, "deployment_id": promoted.ID}, nil)
+	ts.expirePreviews(time.Now().Add(2 * time.Hour))
+	if d := deployments()[0]; d.ID != promoted.ID || d.Status != deploySucceeded || d.ExpiresAt != 0 || !d.Live {
+		t.Errorf("promoted preview %+v", d)
+	}
+	if got := ts.livePage(t, project.ID); got != "build 3" {
+		t.Errorf("live page %q, want build 3", got)
+	}
+}
+
+func TestGuestDeploymentExpiry(t *testing.T) {
+	guestUploadsEnabled = true
+	t.Cleanup(func() { guestUploadsEnabled = false })
+	ts := newTestServer(t, stubRunner{})
+
+	guest := ts.createGuest(t)
+	project, _ := ts.upload(t, guest.Token, "site", siteZip(t))
+	ts.waitForStatus(t, guest.Token, project.ID)
+	path := "/api/projects/" + project.ID
+	var list []Deployment
+	ts.do(t, "GET", path+"/deployments", guest.Token, nil, "", &list)
+	if len(list) != 1 || list[0].ExpiresAt != guest.ExpiresAt {
+		t.Fatalf("guest deployments %+v, want expiry %d", list, guest.ExpiresAt)
+	}
+
+	var registered struct {
+		Token string `json:"token"`
+	}
+	ts.postJSON(t, "/api/register", "", map[string]string{
+		"email": "ada@example.com", "password": "correct horse battery 0", "claim_token": guest.ClaimToken,
+	}, &registered)
+	list = nil
+	ts.do(t, "GET", path+"/deployments", registered.Token, nil, "", &list)
+	if len(list) != 1 || list[0].ExpiresAt != 0 {
+		t.Errorf("claimed deployments %+v", list)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Users can download everything the service holds about them: POST
+// /api/me/export starts assembling a zip in the background, and once it is
+// ready GET /api/me/exports/{id} hands out a signed, short-lived download
+// URL. Secrets (password hashes, token hashes, 2FA secrets, secret project
+// variables) are left out.
+
+var (
+	exportTTL    = envDuration("GRAPE_EXPORT_TTL", 7*24*time.Hour)
+	exportURLTTL = envDuration("GRAPE_EXPORT_URL_TTL", time.Hour)
+)
+
+const (
+	exportPending = "pending"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+)
+
+type DataExport struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	Size        int64  `json:"size,omitempty"`
+	CreatedAt   int64  `json:"created_at"`
+	ExpiresAt   int64  `json:"expires_at"`
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+func exportKey(id string) string { return "exports/" + id + ".zip" }
+
+func (s *Server) handleRequestExport(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	s.pruneExports()
+
+	var pending int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM data_exports WHERE user_id = ? AND status = ?", userID, exportPending).Scan(&pending); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if pending > 0 {
+		writeJSONError(w, http.StatusConflict, "export_in_progress", "An export is already being prepared")
+		return
+	}
+
+	now := time.Now()
+	export := DataExport{ID: generateID(), Status: exportPending, CreatedAt: now.Unix(), ExpiresAt: now.Add(exportTTL).Unix()}
+	if _, err := s.db.Exec("INSERT INTO data_exports (id, user_id, status, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		export.ID, userID, export.Status, export.CreatedAt, export.ExpiresAt); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	go s.runExport(export.ID, userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(export)
+}
+
+// runExport assembles the zip and marks the export ready or failed.
+func (s *Server) runExport(id string, userID int) {
+	status := exportReady
+	size, err := s.buildExport(id, userID)
+	if err != nil {
+		log.Printf("export %s (user %d) failed: %v", id, userID, err)
+		status = exportFailed
+	}
+	if _, err := s.execWithRetry("UPDATE data_exports SET status = ?, size = ? WHERE id = ?", status, size, id); err != nil {
+		log.Printf("export %s: cannot record status: %v", id, err)
+	}
+}
+
+func (s *Server) buildExport(id string, userID int) (int64, error) {
+	path := filepath.Join(s.cfg.StagingDir, id+".export.zip")
+	defer os.Remove(path)
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	if err := s.writeExport(zw, userID); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size, s.storage.Put(exportKey(id), f)
+}
+
+// exportQueries are the per-user records in account.json, each selected
+// with the user's ID.
+var exportQueries = []struct{ name, query string }{
+	{"logins", "SELECT method, success, reason, ip, user_agent, created_at FROM login_events WHERE user_id = ? ORDER BY id"},
+	{"sessions", "SELECT id, user_agent, ip, created_at, last_used_at, revoked_at FROM sessions WHERE user_id = ? ORDER BY created_at"},
+	{"devices", "SELECT user_agent, last_ip, first_seen_at, last_seen_at FROM known_devices WHERE user_id = ? ORDER BY id"},
+	{"api_keys", "SELECT name, prefix, scopes, created_at, last_used_at FROM api_keys WHERE user_id = ? ORDER BY created_at"},
+	{"ip_allowlist", "SELECT cidr, created_at FROM ip_allowlist WHERE user_id = ? ORDER BY created_at"},
+	{"organizations", "SELECT o.id, o.name, m.role FROM orgs o JOIN org_members m ON m.org_id = o.id WHERE m.user_id = ? ORDER BY o.id"},
+	{"project_memberships", "SELECT project_id, role FROM project_members WHERE user_id = ? ORDER BY project_id"},
+	{"sso_identities", "SELECT provider, subject, created_at FROM sso_identities WHERE user_id = ?"},
+}
+
+func (s *Server) writeExport(zw *zip.Writer, userID int) error {
+	profile, err := s.loadProfile(userID)
+	if err != nil {
+		return err
+	}
+	account := map[string]interface{}{"profile": profile}
+	for _, q := range exportQueries {
+		records, err := s.queryRecords(q.query, userID)
+		if err != nil {
+			return fmt.Errorf("%s: %w", q.name, err)
+		}
+		account[q.name] = records
+	}
+	if err := writeZipJSON(zw, "account.json", account); err != nil {
+		return err
+	}
+
+	projectIDs, err := s.userProjectIDs(userID)
+	if err != nil {
+		return err
+	}
+	for _, projectID := range projectIDs {
+		var (
+			p        Project
+			buildLog string
+		)
+		err := s.db.QueryRow(`
+			SELECT id, user_id, name, status, subdomain, created_at, url_preset, force_https, COALESCE(org_id, 0), build_log
+			FROM projects WHERE id = ?
+		`, projectID).Scan(&p.ID, &p.UserID, &p.Name, &p.Status, &p.Subdomain, &p.CreatedAt, &p.Preset, &p.ForceHTTPS, &p.OrgID, &buildLog)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		dir := "projects/" + projectID + "/"
+		vars, err := s.projectEnv(projectID)
+		if err != nil {
+			return err
+		}
+		if err := writeZipJSON(zw, dir+"project.json", map[string]interface{}{"project": p, "variables": redactedEnv(vars)}); err != nil {
+			return err
+		}
+		fw, err := zw.Create(dir + "build.log")
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(fw, buildLog); err != nil {
+			return err
+		}
+
+		live := s.liveDeployPrefix(projectID)
+		objects, err := s.storage.List(live)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			fw, err := zw.Create(dir + "deploy/" + strings.TrimPrefix(obj.Key, live))
+			if err != nil {
+				return err
+			}
+			rc, _, err := s.storage.Get(obj.Key)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(fw, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// queryRecords runs query and returns its rows as column-keyed maps.
+func (s *Server) queryRecords(query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	records := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		record := make(map[string]interface{}, len(cols))
+		for i, col := range cols {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			record[col] = values[i]
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (s *Server) handleListExports(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	rows, err := s.db.Query(`
+		SELECT id, status, size, created_at, expires_at FROM data_exports
+		WHERE user_id = ? AND expires_at > ? ORDER BY created_at DESC
+	`, userID, time.Now().Unix())
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	exports := []DataExport{}
+	for rows.Next() {
+		var e DataExport
+		if err := rows.Scan(&e.ID, &e.Status, &e.Size, &e.CreatedAt, &e.ExpiresAt); err != nil {
+			continue
+		}
+		exports = append(exports, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(exports)
+}
+
+// handleGetExport reports an export's progress and, once it is ready, signs
+// a new download URL. Each URL replaces the one handed out before.
+func (s *Server) handleGetExport(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	var e DataExport
+	err := s.db.QueryRow(`
+		SELECT id, status, size, created_at, expires_at FROM data_exports
+		WHERE id = ? AND user_id = ? AND expires_at > ?
+	`, mux.Vars(r)["id"], userID, time.Now().Unix()).Scan(&e.ID, &e.Status, &e.Size, &e.CreatedAt, &e.ExpiresAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if e.Status == exportReady {
+		token := randomToken()
+		expires := time.Now().Add(exportURLTTL)
+		if expires.Unix() > e.ExpiresAt {
+			expires = time.Unix(e.ExpiresAt, 0)
+		}
+		if _, err := s.db.Exec("UPDATE data_exports SET token_hash = ?, token_expires_at = ? WHERE id = ?",
+			hashToken(token), expires.Unix(), e.ID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		e.DownloadURL = fmt.Sprintf("%s/api/exports/%s/download?token=%s", publicURL, e.ID, url.QueryEscape(token))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
+
+// handleDownloadExport serves the zip to whoever holds a valid signed URL;
+// no other authentication is needed, so it works from a plain browser link.
+func (s *Server) handleDownloadExport(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	token := r.URL.Query().Get("token")
+	var n int
+	s.db.QueryRow(`
+		SELECT COUNT(*) FROM data_exports
+		WHERE id = ? AND status = ? AND token_hash = ? AND token_hash != '' AND token_expires_at > ?
+	`, id, exportReady, hashToken(token), time.Now().Unix()).Scan(&n)
+	if token == "" || n == 0 {
+		writeJSONError(w, http.StatusForbidden, "invalid_signature", "This download link is invalid or has expired")
+		return
+	}
+
+	rc, info, err := s.storage.Get(exportKey(id))
+	if err != nil {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="grape-export-%s.zip"`, id))
+	http.ServeContent(w, r, "", info.ModTime, rc)
+}
+
+// pruneExports removes expired exports and their files.
+func (s *Server) pruneExports() {
+	rows, err := s.db.Query("SELECT id FROM data_exports WHERE expires_at <= ?", time.Now().Unix())
+	if err != nil {
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	for _, id := range ids {
+		if err := s.storage.Delete(exportKey(id)); err != nil {
+			log.Printf("export %s: cannot delete file: %v", id, err)
+			continue
+		}
+		s.db.Exec("DELETE FROM data_exports WHERE id = ?", id)
+	}
+}
+
+// failInterruptedExports fails exports a previous process was assembling.
+func (s *Server) failInterruptedExports() {
+	if _, err := s.db.Exec("UPDATE data_exports SET status = ? WHERE status = ?", exportFailed, exportPending); err != nil {
+		log.Printf("cannot fail interrupted exports: %v", err)
+	}
+}
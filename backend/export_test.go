@@ -0,0 +1,81 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDataExport(t *testing.T) {
+	ts := newTestServer(t, stubRunner{output: "built\n"})
+	session := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, session, "site", siteZip(t))
+	ts.waitForStatus(t, session, project.ID)
+	ts.postJSON(t, "/api/projects/"+project.ID+"/env", session, map[string]string{"key": "API_TOKEN", "value": "hunter2hunter2"}, nil)
+
+	var export DataExport
+	if resp := ts.postJSON(t, "/api/me/export", session, nil, &export); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("request export: status %d", resp.StatusCode)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for export.Status == exportPending {
+		if time.Now().After(deadline) {
+			t.Fatal("export still pending")
+		}
+		time.Sleep(20 * time.Millisecond)
+		if resp := ts.do(t, "GET", "/api/me/exports/"+export.ID, session, nil, "", &export); resp.StatusCode != http.StatusOK {
+			t.Fatalf("export status: %d", resp.StatusCode)
+		}
+	}
+	if export.Status != exportReady || export.DownloadURL == "" {
+		t.Fatalf("export = %+v", export)
+	}
+
+	path := export.DownloadURL[strings.Index(export.DownloadURL, "/api/"):]
+	resp, err := ts.http.Client().Get(ts.http.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("download: status %d", resp.StatusCode)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(b)
+	}
+	dir := "projects/" + project.ID + "/"
+	if !strings.Contains(files["account.json"], "ada@example.com") {
+		t.Errorf("account.json = %q", files["account.json"])
+	}
+	if !strings.Contains(files[dir+"build.log"], "built") || files[dir+"deploy/index.html"] == "" {
+		t.Errorf("project files missing from %v", files)
+	}
+	for name, content := range files {
+		if strings.Contains(content, "hunter2hunter2") || strings.Contains(content, "$2a$") {
+			t.Errorf("%s contains a secret", name)
+		}
+	}
+
+	if resp, _ := ts.http.Client().Get(ts.http.URL + path + "x"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("tampered URL: status %d, want 403", resp.StatusCode)
+	}
+	// A new URL replaces the old one
+	ts.do(t, "GET", "/api/me/exports/"+export.ID, session, nil, "", &export)
+	if resp, _ := ts.http.Client().Get(ts.http.URL + path); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("superseded URL: status %d, want 403", resp.StatusCode)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// GET /api/projects/{id}/files lists a deployment's files with their sizes
+// and SHA-256 hashes, and the size of every directory, so users can see what
+// makes a site big without access to the server. Deployments don't change
+// once published, so their inventories are cached.
+
+// DeployedFile is one file of a deployment.
+type DeployedFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// DeployedDir is a directory of a deployment with everything below it.
+type DeployedDir struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Files int    `json:"files"`
+}
+
+// FileInventory is a deployment's file tree.
+type FileInventory struct {
+	DeploymentID string         `json:"deployment_id,omitempty"`
+	TotalBytes   int64          `json:"total_bytes"`
+	FileCount    int            `json:"file_count"`
+	Directories  []DeployedDir  `json:"directories"`
+	Files        []DeployedFile `json:"files"`
+}
+
+// maxCachedInventories bounds the inventory cache; any entry is dropped when
+// it is full.
+const maxCachedInventories = 64
+
+var inventoryCache = struct {
+	sync.Mutex
+	entries map[string]FileInventory
+}{entries: make(map[string]FileInventory)}
+
+// fileInventory lists the files stored under prefix, hashing them if asked.
+func (s *Server) fileInventory(prefix string, hashes bool) (FileInventory, error) {
+	objects, err := s.storage.List(prefix)
+	if err != nil {
+		return FileInventory{}, err
+	}
+	inv := FileInventory{Files: []DeployedFile{}}
+	dirs := map[string]*DeployedDir{}
+	for _, obj := range objects {
+		f := DeployedFile{Path: strings.TrimPrefix(obj.Key, prefix), Size: obj.Size}
+		if hashes {
+			if f.SHA256, err = s.hashObject(obj.Key); err != nil {
+				return inv, err
+			}
+		}
+		inv.Files = append(inv.Files, f)
+		inv.TotalBytes += f.Size
+		inv.FileCount++
+		for dir := path.Dir(f.Path); dir != "."; dir = path.Dir(dir) {
+			d := dirs[dir]
+			if d == nil {
+				d = &DeployedDir{Path: dir}
+				dirs[dir] = d
+			}
+			d.Size += f.Size
+			d.Files++
+		}
+	}
+	sort.Slice(inv.Files, func(i, j int) bool { return inv.Files[i].Path < inv.Files[j].Path })
+	inv.Directories = make([]DeployedDir, 0, len(dirs))
+	for _, d := range dirs {
+		inv.Directories = append(inv.Directories, *d)
+	}
+	sort.Slice(inv.Directories, func(i, j int) bool { return inv.Directories[i].Path < inv.Directories[j].Path })
+	return inv, nil
+}
+
+func (s *Server) hashObject(key string) (string, error) {
+	rc, _, err := s.storage.Get(key)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// deploymentInventory is the inventory of one published deployment, from the
+// cache if it was listed with hashes before.
+func (s *Server) deploymentInventory(projectID, deploymentID string, hashes bool) (FileInventory, error) {
+	key := projectID + "/" + deploymentID
+	inventoryCache.Lock()
+	inv, ok := inventoryCache.entries[key]
+	inventoryCache.Unlock()
+	if ok {
+		return inv, nil
+	}
+
+	inv, err := s.fileInventory(deploymentPrefix(projectID, deploymentID), hashes)
+	if err != nil {
+		return inv, err
+	}
+	inv.DeploymentID = deploymentID
+	if hashes {
+		inventoryCache.Lock()
+		if len(inventoryCache.entries) >= maxCachedInventories {
+			for k := range inventoryCache.entries {
+				delete(inventoryCache.entries, k)
+				break
+			}
+		}
+		inventoryCache.entries[key] = inv
+		inventoryCache.Unlock()
+	}
+	return inv, nil
+}
+
+// handleListFiles returns the file tree of the live deployment, or of the
+// one named by ?deployment=. ?sort=size puts the biggest files and
+// directories first; ?hashes=false skips hashing, which reads every file.
+func (s *Server) handleListFiles(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleViewer)
+	if !ok {
+		return
+	}
+	hashes := r.URL.Query().Get("hashes") != "false"
+
+	var inv FileInventory
+	var err error
+	if deploymentID := r.URL.Query().Get("deployment"); deploymentID != "" {
+		var status string
+		err = s.db.QueryRow("SELECT status FROM deployments WHERE id = ? AND project_id = ?", deploymentID, projectID).Scan(&status)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "deployment_not_found", "Deployment not found")
+			return
+		}
+		if err == nil && status != deploySucceeded {
+			writeJSONError(w, http.StatusConflict, "deployment_unsuccessful", "Only successful deployments have files")
+			return
+		}
+		if err == nil {
+			inv, err = s.deploymentInventory(projectID, deploymentID, hashes)
+		}
+	} else {
+		var live string
+		err = s.db.QueryRow("SELECT live_deployment FROM projects WHERE id = ?", projectID).Scan(&live)
+		switch {
+		case err != nil:
+		case live != "":
+			inv, err = s.deploymentInventory(projectID, live, hashes)
+		default:
+			// Published before deployments were versioned, so not cached
+			inv, err = s.fileInventory(deployPrefix(projectID), hashes)
+			if err == nil && inv.FileCount == 0 {
+				writeJSONError(w, http.StatusNotFound, "no_deployment", "The project has no deploy output yet")
+				return
+			}
+		}
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Cannot list files")
+		return
+	}
+
+	if r.URL.Query().Get("sort") == "size" {
+		files := append([]DeployedFile(nil), inv.Files...)
+		sort.SliceStable(files, func(i, j int) bool { return files[i].Size > files[j].Size })
+		dirs := append([]DeployedDir(nil), inv.Directories...)
+		sort.SliceStable(dirs, func(i, j int) bool { return dirs[i].Size > dirs[j].Size })
+		inv.Files, inv.Directories = files, dirs
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inv)
+}
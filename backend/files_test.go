@@ -0,0 +1,101 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// treeRunner publishes the whole source as the build output.
+type treeRunner struct{}
+
+func (treeRunner) Run(ctx context.Context, projectPath, stagePath string, timeout time.Duration, env []string, onStage func(string)) (string, error) {
+	return "", filepath.Walk(projectPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(projectPath, p)
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(stagePath, rel), 0755)
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(stagePath, rel), data, 0644)
+	})
+}
+
+func TestListFiles(t *testing.T) {
+	ts := newTestServer(t, treeRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+
+	page := "<h1>hello</h1>"
+	var js strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&js, "console.log(%d);\n", i*7919%1000)
+	}
+	bundle := js.String()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{"index.html": page, "assets/js/app.js": bundle, "assets/app.css": "body{}"} {
+		f, _ := zw.Create(name)
+		f.Write([]byte(content))
+	}
+	zw.Close()
+	project, resp := ts.upload(t, token, "site", buf.Bytes())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: status %d", resp.StatusCode)
+	}
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID + "/files"
+
+	var inv FileInventory
+	if resp := ts.do(t, "GET", path, token, nil, "", &inv); resp.StatusCode != http.StatusOK {
+		t.Fatalf("files: status %d", resp.StatusCode)
+	}
+	files := map[string]DeployedFile{}
+	for _, f := range inv.Files {
+		files[f.Path] = f
+	}
+	sum := sha256.Sum256([]byte(page))
+	if f := files["index.html"]; f.Size != int64(len(page)) || f.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("index.html %+v", f)
+	}
+	if f := files["assets/js/app.js"]; f.Size != int64(len(bundle)) {
+		t.Errorf("app.js %+v", f)
+	}
+	if inv.DeploymentID == "" || inv.FileCount != len(inv.Files) || inv.TotalBytes < int64(len(page)+len(bundle)) {
+		t.Errorf("inventory %+v", inv)
+	}
+	dirs := map[string]DeployedDir{}
+	for _, d := range inv.Directories {
+		dirs[d.Path] = d
+	}
+	if d := dirs["assets"]; d.Files != 2 || d.Size != int64(len(bundle)+len("body{}")) {
+		t.Errorf("assets directory %+v", d)
+	}
+
+	live := inv.DeploymentID
+	inv = FileInventory{}
+	ts.do(t, "GET", path+"?sort=size&hashes=false&deployment="+live, token, nil, "", &inv)
+	if len(inv.Files) == 0 || inv.Files[0].Path != "assets/js/app.js" || inv.Directories[0].Path != "assets" || inv.DeploymentID != live {
+		t.Errorf("by size %+v", inv)
+	}
+	if resp := ts.do(t, "GET", path+"?deployment=nope", token, nil, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown deployment: status %d, want 404", resp.StatusCode)
+	}
+	other := ts.signUp(t, "bob@example.com", "correct horse battery 1")
+	if resp := ts.do(t, "GET", path, other, nil, "", nil); resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusForbidden {
+		t.Errorf("someone else's files: status %d", resp.StatusCode)
+	}
+}
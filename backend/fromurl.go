@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// POST /api/projects/from-url downloads an archive, e.g. a CI artifact, and
+// deploys it like an upload. Only https URLs of public hosts are fetched, with
+// publicClient. Downloads get the upload size limit and must look like an
+// archive by their Content-Type as well as their content.
+
+var archiveFetchTimeout = envDuration("GRAPE_ARCHIVE_FETCH_TIMEOUT", 2*time.Minute)
+
+// archiveSchemes are the URL schemes archives may be downloaded over.
+var archiveSchemes = map[string]bool{"https": true}
+
+// archiveContentTypes are the Content-Types accepted for a downloaded
+// archive; its actual format is sniffed afterwards, as for uploads.
+var archiveContentTypes = map[string]bool{
+	"application/zip":              true,
+	"application/x-zip-compressed": true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-gtar":           true,
+	"application/x-tar":            true,
+	"application/x-compressed-tar": true,
+	"application/zstd":             true,
+	"application/x-zstd":           true,
+	"application/octet-stream":     true,
+	"binary/octet-stream":          true,
+}
+
+var (
+	errArchiveTooLarge    = errors.New("archive too large")
+	errArchiveContentType = errors.New("not an archive content type")
+)
+
+// urlRequest is the body of POST /api/projects/from-url. Besides the archive
+// it takes the same settings as an upload.
+type urlRequest struct {
+	URL             string `json:"url"`
+	Token           string `json:"token"`
+	Name            string `json:"name"`
+	Subdomain       string `json:"subdomain"`
+	Preset          string `json:"preset"`
+	OrgID           int    `json:"org_id"`
+	BuildTimeout    string `json:"build_timeout"`
+	ForceHTTPS      bool   `json:"force_https"`
+	HealthCheckPath string `json:"health_check_path"`
+	RootDir         string `json:"root_dir"`
+	Commit          string `json:"commit"`
+	CommitMessage   string `json:"commit_message"`
+}
+
+// validateArchiveURL accepts absolute URLs over an allowed scheme.
+// Credentials go in the token field, never the URL.
+func validateArchiveURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("url must be an absolute URL")
+	}
+	if !archiveSchemes[u.Scheme] {
+		return nil, errors.New("url must use https")
+	}
+	if u.User != nil {
+		return nil, errors.New("pass credentials in token, not in url")
+	}
+	return u, nil
+}
+
+// fetchArchive downloads u to dest and returns its size and the file name
+// the server gave it, if any. A token is sent as a bearer token, and dropped
+// if a redirect leaves the host.
+func fetchArchive(ctx context.Context, u *url.URL, token, dest string) (int64, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, archiveFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return 0, "", err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := publicClient(archiveSchemes, 0).Do(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return 0, "", fmt.Errorf("download timed out after %s", archiveFetchTimeout)
+		}
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, "", fmt.Errorf("server answered %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		if mediaType, _, err := mime.ParseMediaType(ct); err != nil || !archiveContentTypes[mediaType] {
+			return 0, "", fmt.Errorf("%w: %s", errArchiveContentType, ct)
+		}
+	}
+	if resp.ContentLength > maxUploadSize {
+		return 0, "", errArchiveTooLarge
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return 0, "", err
+	}
+	size, err := io.Copy(f, io.LimitReader(resp.Body, maxUploadSize+1))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	switch {
+	case err != nil && ctx.Err() == context.DeadlineExceeded:
+		err = fmt.Errorf("download timed out after %s", archiveFetchTimeout)
+	case err == nil && size > maxUploadSize:
+		err = errArchiveTooLarge
+	}
+	if err != nil {
+		os.Remove(dest)
+		return 0, "", err
+	}
+
+	var filename string
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		filename = path.Base(params["filename"])
+	}
+	return size, filename, nil
+}
+
+// handleDeployFromURL creates a project from an archive downloaded from a URL.
+func (s *Server) handleDeployFromURL(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	var req urlRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxFormFieldSize)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	u, err := validateArchiveURL(strings.TrimSpace(req.URL))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_url", err.Error())
+		return
+	}
+	if !s.uploadAllowed(w, r, userID) {
+		return
+	}
+
+	projectID := generateID()
+	uploadPath := filepath.Join(s.cfg.StagingDir, projectID+".upload")
+	defer os.Remove(uploadPath)
+	size, filename, err := fetchArchive(r.Context(), u, req.Token, uploadPath)
+	switch {
+	case errors.Is(err, errArchiveTooLarge):
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "archive_too_large", fmt.Sprintf("Archive exceeds the %d MB limit", maxUploadSize>>20))
+		return
+	case errors.Is(err, errArchiveContentType):
+		writeJSONError(w, http.StatusUnsupportedMediaType, "unsupported_content_type", err.Error())
+		return
+	case err != nil:
+		if req.Token != "" {
+			err = errors.New(strings.ReplaceAll(err.Error(), req.Token, redacted))
+		}
+		writeJSONError(w, http.StatusUnprocessableEntity, "download_failed", "Cannot download archive: "+err.Error())
+		return
+	}
+
+	// The query string may hold a signed URL's credentials, so it isn't kept
+	source := u.Scheme + "://" + u.Host + u.Path
+	if filename == "" || filename == "." || filename == "/" {
+		filename = path.Base(u.Path)
+	}
+	form := &uploadForm{
+		fields: map[string]string{
+			"name":              req.Name,
+			"subdomain":         req.Subdomain,
+			"preset":            req.Preset,
+			"build_timeout":     req.BuildTimeout,
+			"force_https":       strconv.FormatBool(req.ForceHTTPS),
+			"health_check_path": req.HealthCheckPath,
+			"root_dir":          req.RootDir,
+			"commit":            req.Commit,
+			"commit_message":    req.CommitMessage,
+		},
+		filename: filename,
+		size:     size,
+	}
+	if req.Name == "" {
+		form.fields["name"] = strings.TrimSuffix(strings.TrimSuffix(filename, path.Ext(filename)), ".tar")
+	}
+	if req.OrgID != 0 {
+		form.fields["org_id"] = strconv.Itoa(req.OrgID)
+	}
+	s.createProject(w, r, userID, projectID, uploadPath, form, deploySource{Trigger: "url", Name: source})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeployFromURL(t *testing.T) {
+	archiveSchemes["http"] = true
+	savedAllowed := publicHostAllowed
+	publicHostAllowed = func(net.IP) bool { return true }
+	t.Cleanup(func() {
+		delete(archiveSchemes, "http")
+		publicHostAllowed = savedAllowed
+	})
+
+	site := siteZip(t)
+	artifacts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/builds/site.zip":
+			if r.Header.Get("Authorization") != "Bearer ci-secret" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/zip")
+			w.Write(site)
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<h1>not an archive</h1>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer artifacts.Close()
+
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+
+	var project Project
+	if resp := ts.postJSON(t, "/api/projects/from-url", token, map[string]string{"url": artifacts.URL + "/builds/site.zip?sig=abc", "token": "ci-secret"}, &project); resp.StatusCode != http.StatusOK {
+		t.Fatalf("from-url: status %d", resp.StatusCode)
+	}
+	if p := ts.waitForStatus(t, token, project.ID); p.Status != "live" {
+		t.Fatalf("build %s: %s", p.Status, p.BuildLog)
+	}
+	if project.Name != "site" {
+		t.Errorf("project named %q", project.Name)
+	}
+	var deployments []Deployment
+	ts.do(t, "GET", "/api/projects/"+project.ID+"/deployments", token, nil, "", &deployments)
+	if len(deployments) != 1 || deployments[0].Trigger != "url" || strings.Contains(deployments[0].SourceName, "sig=") {
+		t.Errorf("deployments %+v", deployments)
+	}
+
+	for _, tc := range []struct {
+		body map[string]string
+		want int
+	}{
+		{map[string]string{"url": artifacts.URL + "/builds/site.zip"}, http.StatusUnprocessableEntity},
+		{map[string]string{"url": artifacts.URL + "/page.html"}, http.StatusUnsupportedMediaType},
+		{map[string]string{"url": "ftp://example.com/site.zip"}, http.StatusBadRequest},
+	} {
+		if resp := ts.postJSON(t, "/api/projects/from-url", token, tc.body, nil); resp.StatusCode != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.body["url"], resp.StatusCode, tc.want)
+		}
+	}
+
+	// Internal addresses are refused when connecting
+	publicHostAllowed = savedAllowed
+	if resp := ts.postJSON(t, "/api/projects/from-url", token, map[string]string{"url": artifacts.URL + "/builds/site.zip", "token": "ci-secret"}, nil); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("loopback host: status %d, want 422", resp.StatusCode)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// POST /api/projects/from-git clones a repository and deploys it like an
+// upload: the working tree is zipped and stored as the project's source, so
+// rebuilds, downloads and exports work the same. Only the requested ref is
+// fetched, without history, tags or submodules.
+
+var gitCloneTimeout = envDuration("GRAPE_GIT_CLONE_TIMEOUT", 2*time.Minute)
+
+// cloneSizeInterval is how often a running clone's size is checked.
+var cloneSizeInterval = 200 * time.Millisecond
+
+// errCloneTooLarge stops a clone that outgrows maxProjectSize.
+var errCloneTooLarge = errors.New("repository is larger than a project may be")
+
+// gitRequest is the body of POST /api/projects/from-git. Besides the
+// repository it takes the same settings as an upload.
+type gitRequest struct {
+	RepoURL         string `json:"repo_url"`
+	Provider        string `json:"provider"`
+	Ref             string `json:"ref"`
+	Token           string `json:"token"`
+	Name            string `json:"name"`
+	Subdomain       string `json:"subdomain"`
+	Preset          string `json:"preset"`
+	OrgID           int    `json:"org_id"`
+	BuildTimeout    string `json:"build_timeout"`
+	ForceHTTPS      bool   `json:"force_https"`
+	HealthCheckPath string `json:"health_check_path"`
+	RootDir         string `json:"root_dir"`
+}
+
+// validateRepoURL accepts URLs of public hosts over one of the configured
+// GitSchemes. Credentials go in the token field, never the URL, so they
+// aren't stored with the deployment.
+func (s *Server) validateRepoURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("repo_url must be an absolute URL")
+	}
+	if !s.cfg.GitSchemes[u.Scheme] {
+		return nil, errors.New("repo_url must use https")
+	}
+	if u.User != nil {
+		return nil, errors.New("pass credentials in token, not in repo_url")
+	}
+	if _, err := resolvePublicHost(context.Background(), u.Hostname()); err != nil {
+		return nil, fmt.Errorf("repo_url must be a public host: %v", err)
+	}
+	return u, nil
+}
+
+// gitNetConfig keeps git from reaching internal hosts: the repository's host
+// is resolved and checked again and git is pinned to that address, so the
+// name can't resolve elsewhere once checked, and redirects aren't followed.
+func gitNetConfig(ctx context.Context, repo *url.URL) ([]string, error) {
+	config := []string{"-c", "http.followRedirects=false"}
+	ip, err := resolvePublicHost(ctx, repo.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	port := repo.Port()
+	if port == "" {
+		port = "443"
+		if repo.Scheme == "http" {
+			port = "80"
+		}
+	}
+	addr := ip.String()
+	if ip.To4() == nil {
+		addr = "[" + addr + "]"
+	}
+	return append(config, "-c", "http.curloptResolve="+repo.Hostname()+":"+port+":"+addr), nil
+}
+
+// validateGitRef keeps refs from being read as options by git.
+func validateGitRef(ref string) error {
+	if strings.HasPrefix(ref, "-") || strings.ContainsAny(ref, " \t\r\n~^:?*[\\") || len(ref) > 255 {
+		return errors.New("ref is not a valid branch or tag name")
+	}
+	return nil
+}
+
+// cloneRepo shallow-clones ref (or the default branch) of repo into dir and
+// returns the commit it checked out and its subject line. A token is sent as
+// the password of the provider's clone user. The clone is stopped with
+// errCloneTooLarge as soon as dir outgrows maxProjectSize.
+func (s *Server) cloneRepo(ctx context.Context, repo *url.URL, ref string, provider gitProvider, token, dir string) (commit, subject string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, gitCloneTimeout)
+	defer cancel()
+
+	schemes := make([]string, 0, len(s.cfg.GitSchemes))
+	for scheme := range s.cfg.GitSchemes {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	netConfig, err := gitNetConfig(ctx, repo)
+	if err != nil {
+		return "", "", err
+	}
+	git := func(args ...string) (string, error) {
+		config := netConfig
+		if token != "" {
+			// Sent as a header so the token never lands in .git/config
+			auth := base64.StdEncoding.EncodeToString([]byte(provider.cloneUser() + ":" + token))
+			config = append(config[:len(config):len(config)], "-c", "http.extraHeader=Authorization: Basic "+auth)
+		}
+		cmd := exec.CommandContext(ctx, "git", append(config, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL="+strings.Join(schemes, ":"))
+		out, err := cmd.CombinedOutput()
+		if token != "" {
+			out = []byte(strings.ReplaceAll(string(out), token, redacted))
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("git %s timed out after %s", args[0], gitCloneTimeout)
+		}
+		if err != nil {
+			return "", fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(string(out)))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	args := []string{"clone", "--depth", "1", "--single-branch", "--no-tags"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	stopWatching := watchCloneSize(dir, cancel)
+	_, err = git(append(args, "--", repo.String(), dir)...)
+	if sizeErr := stopWatching(); sizeErr != nil {
+		return "", "", sizeErr
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if commit, err = git("-C", dir, "rev-parse", "HEAD"); err != nil {
+		return "", "", err
+	}
+	if subject, err = git("-C", dir, "log", "-1", "--format=%s"); err != nil {
+		return "", "", err
+	}
+	return commit, subject, os.RemoveAll(filepath.Join(dir, ".git"))
+}
+
+// watchCloneSize checks the size of dir while a clone writes to it and
+// cancels the clone once it is over maxProjectSize. The returned function
+// stops watching and reports whether the clone was, or ended up, too large.
+func watchCloneSize(dir string, cancel context.CancelFunc) func() error {
+	tooLarge := func() error {
+		if maxProjectSize > 0 && dirSize(dir) > maxProjectSize {
+			return fmt.Errorf("%w: more than %d MB", errCloneTooLarge, maxProjectSize>>20)
+		}
+		return nil
+	}
+	done, result := make(chan struct{}), make(chan error, 1)
+	go func() {
+		ticker := time.NewTicker(cloneSizeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				result <- tooLarge()
+				return
+			case <-ticker.C:
+				if err := tooLarge(); err != nil {
+					cancel()
+					result <- err
+					return
+				}
+			}
+		}
+	}()
+	return func() error {
+		close(done)
+		return <-result
+	}
+}
+
+// zipDir writes the regular files under dir to a zip archive at dest and
+// returns its size. Symlinks are left out, as they would be on extraction.
+func zipDir(dir, dest string) (int64, error) {
+	f, err := os.Create(dest)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name, hdr.Method = filepath.ToSlash(rel), zip.Deflate
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(w, src)
+		return err
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// handleDeployFromGit creates a project from a Git repository.
+func (s *Server) handleDeployFromGit(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	var req gitRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxFormFieldSize)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	repo, err := s.validateRepoURL(strings.TrimSpace(req.RepoURL))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_repo_url", err.Error())
+		return
+	}
+	if err := validateGitRef(req.Ref); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_ref", err.Error())
+		return
+	}
+	if req.Provider == "" {
+		req.Provider = detectGitProvider(repo)
+	}
+	provider, ok := gitProviders[req.Provider]
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "unknown_provider", "Unknown provider "+req.Provider)
+		return
+	}
+	if !s.uploadAllowed(w, r, userID) {
+		return
+	}
+
+	projectID := generateID()
+	cloneDir := filepath.Join(s.cfg.StagingDir, projectID+".git")
+	defer os.RemoveAll(cloneDir)
+	commit, subject, err := s.cloneRepo(r.Context(), repo, req.Ref, provider, req.Token, cloneDir)
+	if errors.Is(err, errCloneTooLarge) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "repository_too_large", err.Error())
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, "clone_failed", err.Error())
+		return
+	}
+
+	uploadPath := filepath.Join(s.cfg.StagingDir, projectID+".upload")
+	defer os.Remove(uploadPath)
+	size, err := zipDir(cloneDir, uploadPath)
+	if err != nil {
+		http.Error(w, "Cannot package repository", http.StatusInternalServerError)
+		return
+	}
+	if size > maxUploadSize {
+		http.Error(w, fmt.Sprintf("Repository exceeds the %d MB limit", maxUploadSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if len(subject) > maxCommitMessageLength {
+		subject = subject[:maxCommitMessageLength]
+	}
+	form := &uploadForm{
+		fields: map[string]string{
+			"name":              req.Name,
+			"subdomain":         req.Subdomain,
+			"preset":            req.Preset,
+			"build_timeout":     req.BuildTimeout,
+			"force_https":       strconv.FormatBool(req.ForceHTTPS),
+			"health_check_path": req.HealthCheckPath,
+			"root_dir":          req.RootDir,
+			"commit":            commit,
+			"commit_message":    subject,
+		},
+		filename: path.Base(strings.TrimSuffix(repo.Path, ".git")) + ".zip",
+		size:     size,
+	}
+	if req.Name == "" {
+		form.fields["name"] = strings.TrimSuffix(form.filename, ".zip")
+	}
+	if req.OrgID != 0 {
+		form.fields["org_id"] = strconv.Itoa(req.OrgID)
+	}
+	s.createProject(w, r, userID, projectID, uploadPath, form, deploySource{Trigger: "git", Name: repo.String()})
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// A project linked to a repository is rebuilt from the tip of its branch
+// whenever its provider delivers a push to /api/hooks/{provider} signed with
+// the project's webhook secret. Each push replaces the stored source, so
+// later rebuilds, downloads and exports see the new commit. Pushes to other
+// branches are built too when branch deploys are on (see branches.go).
+
+// maxHookPayload bounds webhook bodies; providers allow up to 25 MB but push
+// payloads are far smaller unless a push carries thousands of commits.
+const maxHookPayload = 5 << 20
+
+// Associated data for the sealed repository token, which can't collide with
+// an environment variable name.
+const gitTokenKey = "git:token"
+
+type gitLink struct {
+	Provider      string         `json:"provider"`
+	RepoURL       string         `json:"repo_url"`
+	Branch        string         `json:"branch"`
+	BranchDeploys bool           `json:"branch_deploys"`
+	Branches      []BranchDeploy `json:"branches,omitempty"`
+	WebhookURL    string         `json:"webhook_url"`
+	Secret        string         `json:"secret,omitempty"`
+}
+
+// normalizeRepoURL makes the clone and web URLs of a repository compare
+// equal: https://GitHub.com/ada/site.git and https://github.com/ada/site/.
+func normalizeRepoURL(u *url.URL) string {
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) +
+		strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), ".git")
+}
+
+func gitWebhookURL(provider string) string {
+	return strings.TrimSuffix(publicURL, "/") + "/api/hooks/" + provider
+}
+
+// handleGetGitLink shows which repository and branch the project deploys from.
+func (s *Server) handleGetGitLink(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleViewer)
+	if !ok {
+		return
+	}
+	var link gitLink
+	var subdomain string
+	s.db.QueryRow("SELECT git_provider, git_repo, git_branch, git_branch_deploys, subdomain FROM projects WHERE id = ?", projectID).
+		Scan(&link.Provider, &link.RepoURL, &link.Branch, &link.BranchDeploys, &subdomain)
+	if link.RepoURL == "" {
+		writeJSONError(w, http.StatusNotFound, "not_linked", "Project is not linked to a repository")
+		return
+	}
+	link.WebhookURL = gitWebhookURL(link.Provider)
+	if link.BranchDeploys {
+		var err error
+		if link.Branches, err = s.branchDeploys(projectID, subdomain); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(link)
+}
+
+// handleSetGitLink links the project to a repository, returning a fresh
+// webhook secret. It is only ever shown here; linking again rotates it.
+func (s *Server) handleSetGitLink(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleDeployer)
+	if !ok {
+		return
+	}
+	var req struct {
+		Provider string `json:"provider"`
+		RepoURL  string `json:"repo_url"`
+		Branch   string `json:"branch"`
+		Token    string `json:"token"`
+		// BranchDeploys builds pushes to other branches into their own hosts
+		BranchDeploys bool `json:"branch_deploys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	repo, err := s.validateRepoURL(strings.TrimSpace(req.RepoURL))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_repo_url", err.Error())
+		return
+	}
+	if req.Provider == "" {
+		req.Provider = detectGitProvider(repo)
+	}
+	if _, ok := gitProviders[req.Provider]; !ok {
+		writeJSONError(w, http.StatusBadRequest, "unknown_provider", "Unknown provider "+req.Provider)
+		return
+	}
+	if req.Branch == "" {
+		req.Branch = "main"
+	}
+	if err := validateGitRef(req.Branch); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_ref", err.Error())
+		return
+	}
+
+	var token string
+	if req.Token != "" {
+		token = s.sealEnv(projectID, gitTokenKey, req.Token)
+	}
+	link := gitLink{
+		Provider:      req.Provider,
+		RepoURL:       normalizeRepoURL(repo),
+		Branch:        req.Branch,
+		BranchDeploys: req.BranchDeploys,
+		WebhookURL:    gitWebhookURL(req.Provider),
+		Secret:        randomToken(),
+	}
+	if _, err := s.db.Exec("UPDATE projects SET git_provider = ?, git_repo = ?, git_branch = ?, git_token = ?, git_webhook_secret = ?, git_branch_deploys = ? WHERE id = ?",
+		link.Provider, link.RepoURL, link.Branch, token, link.Secret, link.BranchDeploys, projectID); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	// Branches of another repository, or that are no longer built, go away
+	if _, err := s.db.Exec("DELETE FROM branch_deploys WHERE project_id = ? AND (? OR branch = ?)", projectID, !link.BranchDeploys, link.Branch); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(link)
+}
+
+func (s *Server) handleDeleteGitLink(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleDeployer)
+	if !ok {
+		return
+	}
+	if _, err := s.db.Exec("UPDATE projects SET git_repo = '', git_branch = '', git_token = '', git_webhook_secret = '', git_branch_deploys = 0 WHERE id = ?", projectID); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if _, err := s.db.Exec("DELETE FROM branch_deploys WHERE project_id = ?", projectID); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGitHook rebuilds the projects linked to a pushed branch whose secret
+// the delivery was signed with. Projects with branch deploys also build
+// their other pushed branches and drop the deploys of deleted ones. A
+// project builds one thing at a time, production first, and skips pushes
+// that leave its root directory alone.
+func (s *Server) handleGitHook(w http.ResponseWriter, r *http.Request) {
+	providerName := mux.Vars(r)["provider"]
+	provider, ok := gitProviders[providerName]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "unknown_provider", "Unknown provider "+providerName)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxHookPayload+1))
+	if err != nil || len(body) > maxHookPayload {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "payload_too_large", "Payload too large")
+		return
+	}
+	push, err := provider.parsePush(r.Header, body)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	if len(push.repos) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_payload", "Payload names no repository")
+		return
+	}
+
+	type linked struct {
+		id, branch, status, rootDir string
+		userID                      int
+		branchDeploys               bool
+	}
+	args := []interface{}{providerName}
+	for _, repo := range push.repos {
+		args = append(args, repo)
+	}
+	rows, err := s.db.Query(`SELECT id, user_id, git_branch, git_branch_deploys, git_webhook_secret, status, root_dir FROM projects
+		WHERE git_provider = ? AND git_repo IN (?`+strings.Repeat(", ?", len(push.repos)-1)+`) AND git_webhook_secret != ''`, args...)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	var projects []linked
+	for rows.Next() {
+		var p linked
+		var secret string
+		if rows.Scan(&p.id, &p.userID, &p.branch, &p.branchDeploys, &secret, &p.status, &p.rootDir) == nil && provider.verify(r.Header, body, secret) {
+			projects = append(projects, p)
+		}
+	}
+	rows.Close()
+	if len(projects) == 0 {
+		writeJSONError(w, http.StatusUnauthorized, "invalid_signature", "No linked project matches the signature")
+		return
+	}
+
+	result := map[string][]string{"queued": {}, "skipped": {}}
+	if push.event != "push" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	for _, p := range projects {
+		// Pushes that change nothing under the root directory aren't built
+		var branch *pushedBranch
+		for i, b := range push.branches {
+			if !touchesRootDir(p.rootDir, b.changed) {
+				continue
+			}
+			if b.name == p.branch {
+				branch = &push.branches[i]
+			} else if p.branchDeploys && branch == nil {
+				branch = &push.branches[i]
+			}
+		}
+		if p.branchDeploys {
+			for _, name := range push.deleted {
+				if err := s.removeBranchDeploy(p.id, name); err != nil {
+					log.Printf("project %s: cannot remove the deploy of branch %s: %v", p.id, name, err)
+				}
+			}
+		}
+		queued := false
+		building := p.status == "queued" || p.status == "building"
+		if branch != nil && !building && p.status != "archived" {
+			queued, err = s.updateProjectStatusLog(p.id, p.status, "queued", "")
+			if err != nil {
+				log.Printf("project %s: cannot queue push build: %v", p.id, err)
+			}
+		}
+		if !queued {
+			result["skipped"] = append(result["skipped"], p.id)
+			continue
+		}
+		result["queued"] = append(result["queued"], p.id)
+		s.publishStatus(p.id, p.userID, "queued")
+		src := deploySource{Trigger: "push", Commit: branch.commit, CommitMessage: branch.message}
+		if branch.name != p.branch {
+			src.Branch = branch.name
+		}
+		s.deployPush(p.id, p.userID, src)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(result)
+}
+
+// deployPush fetches the tip of the project's branch, or of src.Branch, in
+// the background and builds it. A failed fetch is recorded as a failed
+// deployment.
+func (s *Server) deployPush(projectID string, userID int, src deploySource) {
+	s.builds.wg.Add(1)
+	go func() {
+		defer s.builds.wg.Done()
+		projectPath := filepath.Join(s.cfg.ProjectsDir, projectID)
+		var err error
+		if src.Branch != "" {
+			projectPath, err = s.fetchBranchSource(projectID, &src)
+		} else {
+			err = s.fetchGitSource(projectID, &src)
+		}
+		if err == nil {
+			s.startBuild(projectID, projectPath, src)
+			return
+		}
+		if _, derr := s.createDeployment(projectID, src); derr != nil {
+			log.Printf("project %s: cannot record deployment: %v", projectID, derr)
+		}
+		if ok, _ := s.updateProjectStatusLog(projectID, "queued", "failed", "Error: "+err.Error()+"\n"); ok {
+			s.publishStatus(projectID, userID, "failed")
+		}
+	}()
+}
+
+// fetchGitSource clones the project's branch and makes it the project's
+// source, filling in what src was built from.
+func (s *Server) fetchGitSource(projectID string, src *deploySource) error {
+	cloneDir := filepath.Join(s.cfg.StagingDir, projectID+".git")
+	os.RemoveAll(cloneDir)
+	defer os.RemoveAll(cloneDir)
+	if err := s.cloneLinkedRepo(projectID, "", cloneDir, src); err != nil {
+		return err
+	}
+
+	rootDir := s.rootDir(projectID)
+	if err := checkProjectRoot(cloneDir, rootDir); err != nil {
+		return err
+	}
+	headerRules, redirectRules, buildConfig, err := loadSiteFiles(projectRoot(cloneDir, rootDir))
+	if err != nil {
+		return fmt.Errorf("invalid %v", err)
+	}
+
+	archive := filepath.Join(s.cfg.StagingDir, projectID+".push"+archiveExt(formatZip))
+	defer os.Remove(archive)
+	if src.Size, err = zipDir(cloneDir, archive); err != nil {
+		return err
+	}
+	src.Format = formatZip
+	if src.Size > maxUploadSize {
+		return fmt.Errorf("repository exceeds the %d MB limit", maxUploadSize>>20)
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := validateArchive(f, src.Size, formatZip); err != nil {
+		return err
+	}
+	if err := s.storage.Put(uploadKey(projectID, formatZip), f); err != nil {
+		return fmt.Errorf("cannot store source: %v", err)
+	}
+	for _, af := range archiveFormats {
+		if af.format != formatZip {
+			s.storage.Delete(uploadKey(projectID, af.format))
+		}
+	}
+
+	if _, err := s.db.Exec("UPDATE projects SET header_rules = ?, redirect_rules = ?, build_config = ? WHERE id = ?",
+		headerRules, redirectRules, buildConfig, projectID); err != nil {
+		return err
+	}
+	projectPath := filepath.Join(s.cfg.ProjectsDir, projectID)
+	if err := os.RemoveAll(projectPath); err != nil {
+		return err
+	}
+	return os.Rename(cloneDir, projectPath)
+}
+
+// fetchBranchSource clones src.Branch for a branch deploy and returns where.
+// The project's own source is left alone; the checkout stays until the next
+// branch build.
+func (s *Server) fetchBranchSource(projectID string, src *deploySource) (string, error) {
+	dir := filepath.Join(s.cfg.StagingDir, projectID+".branch")
+	os.RemoveAll(dir)
+	if err := s.cloneLinkedRepo(projectID, src.Branch, dir, src); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// cloneLinkedRepo clones branch, or the project's own branch if empty, of the
+// project's repository into dir and fills in what src is built from.
+func (s *Server) cloneLinkedRepo(projectID, branch, dir string, src *deploySource) error {
+	var providerName, repoURL, linkedBranch, sealedToken string
+	if err := s.db.QueryRow("SELECT git_provider, git_repo, git_branch, git_token FROM projects WHERE id = ?", projectID).
+		Scan(&providerName, &repoURL, &linkedBranch, &sealedToken); err != nil {
+		return err
+	}
+	if branch == "" {
+		branch = linkedBranch
+	}
+	provider, ok := gitProviders[providerName]
+	if !ok {
+		return fmt.Errorf("unknown provider %s", providerName)
+	}
+	var token string
+	if sealedToken != "" {
+		var err error
+		if token, err = s.openEnv(projectID, gitTokenKey, sealedToken); err != nil {
+			return err
+		}
+	}
+	repo, err := s.validateRepoURL(repoURL)
+	if err != nil {
+		return err
+	}
+	if err := validateGitRef(branch); err != nil {
+		return err
+	}
+
+	commit, subject, err := s.cloneRepo(context.Background(), repo, branch, provider, token, dir)
+	if err != nil {
+		return err
+	}
+	// The branch may have moved on since the push; describe what is built
+	if commit != src.Commit {
+		src.CommitMessage = subject
+	}
+	src.Commit, src.Name = commit, repo.String()
+	if len(src.CommitMessage) > maxCommitMessageLength {
+		src.CommitMessage = src.CommitMessage[:maxCommitMessageLength]
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sourceRunner publishes the project's own index.html, so tests can see
+// which source was built.
+type sourceRunner struct{}
+
+func (sourceRunner) Run(ctx context.Context, projectPath, stagePath string, timeout time.Duration, env []string, onStage func(string)) (string, error) {
+	page, err := os.ReadFile(filepath.Join(projectPath, "index.html"))
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(stagePath, 0755); err != nil {
+		return "", err
+	}
+	return "", os.WriteFile(filepath.Join(stagePath, "index.html"), page, 0644)
+}
+
+func TestGitHubPushDeploys(t *testing.T) {
+	repo := gitRepo(t)
+	ts := newTestServer(t, sourceRunner{})
+	remote := ts.gitRemote(t, repo)
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID
+
+	var link gitLink
+	if resp := ts.do(t, "PUT", path+"/git", token, jsonBody(map[string]string{"repo_url": remote + ".git/"}), "application/json", &link); resp.StatusCode != http.StatusOK {
+		t.Fatalf("link: status %d", resp.StatusCode)
+	}
+	if link.Secret == "" || link.Branch != "main" || link.RepoURL != remote {
+		t.Fatalf("link %+v", link)
+	}
+
+	os.WriteFile(filepath.Join(repo, "index.html"), []byte("<h1>pushed</h1>"), 0644)
+	commit := exec.Command("git", "-C", repo, "-c", "user.name=Ada", "-c", "user.email=ada@example.com", "commit", "-qam", "Update the home page")
+	if out, err := commit.CombinedOutput(); err != nil {
+		t.Fatalf("git commit: %v\n%s", err, out)
+	}
+	head, _ := exec.Command("git", "-C", repo, "rev-parse", "HEAD").Output()
+	sha := strings.TrimSpace(string(head))
+
+	deliver := func(event, secret, ref string) *http.Response {
+		body := []byte(`{"ref": "` + ref + `", "after": "` + sha + `", "repository": {"clone_url": "` + remote + `.git"},
+			"head_commit": {"id": "` + sha + `", "message": "Update the home page\n\nWith details"}}`)
+		req, _ := http.NewRequest("POST", ts.http.URL+"/api/hooks/github", bytes.NewReader(body))
+		req.Header.Set("X-GitHub-Event", event)
+		req.Header.Set("X-Hub-Signature-256", signWebhook(secret, body))
+		resp, err := ts.http.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := deliver("push", "wrong", "refs/heads/main"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("bad signature: status %d, want 401", resp.StatusCode)
+	}
+	if resp := deliver("push", link.Secret, "refs/heads/dev"); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("push to another branch: status %d", resp.StatusCode)
+	}
+	if resp := deliver("push", link.Secret, "refs/heads/main"); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("push: status %d", resp.StatusCode)
+	}
+	if p := ts.waitForStatus(t, token, project.ID); p.Status != "live" {
+		t.Fatalf("push build %s: %s", p.Status, p.BuildLog)
+	}
+	if got := ts.livePage(t, project.ID); got != "<h1>pushed</h1>" {
+		t.Errorf("live page %q", got)
+	}
+
+	var deployments []Deployment
+	ts.do(t, "GET", path+"/deployments", token, nil, "", &deployments)
+	if len(deployments) != 2 || deployments[0].Trigger != "push" || deployments[0].Commit != sha || !strings.HasPrefix(deployments[0].CommitMessage, "Update the home page") {
+		t.Errorf("deployments %+v", deployments)
+	}
+
+	ts.do(t, "DELETE", path+"/git", token, nil, "", nil)
+	if resp := deliver("push", link.Secret, "refs/heads/main"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("push after unlinking: status %d, want 401", resp.StatusCode)
+	}
+}
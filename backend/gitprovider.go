@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gitProvider adapts one Git host's webhooks and clone authentication. Each
+// is served at /api/hooks/{name}; add new hosts to gitProviders.
+type gitProvider interface {
+	// parsePush reads a webhook delivery. It is called before the delivery
+	// is verified, so nothing it returns may be acted on until verify agrees.
+	parsePush(h http.Header, body []byte) (*gitPush, error)
+	// verify reports whether the delivery was signed with, or carries,
+	// the project's webhook secret.
+	verify(h http.Header, body []byte, secret string) bool
+	// cloneUser is the basic auth user name that goes with an access token.
+	cloneUser() string
+}
+
+// gitPush is what a provider's delivery says happened.
+type gitPush struct {
+	event    string   // "push", "ping" or anything else, which is ignored
+	repos    []string // URLs of the repository, normalized
+	branches []pushedBranch
+	deleted  []string // names of the branches the push deleted
+}
+
+// pushedBranch is a branch a push moved, leaving out deleted ones.
+type pushedBranch struct {
+	name, commit, message string
+	// changed lists the files the push touched, or is nil if the delivery
+	// doesn't tell them all (new or force-pushed branches, long pushes)
+	changed []string
+}
+
+// pushCommit is the part of a GitHub or GitLab push commit that says which
+// files it touched.
+type pushCommit struct {
+	ID       string   `json:"id"`
+	Message  string   `json:"message"`
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+}
+
+// maxPushCommits is how many commits GitHub and GitLab put in a delivery.
+const maxPushCommits = 20
+
+func changedFiles(commits []pushCommit) []string {
+	files := []string{}
+	for _, c := range commits {
+		files = append(append(append(files, c.Added...), c.Modified...), c.Removed...)
+	}
+	return files
+}
+
+var gitProviders = map[string]gitProvider{
+	"github":    githubProvider{},
+	"gitlab":    gitlabProvider{},
+	"bitbucket": bitbucketProvider{},
+}
+
+// detectGitProvider guesses the provider from the repository's host, so
+// links to the well-known hosts don't need to name one.
+func detectGitProvider(repo *url.URL) string {
+	host := strings.ToLower(repo.Hostname())
+	switch {
+	case host == "gitlab.com" || strings.HasPrefix(host, "gitlab."):
+		return "gitlab"
+	case host == "bitbucket.org":
+		return "bitbucket"
+	}
+	return "github"
+}
+
+// repoURLs normalizes the repository URLs a delivery names, skipping blanks.
+func repoURLs(raw ...string) []string {
+	var repos []string
+	for _, r := range raw {
+		if u, err := url.Parse(r); err == nil && r != "" {
+			repos = append(repos, normalizeRepoURL(u))
+		}
+	}
+	return repos
+}
+
+// zeroCommit is the "after" of a push that deleted the branch.
+const zeroCommit = "0000000000000000000000000000000000000000"
+
+type githubProvider struct{}
+
+func (githubProvider) parsePush(h http.Header, body []byte) (*gitPush, error) {
+	var p struct {
+		Ref        string       `json:"ref"`
+		After      string       `json:"after"`
+		Created    bool         `json:"created"`
+		Deleted    bool         `json:"deleted"`
+		Forced     bool         `json:"forced"`
+		Commits    []pushCommit `json:"commits"`
+		Repository struct {
+			CloneURL string `json:"clone_url"`
+			HTMLURL  string `json:"html_url"`
+		} `json:"repository"`
+		HeadCommit *struct {
+			Message string `json:"message"`
+		} `json:"head_commit"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	push := &gitPush{event: h.Get("X-GitHub-Event"), repos: repoURLs(p.Repository.CloneURL, p.Repository.HTMLURL)}
+	if name, ok := strings.CutPrefix(p.Ref, "refs/heads/"); ok && p.Deleted {
+		push.deleted = append(push.deleted, name)
+	} else if ok {
+		b := pushedBranch{name: name, commit: p.After}
+		if p.HeadCommit != nil {
+			b.message = p.HeadCommit.Message
+		}
+		if !p.Created && !p.Forced && len(p.Commits) < maxPushCommits {
+			b.changed = changedFiles(p.Commits)
+		}
+		push.branches = append(push.branches, b)
+	}
+	return push, nil
+}
+
+func (githubProvider) verify(h http.Header, body []byte, secret string) bool {
+	return hmac.Equal([]byte(signWebhook(secret, body)), []byte(h.Get("X-Hub-Signature-256")))
+}
+
+func (githubProvider) cloneUser() string { return "x-access-token" }
+
+// gitlabProvider sends the secret itself in X-Gitlab-Token rather than
+// signing deliveries.
+type gitlabProvider struct{}
+
+func (gitlabProvider) parsePush(h http.Header, body []byte) (*gitPush, error) {
+	var p struct {
+		ObjectKind   string `json:"object_kind"`
+		Ref          string `json:"ref"`
+		Before       string `json:"before"`
+		After        string `json:"after"`
+		TotalCommits int    `json:"total_commits_count"`
+		Project      struct {
+			GitHTTPURL string `json:"git_http_url"`
+			WebURL     string `json:"web_url"`
+		} `json:"project"`
+		Commits []pushCommit `json:"commits"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	push := &gitPush{event: p.ObjectKind, repos: repoURLs(p.Project.GitHTTPURL, p.Project.WebURL)}
+	if name, ok := strings.CutPrefix(p.Ref, "refs/heads/"); ok && p.After == zeroCommit {
+		push.deleted = append(push.deleted, name)
+	} else if ok {
+		b := pushedBranch{name: name, commit: p.After}
+		for _, c := range p.Commits {
+			if c.ID == p.After {
+				b.message = c.Message
+			}
+		}
+		if p.Before != zeroCommit && p.TotalCommits == len(p.Commits) && len(p.Commits) < maxPushCommits {
+			b.changed = changedFiles(p.Commits)
+		}
+		push.branches = append(push.branches, b)
+	}
+	return push, nil
+}
+
+func (gitlabProvider) verify(h http.Header, body []byte, secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(h.Get("X-Gitlab-Token")), []byte(secret)) == 1
+}
+
+func (gitlabProvider) cloneUser() string { return "oauth2" }
+
+// bitbucketProvider handles Bitbucket Cloud, whose pushes can move several
+// branches at once.
+type bitbucketProvider struct{}
+
+func (bitbucketProvider) parsePush(h http.Header, body []byte) (*gitPush, error) {
+	var p struct {
+		Repository struct {
+			Links struct {
+				HTML struct {
+					Href string `json:"href"`
+				} `json:"html"`
+			} `json:"links"`
+		} `json:"repository"`
+		Push struct {
+			Changes []struct {
+				Old *struct {
+					Type string `json:"type"`
+					Name string `json:"name"`
+				} `json:"old"`
+				New *struct {
+					Type   string `json:"type"`
+					Name   string `json:"name"`
+					Target struct {
+						Hash    string `json:"hash"`
+						Message string `json:"message"`
+					} `json:"target"`
+				} `json:"new"`
+			} `json:"changes"`
+		} `json:"push"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	push := &gitPush{repos: repoURLs(p.Repository.Links.HTML.Href)}
+	switch h.Get("X-Event-Key") {
+	case "repo:push":
+		push.event = "push"
+	case "diagnostics:ping":
+		push.event = "ping"
+	}
+	for _, c := range p.Push.Changes {
+		if c.New != nil && c.New.Type == "branch" {
+			push.branches = append(push.branches, pushedBranch{name: c.New.Name, commit: c.New.Target.Hash, message: c.New.Target.Message})
+		} else if c.New == nil && c.Old != nil && c.Old.Type == "branch" {
+			push.deleted = append(push.deleted, c.Old.Name)
+		}
+	}
+	return push, nil
+}
+
+func (bitbucketProvider) verify(h http.Header, body []byte, secret string) bool {
+	return hmac.Equal([]byte(signWebhook(secret, body)), []byte(h.Get("X-Hub-Signature")))
+}
+
+func (bitbucketProvider) cloneUser() string { return "x-token-auth" }
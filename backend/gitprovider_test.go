@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestGitProviderPushes(t *testing.T) {
+	const sha = "3f9a1c2b3f9a1c2b3f9a1c2b3f9a1c2b3f9a1c2b"
+	tests := []struct {
+		provider string
+		header   http.Header
+		body     string
+		repo     string
+	}{
+		{
+			provider: "github",
+			header:   http.Header{"X-Github-Event": {"push"}},
+			body: `{"ref": "refs/heads/main", "after": "` + sha + `", "repository": {"clone_url": "https://github.com/ada/site.git"},
+				"head_commit": {"message": "Fix the footer"}}`,
+			repo: "https://github.com/ada/site",
+		},
+		{
+			provider: "gitlab",
+			header:   http.Header{"X-Gitlab-Event": {"Push Hook"}},
+			body: `{"object_kind": "push", "ref": "refs/heads/main", "after": "` + sha + `",
+				"project": {"git_http_url": "https://gitlab.com/ada/site.git", "web_url": "https://gitlab.com/ada/site"},
+				"commits": [{"id": "1111", "message": "Older"}, {"id": "` + sha + `", "message": "Fix the footer"}]}`,
+			repo: "https://gitlab.com/ada/site",
+		},
+		{
+			provider: "bitbucket",
+			header:   http.Header{"X-Event-Key": {"repo:push"}},
+			body: `{"repository": {"links": {"html": {"href": "https://bitbucket.org/ada/site"}}},
+				"push": {"changes": [{"new": null}, {"new": {"type": "branch", "name": "main", "target": {"hash": "` + sha + `", "message": "Fix the footer"}}}]}}`,
+			repo: "https://bitbucket.org/ada/site",
+		},
+	}
+	for _, tt := range tests {
+		provider := gitProviders[tt.provider]
+		push, err := provider.parsePush(tt.header, []byte(tt.body))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.provider, err)
+		}
+		if push.event != "push" || push.repos[0] != tt.repo || len(push.branches) != 1 {
+			t.Fatalf("%s: parsed %+v", tt.provider, push)
+		}
+		if b := push.branches[0]; b.name != "main" || b.commit != sha || b.message != "Fix the footer" {
+			t.Errorf("%s: branch %+v", tt.provider, b)
+		}
+		u, _ := url.Parse(tt.repo)
+		if got := detectGitProvider(u); got != tt.provider {
+			t.Errorf("%s detected as %s", tt.repo, got)
+		}
+	}
+
+	body := []byte(`{}`)
+	for name, h := range map[string]http.Header{
+		"github":    {"X-Hub-Signature-256": {signWebhook("s3cret", body)}},
+		"gitlab":    {"X-Gitlab-Token": {"s3cret"}},
+		"bitbucket": {"X-Hub-Signature": {signWebhook("s3cret", body)}},
+	} {
+		if !gitProviders[name].verify(h, body, "s3cret") || gitProviders[name].verify(h, body, "other") {
+			t.Errorf("%s: signature check", name)
+		}
+	}
+
+	deleted := `{"object_kind": "push", "ref": "refs/heads/main", "after": "` + zeroCommit + `", "project": {"web_url": "https://gitlab.com/ada/site"}}`
+	if push, _ := gitProviders["gitlab"].parsePush(nil, []byte(deleted)); len(push.branches) != 0 || len(push.deleted) != 1 || push.deleted[0] != "main" {
+		t.Errorf("deleted branch parsed as %+v", push)
+	}
+	deleted = `{"repository": {"links": {"html": {"href": "https://bitbucket.org/ada/site"}}},
+		"push": {"changes": [{"old": {"type": "branch", "name": "feature/x"}, "new": null}]}}`
+	if push, _ := gitProviders["bitbucket"].parsePush(http.Header{"X-Event-Key": {"repo:push"}}, []byte(deleted)); len(push.deleted) != 1 || push.deleted[0] != "feature/x" {
+		t.Errorf("bitbucket deleted branches %+v", push.deleted)
+	}
+}
+
+func TestGitLabPushDeploys(t *testing.T) {
+	repo := gitRepo(t)
+	ts := newTestServer(t, stubRunner{})
+	remote := ts.gitRemote(t, repo)
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+
+	var link gitLink
+	ts.do(t, "PUT", "/api/projects/"+project.ID+"/git", token, jsonBody(map[string]string{"repo_url": remote, "provider": "gitlab"}), "application/json", &link)
+	if link.Provider != "gitlab" || link.WebhookURL != publicURL+"/api/hooks/gitlab" {
+		t.Fatalf("link %+v", link)
+	}
+
+	deliver := func(path, secret string) int {
+		body := []byte(`{"object_kind": "push", "ref": "refs/heads/main", "after": "abc", "project": {"git_http_url": "` + remote + `"}}`)
+		req, _ := http.NewRequest("POST", ts.http.URL+path, bytes.NewReader(body))
+		req.Header.Set("X-Gitlab-Token", secret)
+		resp, err := ts.http.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := deliver("/api/hooks/github", link.Secret); status == http.StatusAccepted {
+		t.Error("GitLab delivery accepted by the GitHub hook")
+	}
+	if status := deliver("/api/hooks/gitea", link.Secret); status != http.StatusNotFound {
+		t.Errorf("unknown provider: status %d, want 404", status)
+	}
+	if status := deliver("/api/hooks/gitlab", link.Secret); status != http.StatusAccepted {
+		t.Fatalf("push: status %d", status)
+	}
+	if p := ts.waitForStatus(t, token, project.ID); p.Status != "live" {
+		t.Fatalf("push build %s: %s", p.Status, p.BuildLog)
+	}
+	var deployments []Deployment
+	ts.do(t, "GET", "/api/projects/"+project.ID+"/deployments", token, nil, "", &deployments)
+	if len(deployments) != 2 || deployments[0].Trigger != "push" || deployments[0].CommitMessage != "Add the home page" {
+		t.Errorf("deployments %+v", deployments)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Guests can try the platform without signing up. POST /api/guest creates a
+// throwaway account on the guest tier and returns tokens for it plus a claim
+// token. Its projects are deleted with it after guestTTL, unless the claim
+// token is passed on signup or login, which moves them to the real account.
+// Guest accounts are off unless GRAPE_GUEST_UPLOADS is true.
+
+var (
+	guestUploadsEnabled = envString("GRAPE_GUEST_UPLOADS", "false") == "true"
+	guestTTL            = envDuration("GRAPE_GUEST_TTL", 24*time.Hour)
+)
+
+// guestExpiryInterval is how often expired guest accounts are removed.
+const guestExpiryInterval = 10 * time.Minute
+
+// guestEmailDomain is reserved (RFC 2606), so guest addresses never collide
+// with real ones.
+const guestEmailDomain = "guest.invalid"
+
+var errInvalidClaim = errors.New("invalid or expired claim token")
+
+func (s *Server) handleCreateGuest(w http.ResponseWriter, r *http.Request) {
+	if !guestUploadsEnabled {
+		writeJSONError(w, http.StatusNotFound, "guests_disabled", "Guest deployments are not enabled")
+		return
+	}
+	var req struct {
+		Captcha string `json:"captcha"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+			return
+		}
+	}
+	if !s.checkCaptcha(w, r, req.Captcha) {
+		return
+	}
+
+	claim := randomToken()
+	expires := time.Now().Add(guestTTL)
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	userID, err := createPasswordlessUser(tx, "guest-"+generateID()+"@"+guestEmailDomain, true)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE users SET tier = 'guest', guest_expires_at = ?, guest_claim_hash = ? WHERE id = ?",
+		expires.Unix(), hashToken(claim), userID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := s.issueTokens(r, userID, "")
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":         tokens.Token,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+		"claim_token":   claim,
+		"expires_at":    expires.Unix(),
+	})
+}
+
+// claimGuest moves the projects of the guest account behind claim to userID
+// and deletes the guest account. It returns the IDs of the moved projects.
+func (s *Server) claimGuest(claim string, userID int) ([]string, error) {
+	var guestID int
+	err := s.db.QueryRow("SELECT id FROM users WHERE guest_claim_hash = ? AND guest_expires_at > ?",
+		hashToken(strings.TrimSpace(claim)), time.Now().Unix()).Scan(&guestID)
+	if err == sql.ErrNoRows || guestID == userID {
+		return nil, errInvalidClaim
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	projectIDs, err := s.userProjectIDs(guestID)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// Clearing the hash first makes a concurrent claim of the same token fail
+	res, err := tx.Exec("UPDATE users SET guest_claim_hash = NULL WHERE id = ? AND guest_claim_hash IS NOT NULL", guestID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, errInvalidClaim
+	}
+	// Their deployments no longer go with the guest; previews get a fresh TTL
+	if _, err := tx.Exec(`
+		UPDATE deployments SET expires_at = CASE WHEN alias = '' AND branch = '' THEN 0 ELSE ? END
+		WHERE expires_at != 0 AND project_id IN (SELECT id FROM projects WHERE user_id = ?)
+	`, previewExpiry(time.Now()), guestID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE projects SET user_id = ? WHERE user_id = ?", userID, guestID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s.projectsCache.invalidate(userID)
+	s.projectsCache.invalidate(guestID)
+	if err := s.deleteAccount(guestID); err != nil {
+		log.Printf("guest %d: cannot delete claimed account: %v", guestID, err)
+	}
+	return projectIDs, nil
+}
+
+// handleClaimGuest claims a guest account's projects for the signed-in user.
+func (s *Server) handleClaimGuest(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	var req struct {
+		ClaimToken string `json:"claim_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	if s.isGuest(userID) {
+		writeJSONError(w, http.StatusForbidden, "guest_account", "Sign up before claiming projects")
+		return
+	}
+	projects, err := s.claimGuest(req.ClaimToken, userID)
+	if errors.Is(err, errInvalidClaim) {
+		writeJSONError(w, http.StatusNotFound, "invalid_claim", "Unknown or expired claim token")
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"projects": projects})
+}
+
+// claimOnSignIn claims the guest projects named in a register or login
+// request, adding the outcome to its response.
+func (s *Server) claimOnSignIn(claim string, userID int, response map[string]interface{}) {
+	projects, err := s.claimGuest(claim, userID)
+	switch {
+	case errors.Is(err, errInvalidClaim):
+		response["claim_error"] = "invalid_claim"
+	case err != nil:
+		log.Printf("user %d: cannot claim guest projects: %v", userID, err)
+		response["claim_error"] = "internal_error"
+	default:
+		response["claimed_projects"] = projects
+	}
+}
+
+func (s *Server) isGuest(userID int) bool {
+	var expires int64
+	s.db.QueryRow("SELECT guest_expires_at FROM users WHERE id = ?", userID).Scan(&expires)
+	return expires != 0
+}
+
+// expireGuests deletes guest accounts, and with them their projects, once
+// they have outlived guestTTL.
+func (s *Server) expireGuests() {
+	rows, err := s.db.Query("SELECT id FROM users WHERE guest_expires_at != 0 AND guest_expires_at <= ?", time.Now().Unix())
+	if err != nil {
+		log.Printf("guest expiry: %v", err)
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := s.deleteAccount(id); err != nil {
+			log.Printf("guest %d: cannot delete expired account: %v", id, err)
+		}
+	}
+	if len(ids) > 0 {
+		log.Printf("Deleted %d expired guest accounts", len(ids))
+	}
+}
+
+// runGuestExpiry removes expired guest accounts until ctx is cancelled.
+func (s *Server) runGuestExpiry(ctx context.Context) {
+	ticker := time.NewTicker(guestExpiryInterval)
+	defer ticker.Stop()
+	for {
+		s.expireGuests()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
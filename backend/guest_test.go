@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+type guestAccount struct {
+	Token      string `json:"token"`
+	ClaimToken string `json:"claim_token"`
+	ExpiresAt  int64  `json:"expires_at"`
+}
+
+func (ts *testServer) createGuest(t *testing.T) guestAccount {
+	t.Helper()
+	var guest guestAccount
+	if resp := ts.postJSON(t, "/api/guest", "", nil, &guest); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create guest: status %d", resp.StatusCode)
+	}
+	return guest
+}
+
+func TestGuestDeploymentClaimedOnSignup(t *testing.T) {
+	guestUploadsEnabled = true
+	t.Cleanup(func() { guestUploadsEnabled = false })
+	ts := newTestServer(t, stubRunner{})
+
+	guest := ts.createGuest(t)
+	project, resp := ts.upload(t, guest.Token, "site", siteZip(t))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("guest upload: status %d", resp.StatusCode)
+	}
+	if got := ts.waitForStatus(t, guest.Token, project.ID); got.Status != "live" {
+		t.Fatalf("guest project %s", got.Status)
+	}
+	if _, resp := ts.upload(t, guest.Token, "second", siteZip(t)); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("second guest upload: status %d, want 403", resp.StatusCode)
+	}
+
+	var registered struct {
+		Token   string   `json:"token"`
+		Claimed []string `json:"claimed_projects"`
+	}
+	resp = ts.postJSON(t, "/api/register", "", map[string]string{
+		"email": "ada@example.com", "password": "correct horse battery 0", "claim_token": guest.ClaimToken,
+	}, &registered)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("register: status %d", resp.StatusCode)
+	}
+	if len(registered.Claimed) != 1 || registered.Claimed[0] != project.ID {
+		t.Fatalf("claimed %v, want [%s]", registered.Claimed, project.ID)
+	}
+	var projects []Project
+	ts.do(t, "GET", "/api/projects", registered.Token, nil, "", &projects)
+	if len(projects) != 1 || projects[0].ID != project.ID {
+		t.Errorf("projects after claiming = %+v", projects)
+	}
+	if resp := ts.do(t, "GET", "/api/projects", guest.Token, nil, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("guest token after claiming: status %d, want 401", resp.StatusCode)
+	}
+	if resp := ts.postJSON(t, "/api/guest/claim", registered.Token, map[string]string{"claim_token": guest.ClaimToken}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("claiming twice: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestGuestExpiry(t *testing.T) {
+	guestUploadsEnabled = true
+	t.Cleanup(func() { guestUploadsEnabled = false })
+	ts := newTestServer(t, stubRunner{})
+
+	guest := ts.createGuest(t)
+	project, _ := ts.upload(t, guest.Token, "site", siteZip(t))
+	ts.waitForStatus(t, guest.Token, project.ID)
+
+	if _, err := ts.db.Exec("UPDATE users SET guest_expires_at = 1 WHERE guest_expires_at != 0"); err != nil {
+		t.Fatal(err)
+	}
+	ts.expireGuests()
+
+	var n int
+	ts.db.QueryRow("SELECT COUNT(*) FROM projects WHERE id = ?", project.ID).Scan(&n)
+	if n != 0 {
+		t.Error("expired guest's project was not deleted")
+	}
+	session := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	if resp := ts.postJSON(t, "/api/guest/claim", session, map[string]string{"claim_token": guest.ClaimToken}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("claiming an expired guest: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestGuestsDisabled(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	if resp := ts.postJSON(t, "/api/guest", "", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("create guest: status %d, want 404", resp.StatusCode)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Headers a project may set through its _headers file. Anything that could
+// interfere with routing, caching proxies or cookies is left out.
+var allowedCustomHeaders = map[string]bool{
+	"Access-Control-Allow-Headers":  true,
+	"Access-Control-Allow-Methods":  true,
+	"Access-Control-Allow-Origin":   true,
+	"Access-Control-Expose-Headers": true,
+	"Access-Control-Max-Age":        true,
+	"Cache-Control":                 true,
+	"Content-Language":              true,
+	"Content-Security-Policy":       true,
+	"Cross-Origin-Embedder-Policy":  true,
+	"Cross-Origin-Opener-Policy":    true,
+	"Cross-Origin-Resource-Policy":  true,
+	"Link":                          true,
+	"Permissions-Policy":            true,
+	"Referrer-Policy":               true,
+	"Strict-Transport-Security":     true,
+	"X-Content-Type-Options":        true,
+	"X-Frame-Options":               true,
+	"X-Robots-Tag":                  true,
+	"X-Xss-Protection":              true,
+}
+
+type headerRule struct {
+	Pattern string            `json:"pattern"`
+	Headers map[string]string `json:"headers"`
+}
+
+// matches reports whether the rule applies to path. A trailing * matches any
+// suffix; anything else must match exactly.
+func (h headerRule) matches(path string) bool {
+	if prefix, ok := strings.CutSuffix(h.Pattern, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == h.Pattern
+}
+
+// specificity orders rules so exact paths beat wildcards and longer
+// wildcard prefixes beat shorter ones.
+func (h headerRule) specificity() int {
+	if strings.HasSuffix(h.Pattern, "*") {
+		return len(h.Pattern) - 1
+	}
+	return 1 << 20
+}
+
+// parseHeadersFile reads the _headers format: an unindented path pattern
+// followed by indented "Name: value" lines.
+func parseHeadersFile(r io.Reader) ([]headerRule, error) {
+	var (
+		rules   []headerRule
+		current *headerRule
+	)
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			if !strings.HasPrefix(trimmed, "/") {
+				return nil, fmt.Errorf("line %d: path pattern must start with /", lineNo)
+			}
+			rules = append(rules, headerRule{Pattern: trimmed, Headers: map[string]string{}})
+			current = &rules[len(rules)-1]
+			continue
+		}
+
+		if current == nil {
+			return nil, fmt.Errorf("line %d: header before any path pattern", lineNo)
+		}
+		name, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"Name: value\"", lineNo)
+		}
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if !allowedCustomHeaders[name] {
+			return nil, fmt.Errorf("line %d: header %q is not allowed", lineNo, name)
+		}
+		current.Headers[name] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].specificity() < rules[j].specificity()
+	})
+	return rules, nil
+}
+
+// loadHeadersFile parses projectPath/_headers and returns the rules encoded
+// for storage, or "" when the project has no _headers file.
+func loadHeadersFile(projectPath string) (string, error) {
+	f, err := os.Open(filepath.Join(projectPath, "_headers"))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	rules, err := parseHeadersFile(f)
+	if err != nil {
+		return "", fmt.Errorf("_headers %v", err)
+	}
+	data, err := json.Marshal(rules)
+	return string(data), err
+}
+
+// applyHeaderRules sets headers from every matching rule; rules are sorted by
+// specificity so the most specific match wins on conflicts.
+func applyHeaderRules(w http.ResponseWriter, rules []headerRule, path string) {
+	for _, rule := range rules {
+		if rule.matches(path) {
+			for name, value := range rule.Headers {
+				w.Header().Set(name, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHeaderRuleSpecificity(t *testing.T) {
+	rules, err := parseHeadersFile(strings.NewReader(`# The exact rule comes first here but is applied last
+/assets/logo.svg
+  Cache-Control: no-store
+  X-Frame-Options: SAMEORIGIN
+
+/*
+  Cache-Control: public, max-age=60
+  X-Frame-Options: DENY
+  X-Content-Type-Options: nosniff
+
+/assets/*
+  Cache-Control: public, max-age=600
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, rule := range rules {
+		order = append(order, rule.Pattern)
+	}
+	if got := strings.Join(order, " "); got != "/* /assets/* /assets/logo.svg" {
+		t.Errorf("rules applied in order %s", got)
+	}
+
+	dir := t.TempDir()
+	writeSite(t, dir, "index.html", "assets/logo.svg", "assets/app.css")
+	handler := deployFileHandler(localSiteFiles(dir), "/", siteConfig{Preset: urlPresets["static"], Headers: rules})
+
+	for _, tc := range []struct {
+		path, cacheControl, frameOptions string
+	}{
+		{"/assets/logo.svg", "no-store", "SAMEORIGIN"},
+		{"/assets/app.css", "public, max-age=600", "DENY"},
+		{"/index.html", "public, max-age=60", "DENY"},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		h := w.Result().Header
+		if h.Get("Cache-Control") != tc.cacheControl || h.Get("X-Frame-Options") != tc.frameOptions || h.Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s: headers %v", tc.path, h)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+var healthCheckTimeout = envDuration("GRAPE_HEALTH_CHECK_TIMEOUT", 10*time.Second)
+
+// checkDeployHealth starts the staged version on a loopback port and probes
+// path once. The version is healthy only if it answers 2xx within
+// healthCheckTimeout; the files are static, so a failure will not clear up on
+// a retry.
+func checkDeployHealth(dir, path string, site siteConfig) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: deployFileHandler(localSiteFiles(dir), "/", site)}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	return probeHealth("http://"+ln.Addr().String()+path, healthCheckTimeout)
+}
+
+// probeHealth requests url without following redirects: the site's own
+// redirect rules must not send the server's requests elsewhere.
+func probeHealth(url string, timeout time.Duration) error {
+	client := &http.Client{
+		Timeout:       timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		return fmt.Errorf("status %d redirecting to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeSite creates the named files under dir, each holding its own name.
+func writeSite(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckDeployHealth(t *testing.T) {
+	var followed atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { followed.Add(1) }))
+	defer target.Close()
+
+	dir := t.TempDir()
+	writeSite(t, dir, "index.html", "health.json")
+	site := siteConfig{
+		Preset: urlPresets["static"],
+		Redirects: []redirectRule{
+			{From: "/elsewhere", To: target.URL + "/", Status: http.StatusFound},
+			{From: "/moved", To: "/health.json", Status: http.StatusMovedPermanently},
+		},
+	}
+
+	for _, path := range []string{"/", "/health.json"} {
+		if err := checkDeployHealth(dir, path, site); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+	// A 404 fails on the first answer instead of waiting out the timeout
+	start := time.Now()
+	if err := checkDeployHealth(dir, "/missing.json", site); err == nil {
+		t.Error("/missing.json passed the health check")
+	}
+	if waited := time.Since(start); waited >= healthCheckTimeout {
+		t.Errorf("gave up after %s, the whole %s timeout", waited, healthCheckTimeout)
+	}
+	// Redirects count as unhealthy and are never followed
+	for _, path := range []string{"/elsewhere", "/moved"} {
+		if err := checkDeployHealth(dir, path, site); err == nil {
+			t.Errorf("%s passed the health check", path)
+		}
+	}
+	if n := followed.Load(); n != 0 {
+		t.Errorf("followed a redirect to another host %d times", n)
+	}
+}
+
+func TestFailedHealthCheckKeepsPreviousVersion(t *testing.T) {
+	ts := newTestServer(t, countingRunner{n: new(atomic.Int32)})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	if p := ts.waitForStatus(t, token, project.ID); p.Status != "live" {
+		t.Fatalf("first build %s: %s", p.Status, p.BuildLog)
+	}
+	path := "/api/projects/" + project.ID
+
+	// The built site has no /health.json, so the new version never gets healthy
+	if _, err := ts.db.Exec("UPDATE projects SET health_check_path = '/health.json' WHERE id = ?", project.ID); err != nil {
+		t.Fatal(err)
+	}
+	ts.do(t, "POST", path+"/rebuild", token, nil, "", nil)
+	if p := ts.waitForStatus(t, token, project.ID); p.Status != "failed" || !strings.Contains(p.BuildLog, "health check failed") {
+		t.Errorf("unhealthy build %s: %s", p.Status, p.BuildLog)
+	}
+	if got := ts.livePage(t, project.ID); got != "build 1" {
+		t.Errorf("live page %q after a failed health check, want the previous version", got)
+	}
+	var deployments []Deployment
+	ts.do(t, "GET", path+"/deployments", token, nil, "", &deployments)
+	if len(deployments) != 2 || deployments[0].Live || !deployments[1].Live {
+		t.Errorf("deployments %+v", deployments)
+	}
+
+	// A path the site serves passes
+	ts.db.Exec("UPDATE projects SET health_check_path = '/' WHERE id = ?", project.ID)
+	ts.do(t, "POST", path+"/rebuild", token, nil, "", nil)
+	if p := ts.waitForStatus(t, token, project.ID); p.Status != "live" {
+		t.Errorf("healthy build %s: %s", p.Status, p.BuildLog)
+	}
+	if got := ts.livePage(t, project.ID); got != "build 3" {
+		t.Errorf("live page %q after a healthy build", got)
+	}
+}
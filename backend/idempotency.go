@@ -0,0 +1,68 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Uploads sent with the same Idempotency-Key within this window return the
+// project the first one created instead of building again.
+var idempotencyTTL = envDuration("GRAPE_IDEMPOTENCY_TTL", 24*time.Hour)
+
+const maxIdempotencyKeyLength = 255
+
+func validateIdempotencyKey(key string) error {
+	if len(key) > maxIdempotencyKeyLength {
+		return errors.New("must be at most 255 characters")
+	}
+	for _, c := range key {
+		if c < 0x21 || c > 0x7e {
+			return errors.New("must be printable ASCII without spaces")
+		}
+	}
+	return nil
+}
+
+// isIdempotencyConflict reports whether err is the unique index rejecting a
+// second project for the same user and key.
+func isIdempotencyConflict(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed: projects.user_id, projects.idempotency_key")
+}
+
+// expireIdempotencyKeys releases the user's keys whose window has passed, so
+// they can be reused and don't pile up.
+func (s *Server) expireIdempotencyKeys(userID int) error {
+	_, err := s.db.Exec(`
+		UPDATE projects SET idempotency_key = NULL, idempotency_expires_at = 0
+		WHERE user_id = ? AND idempotency_key IS NOT NULL AND idempotency_expires_at <= ?
+	`, userID, time.Now().Unix())
+	return err
+}
+
+// idempotentProject returns the project an earlier upload with key created,
+// or sql.ErrNoRows if there is none.
+func (s *Server) idempotentProject(userID int, key string) (Project, error) {
+	var project Project
+	err := s.db.QueryRow(`
+		SELECT id, name, status, subdomain, created_at, url_preset, force_https, COALESCE(org_id, 0) FROM projects
+		WHERE user_id = ? AND idempotency_key = ? AND idempotency_expires_at > ?
+	`, userID, key, time.Now().Unix()).
+		Scan(&project.ID, &project.Name, &project.Status, &project.Subdomain, &project.CreatedAt, &project.Preset, &project.ForceHTTPS, &project.OrgID)
+	project.UserID = userID
+	return project, err
+}
+
+// nullableKey stores an empty key as NULL, which the unique index ignores.
+func nullableKey(key string) sql.NullString {
+	return sql.NullString{String: key, Valid: key != ""}
+}
+
+func writeIdempotentReplay(w http.ResponseWriter, project Project) {
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func idempotencyHeader(key string) http.Header {
+	h := http.Header{}
+	h.Set("Idempotency-Key", key)
+	return h
+}
+
+func (ts *testServer) projectCount(t *testing.T, token string) int {
+	t.Helper()
+	var projects []Project
+	ts.do(t, "GET", "/api/projects", token, nil, "", &projects)
+	return len(projects)
+}
+
+func TestIdempotentUploadReplaysProject(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery")
+
+	first, resp := ts.uploadWithHeader(t, token, "site", siteZip(t), idempotencyHeader("ci-run-42"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first upload: status %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Error("first upload marked as a replay")
+	}
+	ts.waitForStatus(t, token, first.ID)
+
+	second, resp := ts.uploadWithHeader(t, token, "site", siteZip(t), idempotencyHeader("ci-run-42"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("retried upload: status %d", resp.StatusCode)
+	}
+	if second.ID != first.ID || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry created %s (replayed %q), want %s", second.ID, resp.Header.Get("Idempotent-Replayed"), first.ID)
+	}
+	if second.Status != "live" {
+		t.Errorf("replayed status = %s, want the existing project's live", second.Status)
+	}
+
+	other, _ := ts.uploadWithHeader(t, token, "site", siteZip(t), idempotencyHeader("ci-run-43"))
+	if other.ID == first.ID {
+		t.Error("a different key replayed the first project")
+	}
+	ts.waitForStatus(t, token, other.ID)
+	if n := ts.projectCount(t, token); n != 2 {
+		t.Errorf("%d projects, want 2", n)
+	}
+}
+
+func TestIdempotencyKeysArePerUser(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	alice := ts.signUp(t, "alice@example.com", "correct horse battery")
+	bob := ts.signUp(t, "bob@example.com", "correct horse battery")
+
+	a, _ := ts.uploadWithHeader(t, alice, "site", siteZip(t), idempotencyHeader("deploy"))
+	b, resp := ts.uploadWithHeader(t, bob, "site", siteZip(t), idempotencyHeader("deploy"))
+	if resp.StatusCode != http.StatusOK || b.ID == a.ID {
+		t.Fatalf("bob's upload: status %d, project %s (alice's is %s)", resp.StatusCode, b.ID, a.ID)
+	}
+	ts.waitForStatus(t, alice, a.ID)
+	ts.waitForStatus(t, bob, b.ID)
+}
+
+func TestConcurrentIdempotentUploadsCreateOneProject(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery")
+	archive := siteZip(t)
+
+	const n = 5
+	ids := make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			project, resp := ts.uploadWithHeader(t, token, "site", archive, idempotencyHeader("same"))
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("upload %d: status %d", i, resp.StatusCode)
+			}
+			ids[i] = project.ID
+		}(i)
+	}
+	wg.Wait()
+
+	for _, id := range ids[1:] {
+		if id != ids[0] {
+			t.Fatalf("uploads returned different projects: %v", ids)
+		}
+	}
+	ts.waitForStatus(t, token, ids[0])
+	if got := ts.projectCount(t, token); got != 1 {
+		t.Errorf("%d projects, want 1", got)
+	}
+}
+
+func TestExpiredIdempotencyKeyCreatesNewProject(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery")
+
+	defer func(ttl time.Duration) { idempotencyTTL = ttl }(idempotencyTTL)
+	idempotencyTTL = -time.Second
+
+	first, _ := ts.uploadWithHeader(t, token, "site", siteZip(t), idempotencyHeader("nightly"))
+	ts.waitForStatus(t, token, first.ID)
+	second, resp := ts.uploadWithHeader(t, token, "site", siteZip(t), idempotencyHeader("nightly"))
+	if resp.StatusCode != http.StatusOK || second.ID == first.ID {
+		t.Fatalf("upload after expiry: status %d, project %s", resp.StatusCode, second.ID)
+	}
+	ts.waitForStatus(t, token, second.ID)
+}
+
+func TestInvalidIdempotencyKey(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery")
+
+	if _, resp := ts.uploadWithHeader(t, token, "site", siteZip(t), idempotencyHeader("has space")); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// Admins can mint a short-lived token to see the API as a user does, to
+// reproduce a support case without the user's password. Impersonation tokens
+// only work for GET requests, never reach the endpoints that show or create
+// the user's credentials, can't be refreshed, and name the admin in their imp
+// claim. Each one is recorded with its reason, and so is every request
+// made with it.
+
+var impersonationTTL = envDuration("GRAPE_IMPERSONATION_TTL", 15*time.Minute)
+
+// credentialPaths return the user's secrets or sessions, and reading the
+// webhook secret creates one, so impersonation tokens are refused there and
+// below.
+var credentialPaths = []string{
+	"/api/me/webhook-secret",
+	"/api/me/devices",
+	"/api/keys",
+	"/api/tokens",
+	"/api/sessions",
+}
+
+func isCredentialPath(p string) bool {
+	for _, prefix := range credentialPaths {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type Impersonation struct {
+	ID        int    `json:"id"`
+	AdminID   int    `json:"admin_id"`
+	UserID    int    `json:"user_id"`
+	Reason    string `json:"reason"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at"`
+	Requests  int    `json:"requests"`
+}
+
+// handleImpersonate issues an impersonation token for the user.
+func (s *Server) handleImpersonate(w http.ResponseWriter, r *http.Request) {
+	adminID := r.Context().Value("userID").(int)
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_reason", "Give a reason, such as the support ticket, for the audit log")
+		return
+	}
+	if len(req.Reason) > 500 {
+		req.Reason = req.Reason[:500]
+	}
+
+	var (
+		version int
+		isAdmin bool
+	)
+	err = s.db.QueryRow("SELECT token_version, is_admin FROM users WHERE id = ?", userID).Scan(&version, &isAdmin)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if isAdmin || userID == adminID {
+		writeJSONError(w, http.StatusForbidden, "cannot_impersonate", "Admins cannot be impersonated")
+		return
+	}
+
+	now := time.Now()
+	expires := now.Add(impersonationTTL)
+	claims := &Claims{
+		UserID:       userID,
+		TokenVersion: version,
+		Impersonator: adminID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        generateID(),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	}
+	token, err := s.keys.sign(claims)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+	res, err := s.db.Exec(`
+		INSERT INTO impersonations (admin_id, user_id, reason, jti, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, adminID, userID, req.Reason, claims.ID, now.Unix(), expires.Unix())
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	log.Printf("admin %d impersonating user %d (impersonation %d): %s", adminID, userID, id, req.Reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":            token,
+		"expires_in":       int(impersonationTTL.Seconds()),
+		"impersonation_id": id,
+	})
+}
+
+// checkImpersonation vets a request made with an impersonation token and
+// records it. It writes the error response itself and reports whether to go
+// on.
+func (s *Server) checkImpersonation(w http.ResponseWriter, r *http.Request, claims *Claims) bool {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusForbidden, "impersonation_read_only", "Impersonation tokens can only read")
+		return false
+	}
+	if isCredentialPath(path.Clean(r.URL.Path)) {
+		writeJSONError(w, http.StatusForbidden, "impersonation_forbidden", "Impersonation tokens cannot read the user's credentials")
+		return false
+	}
+
+	var (
+		id      int
+		isAdmin bool
+	)
+	err := s.db.QueryRow(`
+		SELECT i.id, u.is_admin FROM impersonations i JOIN users u ON u.id = i.admin_id
+		WHERE i.jti = ? AND i.admin_id = ? AND i.user_id = ?
+	`, claims.ID, claims.Impersonator, claims.UserID).Scan(&id, &isAdmin)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if err == sql.ErrNoRows || !isAdmin {
+		writeJSONError(w, http.StatusUnauthorized, "token_revoked", "Token has been revoked, log in again")
+		return false
+	}
+
+	if _, err := s.db.Exec("INSERT INTO impersonation_requests (impersonation_id, method, path, created_at) VALUES (?, ?, ?, ?)",
+		id, r.Method, r.URL.RequestURI(), time.Now().Unix()); err != nil {
+		// An unrecorded request is not let through
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// handleListImpersonations returns the impersonation audit log, newest
+// first; ?user_id= narrows it to one impersonated user.
+func (s *Server) handleListImpersonations(w http.ResponseWriter, r *http.Request) {
+	query := `
+		SELECT i.id, i.admin_id, i.user_id, i.reason, i.created_at, i.expires_at,
+			(SELECT COUNT(*) FROM impersonation_requests q WHERE q.impersonation_id = i.id)
+		FROM impersonations i`
+	var args []interface{}
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		userID, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid user id", http.StatusBadRequest)
+			return
+		}
+		query += " WHERE i.user_id = ?"
+		args = append(args, userID)
+	}
+	rows, err := s.db.Query(query+" ORDER BY i.id DESC", args...)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	impersonations := []Impersonation{}
+	for rows.Next() {
+		var i Impersonation
+		if err := rows.Scan(&i.ID, &i.AdminID, &i.UserID, &i.Reason, &i.CreatedAt, &i.ExpiresAt, &i.Requests); err != nil {
+			continue
+		}
+		impersonations = append(impersonations, i)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(impersonations)
+}
+
+type impersonationRequest struct {
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// handleListImpersonationRequests returns every request made during one
+// impersonation, in order.
+func (s *Server) handleListImpersonationRequests(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Impersonation not found", http.StatusNotFound)
+		return
+	}
+	rows, err := s.db.Query("SELECT method, path, created_at FROM impersonation_requests WHERE impersonation_id = ? ORDER BY id", id)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	requests := []impersonationRequest{}
+	for rows.Next() {
+		var q impersonationRequest
+		if err := rows.Scan(&q.Method, &q.Path, &q.CreatedAt); err != nil {
+			continue
+		}
+		requests = append(requests, q)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
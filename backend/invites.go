@@ -0,0 +1,349 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Invites let org owners bring in people who may not have an account yet.
+// An invite is a secret token, mailed to one address or shared as a link;
+// it can be accepted when registering, when logging in, or by a signed-in
+// user. Invites for an address work once and only for that address; shared
+// links work up to max_uses times (0 for no limit) until they expire.
+
+var inviteTTL = envDuration("GRAPE_INVITE_TTL", 7*24*time.Hour)
+
+type OrgInvite struct {
+	ID        int    `json:"id"`
+	OrgID     int    `json:"org_id"`
+	Email     string `json:"email,omitempty"`
+	Role      string `json:"role"`
+	MaxUses   int    `json:"max_uses"`
+	Uses      int    `json:"uses"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at"`
+	// Token and Link are only returned when the invite is created
+	Token string `json:"token,omitempty"`
+	Link  string `json:"link,omitempty"`
+}
+
+var (
+	errInviteInvalid = errors.New("invalid, expired or used-up invite")
+	errInviteEmail   = errors.New("invite is for another email address")
+)
+
+func inviteLink(token string) string {
+	return fmt.Sprintf("%s/invite?token=%s", appURL, token)
+}
+
+// lookupInvite returns the usable invite with this token and its org's name.
+func lookupInvite(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, token string, now time.Time) (OrgInvite, string, error) {
+	var (
+		inv       OrgInvite
+		orgName   string
+		revokedAt int64
+	)
+	err := q.QueryRow(`
+		SELECT i.id, i.org_id, i.email, i.role, i.max_uses, i.uses, i.created_at, i.expires_at, i.revoked_at, o.name
+		FROM org_invites i JOIN orgs o ON o.id = i.org_id WHERE i.token_hash = ?
+	`, hashToken(token)).Scan(&inv.ID, &inv.OrgID, &inv.Email, &inv.Role, &inv.MaxUses, &inv.Uses, &inv.CreatedAt, &inv.ExpiresAt, &revokedAt, &orgName)
+	if err == sql.ErrNoRows {
+		return inv, "", errInviteInvalid
+	}
+	if err != nil {
+		return inv, "", err
+	}
+	if revokedAt != 0 || now.Unix() > inv.ExpiresAt || (inv.MaxUses > 0 && inv.Uses >= inv.MaxUses) {
+		return inv, "", errInviteInvalid
+	}
+	return inv, orgName, nil
+}
+
+// checkInvite returns the invite if someone with email could accept it.
+func (s *Server) checkInvite(token, email string) (OrgInvite, error) {
+	inv, _, err := lookupInvite(s.db, token, time.Now())
+	if err != nil {
+		return inv, err
+	}
+	if inv.Email != "" && !strings.EqualFold(inv.Email, email) {
+		return inv, errInviteEmail
+	}
+	return inv, nil
+}
+
+// acceptInvite adds the user to the invite's org. Someone who is already a
+// member keeps their role.
+func (s *Server) acceptInvite(token string, userID int, email string) (Org, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Org{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	inv, orgName, err := lookupInvite(tx, token, now)
+	if err != nil {
+		return Org{}, err
+	}
+	if inv.Email != "" && !strings.EqualFold(inv.Email, email) {
+		return Org{}, errInviteEmail
+	}
+	res, err := tx.Exec("UPDATE org_invites SET uses = uses + 1 WHERE id = ? AND (max_uses = 0 OR uses < max_uses)", inv.ID)
+	if err != nil {
+		return Org{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Org{}, errInviteInvalid
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO org_members (org_id, user_id, role, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (org_id, user_id) DO NOTHING
+	`, inv.OrgID, userID, inv.Role, now.Unix()); err != nil {
+		return Org{}, err
+	}
+	org := Org{ID: inv.OrgID, Name: orgName}
+	if err := tx.QueryRow("SELECT role, created_at FROM org_members WHERE org_id = ? AND user_id = ?", inv.OrgID, userID).
+		Scan(&org.Role, &org.CreatedAt); err != nil {
+		return Org{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Org{}, err
+	}
+	s.projectsCache.invalidate(userID)
+	return org, nil
+}
+
+// inviteErrorCode is the API error code for an invite that can't be used,
+// or "" if err is something else.
+func inviteErrorCode(err error) string {
+	switch {
+	case errors.Is(err, errInviteInvalid):
+		return "invalid_invite"
+	case errors.Is(err, errInviteEmail):
+		return "invite_email_mismatch"
+	}
+	return ""
+}
+
+// writeInviteError answers for an invite that can't be used, reporting
+// whether err was one.
+func writeInviteError(w http.ResponseWriter, err error) bool {
+	switch inviteErrorCode(err) {
+	case "invalid_invite":
+		writeJSONError(w, http.StatusBadRequest, "invalid_invite", "This invite is invalid, expired or already used")
+	case "invite_email_mismatch":
+		writeJSONError(w, http.StatusForbidden, "invite_email_mismatch", "This invite was sent to a different email address")
+	default:
+		return false
+	}
+	return true
+}
+
+// handleCreateInvite makes an invite, mailing it if it names an address.
+// Owners only.
+func (s *Server) handleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	orgID, role, ok := s.orgFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if role != orgRoleOwner {
+		http.Error(w, "Only organization owners can manage members", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Email     string `json:"email"`
+		Role      string `json:"role"`
+		MaxUses   *int   `json:"max_uses"`
+		ExpiresIn string `json:"expires_in"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email != "" && !validEmail(req.Email) {
+		http.Error(w, "Invalid email", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = orgRoleMember
+	}
+	if req.Role != orgRoleOwner && req.Role != orgRoleMember {
+		http.Error(w, "role must be owner or member", http.StatusBadRequest)
+		return
+	}
+	maxUses := 1
+	if req.MaxUses != nil && req.Email == "" {
+		maxUses = *req.MaxUses
+	}
+	if maxUses < 0 {
+		http.Error(w, "max_uses must not be negative", http.StatusBadRequest)
+		return
+	}
+	ttl := inviteTTL
+	if req.ExpiresIn != "" {
+		d, err := parseDuration(req.ExpiresIn)
+		if err != nil {
+			http.Error(w, "Invalid expires_in: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	token := randomToken()
+	now := time.Now()
+	inv := OrgInvite{
+		OrgID:     orgID,
+		Email:     req.Email,
+		Role:      req.Role,
+		MaxUses:   maxUses,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		Token:     token,
+		Link:      inviteLink(token),
+	}
+	res, err := s.db.Exec(`
+		INSERT INTO org_invites (org_id, token_hash, email, role, max_uses, created_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, orgID, hashToken(token), inv.Email, inv.Role, inv.MaxUses, userID, inv.CreatedAt, inv.ExpiresAt)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	inv.ID = int(id)
+
+	if inv.Email != "" {
+		var orgName, inviter string
+		s.db.QueryRow("SELECT name FROM orgs WHERE id = ?", orgID).Scan(&orgName)
+		s.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&inviter)
+		if err := s.mailer.Send(inv.Email, fmt.Sprintf("Join %s on Grape.ai", orgName),
+			fmt.Sprintf("%s invited you to join %s on Grape.ai. Open this link to accept:\n\n%s\n\nThe invite expires in %s.", inviter, orgName, inv.Link, ttl)); err != nil {
+			log.Printf("org %d: cannot send invite %d: %v", orgID, inv.ID, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(inv)
+}
+
+// handleListInvites lists the org's usable invites. Owners only.
+func (s *Server) handleListInvites(w http.ResponseWriter, r *http.Request) {
+	orgID, role, ok := s.orgFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if role != orgRoleOwner {
+		http.Error(w, "Only organization owners can manage members", http.StatusForbidden)
+		return
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id, org_id, email, role, max_uses, uses, created_at, expires_at FROM org_invites
+		WHERE org_id = ? AND revoked_at = 0 AND expires_at > ? AND (max_uses = 0 OR uses < max_uses)
+		ORDER BY created_at DESC
+	`, orgID, time.Now().Unix())
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	invites := []OrgInvite{}
+	for rows.Next() {
+		var inv OrgInvite
+		if err := rows.Scan(&inv.ID, &inv.OrgID, &inv.Email, &inv.Role, &inv.MaxUses, &inv.Uses, &inv.CreatedAt, &inv.ExpiresAt); err != nil {
+			continue
+		}
+		invites = append(invites, inv)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invites)
+}
+
+// handleRevokeInvite stops an invite from working. Owners only.
+func (s *Server) handleRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	orgID, role, ok := s.orgFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if role != orgRoleOwner {
+		http.Error(w, "Only organization owners can manage members", http.StatusForbidden)
+		return
+	}
+	inviteID, err := strconv.Atoi(mux.Vars(r)["inviteID"])
+	if err != nil {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	}
+
+	res, err := s.db.Exec("UPDATE org_invites SET revoked_at = ? WHERE id = ? AND org_id = ? AND revoked_at = 0",
+		time.Now().Unix(), inviteID, orgID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetInvite describes an invite to whoever holds its token, so the
+// frontend can show what they are joining before they sign in.
+func (s *Server) handleGetInvite(w http.ResponseWriter, r *http.Request) {
+	inv, orgName, err := lookupInvite(s.db, mux.Vars(r)["token"], time.Now())
+	if writeInviteError(w, err) {
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"org":        map[string]interface{}{"id": inv.OrgID, "name": orgName},
+		"role":       inv.Role,
+		"email":      inv.Email,
+		"expires_at": inv.ExpiresAt,
+	})
+}
+
+// handleAcceptInvite joins the signed-in user to the invite's org.
+func (s *Server) handleAcceptInvite(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	var email string
+	if err := s.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	org, err := s.acceptInvite(mux.Vars(r)["token"], userID, email)
+	if writeInviteError(w, err) {
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(org)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+var inviteLinkPattern = regexp.MustCompile(`invite\?token=([0-9a-f]+)`)
+
+func TestInviteByEmailOnRegistration(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	alice := ts.signUp(t, "alice@example.com", "correct horse battery")
+	var org Org
+	ts.postJSON(t, "/api/orgs", alice, map[string]string{"name": "Acme"}, &org)
+
+	var invite OrgInvite
+	if resp := ts.postJSON(t, fmt.Sprintf("/api/orgs/%d/invites", org.ID), alice, map[string]string{"email": "bob@example.com"}, &invite); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create invite: status %d", resp.StatusCode)
+	}
+	m := inviteLinkPattern.FindStringSubmatch(ts.mailer.last())
+	if m == nil || m[1] != invite.Token {
+		t.Fatalf("invite mail %q does not carry the token", ts.mailer.last())
+	}
+
+	var preview struct {
+		Org  struct{ Name string }
+		Role string
+	}
+	if resp := ts.do(t, "GET", "/api/invites/"+invite.Token, "", nil, "", &preview); resp.StatusCode != http.StatusOK || preview.Org.Name != "Acme" {
+		t.Fatalf("preview: status %d, %+v", resp.StatusCode, preview)
+	}
+
+	if resp := ts.postJSON(t, "/api/register", "", map[string]string{"email": "carol@example.com", "password": "correct horse battery", "invite": invite.Token}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("registering another address with the invite: status %d, want 403", resp.StatusCode)
+	}
+	var registered struct {
+		Token string
+		Org   Org
+		User  struct{ Verified bool }
+	}
+	if resp := ts.postJSON(t, "/api/register", "", map[string]string{"email": "bob@example.com", "password": "correct horse battery", "invite": invite.Token}, &registered); resp.StatusCode != http.StatusOK {
+		t.Fatalf("register with invite: status %d", resp.StatusCode)
+	}
+	if registered.Org.ID != org.ID || registered.Org.Role != orgRoleMember || !registered.User.Verified {
+		t.Errorf("register with invite returned %+v", registered)
+	}
+	if resp := ts.do(t, "GET", "/api/invites/"+invite.Token, "", nil, "", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("used invite: status %d, want 400", resp.StatusCode)
+	}
+
+	var orgs []Org
+	ts.do(t, "GET", "/api/orgs", registered.Token, nil, "", &orgs)
+	if len(orgs) != 1 || orgs[0].ID != org.ID {
+		t.Errorf("bob's orgs = %+v", orgs)
+	}
+}
+
+func TestSharedInviteLink(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	alice := ts.signUp(t, "alice@example.com", "correct horse battery")
+	bob := ts.signUp(t, "bob@example.com", "correct horse battery")
+	ts.signUp(t, "carol@example.com", "correct horse battery")
+	dave := ts.signUp(t, "dave@example.com", "correct horse battery")
+	var org Org
+	ts.postJSON(t, "/api/orgs", alice, map[string]string{"name": "Acme"}, &org)
+	invitesPath := fmt.Sprintf("/api/orgs/%d/invites", org.ID)
+
+	var invite OrgInvite
+	if resp := ts.postJSON(t, invitesPath, alice, map[string]interface{}{"max_uses": 2}, &invite); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create link: status %d", resp.StatusCode)
+	}
+	if resp := ts.postJSON(t, invitesPath, bob, map[string]interface{}{}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("non-member creating an invite: status %d, want 404", resp.StatusCode)
+	}
+
+	if resp := ts.postJSON(t, "/api/invites/"+invite.Token+"/accept", bob, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("accept: status %d", resp.StatusCode)
+	}
+	// Accepting on login
+	var loggedIn struct {
+		Org Org
+	}
+	ts.postJSON(t, "/api/login", "", map[string]string{"email": "carol@example.com", "password": "correct horse battery", "invite": invite.Token}, &loggedIn)
+	if loggedIn.Org.ID != org.ID {
+		t.Errorf("login with invite returned %+v", loggedIn)
+	}
+	if resp := ts.postJSON(t, "/api/invites/"+invite.Token+"/accept", dave, nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("accepting past max_uses: status %d, want 400", resp.StatusCode)
+	}
+
+	var second OrgInvite
+	ts.postJSON(t, invitesPath, alice, map[string]interface{}{"max_uses": 0}, &second)
+	var listed []OrgInvite
+	ts.do(t, "GET", invitesPath, alice, nil, "", &listed)
+	if len(listed) != 1 || listed[0].ID != second.ID || listed[0].Token != "" {
+		t.Errorf("listed invites = %+v", listed)
+	}
+	if resp := ts.do(t, "DELETE", fmt.Sprintf("%s/%d", invitesPath, second.ID), alice, nil, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("revoke: status %d", resp.StatusCode)
+	}
+	if resp := ts.postJSON(t, "/api/invites/"+second.Token+"/accept", dave, nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("accepting a revoked invite: status %d, want 400", resp.StatusCode)
+	}
+}
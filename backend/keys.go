@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Access tokens are signed with asymmetric keys kept as PKCS#8 PEM files,
+// one per key, in the keys directory. A file's name (without .pem) is the
+// key's kid; kids sort by creation time and the newest key signs. Older keys
+// keep verifying the tokens they signed until they are retired, so rotating
+// doesn't sign anyone out.
+
+const keyReloadMinInterval = 10 * time.Second
+
+type signingKey struct {
+	kid    string
+	method jwt.SigningMethod
+	signer crypto.Signer
+}
+
+type keyring struct {
+	dir string
+
+	mu       sync.RWMutex
+	keys     map[string]signingKey
+	current  string
+	loadedAt time.Time
+}
+
+// newKeyAlg is the algorithm for generated keys: "EdDSA" or "RS256".
+func newKeyAlg() string {
+	return envString("GRAPE_JWT_ALG", "EdDSA")
+}
+
+// loadKeyring reads the keys in dir, generating the first one for a fresh
+// install.
+func loadKeyring(dir string) (*keyring, error) {
+	k := &keyring{dir: dir}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	if k.current == "" {
+		kid, err := rotateSigningKey(dir, newKeyAlg())
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("generated JWT signing key %s", kid)
+		if err := k.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+func readSigningKeys(dir string) (map[string]signingKey, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]signingKey{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]signingKey{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".pem") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseSigningKey(strings.TrimSuffix(name, ".pem"), data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		keys[key.kid] = key
+	}
+	return keys, nil
+}
+
+func parseSigningKey(kid string, data []byte) (signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return signingKey{}, errors.New("not a PKCS#8 PEM private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return signingKey{}, err
+	}
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 2048 {
+			return signingKey{}, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return signingKey{kid: kid, method: jwt.SigningMethodRS256, signer: key}, nil
+	case ed25519.PrivateKey:
+		return signingKey{kid: kid, method: jwt.SigningMethodEdDSA, signer: key}, nil
+	default:
+		return signingKey{}, fmt.Errorf("unsupported key type %T", parsed)
+	}
+}
+
+func (k *keyring) reload() error {
+	keys, err := readSigningKeys(k.dir)
+	if err != nil {
+		return err
+	}
+	current := ""
+	for kid := range keys {
+		if kid > current {
+			current = kid
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys, k.current, k.loadedAt = keys, current, time.Now()
+	return nil
+}
+
+// watch picks up keys rotated or retired by another process.
+func (k *keyring) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.reload(); err != nil {
+				log.Printf("cannot reload JWT signing keys: %v", err)
+			}
+		}
+	}
+}
+
+func (k *keyring) sign(claims jwt.Claims) (string, error) {
+	k.mu.RLock()
+	key, ok := k.keys[k.current]
+	k.mu.RUnlock()
+	if !ok {
+		return "", errors.New("no JWT signing key")
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.signer)
+}
+
+// verificationKey is the jwt.Keyfunc for access tokens. A token must name its
+// key and use that key's algorithm. An unknown kid may be a key another
+// replica just rotated in, so the directory is re-read, at most every few
+// seconds.
+func (k *keyring) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("token has no kid")
+	}
+
+	k.mu.RLock()
+	key, ok := k.keys[kid]
+	stale := time.Since(k.loadedAt) > keyReloadMinInterval
+	k.mu.RUnlock()
+	if !ok && stale {
+		if err := k.reload(); err != nil {
+			return nil, err
+		}
+		k.mu.RLock()
+		key, ok = k.keys[kid]
+		k.mu.RUnlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown or retired key %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("key %q does not sign with %s", kid, token.Method.Alg())
+	}
+	return key.signer.Public(), nil
+}
+
+// rotateSigningKey generates a key that takes over signing and returns its
+// kid. Running servers switch to it on their next reload.
+func rotateSigningKey(dir, alg string) (string, error) {
+	var (
+		private interface{}
+		err     error
+	)
+	switch alg {
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return "", fmt.Errorf("unsupported GRAPE_JWT_ALG %q (use EdDSA or RS256)", alg)
+	}
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	kid := time.Now().UTC().Format("20060102T150405.000000000Z") + "-" + hex.EncodeToString(suffix)
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	// Written under a temporary name so a reload never sees half a key
+	tmp := filepath.Join(dir, "."+kid+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return "", err
+	}
+	return kid, os.Rename(tmp, filepath.Join(dir, kid+".pem"))
+}
+
+// retireSigningKey deletes a key, so the tokens it signed stop verifying.
+// Their holders refresh and get tokens from a remaining key; the last key
+// can't be retired, rotate first.
+func retireSigningKey(dir, kid string) error {
+	keys, err := readSigningKeys(dir)
+	if err != nil {
+		return err
+	}
+	if _, ok := keys[kid]; !ok {
+		return fmt.Errorf("no signing key %q in %s", kid, dir)
+	}
+	if len(keys) == 1 {
+		return errors.New("cannot retire the only signing key; rotate first")
+	}
+	return os.Remove(filepath.Join(dir, kid+".pem"))
+}
+
+// handleJWKS publishes the public verification keys, so other services can
+// check access tokens.
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	s.keys.mu.RLock()
+	kids := make([]string, 0, len(s.keys.keys))
+	for kid := range s.keys.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	jwks := []map[string]string{}
+	for _, kid := range kids {
+		key := s.keys.keys[kid]
+		jwk := map[string]string{"kid": kid, "alg": key.method.Alg(), "use": "sig"}
+		switch pub := key.signer.Public().(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		jwks = append(jwks, jwk)
+	}
+	s.keys.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": jwks})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestKeyRotation(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	oldToken := ts.signUp(t, "ada@example.com", "correct horse battery")
+
+	kid, err := rotateSigningKey(ts.cfg.KeysDir, "RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.keys.reload(); err != nil {
+		t.Fatal(err)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+		} `json:"keys"`
+	}
+	ts.do(t, "GET", "/.well-known/jwks.json", "", nil, "", &jwks)
+	if len(jwks.Keys) != 2 || jwks.Keys[1].Kid != kid || jwks.Keys[1].Alg != "RS256" {
+		t.Fatalf("jwks after rotating = %+v", jwks.Keys)
+	}
+
+	newToken := ts.login(t, "ada@example.com", "correct horse battery").Token
+	parsed, _, _ := jwt.NewParser().ParseUnverified(newToken, &Claims{})
+	if parsed.Header["kid"] != kid || parsed.Method.Alg() != "RS256" {
+		t.Errorf("new token signed with %v/%s, want %s/RS256", parsed.Header["kid"], parsed.Method.Alg(), kid)
+	}
+	for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+		if resp := ts.do(t, "GET", "/api/me", token, nil, "", nil); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s token after rotating: status %d", name, resp.StatusCode)
+		}
+	}
+
+	// Retiring the old key invalidates only what it signed
+	if err := retireSigningKey(ts.cfg.KeysDir, jwks.Keys[0].Kid); err != nil {
+		t.Fatal(err)
+	}
+	ts.keys.reload()
+	if resp := ts.do(t, "GET", "/api/me", oldToken, nil, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token of a retired key: status %d, want 401", resp.StatusCode)
+	}
+	if resp := ts.do(t, "GET", "/api/me", newToken, nil, "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("token of the current key after retiring: status %d", resp.StatusCode)
+	}
+	if err := retireSigningKey(ts.cfg.KeysDir, kid); err == nil {
+		t.Error("retiring the only key succeeded")
+	}
+}
+
+func TestTokenMustMatchKeyAlgorithm(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	ts.signUp(t, "ada@example.com", "correct horse battery")
+
+	ts.keys.mu.RLock()
+	kid := ts.keys.current
+	ts.keys.mu.RUnlock()
+	pem, err := os.ReadFile(filepath.Join(ts.cfg.KeysDir, kid+".pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An HS256 token keyed with material an attacker might know is refused
+	claims := &Claims{UserID: 1, RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}}
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	forged.Header["kid"] = kid
+	signed, _ := forged.SignedString(pem)
+	if resp := ts.do(t, "GET", "/api/me", signed, nil, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("HS256 token: status %d, want 401", resp.StatusCode)
+	}
+}
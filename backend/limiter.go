@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buildLimiter is a counting semaphore whose size can change while builds are
+// waiting on it.
+type buildLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	active int
+	wake   chan struct{} // closed whenever a slot may have opened up
+}
+
+func newBuildLimiter(limit int) *buildLimiter {
+	if limit < 1 {
+		limit = 1
+	}
+	return &buildLimiter{limit: limit, wake: make(chan struct{})}
+}
+
+func (l *buildLimiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.active < l.limit {
+			l.active++
+			l.mu.Unlock()
+			return nil
+		}
+		wake := l.wake
+		l.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *buildLimiter) release() {
+	l.mu.Lock()
+	l.active--
+	l.broadcast()
+	l.mu.Unlock()
+}
+
+func (l *buildLimiter) setLimit(n int) {
+	l.mu.Lock()
+	l.limit = n
+	l.broadcast()
+	l.mu.Unlock()
+}
+
+func (l *buildLimiter) currentLimit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+func (l *buildLimiter) broadcast() {
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// hostLoad is a point-in-time sample of how busy the machine is. Both fields
+// are fractions where 1.0 means fully saturated.
+type hostLoad struct {
+	CPU    float64
+	Memory float64
+}
+
+// autoscaler nudges the build limit down under pressure and back up when the
+// host is idle, one step per sample, within [min, max].
+type autoscaler struct {
+	limiter  *buildLimiter
+	min, max int
+	sample   func() (hostLoad, error)
+}
+
+func (a *autoscaler) adjust(load hostLoad) int {
+	limit := a.limiter.currentLimit()
+	switch {
+	case load.CPU > 0.9 || load.Memory > 0.9:
+		limit--
+	case load.CPU < 0.5 && load.Memory < 0.7:
+		limit++
+	}
+	if limit < a.min {
+		limit = a.min
+	}
+	if limit > a.max {
+		limit = a.max
+	}
+	a.limiter.setLimit(limit)
+	return limit
+}
+
+func (a *autoscaler) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			load, err := a.sample()
+			if err != nil {
+				log.Printf("build autoscaler: cannot sample host load: %v", err)
+				continue
+			}
+			a.adjust(load)
+		}
+	}
+}
+
+// sampleHostLoad reads the 1-minute load average and memory usage from /proc,
+// so adaptive concurrency is only available on Linux.
+func sampleHostLoad() (hostLoad, error) {
+	var load hostLoad
+
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return load, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return load, fmt.Errorf("unexpected /proc/loadavg format")
+	}
+	avg, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return load, err
+	}
+	load.CPU = avg / float64(runtime.NumCPU())
+
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return load, err
+	}
+	defer f.Close()
+
+	var total, available float64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, _ := strconv.ParseFloat(fields[1], 64)
+		switch fields[0] {
+		case "MemTotal:":
+			total = v
+		case "MemAvailable:":
+			available = v
+		}
+	}
+	if total == 0 {
+		return load, fmt.Errorf("MemTotal missing from /proc/meminfo")
+	}
+	load.Memory = 1 - available/total
+	return load, nil
+}
+
+// startAutoscaler enables adaptive build concurrency when GRAPE_BUILD_AUTOSCALE
+// is set; otherwise the limit stays at GRAPE_BUILD_CONCURRENCY.
+func (s *Server) startAutoscaler(ctx context.Context) {
+	if os.Getenv("GRAPE_BUILD_AUTOSCALE") != "true" {
+		return
+	}
+	a := &autoscaler{
+		limiter: s.buildSlots,
+		min:     envInt("GRAPE_BUILD_CONCURRENCY_MIN", 1),
+		max:     envInt("GRAPE_BUILD_CONCURRENCY_MAX", 2*runtime.NumCPU()),
+		sample:  sampleHostLoad,
+	}
+	log.Printf("Build autoscaler enabled (%d-%d concurrent builds)", a.min, a.max)
+	go a.run(ctx, envDuration("GRAPE_BUILD_AUTOSCALE_INTERVAL", 15*time.Second))
+}
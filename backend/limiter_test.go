@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestAutoscalerAdjust(t *testing.T) {
+	idle := hostLoad{CPU: 0.2, Memory: 0.3}
+	busy := hostLoad{CPU: 0.95, Memory: 0.5}
+	swapping := hostLoad{CPU: 0.4, Memory: 0.95}
+	steady := hostLoad{CPU: 0.7, Memory: 0.5}
+
+	for _, tc := range []struct {
+		name  string
+		start int
+		loads []hostLoad
+		want  []int
+	}{
+		{"grows one step per idle sample", 2, []hostLoad{idle, idle, idle}, []int{3, 4, 4}},
+		{"shrinks under CPU pressure", 4, []hostLoad{busy, busy, busy, busy}, []int{3, 2, 1, 1}},
+		{"shrinks under memory pressure", 3, []hostLoad{swapping}, []int{2}},
+		{"holds in between", 3, []hostLoad{steady, steady}, []int{3, 3}},
+		{"recovers after a spike", 2, []hostLoad{busy, idle, idle, steady}, []int{1, 2, 3, 3}},
+		{"clamps a limit set outside the range", 9, []hostLoad{steady}, []int{4}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &autoscaler{limiter: newBuildLimiter(tc.start), min: 1, max: 4}
+			for i, load := range tc.loads {
+				if got := a.adjust(load); got != tc.want[i] || a.limiter.currentLimit() != got {
+					t.Fatalf("sample %d (%+v): limit %d, limiter at %d, want %d", i, load, got, a.limiter.currentLimit(), tc.want[i])
+				}
+			}
+		})
+	}
+}
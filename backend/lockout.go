@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Password guessing is slowed down per address and per IP, using the failed
+// attempts in the login history. After a few free failures each further one
+// doubles the wait before the address can be tried again; at the threshold
+// the address is locked for the lockout duration and its owner is mailed a
+// link to unlock it. An IP is locked once it reaches its own, higher
+// threshold. Unknown addresses are throttled too, so lockouts don't reveal
+// which accounts exist.
+
+const (
+	freeLoginFailures = 3
+	unlockTokenTTL    = time.Hour
+)
+
+var (
+	loginLockoutThreshold = envInt("GRAPE_LOGIN_LOCKOUT_THRESHOLD", 10)
+	loginLockoutDuration  = envDuration("GRAPE_LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+	loginIPThreshold      = envInt("GRAPE_LOGIN_IP_THRESHOLD", 50)
+)
+
+// countedLoginFailures are the reasons that count as guesses; otp_required
+// is the normal first step of a two-factor login and doesn't.
+const countedLoginFailures = "('invalid_password', 'invalid_otp', 'unknown_email')"
+
+// loginDelay is how long after the n-th consecutive failure an address must
+// wait, or 0.
+func loginDelay(n int) time.Duration {
+	if n >= loginLockoutThreshold {
+		return loginLockoutDuration
+	}
+	if n < freeLoginFailures {
+		return 0
+	}
+	d := time.Second << uint(n-freeLoginFailures)
+	if d > loginLockoutDuration {
+		d = loginLockoutDuration
+	}
+	return d
+}
+
+// loginFailures counts failures for email since its last successful login or
+// unlock, within the lockout window, and returns the time of the latest.
+func (s *Server) loginFailures(email string, now time.Time) (int, time.Time, error) {
+	since := now.Add(-loginLockoutDuration).Unix()
+	var unlockedAt int64
+	s.db.QueryRow("SELECT login_unlocked_at FROM users WHERE email = ?", email).Scan(&unlockedAt)
+	if unlockedAt > since {
+		since = unlockedAt
+	}
+
+	var n, last int64
+	err := s.db.QueryRow(`
+		SELECT COUNT(*), COALESCE(MAX(created_at), 0) FROM login_events
+		WHERE email = ? AND success = 0 AND reason IN `+countedLoginFailures+` AND created_at > ?
+		AND id > (SELECT COALESCE(MAX(id), 0) FROM login_events WHERE email = ? AND success = 1)
+	`, email, since, email).Scan(&n, &last)
+	return int(n), time.Unix(last, 0), err
+}
+
+// loginBlocked reports how long a login for email from ip must wait, and the
+// error code to answer with.
+func (s *Server) loginBlocked(email, ip string, now time.Time) (time.Duration, string, error) {
+	var (
+		ipFailures int
+		oldest     int64
+	)
+	err := s.db.QueryRow(`
+		SELECT COUNT(*), COALESCE(MIN(created_at), 0) FROM login_events
+		WHERE ip = ? AND success = 0 AND reason IN `+countedLoginFailures+` AND created_at > ?
+	`, ip, now.Add(-loginLockoutDuration).Unix()).Scan(&ipFailures, &oldest)
+	if err != nil {
+		return 0, "", err
+	}
+	if ipFailures >= loginIPThreshold {
+		// Locked until enough failures age out of the window
+		return time.Unix(oldest, 0).Add(loginLockoutDuration).Sub(now), "ip_locked", nil
+	}
+
+	n, last, err := s.loginFailures(email, now)
+	if err != nil {
+		return 0, "", err
+	}
+	if wait := last.Add(loginDelay(n)).Sub(now); wait > 0 {
+		if n >= loginLockoutThreshold {
+			return wait, "account_locked", nil
+		}
+		return wait, "login_delayed", nil
+	}
+	return 0, "", nil
+}
+
+func writeLoginBlocked(w http.ResponseWriter, wait time.Duration, code string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	message := "Too many failed sign-ins; try again later"
+	if code == "account_locked" {
+		message = "Too many failed sign-ins; this account is locked for now. Check your email to unlock it"
+	}
+	writeJSONError(w, http.StatusTooManyRequests, code, message)
+}
+
+// loginFailed records a failed password login. The failure that locks an
+// account mails its owner an unlock link.
+func (s *Server) loginFailed(r *http.Request, userID int, email, reason string) {
+	s.recordLogin(r, userID, email, loginPassword, reason)
+	if userID == 0 {
+		return
+	}
+	n, _, err := s.loginFailures(email, time.Now())
+	if err != nil || n != loginLockoutThreshold {
+		return
+	}
+	if err := s.sendUnlockLink(userID, email); err != nil {
+		log.Printf("user %d: cannot send unlock link: %v", userID, err)
+	}
+}
+
+func (s *Server) sendUnlockLink(userID int, email string) error {
+	token := randomToken()
+	_, err := s.db.Exec(
+		"INSERT INTO account_unlocks (token_hash, user_id, expires_at) VALUES (?, ?, ?)",
+		hashToken(token), userID, time.Now().Add(unlockTokenTTL).Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s/unlock?token=%s", appURL, token)
+	return s.mailer.Send(email, "Your Grape.ai account was locked",
+		fmt.Sprintf("There were %d failed attempts to sign in to this account, so sign-ins are paused for %s. If that was you, open this link to unlock it now:\n\n%s\n\nIf it wasn't, consider changing your password.", loginLockoutThreshold, loginLockoutDuration, link))
+}
+
+// handleUnlockAccount lifts a lockout from the emailed link. It only clears
+// the address's failures; an IP that is locked stays locked.
+func (s *Server) handleUnlockAccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		userID    int
+		expiresAt int64
+	)
+	err = tx.QueryRow("SELECT user_id, expires_at FROM account_unlocks WHERE token_hash = ?", hashToken(req.Token)).Scan(&userID, &expiresAt)
+	if err != nil || time.Now().Unix() > expiresAt {
+		writeJSONError(w, http.StatusBadRequest, "invalid_unlock_token", "Invalid or expired unlock link")
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM account_unlocks WHERE user_id = ?", userID); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if _, err := tx.Exec("UPDATE users SET login_unlocked_at = ? WHERE id = ?", time.Now().Unix(), userID); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+var unlockLink = regexp.MustCompile(`unlock\?token=([0-9a-f]+)`)
+
+// lockoutTestServer turns off the per-IP rate limit, which would otherwise
+// step in first, and lowers the lockout thresholds.
+func lockoutTestServer(t *testing.T, accountThreshold, ipThreshold int) *testServer {
+	t.Setenv("GRAPE_RATE_LIMIT_AUTH", "0")
+	savedAccount, savedIP := loginLockoutThreshold, loginIPThreshold
+	loginLockoutThreshold, loginIPThreshold = accountThreshold, ipThreshold
+	t.Cleanup(func() { loginLockoutThreshold, loginIPThreshold = savedAccount, savedIP })
+	return newTestServer(t, stubRunner{})
+}
+
+// ageLoginEvents moves recorded attempts a minute into the past, past any
+// progressive delay but inside the lockout window.
+func (ts *testServer) ageLoginEvents(t *testing.T) {
+	t.Helper()
+	if _, err := ts.db.Exec("UPDATE login_events SET created_at = created_at - 60"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (ts *testServer) tryLogin(t *testing.T, email, password string) (int, string) {
+	t.Helper()
+	resp, err := ts.http.Client().Post(ts.http.URL+"/api/login", "application/json",
+		jsonBody(map[string]string{"email": email, "password": password}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+		t.Errorf("429 without Retry-After")
+	}
+	return resp.StatusCode, body.Error
+}
+
+func TestAccountLockout(t *testing.T) {
+	ts := lockoutTestServer(t, 5, 100)
+	ts.signUp(t, "ada@example.com", "correct horse battery")
+
+	for i := 0; i < freeLoginFailures; i++ {
+		if status, _ := ts.tryLogin(t, "ada@example.com", "wrong"); status != http.StatusUnauthorized {
+			t.Fatalf("failure %d: status %d", i+1, status)
+		}
+	}
+	if status, code := ts.tryLogin(t, "ada@example.com", "correct horse battery"); status != http.StatusTooManyRequests || code != "login_delayed" {
+		t.Fatalf("right after %d failures: %d %s, want 429 login_delayed", freeLoginFailures, status, code)
+	}
+
+	for i := freeLoginFailures; i < 5; i++ {
+		ts.ageLoginEvents(t)
+		if status, _ := ts.tryLogin(t, "ada@example.com", "wrong"); status != http.StatusUnauthorized {
+			t.Fatalf("failure %d after waiting: status %d", i+1, status)
+		}
+	}
+	ts.ageLoginEvents(t)
+	if status, code := ts.tryLogin(t, "ada@example.com", "correct horse battery"); status != http.StatusTooManyRequests || code != "account_locked" {
+		t.Fatalf("locked account: %d %s, want 429 account_locked", status, code)
+	}
+
+	m := unlockLink.FindStringSubmatch(ts.mailer.last())
+	if m == nil {
+		t.Fatalf("no unlock link in %q", ts.mailer.last())
+	}
+	if resp := ts.postJSON(t, "/api/auth/unlock", "", map[string]string{"token": m[1]}, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unlock: status %d", resp.StatusCode)
+	}
+	if status, _ := ts.tryLogin(t, "ada@example.com", "correct horse battery"); status != http.StatusOK {
+		t.Errorf("login after unlocking: status %d", status)
+	}
+	if resp := ts.postJSON(t, "/api/auth/unlock", "", map[string]string{"token": m[1]}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("reusing the unlock link: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestIPLockout(t *testing.T) {
+	ts := lockoutTestServer(t, 100, 4)
+	ts.signUp(t, "ada@example.com", "correct horse battery")
+
+	// Spread over addresses, so no single one is throttled
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"} {
+		if status, _ := ts.tryLogin(t, email, "wrong"); status != http.StatusUnauthorized {
+			t.Fatalf("%s: status %d", email, status)
+		}
+	}
+	if status, code := ts.tryLogin(t, "ada@example.com", "correct horse battery"); status != http.StatusTooManyRequests || code != "ip_locked" {
+		t.Errorf("locked IP: %d %s, want 429 ip_locked", status, code)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Every sign-in attempt is recorded so users can review their account's
+// activity. Attempts for unknown addresses are kept with user_id 0 and are
+// only visible in the database.
+
+// Sign-in methods recorded in the login history.
+const (
+	loginPassword  = "password"
+	loginMagicLink = "magic_link"
+	loginSSO       = "sso"
+)
+
+const maxLoginEvents = 200
+
+var loginHistoryTTL = envDuration("GRAPE_LOGIN_HISTORY_TTL", 90*24*time.Hour)
+
+type LoginEvent struct {
+	Method    string `json:"method"`
+	Success   bool   `json:"success"`
+	Reason    string `json:"reason,omitempty"`
+	IP        string `json:"ip"`
+	Device    string `json:"device"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// recordLogin logs a sign-in attempt; failure is empty when it succeeded, or
+// else the error code the client got. Recording is best effort and never
+// fails the sign-in.
+func (s *Server) recordLogin(r *http.Request, userID int, email, method, failure string) {
+	device := r.UserAgent()
+	if len(device) > maxDeviceLength {
+		device = device[:maxDeviceLength]
+	}
+	now := time.Now()
+	_, err := s.db.Exec(`
+		INSERT INTO login_events (user_id, email, method, success, reason, ip, user_agent, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, userID, email, method, failure == "", failure, clientIP(r), device, now.Unix())
+	if err != nil {
+		log.Printf("cannot record login for %q: %v", email, err)
+		return
+	}
+	s.db.Exec("DELETE FROM login_events WHERE user_id = ? AND created_at < ?", userID, now.Add(-loginHistoryTTL).Unix())
+	if failure == "" && userID != 0 {
+		s.noteDevice(userID, email, device, clientIP(r), now)
+	}
+}
+
+// lastLogin returns the user's most recent successful sign-in, if any.
+func (s *Server) lastLogin(userID int) *LoginEvent {
+	e := LoginEvent{Success: true}
+	err := s.db.QueryRow(`
+		SELECT method, ip, user_agent, created_at FROM login_events
+		WHERE user_id = ? AND success = 1 ORDER BY id DESC LIMIT 1
+	`, userID).Scan(&e.Method, &e.IP, &e.Device, &e.CreatedAt)
+	if err != nil {
+		return nil
+	}
+	return &e
+}
+
+// handleListLogins returns the caller's sign-in attempts, newest first.
+func (s *Server) handleListLogins(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	limit := 50
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	if limit > maxLoginEvents {
+		limit = maxLoginEvents
+	}
+
+	rows, err := s.db.Query(`
+		SELECT method, success, reason, ip, user_agent, created_at FROM login_events
+		WHERE user_id = ? ORDER BY id DESC LIMIT ?
+	`, userID, limit)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	events := []LoginEvent{}
+	for rows.Next() {
+		var e LoginEvent
+		if err := rows.Scan(&e.Method, &e.Success, &e.Reason, &e.IP, &e.Device, &e.CreatedAt); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		events = append(events, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLoginHistory(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	ts.signUp(t, "ada@example.com", "correct horse battery 1")
+
+	if resp := ts.postJSON(t, "/api/login", "", map[string]string{"email": "ada@example.com", "password": "wrong"}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status %d", resp.StatusCode)
+	}
+	ts.postJSON(t, "/api/login", "", map[string]string{"email": "nobody@example.com", "password": "wrong"}, nil)
+	session := ts.loginFrom(t, "Firefox").Token
+
+	var logins []LoginEvent
+	if resp := ts.do(t, "GET", "/api/me/logins", session, nil, "", &logins); resp.StatusCode != http.StatusOK {
+		t.Fatalf("list logins: status %d", resp.StatusCode)
+	}
+	// signUp's login, the failure, then the one from Firefox; the unknown
+	// address belongs to nobody
+	if len(logins) != 3 {
+		t.Fatalf("got %d logins: %+v", len(logins), logins)
+	}
+	if !logins[0].Success || logins[0].Device != "Firefox" || logins[0].Method != loginPassword || logins[0].IP == "" {
+		t.Errorf("newest login = %+v", logins[0])
+	}
+	if logins[1].Success || logins[1].Reason != "invalid_password" {
+		t.Errorf("failed login = %+v", logins[1])
+	}
+
+	var me Profile
+	ts.do(t, "GET", "/api/me", session, nil, "", &me)
+	if me.LastLogin == nil || me.LastLogin.Device != "Firefox" {
+		t.Errorf("profile last_login = %+v", me.LastLogin)
+	}
+
+	ts.do(t, "GET", "/api/me/logins?limit=1", session, nil, "", &logins)
+	if len(logins) != 1 {
+		t.Errorf("limit=1 returned %d logins", len(logins))
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+)
+
+// handleProjectLogs returns the build log from byte offset onwards so clients
+// can tail it. An offset past the end means the log was reset by a rebuild,
+// in which case the whole log is returned with reset set.
+//
+// Chunks hold whole UTF-8 characters, so they survive the trip through JSON:
+// an offset inside a character is moved back to its start, which start
+// reports, and a character still being written is left for the next request.
+func (s *Server) handleProjectLogs(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleViewer)
+	if !ok {
+		return
+	}
+
+	var offset int64
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	var (
+		status string
+		length int64
+	)
+	err := s.db.QueryRow("SELECT status, length(CAST(build_log AS BLOB)) FROM projects WHERE id = ?", projectID).
+		Scan(&status, &length)
+	if err != nil {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+
+	reset := offset > length
+	if reset {
+		offset = 0
+	}
+
+	var chunk []byte
+	if offset < length {
+		// Read from up to a character's width earlier to find where it starts
+		from := offset - (utf8.UTFMax - 1)
+		if from < 0 {
+			from = 0
+		}
+		err = s.db.QueryRow("SELECT substr(CAST(build_log AS BLOB), ?) FROM projects WHERE id = ?", from+1, projectID).Scan(&chunk)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		i := int(offset - from)
+		for i > 0 && i < len(chunk) && !utf8.RuneStart(chunk[i]) {
+			i--
+		}
+		chunk = chunk[i:]
+		offset = from + int64(i)
+		if status == "queued" || status == "building" {
+			chunk = chunk[:completeRunes(chunk)]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"log":    string(chunk),
+		"start":  offset,
+		"offset": offset + int64(len(chunk)),
+		"length": length,
+		"reset":  reset,
+		"status": status,
+	})
+}
+
+// completeRunes returns the length of b without a trailing incomplete UTF-8
+// character.
+func completeRunes(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return len(b)
+			}
+			return i
+		}
+	}
+	return len(b)
+}
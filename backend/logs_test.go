@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestProjectLogsKeepCharactersWhole(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID + "/logs"
+
+	type logChunk struct {
+		Log    string `json:"log"`
+		Start  int64  `json:"start"`
+		Offset int64  `json:"offset"`
+		Length int64  `json:"length"`
+	}
+	setLog := func(log, status string) {
+		t.Helper()
+		if _, err := ts.db.Exec("UPDATE projects SET build_log = ?, status = ? WHERE id = ?", log, status, project.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stored := "héllo ✓ wörld 🍇\n"
+	setLog(stored, "live")
+	for offset := 0; offset <= len(stored); offset++ {
+		var got logChunk
+		ts.do(t, "GET", fmt.Sprintf("%s?offset=%d", path, offset), token, nil, "", &got)
+		if got.Start > int64(offset) || got.Start < int64(offset-utf8.UTFMax+1) || got.Start < int64(len(stored)) && !utf8.RuneStart(stored[got.Start]) {
+			t.Errorf("offset %d: chunk starts at %d", offset, got.Start)
+			continue
+		}
+		if want := stored[got.Start:]; got.Log != want || got.Offset != int64(len(stored)) {
+			t.Errorf("offset %d: got %q up to %d, want %q up to %d", offset, got.Log, got.Offset, want, len(stored))
+		}
+	}
+
+	// A character half written by a running build waits for the rest
+	grape := "🍇"
+	setLog("building "+grape[:2], "building")
+	var first logChunk
+	ts.do(t, "GET", path, token, nil, "", &first)
+	if first.Log != "building " || first.Offset != int64(len("building ")) || first.Length != int64(len("building "))+2 {
+		t.Fatalf("partial character: %+v", first)
+	}
+	if _, err := ts.db.Exec("UPDATE projects SET build_log = CAST(build_log AS BLOB) || CAST(? AS BLOB) WHERE id = ?", grape[2:]+" done", project.ID); err != nil {
+		t.Fatal(err)
+	}
+	var next logChunk
+	ts.do(t, "GET", fmt.Sprintf("%s?offset=%d", path, first.Offset), token, nil, "", &next)
+	if first.Log+next.Log != "building "+grape+" done" {
+		t.Errorf("reassembled log %q", first.Log+next.Log)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var magicLinkTTL = envDuration("GRAPE_MAGIC_LINK_TTL", 15*time.Minute)
+
+// createPasswordlessUser adds an account for someone who signs in without a
+// password. Its password hash is of a random secret nobody knows, so the
+// password only works once one is set through a reset.
+func createPasswordlessUser(tx *sql.Tx, email string, verified bool) (int, error) {
+	hash, err := hashPassword(randomToken())
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("INSERT INTO users (email, password, verified) VALUES (?, ?, ?)", email, hash, verified)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// handleRequestMagicLink mails a single-use sign-in link. Addresses without an
+// account get one too, created when the link is opened, and the answer is the
+// same either way.
+func (s *Server) handleRequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email   string `json:"email"`
+		Captcha string `json:"captcha"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	if !validEmail(email) {
+		writeJSONError(w, http.StatusBadRequest, "invalid_email", "A valid email is required")
+		return
+	}
+	// Magic links sign up new addresses, so they take the same captcha
+	if !s.checkCaptcha(w, r, req.Captcha) {
+		return
+	}
+
+	token := randomToken()
+	now := time.Now()
+	s.db.Exec("DELETE FROM magic_links WHERE expires_at <= ?", now.Unix())
+	if _, err := s.db.Exec(
+		"INSERT INTO magic_links (token_hash, email, expires_at) VALUES (?, ?, ?)",
+		hashToken(token), email, now.Add(magicLinkTTL).Unix(),
+	); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	link := fmt.Sprintf("%s/magic-link?token=%s", appURL, token)
+	if err := s.mailer.Send(email, "Sign in to Grape.ai",
+		fmt.Sprintf("Open this link to sign in to Grape.ai:\n\n%s\n\nThe link works once and expires in %s. If you didn't ask for it, you can ignore this email.", link, magicLinkTTL)); err != nil {
+		log.Printf("cannot send magic link: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Check your email for a sign-in link"})
+}
+
+var errInvalidMagicLink = errors.New("invalid or expired magic link")
+
+// handleRedeemMagicLink exchanges a magic link token for a token pair, like
+// /api/login. Accounts with two-factor on still need otp; the link is only
+// used up once the sign-in succeeds.
+func (s *Server) handleRedeemMagicLink(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+		OTP   string `json:"otp"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+
+	var (
+		email     string
+		expiresAt int64
+	)
+	err := s.db.QueryRow("SELECT email, expires_at FROM magic_links WHERE token_hash = ?", hashToken(req.Token)).
+		Scan(&email, &expiresAt)
+	if err != nil || time.Now().Unix() > expiresAt {
+		writeJSONError(w, http.StatusBadRequest, "invalid_magic_link", "Invalid or expired sign-in link")
+		return
+	}
+
+	var userID int
+	if err := s.db.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID); err == nil {
+		enabled, err := s.totpEnabled(userID)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+			return
+		}
+		if enabled {
+			switch err := s.checkSecondFactor(userID, req.OTP); {
+			case errors.Is(err, errOTPRequired):
+				s.recordLogin(r, userID, email, loginMagicLink, "otp_required")
+				writeJSONError(w, http.StatusUnauthorized, "otp_required", "Enter the code from your authenticator app or a recovery code")
+				return
+			case errors.Is(err, errInvalidOTP):
+				s.recordLogin(r, userID, email, loginMagicLink, "invalid_otp")
+				writeJSONError(w, http.StatusUnauthorized, "invalid_otp", "Invalid one-time code")
+				return
+			case err != nil:
+				writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+				return
+			}
+		}
+	}
+
+	userID, err = s.consumeMagicLink(req.Token, email)
+	if errors.Is(err, errInvalidMagicLink) {
+		writeJSONError(w, http.StatusBadRequest, "invalid_magic_link", "Invalid or expired sign-in link")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+
+	tokens, err := s.issueTokens(r, userID, "")
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Error generating token")
+		return
+	}
+	s.recordLogin(r, userID, email, loginMagicLink, "")
+	profile, err := s.loadProfile(userID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":         tokens.Token,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+		"user":          profile,
+	})
+}
+
+// consumeMagicLink uses up token and returns the account for email, creating
+// it if needed. Opening the link proves the address, so the account ends up
+// verified either way.
+func (s *Server) consumeMagicLink(token, email string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Deleting the token first makes a concurrent second use fail here
+	res, err := tx.Exec("DELETE FROM magic_links WHERE token_hash = ?", hashToken(token))
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, errInvalidMagicLink
+	}
+
+	var userID int
+	err = tx.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID)
+	switch {
+	case err == nil:
+		if _, err := tx.Exec("UPDATE users SET verified = 1 WHERE id = ?", userID); err != nil {
+			return 0, err
+		}
+	case err == sql.ErrNoRows:
+		if userID, err = createPasswordlessUser(tx, email, true); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var magicLink = regexp.MustCompile(`magic-link\?token=([0-9a-f]+)`)
+
+func (ts *testServer) requestMagicLink(t *testing.T, email string) string {
+	t.Helper()
+	if resp := ts.postJSON(t, "/api/auth/magic-link", "", map[string]string{"email": email}, nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("request magic link: status %d", resp.StatusCode)
+	}
+	m := magicLink.FindStringSubmatch(ts.mailer.last())
+	if m == nil {
+		t.Fatalf("no magic link in %q", ts.mailer.last())
+	}
+	return m[1]
+}
+
+func TestMagicLinkSignIn(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+
+	// A new address gets a verified account on first use
+	token := ts.requestMagicLink(t, "grace@example.com")
+	var signedIn struct {
+		Token string  `json:"token"`
+		User  Profile `json:"user"`
+	}
+	if resp := ts.postJSON(t, "/api/auth/magic-link/verify", "", map[string]string{"token": token}, &signedIn); resp.StatusCode != http.StatusOK {
+		t.Fatalf("redeem: status %d", resp.StatusCode)
+	}
+	if signedIn.Token == "" || signedIn.User.Email != "grace@example.com" || !signedIn.User.Verified {
+		t.Errorf("redeem returned %+v", signedIn)
+	}
+	if resp := ts.do(t, "GET", "/api/me", signedIn.Token, nil, "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("me with the new token: status %d", resp.StatusCode)
+	}
+
+	if resp := ts.postJSON(t, "/api/auth/magic-link/verify", "", map[string]string{"token": token}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("reusing a link: status %d, want 400", resp.StatusCode)
+	}
+	if resp := ts.postJSON(t, "/api/auth/magic-link", "", map[string]string{"email": "not-an-email"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid email: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestMagicLinkRequiresSecondFactor(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	session := ts.signUp(t, "ada@example.com", "correct horse battery")
+
+	var setup struct {
+		Secret string `json:"secret"`
+	}
+	ts.postJSON(t, "/api/auth/2fa/setup", session, nil, &setup)
+	step := time.Now().Unix() / totpPeriod
+	code, _ := totpCode(setup.Secret, step)
+	if resp := ts.postJSON(t, "/api/auth/2fa/verify", session, map[string]string{"code": code}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("enable 2FA: status %d", resp.StatusCode)
+	}
+
+	token := ts.requestMagicLink(t, "ada@example.com")
+	if resp := ts.postJSON(t, "/api/auth/magic-link/verify", "", map[string]string{"token": token}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("redeem without otp: status %d, want 401", resp.StatusCode)
+	}
+	next, _ := totpCode(setup.Secret, step+1)
+	if resp := ts.postJSON(t, "/api/auth/magic-link/verify", "", map[string]string{"token": token, "otp": next}, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("redeem with otp after a failed attempt: status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import "log"
+
+// Mailer delivers transactional email. There is no SMTP integration yet, so
+// the default just writes the message to the log.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+type logMailer struct{}
+
+func (logMailer) Send(to, subject, body string) error {
+	log.Printf("mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
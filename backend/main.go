@@ -1,26 +1,27 @@
 package main
 
 import (
-	"archive/zip"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/gorilla/mux"
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -29,86 +30,67 @@ type User struct {
 	ID       int    `json:"id"`
 	Email    string `json:"email"`
 	Password string `json:"-"`
+	Verified bool   `json:"verified"`
+	IsAdmin  bool   `json:"is_admin"`
 }
 
 type Project struct {
-	ID        string `json:"id"`
-	UserID    int    `json:"user_id"`
-	Name      string `json:"name"`
-	Status    string `json:"status"`
-	Subdomain string `json:"subdomain"`
-	CreatedAt int64  `json:"created_at"`
-	BuildLog  string `json:"build_log,omitempty"`
+	ID                string          `json:"id"`
+	UserID            int             `json:"user_id"`
+	Name              string          `json:"name"`
+	Description       string          `json:"description,omitempty"`
+	Status            string          `json:"status"`
+	Subdomain         string          `json:"subdomain"`
+	CreatedAt         int64           `json:"created_at"`
+	BuildLog          string          `json:"build_log,omitempty"`
+	BuildStage        string          `json:"build_stage,omitempty"`
+	Preset            string          `json:"preset"`
+	RootDir           string          `json:"root_dir,omitempty"`
+	KeepDeployments   int             `json:"keep_deployments,omitempty"`
+	RequireApproval   bool            `json:"require_approval,omitempty"`
+	PendingDeployment string          `json:"pending_deployment,omitempty"`
+	ForceHTTPS        bool            `json:"force_https"`
+	Paused            bool            `json:"paused,omitempty"`
+	Tags              []string        `json:"tags,omitempty"`
+	OrgID             int             `json:"org_id,omitempty"`
+	Role              string          `json:"role,omitempty"`
+	Storage           *ProjectStorage `json:"storage,omitempty"`
 }
 
 type Claims struct {
-	UserID int `json:"user_id"`
+	UserID       int    `json:"user_id"`
+	TokenVersion int    `json:"ver"`
+	IsAdmin      bool   `json:"adm,omitempty"`
+	SessionID    string `json:"sid,omitempty"`
+	// Impersonator is the admin acting as UserID, for impersonation tokens
+	Impersonator int `json:"imp,omitempty"`
 	jwt.RegisteredClaims
 }
 
-var (
-	db           *sql.DB
-	jwtSecret    = []byte("grape-ai-secret-key-change-in-production")
-	uploadsDir   = "uploads"
-	projectsDir  = "projects"
-	deployDir    = "deploy"
-	pythonWorker = "../builder/worker.py"
-)
-
-func initDB() {
-	var err error
-	db, err = sql.Open("sqlite3", "grape.db")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Create users table
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			email TEXT UNIQUE NOT NULL,
-			password TEXT NOT NULL,
-			created_at INTEGER DEFAULT (strftime('%s', 'now'))
-		)
-	`)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Create projects table
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS projects (
-			id TEXT PRIMARY KEY,
-			user_id INTEGER NOT NULL,
-			name TEXT NOT NULL,
-			status TEXT DEFAULT 'queued',
-			subdomain TEXT NOT NULL,
-			build_log TEXT DEFAULT '',
-			created_at INTEGER DEFAULT (strftime('%s', 'now')),
-			FOREIGN KEY (user_id) REFERENCES users (id)
-		)
-	`)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-func ensureDirs() {
-	for _, dir := range []string{uploadsDir, projectsDir, deployDir} {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			log.Fatal(err)
-		}
-	}
-}
-
 func generateID() string {
 	bytes := make([]byte, 8)
 	rand.Read(bytes)
 	return hex.EncodeToString(bytes)
 }
 
+// randomToken returns an unguessable token for links and credentials; only
+// its hashToken digest should be stored.
+func randomToken() string {
+	bytes := make([]byte, 32)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bcryptCost is lowered by tests; hashing at the real cost takes over a second.
+var bcryptCost = 14
+
 func hashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
 	return string(bytes), err
 }
 
@@ -117,36 +99,96 @@ func checkPassword(password, hash string) bool {
 	return err == nil
 }
 
-func generateToken(userID int) (string, error) {
+func (s *Server) generateToken(userID int, sessionID string) (string, error) {
+	var (
+		version int
+		isAdmin bool
+	)
+	if err := s.db.QueryRow("SELECT token_version, is_admin FROM users WHERE id = ?", userID).Scan(&version, &isAdmin); err != nil {
+		return "", err
+	}
+
 	claims := &Claims{
-		UserID: userID,
+		UserID:       userID,
+		TokenVersion: version,
+		IsAdmin:      isAdmin,
+		SessionID:    sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ID:        generateID(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL)),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return s.keys.sign(claims)
 }
 
-func validateToken(tokenString string) (*Claims, error) {
+// Errors returned by validateToken, so callers can tell clients whether to
+// refresh, sign in again or give up.
+var (
+	errTokenExpired = errors.New("token expired")
+	errTokenInvalid = errors.New("invalid token")
+	errTokenRevoked = errors.New("token revoked")
+	errUnknownUser  = errors.New("unknown user")
+)
+
+func (s *Server) validateToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, claims, s.keys.verificationKey,
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, fmt.Errorf("%w: %v", errTokenExpired, err)
+	}
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", errTokenInvalid, err)
 	}
 	if !token.Valid {
-		return nil, fmt.Errorf("invalid token")
+		return nil, errTokenInvalid
+	}
+
+	// Bumping a user's token_version revokes every token issued before it
+	var version int
+	err = s.db.QueryRow("SELECT token_version FROM users WHERE id = ?", claims.UserID).Scan(&version)
+	if err == sql.ErrNoRows {
+		return nil, errUnknownUser
+	}
+	if err != nil {
+		return nil, err
+	}
+	if claims.TokenVersion != version {
+		return nil, errTokenRevoked
+	}
+	if claims.ID != "" {
+		denied, err := s.tokenDenied(claims.ID)
+		if err != nil {
+			return nil, err
+		}
+		if denied {
+			return nil, errTokenRevoked
+		}
+	}
+	if claims.SessionID != "" {
+		revoked, err := s.sessionRevoked(claims.UserID, claims.SessionID)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, errTokenRevoked
+		}
 	}
 	return claims, nil
 }
 
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "message": message})
+}
+
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, Idempotency-Key")
+		w.Header().Set("Access-Control-Expose-Headers", "X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, Retry-After, X-Total-Count")
 		
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -157,30 +199,98 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// authMiddleware accepts a bearer JWT, or an API key (in X-API-Key or as the
+// bearer token) granting one of scopes. Routes listing no scopes are for
+// signed-in users only.
+func (s *Server) authMiddleware(next http.HandlerFunc, scopes ...string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); strings.HasPrefix(bearer, apiKeyPrefix) {
+			key = bearer
+		}
+		if key != "" {
+			userID, isAdmin, granted, err := s.validateAPIKey(key)
+			if err == errInvalidAPIKey {
+				writeJSONError(w, http.StatusUnauthorized, "invalid_api_key", "Unknown or revoked API key")
+				return
+			}
+			if err != nil {
+				log.Printf("API key validation failed: %v", err)
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			if len(scopes) == 0 {
+				writeJSONError(w, http.StatusForbidden, "session_required", "This endpoint cannot be used with an API key")
+				return
+			}
+			allowed := false
+			for _, scope := range scopes {
+				allowed = allowed || hasScope(granted, scope)
+			}
+			if !allowed {
+				writeJSONError(w, http.StatusForbidden, "insufficient_scope", "API key lacks the "+strings.Join(scopes, " or ")+" scope")
+				return
+			}
+			if !s.checkIPAllowlist(w, r, userID) {
+				return
+			}
+			ctx := context.WithValue(r.Context(), "userID", userID)
+			ctx = context.WithValue(ctx, "isAdmin", isAdmin)
+			next(w, r.WithContext(ctx))
+			return
+		}
+
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			http.Error(w, "Missing authorization header", http.StatusUnauthorized)
+			writeJSONError(w, http.StatusUnauthorized, "missing_token", "Missing authorization header")
 			return
 		}
 
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		claims, err := validateToken(tokenString)
-		if err != nil {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+		claims, err := s.validateToken(tokenString)
+		switch {
+		case err == nil:
+		case errors.Is(err, errTokenExpired):
+			writeJSONError(w, http.StatusUnauthorized, "token_expired", "Token has expired, refresh it or log in again")
+			return
+		case errors.Is(err, errTokenRevoked):
+			writeJSONError(w, http.StatusUnauthorized, "token_revoked", "Token has been revoked, log in again")
+			return
+		case errors.Is(err, errUnknownUser):
+			writeJSONError(w, http.StatusUnauthorized, "user_not_found", "The account for this token no longer exists")
+			return
+		case errors.Is(err, errTokenInvalid):
+			writeJSONError(w, http.StatusUnauthorized, "token_invalid", "Invalid token")
+			return
+		default:
+			log.Printf("token validation failed: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		if claims.Impersonator != 0 {
+			if !s.checkImpersonation(w, r, claims) {
+				return
+			}
+		} else if !s.checkIPAllowlist(w, r, claims.UserID) {
 			return
 		}
 
-		r = r.WithContext(context.WithValue(r.Context(), "userID", claims.UserID))
-		next(w, r)
+		ctx := context.WithValue(r.Context(), "userID", claims.UserID)
+		ctx = context.WithValue(ctx, "isAdmin", claims.IsAdmin)
+		ctx = context.WithValue(ctx, "sessionID", claims.SessionID)
+		ctx = context.WithValue(ctx, "impersonator", claims.Impersonator)
+		next(w, r.WithContext(ctx))
 	}
 }
 
-func handleRegister(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Invite   string `json:"invite"`
+		Captcha  string `json:"captcha"`
+		Claim    string `json:"claim_token"`
 	}
 	
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -192,6 +302,26 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Email and password required", http.StatusBadRequest)
 		return
 	}
+	if perr := s.checkPasswordStrength(req.Password); perr != nil {
+		writeJSONError(w, http.StatusBadRequest, perr.Code, perr.Message)
+		return
+	}
+	if !s.checkCaptcha(w, r, req.Captcha) {
+		return
+	}
+
+	var invite OrgInvite
+	if req.Invite != "" {
+		var err error
+		invite, err = s.checkInvite(req.Invite, req.Email)
+		if writeInviteError(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
 
 	hashedPassword, err := hashPassword(req.Password)
 	if err != nil {
@@ -199,7 +329,7 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := db.Exec("INSERT INTO users (email, password) VALUES (?, ?)", req.Email, hashedPassword)
+	result, err := s.db.Exec("INSERT INTO users (email, password, verified) VALUES (?, ?, 0)", req.Email, hashedPassword)
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
 			http.Error(w, "Email already exists", http.StatusConflict)
@@ -210,23 +340,55 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userID, _ := result.LastInsertId()
-	token, err := generateToken(int(userID))
+	response := map[string]interface{}{}
+	// An invite mailed to this address proves it, like a verification link
+	verified := invite.Email != ""
+	if req.Invite != "" {
+		org, err := s.acceptInvite(req.Invite, int(userID), req.Email)
+		if err != nil {
+			log.Printf("user %d: cannot accept invite: %v", userID, err)
+			response["invite_error"] = inviteErrorCode(err)
+			verified = false
+		} else {
+			response["org"] = org
+		}
+	}
+	if verified {
+		if _, err := s.db.Exec("UPDATE users SET verified = 1 WHERE id = ?", userID); err != nil {
+			verified = false
+		}
+	}
+	if !verified {
+		if err := s.sendVerification(int(userID), req.Email); err != nil {
+			log.Printf("user %d: cannot send verification email: %v", userID, err)
+		}
+	}
+
+	tokens, err := s.issueTokens(r, int(userID), "")
 	if err != nil {
 		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
 	}
 
+	if req.Claim != "" {
+		s.claimOnSignIn(req.Claim, int(userID), response)
+	}
+
+	response["token"] = tokens.Token
+	response["refresh_token"] = tokens.RefreshToken
+	response["expires_in"] = tokens.ExpiresIn
+	response["user"] = map[string]interface{}{"id": userID, "email": req.Email, "verified": verified}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"token": token,
-		"user":  map[string]interface{}{"id": userID, "email": req.Email},
-	})
+	json.NewEncoder(w).Encode(response)
 }
 
-func handleLogin(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		OTP      string `json:"otp"`
+		Invite   string `json:"invite"`
+		Claim    string `json:"claim_token"`
 	}
 	
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -234,253 +396,677 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user User
-	err := db.QueryRow("SELECT id, email, password FROM users WHERE email = ?", req.Email).
-		Scan(&user.ID, &user.Email, &user.Password)
+	wait, code, err := s.loginBlocked(req.Email, clientIP(r), time.Now())
 	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		s.recordLogin(r, 0, req.Email, loginPassword, code)
+		writeLoginBlocked(w, wait, code)
+		return
+	}
+
+	var (
+		user        User
+		totpEnabled bool
+	)
+	err = s.db.QueryRow("SELECT id, email, password, verified, is_admin, totp_enabled FROM users WHERE email = ?", req.Email).
+		Scan(&user.ID, &user.Email, &user.Password, &user.Verified, &user.IsAdmin, &totpEnabled)
+	if err != nil {
+		s.loginFailed(r, 0, req.Email, "unknown_email")
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
 	if !checkPassword(req.Password, user.Password) {
+		s.loginFailed(r, user.ID, user.Email, "invalid_password")
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	token, err := generateToken(user.ID)
+	if totpEnabled {
+		switch err := s.checkSecondFactor(user.ID, req.OTP); {
+		case errors.Is(err, errOTPRequired):
+			s.recordLogin(r, user.ID, user.Email, loginPassword, "otp_required")
+			writeJSONError(w, http.StatusUnauthorized, "otp_required", "Enter the code from your authenticator app or a recovery code")
+			return
+		case errors.Is(err, errInvalidOTP):
+			s.loginFailed(r, user.ID, user.Email, "invalid_otp")
+			writeJSONError(w, http.StatusUnauthorized, "invalid_otp", "Invalid one-time code")
+			return
+		case err != nil:
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	tokens, err := s.issueTokens(r, user.ID, "")
 	if err != nil {
 		http.Error(w, "Error generating token", http.StatusInternalServerError)
 		return
 	}
+	s.recordLogin(r, user.ID, user.Email, loginPassword, "")
 
+	response := map[string]interface{}{
+		"token":         tokens.Token,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+		"user":          map[string]interface{}{"id": user.ID, "email": user.Email, "verified": user.Verified, "is_admin": user.IsAdmin},
+	}
+	if req.Invite != "" {
+		if org, err := s.acceptInvite(req.Invite, user.ID, user.Email); err != nil {
+			response["invite_error"] = inviteErrorCode(err)
+		} else {
+			response["org"] = org
+		}
+	}
+	if req.Claim != "" {
+		s.claimOnSignIn(req.Claim, user.ID, response)
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"token": token,
-		"user":  map[string]interface{}{"id": user.ID, "email": user.Email},
-	})
+	json.NewEncoder(w).Encode(response)
 }
 
-func handleUpload(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("userID").(int)
-	
-	if err := r.ParseMultipartForm(100 << 20); err != nil { // 100MB max
-		http.Error(w, "File too large", http.StatusBadRequest)
+	if !s.uploadAllowed(w, r, userID) {
 		return
 	}
 
-	name := r.FormValue("name")
+	// Keep a local copy to extract from; the archive itself goes to storage
+	projectID := generateID()
+	uploadPath := filepath.Join(s.cfg.StagingDir, projectID+".upload")
+	defer os.Remove(uploadPath)
+
+	form, err := receiveUpload(w, r, uploadPath)
+	switch {
+	case err == errUploadTooLarge:
+		http.Error(w, fmt.Sprintf("Upload exceeds the %d MB limit", maxUploadSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	case err == errMissingFile:
+		http.Error(w, "Missing project file", http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !hasArchiveExtension(form.filename) {
+		http.Error(w, "Only .zip, .tar.gz, .tgz, .tar.zst and .tzst files allowed", http.StatusBadRequest)
+		return
+	}
+
+	s.createProject(w, r, userID, projectID, uploadPath, form, deploySource{Trigger: "upload", Name: form.filename})
+}
+
+// uploadAllowed checks that userID may create a project, replaying the
+// project a retried request already created. It has responded when false.
+func (s *Server) uploadAllowed(w http.ResponseWriter, r *http.Request, userID int) bool {
+	if !s.isVerified(userID) {
+		http.Error(w, "Verify your email address before uploading", http.StatusForbidden)
+		return false
+	}
+
+	// A retried upload gets the project the first attempt created
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if err := validateIdempotencyKey(idempotencyKey); err != nil {
+		http.Error(w, "Invalid Idempotency-Key: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if idempotencyKey != "" {
+		if err := s.expireIdempotencyKeys(userID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return false
+		}
+		project, err := s.idempotentProject(userID, idempotencyKey)
+		if err == nil {
+			writeIdempotentReplay(w, project)
+			return false
+		}
+		if err != sql.ErrNoRows {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return false
+		}
+	}
+
+	// Dry runs don't create a project, so they don't need room for one
+	if !isDryRun(r, nil) {
+		quota, err := s.userQuota(userID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return false
+		}
+		if ok, reason := quota.canUpload(); !ok {
+			writeQuotaError(w, quota, reason)
+			return false
+		}
+	}
+	return true
+}
+
+// createProject checks the settings in form and the archive at uploadPath,
+// then stores the archive and starts the project's first build from it.
+func (s *Server) createProject(w http.ResponseWriter, r *http.Request, userID int, projectID, uploadPath string, form *uploadForm, src deploySource) {
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+
+	name := form.value("name")
 	if name == "" {
 		name = "project"
 	}
 
-	file, header, err := r.FormFile("project")
+	// Uploading into an org shares the project with its members
+	var orgID int
+	if v := form.value("org_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid org_id", http.StatusBadRequest)
+			return
+		}
+		role, err := s.orgRole(id, userID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if role == "" {
+			http.Error(w, "You are not a member of that organization", http.StatusForbidden)
+			return
+		}
+		orgID = id
+	} else {
+		// Service accounts deploy into their org unless told otherwise
+		id, err := s.serviceAccountOrg(userID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		orgID = id
+	}
+
+	preset := form.value("preset")
+	if _, ok := urlPresets[preset]; preset != "" && !ok {
+		http.Error(w, "Unknown preset", http.StatusBadRequest)
+		return
+	}
+
+	subdomain := fmt.Sprintf("%s.%s", projectID, baseDomain)
+	if slug := strings.ToLower(strings.TrimSpace(form.value("subdomain"))); slug != "" {
+		if err := validateSubdomain(slug); err != nil {
+			http.Error(w, "Invalid subdomain: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		subdomain = fmt.Sprintf("%s.%s", slug, baseDomain)
+		if s.subdomainTaken(subdomain, projectID) {
+			http.Error(w, "Subdomain "+subdomain+" is already taken", http.StatusConflict)
+			return
+		}
+	}
+
+	buildTimeout, err := parseBuildTimeout(form.value("build_timeout"))
 	if err != nil {
-		http.Error(w, "Missing project file", http.StatusBadRequest)
+		http.Error(w, "Invalid build_timeout: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	if !strings.HasSuffix(header.Filename, ".zip") {
-		http.Error(w, "Only .zip files allowed", http.StatusBadRequest)
+	forceHTTPS := form.value("force_https") == "true"
+
+	healthPath := form.value("health_check_path")
+	if healthPath != "" && !strings.HasPrefix(healthPath, "/") {
+		http.Error(w, "health_check_path must start with /", http.StatusBadRequest)
 		return
 	}
 
-	projectID := generateID()
-	uploadPath := filepath.Join(uploadsDir, projectID+".zip")
-	
-	out, err := os.Create(uploadPath)
+	rootDir, err := validateRootDir(form.value("root_dir"))
 	if err != nil {
-		http.Error(w, "Cannot save upload", http.StatusInternalServerError)
+		http.Error(w, "Invalid root_dir: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer out.Close()
 
-	if _, err := io.Copy(out, file); err != nil {
-		http.Error(w, "Cannot write upload", http.StatusInternalServerError)
+	commit, commitMessage := strings.TrimSpace(form.value("commit")), strings.TrimSpace(form.value("commit_message"))
+	if len(commit) > maxCommitLength || len(commitMessage) > maxCommitMessageLength {
+		http.Error(w, fmt.Sprintf("commit and commit_message may be at most %d and %d characters", maxCommitLength, maxCommitMessageLength), http.StatusBadRequest)
+		return
+	}
+
+	archive, err := os.Open(uploadPath)
+	if err != nil {
+		http.Error(w, "Cannot read upload", http.StatusInternalServerError)
+		return
+	}
+	defer archive.Close()
+
+	format, err := sniffArchive(archive)
+	if err != nil {
+		http.Error(w, "Invalid archive: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateArchive(archive, form.size, format); err != nil {
+		http.Error(w, "Invalid archive: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isDryRun(r, form) {
+		handleDryRun(w, uploadPath, format, filepath.Join(s.cfg.StagingDir, projectID+".dryrun"))
 		return
 	}
 
 	// Extract project
-	projectPath := filepath.Join(projectsDir, projectID)
+	projectPath := filepath.Join(s.cfg.ProjectsDir, projectID)
 	if err := os.MkdirAll(projectPath, 0755); err != nil {
 		http.Error(w, "Cannot create project directory", http.StatusInternalServerError)
 		return
 	}
 
-	if err := unzipFile(uploadPath, projectPath); err != nil {
-		http.Error(w, "Cannot extract zip: "+err.Error(), http.StatusInternalServerError)
+	if err := extractArchive(uploadPath, projectPath, format); err != nil {
+		os.RemoveAll(projectPath)
+		http.Error(w, "Cannot extract archive: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := checkProjectRoot(projectPath, rootDir); err != nil {
+		os.RemoveAll(projectPath)
+		http.Error(w, "Invalid root_dir: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if preset == "" {
+		preset = detectPreset(projectRoot(projectPath, rootDir))
+	}
+
+	headerRules, redirectRules, buildConfig, err := loadSiteFiles(projectRoot(projectPath, rootDir))
+	if err != nil {
+		os.RemoveAll(projectPath)
+		http.Error(w, "Invalid "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		os.RemoveAll(projectPath)
+		http.Error(w, "Cannot store upload", http.StatusInternalServerError)
+		return
+	}
+	if err := s.storage.Put(uploadKey(projectID, format), archive); err != nil {
+		log.Printf("project %s: cannot store upload: %v", projectID, err)
+		os.RemoveAll(projectPath)
+		http.Error(w, "Cannot store upload", http.StatusInternalServerError)
 		return
 	}
 
 	// Save project to database
-	subdomain := fmt.Sprintf("%s.grape.ai", projectID)
-	_, err = db.Exec(`
-		INSERT INTO projects (id, user_id, name, status, subdomain, created_at) 
-		VALUES (?, ?, ?, 'queued', ?, ?)
-	`, projectID, userID, name, subdomain, time.Now().Unix())
+	_, err = s.db.Exec(`
+		INSERT INTO projects (id, user_id, name, status, subdomain, created_at, health_check_path, url_preset, root_dir, header_rules, redirect_rules, build_config, build_timeout, force_https, idempotency_key, idempotency_expires_at, org_id) 
+		VALUES (?, ?, ?, 'queued', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, projectID, userID, name, subdomain, time.Now().Unix(), healthPath, preset, rootDir, headerRules, redirectRules, buildConfig, int(buildTimeout.Seconds()), forceHTTPS,
+		nullableKey(idempotencyKey), time.Now().Add(idempotencyTTL).Unix(), sql.NullInt64{Int64: int64(orgID), Valid: orgID != 0})
 	
 	if err != nil {
+		os.RemoveAll(projectPath)
+		s.storage.Delete(uploadKey(projectID, format))
+		// A concurrent upload with the same key got there first
+		if isIdempotencyConflict(err) {
+			if project, err := s.idempotentProject(userID, idempotencyKey); err == nil {
+				writeIdempotentReplay(w, project)
+				return
+			}
+		}
+		if strings.Contains(err.Error(), "UNIQUE constraint failed: projects.subdomain") {
+			http.Error(w, "Subdomain "+subdomain+" is already taken", http.StatusConflict)
+			return
+		}
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 
 	// Start build process
-	go runBuild(projectID, projectPath)
+	uploadsReceived.Inc()
+	s.publishStatus(projectID, userID, "queued")
+	src.UserID, src.Size, src.Format = userID, form.size, format
+	src.Commit, src.CommitMessage = commit, commitMessage
+	s.startBuild(projectID, projectPath, src)
 
 	project := Project{
-		ID:        projectID,
-		UserID:    userID,
-		Name:      name,
-		Status:    "queued",
-		Subdomain: subdomain,
-		CreatedAt: time.Now().Unix(),
+		ID:         projectID,
+		UserID:     userID,
+		Name:       name,
+		Status:     "queued",
+		Subdomain:  subdomain,
+		CreatedAt:  time.Now().Unix(),
+		Preset:     preset,
+		ForceHTTPS: forceHTTPS,
+		OrgID:      orgID,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(project)
 }
 
-func handleProjects(w http.ResponseWriter, r *http.Request) {
+// handleProjects lists the projects the user can see, a page at a time; see
+// projectListQuery. Build logs are left out, GET /api/projects/{id} has them.
+func (s *Server) handleProjects(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("userID").(int)
-	
-	rows, err := db.Query(`
-		SELECT id, name, status, subdomain, created_at, build_log 
-		FROM projects WHERE user_id = ? ORDER BY created_at DESC
-	`, userID)
+
+	query, err := parseProjectListQuery(r.URL.Query())
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusBadRequest, "invalid_query", err.Error())
 		return
 	}
-	defer rows.Close()
 
-	var projects []Project
-	for rows.Next() {
-		var p Project
-		err := rows.Scan(&p.ID, &p.Name, &p.Status, &p.Subdomain, &p.CreatedAt, &p.BuildLog)
+	projects, ok := s.projectsCache.get(userID)
+	if !ok {
+		rows, err := s.db.Query(`
+			SELECT id, user_id, name, description, status, subdomain, created_at, url_preset, root_dir, keep_deployments, require_approval, pending_deployment, force_https, paused_at != 0, COALESCE(org_id, 0)
+			FROM projects WHERE `+visibleProjects+` ORDER BY created_at DESC
+		`, userID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var p Project
+			err := rows.Scan(&p.ID, &p.UserID, &p.Name, &p.Description, &p.Status, &p.Subdomain, &p.CreatedAt, &p.Preset, &p.RootDir, &p.KeepDeployments, &p.RequireApproval, &p.PendingDeployment, &p.ForceHTTPS, &p.Paused, &p.OrgID)
+			if err != nil {
+				continue
+			}
+			projects = append(projects, p)
+		}
+		tags, err := s.visibleProjectTags(userID)
 		if err != nil {
-			continue
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
 		}
-		p.UserID = userID
-		projects = append(projects, p)
+		for i := range projects {
+			projects[i].Tags = tags[projects[i].ID]
+		}
+		s.projectsCache.set(userID, projects)
 	}
 
+	page, total := query.apply(projects)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(projects)
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	json.NewEncoder(w).Encode(page)
 }
 
-func handleProjectStatus(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	projectID := vars["id"]
-	userID := r.Context().Value("userID").(int)
+func (s *Server) handleProjectStatus(w http.ResponseWriter, r *http.Request) {
+	projectID, userID, ok := s.authorizeProject(w, r, roleViewer)
+	if !ok {
+		return
+	}
+	role, _ := s.projectRole(projectID, userID)
 
-	var project Project
-	err := db.QueryRow(`
-		SELECT id, name, status, subdomain, created_at, build_log 
-		FROM projects WHERE id = ? AND user_id = ?
-	`, projectID, userID).Scan(&project.ID, &project.Name, &project.Status, &project.Subdomain, &project.CreatedAt, &project.BuildLog)
-	
+	project, err := s.loadProject(projectID)
 	if err != nil {
 		http.Error(w, "Project not found", http.StatusNotFound)
 		return
 	}
+	project.Role = role.String()
 
-	project.UserID = userID
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(project)
 }
 
-func unzipFile(src, dest string) error {
-	r, err := zip.OpenReader(src)
+func (s *Server) loadProject(projectID string) (Project, error) {
+	var project Project
+	err := s.db.QueryRow(`
+		SELECT id, user_id, name, description, status, subdomain, created_at, build_log, build_stage, url_preset, root_dir, keep_deployments, require_approval, pending_deployment, force_https, paused_at != 0, COALESCE(org_id, 0)
+		FROM projects WHERE id = ?
+	`, projectID).Scan(&project.ID, &project.UserID, &project.Name, &project.Description, &project.Status, &project.Subdomain, &project.CreatedAt,
+		&project.BuildLog, &project.BuildStage, &project.Preset, &project.RootDir, &project.KeepDeployments, &project.RequireApproval, &project.PendingDeployment, &project.ForceHTTPS, &project.Paused, &project.OrgID)
 	if err != nil {
-		return err
+		return project, err
 	}
-	defer r.Close()
-
-	for _, f := range r.File {
-		fpath := filepath.Join(dest, f.Name)
-		if !strings.HasPrefix(fpath, filepath.Clean(dest)+string(os.PathSeparator)) {
-			return fmt.Errorf("invalid file path: %s", f.Name)
-		}
+	project.Tags, err = s.projectTags(projectID)
+	if err != nil {
+		return project, err
+	}
+	usage, err := s.projectStorageUsage(projectID)
+	project.Storage = &usage
+	return project, err
+}
 
-		if f.FileInfo().IsDir() {
-			os.MkdirAll(fpath, 0755)
-			continue
+func (s *Server) runBuild(ctx context.Context, projectID, projectPath, deploymentID string) {
+	var (
+		userID              int
+		healthPath, rootDir string
+		timeoutSecs         int
+	)
+	s.db.QueryRow("SELECT user_id, health_check_path, root_dir, build_timeout FROM projects WHERE id = ?", projectID).
+		Scan(&userID, &healthPath, &rootDir, &timeoutSecs)
+
+	// Wait for a free build slot
+	err := s.buildSlots.acquire(ctx)
+	s.counters.QueuedBuilds.Add(-1)
+	if err != nil {
+		if ok, _ := s.updateProjectStatusLog(projectID, "queued", "cancelled", "Error: build cancelled before it started"); ok {
+			s.publishStatus(projectID, userID, "cancelled")
 		}
+		return
+	}
+	defer s.buildSlots.release()
 
-		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
-			return err
-		}
+	timeout := time.Duration(timeoutSecs) * time.Second
+	if timeout <= 0 {
+		timeout = defaultBuildTimeout
+	}
 
-		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+	// Update status to building, unless the project moved on while queued
+	if ok, err := s.updateProjectStatus(projectID, "queued", "building"); !ok {
 		if err != nil {
-			return err
+			log.Printf("project %s: cannot mark building: %v", projectID, err)
 		}
-
-		rc, err := f.Open()
-		if err != nil {
-			outFile.Close()
-			return err
+		return
+	}
+	s.publishStatus(projectID, userID, "building")
+	setStage := func(stage string) {
+		if _, err := s.execWithRetry("UPDATE projects SET build_stage = ? WHERE id = ?", stage, projectID); err != nil {
+			log.Printf("project %s: cannot record build stage: %v", projectID, err)
 		}
+	}
+	setStage("")
 
-		_, err = io.Copy(outFile, rc)
-		outFile.Close()
-		rc.Close()
+	s.counters.ActiveBuilds.Add(1)
+	defer s.counters.ActiveBuilds.Add(-1)
+	buildsStarted.Inc()
+	started := time.Now()
 
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
+	// Build into a staging directory so the live version is untouched until promotion
+	stagePath := filepath.Join(s.cfg.StagingDir, projectID)
+	os.RemoveAll(stagePath)
 
-func runBuild(projectID, projectPath string) {
-	// Update status to building
-	db.Exec("UPDATE projects SET status = 'building' WHERE id = ?", projectID)
+	if err := s.restoreSource(projectID, projectPath); err != nil {
+		s.updateProjectStatusLog(projectID, "building", "failed", fmt.Sprintf("Error: project source unavailable: %v", err))
+		s.publishStatus(projectID, userID, "failed")
+		buildsFinished.WithLabelValues("failed").Inc()
+		return
+	}
+	if err := checkProjectRoot(projectPath, rootDir); err != nil {
+		s.updateProjectStatusLog(projectID, "building", "failed", fmt.Sprintf("Error: %v", err))
+		s.publishStatus(projectID, userID, "failed")
+		buildsFinished.WithLabelValues("failed").Inc()
+		return
+	}
+	s.recordSourceSize(projectID, projectPath)
 
-	deployPath := filepath.Join(deployDir, projectID)
-	os.MkdirAll(deployPath, 0755)
+	envVars, err := s.projectEnv(projectID)
+	if err != nil {
+		log.Printf("project %s: cannot load environment: %v", projectID, err)
+	}
 
-	// Call Python worker
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	// Call Python worker, retrying failures that look transient
+	buildCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	pythonExec := "python3"
-	if runtime.GOOS == "windows" {
-		pythonExec = "python"
+	var buildLog string
+	backoff := buildRetryBackoff
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			buildLog += fmt.Sprintf("\n--- retry %d of %d ---\n", attempt, buildRetries)
+		}
+
+		var output string
+		output, err = s.runner.Run(buildCtx, projectRoot(projectPath, rootDir), stagePath, timeout, append(buildEnv(envVars), s.buildConfigEnv(projectID)...), setStage)
+		buildLog += output
+		if err == nil || attempt >= buildRetries || buildCtx.Err() != nil || !isTransientFailure(err, output) {
+			break
+		}
+
+		buildLog += fmt.Sprintf("\nTransient failure (%v), retrying in %s", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-buildCtx.Done():
+		}
+		backoff *= 2
 	}
 
-	cmd := exec.CommandContext(ctx, pythonExec, pythonWorker, projectPath, deployPath)
-	output, err := cmd.CombinedOutput()
-	
-	buildLog := string(output)
 	status := "live"
 	if err != nil {
 		status = "failed"
-		buildLog += fmt.Sprintf("\nError: %v", err)
+		switch {
+		case ctx.Err() != nil:
+			status = "cancelled"
+			buildLog += "\nError: build cancelled"
+		case buildCtx.Err() == context.DeadlineExceeded:
+			buildLog += fmt.Sprintf("\nError: build timed out after %ds", int(timeout.Seconds()))
+		default:
+			buildLog += fmt.Sprintf("\nError: %v", err)
+		}
 	}
 
-	// Update project status and build log
-	db.Exec("UPDATE projects SET status = ?, build_log = ? WHERE id = ?", status, buildLog, projectID)
+	if status == "live" {
+		setStage("postbuild")
+		if output, _ := s.runPostBuildSteps(projectID, stagePath, enabledPostBuildSteps()); output != "" {
+			buildLog += output
+		}
+	}
+
+	if status == "live" {
+		if err := checkProjectSize("build output", dirSize(stagePath)); err != nil {
+			status = "failed"
+			buildLog += fmt.Sprintf("\nError: %v", err)
+		}
+	}
+
+	if status == "live" && healthPath != "" {
+		setStage("healthcheck")
+		if err := checkDeployHealth(stagePath, healthPath, s.loadSiteConfig(projectID)); err != nil {
+			status = "failed"
+			buildLog += fmt.Sprintf("\nfailed: health check failed: %v", err)
+		}
+	}
+
+	if status == "live" {
+		setStage("promote")
+		if err := s.promoteDeploy(projectID, deploymentID); err != nil {
+			status = "failed"
+			buildLog += fmt.Sprintf("\nError: cannot promote deploy: %v", err)
+		} else {
+			if s.awaitingApproval(projectID, deploymentID) {
+				buildLog += "\nWaiting for approval before going live"
+			}
+			s.pruneDeployments(projectID, deploymentID)
+		}
+	}
+	os.RemoveAll(stagePath)
+
+	// Update project status and build log, never persisting secret values
+	buildLog = redactSecrets(buildLog, envVars)
+	ok, err := s.updateProjectStatusLog(projectID, "building", status, buildLog)
+	if err != nil {
+		log.Printf("project %s: cannot record build result: %v", projectID, err)
+		return
+	}
+	if !ok {
+		log.Printf("project %s: status changed during the build, dropping result %s", projectID, status)
+		return
+	}
+	s.recordHistory(projectID, "build", status, "")
+	s.publishStatus(projectID, userID, status)
+	s.notifyBuildFinished(projectID, userID, status, time.Since(started), buildLog)
+	buildsFinished.WithLabelValues(status).Inc()
+	buildDuration.Observe(time.Since(started).Seconds())
 }
 
 func main() {
-	initDB()
-	ensureDirs()
+	promote := flag.String("promote-admin", "", "grant the admin role to the user with this email and exit")
+	rotate := flag.Bool("rotate-jwt-key", false, "generate a new JWT signing key (GRAPE_JWT_ALG) and exit")
+	retire := flag.String("retire-jwt-key", "", "delete the JWT signing key with this kid and exit")
+	breachList := flag.String("build-breach-filter", "", "build GRAPE_PASSWORD_BREACH_FILTER from this HIBP SHA-1 password list and exit")
+	flag.Parse()
+
+	if *breachList != "" {
+		dst := envString("GRAPE_PASSWORD_BREACH_FILTER", "breached-passwords.bf")
+		n, err := buildBreachFilter(*breachList, dst)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("wrote %s with %d hashes\n", dst, n)
+		return
+	}
 
-	r := mux.NewRouter()
-	
-	// Auth routes
-	r.HandleFunc("/api/register", handleRegister).Methods("POST")
-	r.HandleFunc("/api/login", handleLogin).Methods("POST")
-	
-	// Protected routes
-	r.HandleFunc("/api/upload", authMiddleware(handleUpload)).Methods("POST")
-	r.HandleFunc("/api/projects", authMiddleware(handleProjects)).Methods("GET")
-	r.HandleFunc("/api/projects/{id}", authMiddleware(handleProjectStatus)).Methods("GET")
+	cfg := defaultConfig()
+	enforceConfig(cfg)
+	if *rotate {
+		kid, err := rotateSigningKey(cfg.KeysDir, newKeyAlg())
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("new signing key %s\n", kid)
+		return
+	}
+	if *retire != "" {
+		if err := retireSigningKey(cfg.KeysDir, *retire); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("retired signing key %s\n", *retire)
+		return
+	}
+	s := NewServer(cfg, openDB(cfg.DBPath), workerRunner{script: cfg.WorkerPath})
+	if *promote != "" {
+		if err := s.promoteAdmin(*promote); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s is now an admin\n", *promote)
+		return
+	}
+	s.recoverInterruptedBuilds()
+	s.failInterruptedExports()
+
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	s.registerGauges()
+	s.startAutoscaler(bgCtx)
+	go s.runFileCleanup(bgCtx)
+	go s.keys.watch(bgCtx, time.Minute)
+	go s.runGuestExpiry(bgCtx)
+	go s.runSchedules(bgCtx)
+	go s.runPreviewExpiry(bgCtx)
+
+	srv := &http.Server{Addr: ":8080", Handler: s.Handler()}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	fmt.Println("🍇 Grape.ai API running on :8080")
+	servers := []*http.Server{srv}
+	if acmeEnabled {
+		servers = append(servers, s.startACMEServers()...)
+	}
 
-	// Serve static files from deploy directory
-	r.PathPrefix("/deploy/").Handler(http.StripPrefix("/deploy/", http.FileServer(http.Dir(deployDir))))
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
 
-	fmt.Println("🍇 Grape.ai API running on :8080")
-	log.Fatal(http.ListenAndServe(":8080", corsMiddleware(r)))
-}
\ No newline at end of file
+	log.Println("Shutting down, waiting for in-flight builds...")
+	ctx, cancel := context.WithTimeout(context.Background(), envDuration("GRAPE_SHUTDOWN_GRACE", 2*time.Minute))
+	defer cancel()
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("HTTP shutdown: %v", err)
+		}
+	}
+	s.drainBuilds(ctx)
+	s.Close()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+type Profile struct {
+	ID           int         `json:"id"`
+	Email        string      `json:"email"`
+	Verified     bool        `json:"verified"`
+	IsAdmin      bool        `json:"is_admin"`
+	Tier         string      `json:"tier"`
+	TwoFactor    bool        `json:"two_factor"`
+	PendingEmail string      `json:"pending_email,omitempty"`
+	CreatedAt    int64       `json:"created_at"`
+	LastLogin    *LoginEvent `json:"last_login,omitempty"`
+}
+
+func (s *Server) loadProfile(userID int) (Profile, error) {
+	var p Profile
+	err := s.db.QueryRow(`
+		SELECT id, email, verified, is_admin, tier, totp_enabled, created_at FROM users WHERE id = ?
+	`, userID).Scan(&p.ID, &p.Email, &p.Verified, &p.IsAdmin, &p.Tier, &p.TwoFactor, &p.CreatedAt)
+	if err != nil {
+		return p, err
+	}
+	// The address waiting to be confirmed, if a change is in progress
+	s.db.QueryRow(`
+		SELECT email FROM email_verifications WHERE user_id = ? AND email != '' AND expires_at > ?
+		ORDER BY expires_at DESC LIMIT 1
+	`, userID, time.Now().Unix()).Scan(&p.PendingEmail)
+	p.LastLogin = s.lastLogin(userID)
+	return p, nil
+}
+
+// validEmail accepts a bare address such as ada@example.com.
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+func (s *Server) handleGetMe(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	profile, err := s.loadProfile(userID)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "user_not_found", "User not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+// handleUpdateMe changes the caller's email address and/or password; both
+// need the current password. A new address only replaces the old one once
+// the link mailed to it is opened, and needs a two-factor code if that is on.
+// A new password signs out every other session and returns fresh tokens.
+func (s *Server) handleUpdateMe(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	var req struct {
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+		OTP             string  `json:"otp"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	if req.Email == nil && req.Password == nil {
+		writeJSONError(w, http.StatusBadRequest, "nothing_to_update", "Set email and/or password")
+		return
+	}
+
+	var email, hash string
+	if err := s.db.QueryRow("SELECT email, password FROM users WHERE id = ?", userID).Scan(&email, &hash); err != nil {
+		writeJSONError(w, http.StatusNotFound, "user_not_found", "User not found")
+		return
+	}
+	if !checkPassword(req.CurrentPassword, hash) {
+		writeJSONError(w, http.StatusForbidden, "wrong_password", "Current password is incorrect")
+		return
+	}
+
+	var newEmail string
+	if req.Email != nil {
+		newEmail = strings.TrimSpace(*req.Email)
+		if !validEmail(newEmail) {
+			writeJSONError(w, http.StatusBadRequest, "invalid_email", "Enter a valid email address")
+			return
+		}
+		if strings.EqualFold(newEmail, email) {
+			writeJSONError(w, http.StatusBadRequest, "email_unchanged", "That is already your email address")
+			return
+		}
+		var taken int
+		s.db.QueryRow("SELECT COUNT(*) FROM users WHERE email = ?", newEmail).Scan(&taken)
+		if taken > 0 {
+			writeJSONError(w, http.StatusConflict, "email_taken", "Email already exists")
+			return
+		}
+	}
+	if req.Password != nil {
+		if perr := s.checkPasswordStrength(*req.Password); perr != nil {
+			writeJSONError(w, http.StatusBadRequest, perr.Code, perr.Message)
+			return
+		}
+	}
+	if newEmail != "" && !s.requireSecondFactor(w, userID, req.OTP) {
+		return
+	}
+
+	resp := map[string]interface{}{}
+	if req.Password != nil {
+		if err := s.setPassword(userID, *req.Password, true); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+			return
+		}
+		sessionID, _ := r.Context().Value("sessionID").(string)
+		tokens, err := s.issueTokens(r, userID, sessionID)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "Error generating token")
+			return
+		}
+		resp["token"] = tokens.Token
+		resp["refresh_token"] = tokens.RefreshToken
+		resp["expires_in"] = tokens.ExpiresIn
+	}
+
+	if newEmail != "" {
+		// Only the latest requested address can be confirmed
+		if _, err := s.db.Exec("DELETE FROM email_verifications WHERE user_id = ? AND email != ''", userID); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+			return
+		}
+		link, err := s.verificationLink(userID, newEmail)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+			return
+		}
+		if err := s.mailer.Send(newEmail, "Confirm your new Grape.ai email address",
+			fmt.Sprintf("Open this link to use this address for your Grape.ai account:\n\n%s\n\nThe link expires in %s.", link, verifyTokenTTL)); err != nil {
+			log.Printf("user %d: cannot send email change confirmation: %v", userID, err)
+		}
+		if err := s.mailer.Send(email, "Your Grape.ai email address is changing",
+			fmt.Sprintf("Someone asked to change your Grape.ai account's email address to %s. If that wasn't you, change your password now.", newEmail)); err != nil {
+			log.Printf("user %d: cannot send email change notice: %v", userID, err)
+		}
+	}
+
+	profile, err := s.loadProfile(userID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	resp["user"] = profile
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestChangeEmailNeedsConfirmation(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery")
+	ts.signUp(t, "bob@example.com", "correct horse battery")
+
+	var me Profile
+	if resp := ts.do(t, "GET", "/api/me", token, nil, "", &me); resp.StatusCode != http.StatusOK {
+		t.Fatalf("get me: status %d", resp.StatusCode)
+	}
+	if me.Email != "ada@example.com" || !me.Verified || me.Tier != "free" {
+		t.Fatalf("me = %+v", me)
+	}
+
+	patch := func(body map[string]string, out interface{}) *http.Response {
+		return ts.do(t, "PATCH", "/api/me", token, jsonBody(body), "application/json", out)
+	}
+	if resp := patch(map[string]string{"email": "ada@new.example.com", "current_password": "wrong"}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("wrong password: status %d, want 403", resp.StatusCode)
+	}
+	if resp := patch(map[string]string{"email": "bob@example.com", "current_password": "correct horse battery"}, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("taken address: status %d, want 409", resp.StatusCode)
+	}
+	if resp := patch(map[string]string{"email": "not an address", "current_password": "correct horse battery"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid address: status %d, want 400", resp.StatusCode)
+	}
+
+	sent := len(ts.mailer.sent)
+	var updated struct{ User Profile }
+	if resp := patch(map[string]string{"email": "ada@new.example.com", "current_password": "correct horse battery"}, &updated); resp.StatusCode != http.StatusOK {
+		t.Fatalf("change email: status %d", resp.StatusCode)
+	}
+	if updated.User.Email != "ada@example.com" || updated.User.PendingEmail != "ada@new.example.com" {
+		t.Fatalf("before confirming: %+v", updated.User)
+	}
+
+	var link string
+	for _, body := range ts.mailer.sent[sent:] {
+		if l := verifyLink.FindString(body); l != "" {
+			link = l
+		}
+	}
+	if link == "" || len(ts.mailer.sent)-sent != 2 {
+		t.Fatalf("mails sent: %q", ts.mailer.sent[sent:])
+	}
+	if resp := ts.do(t, "GET", link, "", nil, "", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("confirm: status %d", resp.StatusCode)
+	}
+
+	ts.do(t, "GET", "/api/me", token, nil, "", &me)
+	if me.Email != "ada@new.example.com" || me.PendingEmail != "" {
+		t.Errorf("after confirming: %+v", me)
+	}
+	ts.login(t, "ada@new.example.com", "correct horse battery")
+	if resp := ts.postJSON(t, "/api/login", "", map[string]string{"email": "ada@example.com", "password": "correct horse battery"}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("login with the old address: status %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestChangePasswordViaMe(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery")
+	other := ts.login(t, "ada@example.com", "correct horse battery")
+
+	if resp := ts.do(t, "PATCH", "/api/me", token, jsonBody(map[string]string{"password": "short", "current_password": "correct horse battery"}), "application/json", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("weak password: status %d, want 400", resp.StatusCode)
+	}
+
+	var updated struct {
+		Token string
+		User  Profile
+	}
+	body := jsonBody(map[string]string{"password": "new horse battery 2", "current_password": "correct horse battery"})
+	if resp := ts.do(t, "PATCH", "/api/me", token, body, "application/json", &updated); resp.StatusCode != http.StatusOK {
+		t.Fatalf("change password: status %d", resp.StatusCode)
+	}
+	if updated.Token == "" || !strings.EqualFold(updated.User.Email, "ada@example.com") {
+		t.Fatalf("response %+v", updated)
+	}
+	if resp := ts.do(t, "GET", "/api/me", other.Token, nil, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("other session after the change: status %d, want 401", resp.StatusCode)
+	}
+	if resp := ts.do(t, "GET", "/api/me", updated.Token, nil, "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("new token: status %d", resp.StatusCode)
+	}
+	ts.login(t, "ada@example.com", "new horse battery 2")
+}
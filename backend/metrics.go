@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	uploadsReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "grape_uploads_received_total",
+		Help: "Project archives accepted by /api/upload.",
+	})
+	buildsStarted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "grape_builds_started_total",
+		Help: "Builds that acquired a build slot and started running.",
+	})
+	buildsFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grape_builds_finished_total",
+		Help: "Finished builds by resulting project status.",
+	}, []string{"status"})
+	buildDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "grape_build_duration_seconds",
+		Help:    "Wall-clock time from a build starting to its result being recorded.",
+		Buckets: prometheus.ExponentialBuckets(5, 2, 9), // 5s .. ~21m
+	})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grape_http_request_duration_seconds",
+		Help:    "HTTP request latency by route template and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+)
+
+// registerGauges exports the server's build gauges. Only the process's own
+// server registers them; the registry is global, so tests' servers don't.
+func (s *Server) registerGauges() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "grape_builds_in_flight",
+		Help: "Builds currently running.",
+	}, func() float64 { return float64(s.counters.ActiveBuilds.Load()) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "grape_builds_queued",
+		Help: "Builds waiting for a free build slot.",
+	}, func() float64 { return float64(s.counters.QueuedBuilds.Load()) })
+}
+
+// statusRecorder captures the response code while still letting streaming
+// handlers flush.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// metricsMiddleware records latency per route template rather than raw path
+// so project IDs don't explode label cardinality.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		httpDuration.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Observe(time.Since(start).Seconds())
+	})
+}
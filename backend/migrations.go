@@ -0,0 +1,690 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+func execMigration(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumn is a no-op if the column already exists, so databases that picked
+// up columns before migrations were tracked can still be brought forward.
+func addColumn(table, column, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				cid, notNull, pk int
+				name, colType    string
+				dflt             sql.NullString
+			)
+			if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+				return err
+			}
+			if name == column {
+				return nil
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+		return err
+	}
+}
+
+// Append only: never edit or reorder a migration that has shipped.
+var migrations = []migration{
+	{1, "create users and projects", execMigration(`
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			email TEXT UNIQUE NOT NULL,
+			password TEXT NOT NULL,
+			created_at INTEGER DEFAULT (strftime('%s', 'now'))
+		)`, `
+		CREATE TABLE IF NOT EXISTS projects (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			status TEXT DEFAULT 'queued',
+			subdomain TEXT NOT NULL,
+			build_log TEXT DEFAULT '',
+			created_at INTEGER DEFAULT (strftime('%s', 'now')),
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		)`,
+	)},
+	{2, "add projects.health_check_path", addColumn("projects", "health_check_path", "TEXT DEFAULT ''")},
+	{3, "add users.tier", addColumn("users", "tier", "TEXT DEFAULT 'free'")},
+	{4, "add email verification", func(tx *sql.Tx) error {
+		// Accounts that predate verification are treated as verified
+		if err := addColumn("users", "verified", "INTEGER NOT NULL DEFAULT 1")(tx); err != nil {
+			return err
+		}
+		return execMigration(`
+			CREATE TABLE IF NOT EXISTS email_verifications (
+				token_hash TEXT PRIMARY KEY,
+				user_id INTEGER NOT NULL,
+				expires_at INTEGER NOT NULL,
+				FOREIGN KEY (user_id) REFERENCES users (id)
+			)`,
+		)(tx)
+	}},
+	{5, "add projects.url_preset", addColumn("projects", "url_preset", "TEXT DEFAULT 'static'")},
+	{6, "add projects.header_rules", addColumn("projects", "header_rules", "TEXT DEFAULT ''")},
+	{7, "add projects.build_timeout", addColumn("projects", "build_timeout", "INTEGER DEFAULT 0")},
+	{8, "add projects.force_https", addColumn("projects", "force_https", "INTEGER NOT NULL DEFAULT 0")},
+	{9, "add post-build results and project history", execMigration(`
+		CREATE TABLE postbuild_results (
+			project_id TEXT NOT NULL,
+			step TEXT NOT NULL,
+			status TEXT NOT NULL,
+			output TEXT DEFAULT '',
+			updated_at INTEGER NOT NULL,
+			PRIMARY KEY (project_id, step),
+			FOREIGN KEY (project_id) REFERENCES projects (id)
+		)`, `
+		CREATE TABLE project_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			project_id TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			status TEXT NOT NULL,
+			detail TEXT DEFAULT '',
+			created_at INTEGER NOT NULL,
+			FOREIGN KEY (project_id) REFERENCES projects (id)
+		)`, `
+		CREATE INDEX idx_project_history_project ON project_history (project_id, created_at)`,
+	)},
+	{10, "make projects.subdomain unique", execMigration(
+		`CREATE UNIQUE INDEX idx_projects_subdomain ON projects (subdomain)`,
+	)},
+	{11, "add users.token_version", addColumn("users", "token_version", "INTEGER NOT NULL DEFAULT 0")},
+	{12, "add project environment variables", execMigration(`
+		CREATE TABLE project_env (
+			project_id TEXT NOT NULL,
+			key TEXT NOT NULL,
+			value TEXT NOT NULL,
+			updated_at INTEGER NOT NULL,
+			PRIMARY KEY (project_id, key),
+			FOREIGN KEY (project_id) REFERENCES projects (id)
+		)`,
+	)},
+	{13, "add users.is_admin", addColumn("users", "is_admin", "INTEGER NOT NULL DEFAULT 0")},
+	{14, "add build webhooks", func(tx *sql.Tx) error {
+		if err := addColumn("projects", "webhook_url", "TEXT NOT NULL DEFAULT ''")(tx); err != nil {
+			return err
+		}
+		return addColumn("users", "webhook_secret", "TEXT NOT NULL DEFAULT ''")(tx)
+	}},
+	{15, "add api keys", execMigration(`
+		CREATE TABLE api_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			prefix TEXT NOT NULL,
+			key_hash TEXT UNIQUE NOT NULL,
+			created_at INTEGER NOT NULL,
+			last_used_at INTEGER,
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		)`,
+	)},
+	{16, "add projects.build_stage", addColumn("projects", "build_stage", "TEXT NOT NULL DEFAULT ''")},
+	{17, "add upload idempotency keys", func(tx *sql.Tx) error {
+		if err := addColumn("projects", "idempotency_key", "TEXT")(tx); err != nil {
+			return err
+		}
+		if err := addColumn("projects", "idempotency_expires_at", "INTEGER NOT NULL DEFAULT 0")(tx); err != nil {
+			return err
+		}
+		return execMigration(`CREATE UNIQUE INDEX idx_projects_idempotency ON projects (user_id, idempotency_key)`)(tx)
+	}},
+	{18, "add refresh tokens", execMigration(`
+		CREATE TABLE refresh_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			token_hash TEXT UNIQUE NOT NULL,
+			family TEXT NOT NULL,
+			token_version INTEGER NOT NULL,
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL,
+			revoked_at INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		)`, `
+		CREATE INDEX idx_refresh_tokens_family ON refresh_tokens (family)`,
+	)},
+	// Keys created before scopes existed keep full access
+	{19, "add api_keys.scopes", addColumn("api_keys", "scopes", "TEXT NOT NULL DEFAULT 'projects:read projects:write deploy:write'")},
+	{20, "add password resets", execMigration(`
+		CREATE TABLE password_resets (
+			token_hash TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		)`,
+	)},
+	{21, "add two-factor authentication", func(tx *sql.Tx) error {
+		for _, col := range [][2]string{
+			{"totp_secret", "TEXT NOT NULL DEFAULT ''"},
+			{"totp_enabled", "INTEGER NOT NULL DEFAULT 0"},
+			{"totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+		} {
+			if err := addColumn("users", col[0], col[1])(tx); err != nil {
+				return err
+			}
+		}
+		return execMigration(`
+			CREATE TABLE recovery_codes (
+				user_id INTEGER NOT NULL,
+				code_hash TEXT NOT NULL,
+				PRIMARY KEY (user_id, code_hash),
+				FOREIGN KEY (user_id) REFERENCES users (id)
+			)`,
+		)(tx)
+	}},
+	{22, "add organizations", func(tx *sql.Tx) error {
+		if err := execMigration(`
+			CREATE TABLE orgs (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL,
+				created_at INTEGER NOT NULL
+			)`, `
+			CREATE TABLE org_members (
+				org_id INTEGER NOT NULL,
+				user_id INTEGER NOT NULL,
+				role TEXT NOT NULL,
+				created_at INTEGER NOT NULL,
+				PRIMARY KEY (org_id, user_id),
+				FOREIGN KEY (org_id) REFERENCES orgs (id),
+				FOREIGN KEY (user_id) REFERENCES users (id)
+			)`, `
+			CREATE INDEX idx_org_members_user ON org_members (user_id)`,
+		)(tx); err != nil {
+			return err
+		}
+		if err := addColumn("projects", "org_id", "INTEGER REFERENCES orgs (id)")(tx); err != nil {
+			return err
+		}
+		return execMigration(`CREATE INDEX idx_projects_org ON projects (org_id)`)(tx)
+	}},
+	// project_access resolves everyone's access to a project: the uploader is
+	// an admin, org members can view, and explicit grants add to that.
+	{23, "add project roles", execMigration(`
+		CREATE TABLE project_members (
+			project_id TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			role TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			PRIMARY KEY (project_id, user_id),
+			FOREIGN KEY (project_id) REFERENCES projects (id),
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		)`, `
+		CREATE INDEX idx_project_members_user ON project_members (user_id)`, `
+		CREATE VIEW project_access AS
+			SELECT id AS project_id, user_id, 'admin' AS role FROM projects
+			UNION ALL
+			SELECT p.id, m.user_id, 'viewer' FROM projects p JOIN org_members m ON m.org_id = p.org_id
+			UNION ALL
+			SELECT project_id, user_id, role FROM project_members`,
+	)},
+	// A session is a refresh token family; its ID is the family.
+	{24, "add sessions", execMigration(`
+		CREATE TABLE sessions (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			user_agent TEXT NOT NULL DEFAULT '',
+			ip TEXT NOT NULL DEFAULT '',
+			token_version INTEGER NOT NULL,
+			created_at INTEGER NOT NULL,
+			last_used_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL,
+			revoked_at INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		)`, `
+		CREATE INDEX idx_sessions_user ON sessions (user_id)`,
+	)},
+	{25, "add file cleanup queue", execMigration(`
+		CREATE TABLE file_cleanup (
+			project_id TEXT PRIMARY KEY,
+			queued_at INTEGER NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0
+		)`,
+	)},
+	// Set when the link confirms a new address for an existing account
+	{26, "add email_verifications.email", addColumn("email_verifications", "email", "TEXT NOT NULL DEFAULT ''")},
+	{27, "add single sign-on", execMigration(`
+		CREATE TABLE sso_logins (
+			state_hash TEXT PRIMARY KEY,
+			provider TEXT NOT NULL,
+			nonce TEXT NOT NULL,
+			verifier TEXT NOT NULL,
+			expires_at INTEGER NOT NULL
+		)`, `
+		CREATE TABLE sso_identities (
+			provider TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			created_at INTEGER NOT NULL,
+			PRIMARY KEY (provider, subject),
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		)`, `
+		CREATE INDEX idx_sso_identities_user ON sso_identities (user_id)`,
+	)},
+	{28, "add magic links", execMigration(`
+		CREATE TABLE magic_links (
+			token_hash TEXT PRIMARY KEY,
+			email TEXT NOT NULL,
+			expires_at INTEGER NOT NULL
+		)`, `
+		CREATE INDEX idx_magic_links_email ON magic_links (email)`,
+	)},
+	{29, "add login history", execMigration(`
+		CREATE TABLE login_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL DEFAULT 0,
+			email TEXT NOT NULL,
+			method TEXT NOT NULL,
+			success INTEGER NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			ip TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			created_at INTEGER NOT NULL
+		)`, `
+		CREATE INDEX idx_login_events_user ON login_events (user_id, created_at)`,
+	)},
+	{30, "add login lockout", execMigration(`
+		CREATE INDEX idx_login_events_email ON login_events (email, id)`, `
+		CREATE INDEX idx_login_events_ip ON login_events (ip, created_at)`, `
+		ALTER TABLE users ADD COLUMN login_unlocked_at INTEGER NOT NULL DEFAULT 0`, `
+		CREATE TABLE account_unlocks (
+			token_hash TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		)`,
+	)},
+	{31, "add org invites", execMigration(`
+		CREATE TABLE org_invites (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			org_id INTEGER NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			email TEXT NOT NULL DEFAULT '',
+			role TEXT NOT NULL,
+			max_uses INTEGER NOT NULL DEFAULT 1,
+			uses INTEGER NOT NULL DEFAULT 0,
+			created_by INTEGER NOT NULL,
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL,
+			revoked_at INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (org_id) REFERENCES orgs (id)
+		)`, `
+		CREATE INDEX idx_org_invites_org ON org_invites (org_id)`,
+	)},
+	// Owners of an org administer the projects its service accounts deploy.
+	{32, "add service accounts", execMigration(`
+		CREATE TABLE service_accounts (
+			user_id INTEGER PRIMARY KEY,
+			org_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			created_by INTEGER NOT NULL,
+			created_at INTEGER NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users (id),
+			FOREIGN KEY (org_id) REFERENCES orgs (id)
+		)`, `
+		CREATE INDEX idx_service_accounts_org ON service_accounts (org_id)`, `
+		DROP VIEW project_access`, `
+		CREATE VIEW project_access AS
+			SELECT id AS project_id, user_id, 'admin' AS role FROM projects
+			UNION ALL
+			SELECT p.id, m.user_id, 'viewer' FROM projects p JOIN org_members m ON m.org_id = p.org_id
+			UNION ALL
+			SELECT project_id, user_id, role FROM project_members
+			UNION ALL
+			SELECT p.id, m.user_id, 'admin' FROM projects p
+			JOIN service_accounts sa ON sa.user_id = p.user_id
+			JOIN org_members m ON m.org_id = sa.org_id AND m.role = 'owner'`,
+	)},
+	{33, "add proof-of-work challenges", execMigration(`
+		CREATE TABLE pow_challenges (
+			challenge TEXT PRIMARY KEY,
+			difficulty INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL
+		)`,
+	)},
+	{34, "add revoked access tokens", execMigration(`
+		CREATE TABLE revoked_tokens (
+			jti TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL
+		)`,
+	)},
+	{35, "add known devices", execMigration(`
+		CREATE TABLE known_devices (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			fingerprint TEXT NOT NULL,
+			user_agent TEXT NOT NULL,
+			last_ip TEXT NOT NULL,
+			first_seen_at INTEGER NOT NULL,
+			last_seen_at INTEGER NOT NULL,
+			UNIQUE (user_id, fingerprint)
+		)`,
+	)},
+	{36, "add impersonation audit log", execMigration(`
+		CREATE TABLE impersonations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			admin_id INTEGER NOT NULL,
+			user_id INTEGER NOT NULL,
+			reason TEXT NOT NULL,
+			jti TEXT NOT NULL UNIQUE,
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL
+		)`, `
+		CREATE TABLE impersonation_requests (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			impersonation_id INTEGER NOT NULL,
+			method TEXT NOT NULL,
+			path TEXT NOT NULL,
+			created_at INTEGER NOT NULL
+		)`, `
+		CREATE INDEX idx_impersonation_requests ON impersonation_requests (impersonation_id)`,
+	)},
+	{37, "add guest accounts", func(tx *sql.Tx) error {
+		for _, col := range [][2]string{
+			{"guest_expires_at", "INTEGER NOT NULL DEFAULT 0"},
+			{"guest_claim_hash", "TEXT"},
+		} {
+			if err := addColumn("users", col[0], col[1])(tx); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec("CREATE UNIQUE INDEX idx_users_guest_claim ON users (guest_claim_hash)")
+		return err
+	}},
+	{38, "add per-account IP allowlists", func(tx *sql.Tx) error {
+		if err := addColumn("users", "ip_allowlist_mode", "TEXT NOT NULL DEFAULT 'writes'")(tx); err != nil {
+			return err
+		}
+		return execMigration(`
+			CREATE TABLE ip_allowlist (
+				user_id INTEGER NOT NULL,
+				cidr TEXT NOT NULL,
+				created_at INTEGER NOT NULL,
+				PRIMARY KEY (user_id, cidr)
+			)`,
+		)(tx)
+	}},
+	{39, "add data exports", execMigration(`
+		CREATE TABLE data_exports (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			size INTEGER NOT NULL DEFAULT 0,
+			token_hash TEXT NOT NULL DEFAULT '',
+			token_expires_at INTEGER NOT NULL DEFAULT 0,
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL
+		)`, `
+		CREATE INDEX idx_data_exports_user ON data_exports (user_id)`,
+	)},
+	{40, "add versioned deployments", func(tx *sql.Tx) error {
+		if err := addColumn("projects", "live_deployment", "TEXT NOT NULL DEFAULT ''")(tx); err != nil {
+			return err
+		}
+		return execMigration(`
+			CREATE TABLE deployments (
+				id TEXT PRIMARY KEY,
+				project_id TEXT NOT NULL,
+				size INTEGER NOT NULL DEFAULT 0,
+				created_at INTEGER NOT NULL
+			)`, `
+			CREATE INDEX idx_deployments_project ON deployments (project_id, created_at)`,
+		)(tx)
+	}},
+	{41, "record every build as a deployment", func(tx *sql.Tx) error {
+		for _, col := range [][2]string{
+			{"status", "TEXT NOT NULL DEFAULT 'succeeded'"},
+			{"trigger_type", "TEXT NOT NULL DEFAULT ''"},
+			{"triggered_by", "INTEGER NOT NULL DEFAULT 0"},
+			{"source_name", "TEXT NOT NULL DEFAULT ''"},
+			{"source_size", "INTEGER NOT NULL DEFAULT 0"},
+			{"source_format", "TEXT NOT NULL DEFAULT ''"},
+			{"commit_sha", "TEXT NOT NULL DEFAULT ''"},
+			{"commit_message", "TEXT NOT NULL DEFAULT ''"},
+			{"started_at", "INTEGER NOT NULL DEFAULT 0"},
+			{"finished_at", "INTEGER NOT NULL DEFAULT 0"},
+			{"build_log", "TEXT NOT NULL DEFAULT ''"},
+		} {
+			if err := addColumn("deployments", col[0], col[1])(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{42, "encrypt project environment variables", func(tx *sql.Tx) error {
+		for _, col := range [][2]string{
+			{"encrypted", "INTEGER NOT NULL DEFAULT 0"},
+			{"secret", "INTEGER NOT NULL DEFAULT 0"},
+		} {
+			if err := addColumn("project_env", col[0], col[1])(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{43, "add grape.yaml build config and redirects", func(tx *sql.Tx) error {
+		for _, col := range []string{"build_config", "redirect_rules"} {
+			if err := addColumn("projects", col, "TEXT NOT NULL DEFAULT ''")(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{44, "link projects to git repositories", func(tx *sql.Tx) error {
+		for _, col := range []string{"git_repo", "git_branch", "git_token", "git_webhook_secret"} {
+			if err := addColumn("projects", col, "TEXT NOT NULL DEFAULT ''")(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{45, "record the git provider of linked projects", addColumn("projects", "git_provider", "TEXT NOT NULL DEFAULT 'github'")},
+	{46, "add projects.description", addColumn("projects", "description", "TEXT NOT NULL DEFAULT ''")},
+	// Transfers stay after they are resolved as the project's ownership trail.
+	{47, "add project transfers", execMigration(`
+		CREATE TABLE project_transfers (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			project_id TEXT NOT NULL,
+			from_user INTEGER NOT NULL,
+			from_org INTEGER NOT NULL DEFAULT 0,
+			to_user INTEGER NOT NULL DEFAULT 0,
+			to_org INTEGER NOT NULL DEFAULT 0,
+			status TEXT NOT NULL,
+			created_by INTEGER NOT NULL,
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL,
+			resolved_by INTEGER NOT NULL DEFAULT 0,
+			resolved_at INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (project_id) REFERENCES projects (id)
+		)`, `
+		CREATE INDEX idx_project_transfers_project ON project_transfers (project_id, created_at)`, `
+		CREATE INDEX idx_project_transfers_to_user ON project_transfers (to_user, status)`,
+	)},
+	{48, "add projects.paused_at", addColumn("projects", "paused_at", "INTEGER NOT NULL DEFAULT 0")},
+	// Slugs a project gave up, answered with redirects to its new one
+	{49, "add subdomain redirects", execMigration(`
+		CREATE TABLE subdomain_redirects (
+			subdomain TEXT PRIMARY KEY,
+			project_id TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL,
+			FOREIGN KEY (project_id) REFERENCES projects (id)
+		)`, `
+		CREATE INDEX idx_subdomain_redirects_project ON subdomain_redirects (project_id)`,
+	)},
+	{50, "add project tags", execMigration(`
+		CREATE TABLE project_tags (
+			project_id TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (project_id, tag),
+			FOREIGN KEY (project_id) REFERENCES projects (id)
+		)`, `
+		CREATE INDEX idx_project_tags_tag ON project_tags (tag)`,
+	)},
+	// Named aliases of a project's deployments; a build started for an alias
+	// records it so it is promoted there instead of going live.
+	{51, "add deployment aliases", func(tx *sql.Tx) error {
+		if err := addColumn("deployments", "alias", "TEXT NOT NULL DEFAULT ''")(tx); err != nil {
+			return err
+		}
+		return execMigration(`
+			CREATE TABLE project_aliases (
+				project_id TEXT NOT NULL,
+				name TEXT NOT NULL,
+				deployment_id TEXT NOT NULL,
+				updated_by INTEGER NOT NULL,
+				updated_at INTEGER NOT NULL,
+				PRIMARY KEY (project_id, name),
+				FOREIGN KEY (project_id) REFERENCES projects (id)
+			)`,
+		)(tx)
+	}},
+	// Branch deploys: projects linked to Git may build every pushed branch
+	// into its own host; branch_deploys maps each branch to its latest build.
+	{52, "add branch deploys", func(tx *sql.Tx) error {
+		for _, col := range [][3]string{
+			{"projects", "git_branch_deploys", "INTEGER NOT NULL DEFAULT 0"},
+			{"deployments", "branch", "TEXT NOT NULL DEFAULT ''"},
+		} {
+			if err := addColumn(col[0], col[1], col[2])(tx); err != nil {
+				return err
+			}
+		}
+		return execMigration(`
+			CREATE TABLE branch_deploys (
+				project_id TEXT NOT NULL,
+				branch TEXT NOT NULL,
+				label TEXT NOT NULL,
+				deployment_id TEXT NOT NULL,
+				updated_at INTEGER NOT NULL,
+				PRIMARY KEY (project_id, branch),
+				UNIQUE (project_id, label),
+				FOREIGN KEY (project_id) REFERENCES projects (id)
+			)`,
+		)(tx)
+	}},
+	// Monorepos: the directory inside the source that is built and deployed
+	{53, "add projects.root_dir", addColumn("projects", "root_dir", "TEXT NOT NULL DEFAULT ''")},
+	// Deployment retention: how many successful builds a project keeps (0 for
+	// the server default)
+	{54, "add projects.keep_deployments", addColumn("projects", "keep_deployments", "INTEGER NOT NULL DEFAULT 0")},
+	// Scheduled rebuilds
+	{55, "add project schedules", execMigration(`
+		CREATE TABLE project_schedules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			project_id TEXT NOT NULL,
+			cron TEXT NOT NULL,
+			timezone TEXT NOT NULL DEFAULT 'UTC',
+			created_by INTEGER NOT NULL,
+			created_at INTEGER NOT NULL,
+			next_run_at INTEGER NOT NULL,
+			last_run_at INTEGER NOT NULL DEFAULT 0,
+			last_status TEXT NOT NULL DEFAULT '',
+			FOREIGN KEY (project_id) REFERENCES projects (id)
+		)`, `
+		CREATE INDEX idx_project_schedules_next_run ON project_schedules (next_run_at)`,
+	)},
+	// Approval gates: protected projects hold production builds in
+	// pending_deployment until an admin approves or rejects them.
+	{56, "add deployment approvals", func(tx *sql.Tx) error {
+		for _, col := range [][3]string{
+			{"projects", "require_approval", "INTEGER NOT NULL DEFAULT 0"},
+			{"projects", "pending_deployment", "TEXT NOT NULL DEFAULT ''"},
+			{"deployments", "approval", "TEXT NOT NULL DEFAULT ''"},
+			{"deployments", "reviewed_by", "INTEGER NOT NULL DEFAULT 0"},
+			{"deployments", "reviewed_at", "INTEGER NOT NULL DEFAULT 0"},
+		} {
+			if err := addColumn(col[0], col[1], col[2])(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	// Preview expiry
+	{57, "add deployments.expires_at", func(tx *sql.Tx) error {
+		if err := addColumn("deployments", "expires_at", "INTEGER NOT NULL DEFAULT 0")(tx); err != nil {
+			return err
+		}
+		return execMigration(`CREATE INDEX idx_deployments_expires ON deployments (expires_at)`)(tx)
+	}},
+	// Per-user project limit, overriding the tier's (0 for the tier's)
+	{58, "add users.max_projects", addColumn("users", "max_projects", "INTEGER NOT NULL DEFAULT 0")},
+	// Size of each project's source, measured at every build
+	{59, "add projects.source_bytes", addColumn("projects", "source_bytes", "INTEGER NOT NULL DEFAULT 0")},
+}
+
+// migrate applies every migration newer than the recorded schema version,
+// each in its own transaction. Any failure is fatal.
+func (s *Server) migrate() {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var current int
+	if err := s.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		tx, err := s.db.Begin()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := m.up(tx); err != nil {
+			tx.Rollback()
+			log.Fatalf("migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+			m.version, m.name, time.Now().Unix()); err != nil {
+			tx.Rollback()
+			log.Fatalf("migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			log.Fatalf("migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		log.Printf("Applied migration %d: %s", m.version, m.name)
+		current = m.version
+	}
+
+	log.Printf("Database schema at version %d", current)
+}
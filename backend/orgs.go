@@ -0,0 +1,289 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Organizations let several users share projects. A project uploaded into an
+// org stays owned by its uploader, who keeps full control; other members can
+// view it (see roles.go). Org owners manage membership.
+const (
+	orgRoleOwner  = "owner"
+	orgRoleMember = "member"
+)
+
+type Org struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Role      string `json:"role"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type OrgMember struct {
+	UserID   int    `json:"user_id"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+	JoinedAt int64  `json:"joined_at"`
+}
+
+// orgRole returns the user's role in the org, or "" if they are not a member.
+func (s *Server) orgRole(orgID, userID int) (string, error) {
+	var role string
+	err := s.db.QueryRow("SELECT role FROM org_members WHERE org_id = ? AND user_id = ?", orgID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// leaveOrgs removes the user from every org, deleting orgs left empty and
+// detaching their projects. Used when an account is deleted.
+func leaveOrgs(tx *sql.Tx, userID int) error {
+	if _, err := tx.Exec("DELETE FROM org_members WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		"UPDATE projects SET org_id = NULL WHERE org_id NOT IN (SELECT org_id FROM org_members)",
+		"DELETE FROM orgs WHERE id NOT IN (SELECT org_id FROM org_members)",
+		"DELETE FROM org_invites WHERE org_id NOT IN (SELECT id FROM orgs)",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleCreateOrg(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		http.Error(w, "Name must be 1-100 characters", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	res, err := tx.Exec("INSERT INTO orgs (name, created_at) VALUES (?, ?)", req.Name, now)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	orgID, _ := res.LastInsertId()
+	if _, err := tx.Exec("INSERT INTO org_members (org_id, user_id, role, created_at) VALUES (?, ?, ?, ?)",
+		orgID, userID, orgRoleOwner, now); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Org{ID: int(orgID), Name: req.Name, Role: orgRoleOwner, CreatedAt: now})
+}
+
+func (s *Server) handleListOrgs(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	rows, err := s.db.Query(`
+		SELECT o.id, o.name, m.role, o.created_at FROM orgs o JOIN org_members m ON m.org_id = o.id
+		WHERE m.user_id = ? ORDER BY o.name
+	`, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	orgs := []Org{}
+	for rows.Next() {
+		var o Org
+		if err := rows.Scan(&o.ID, &o.Name, &o.Role, &o.CreatedAt); err != nil {
+			continue
+		}
+		orgs = append(orgs, o)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orgs)
+}
+
+// orgFromRequest resolves the {id} route variable to an org the caller
+// belongs to, writing a 404 otherwise.
+func (s *Server) orgFromRequest(w http.ResponseWriter, r *http.Request) (orgID int, role string, ok bool) {
+	userID := r.Context().Value("userID").(int)
+	orgID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return 0, "", false
+	}
+	role, err = s.orgRole(orgID, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return 0, "", false
+	}
+	if role == "" {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return 0, "", false
+	}
+	return orgID, role, true
+}
+
+func (s *Server) handleListOrgMembers(w http.ResponseWriter, r *http.Request) {
+	orgID, _, ok := s.orgFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := s.db.Query(`
+		SELECT u.id, u.email, m.role, m.created_at FROM org_members m JOIN users u ON u.id = m.user_id
+		WHERE m.org_id = ? ORDER BY m.created_at
+	`, orgID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	members := []OrgMember{}
+	for rows.Next() {
+		var m OrgMember
+		if err := rows.Scan(&m.UserID, &m.Email, &m.Role, &m.JoinedAt); err != nil {
+			continue
+		}
+		members = append(members, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// handleAddOrgMember adds an existing user to the org, or changes the role of
+// one who is already a member. Owners only.
+func (s *Server) handleAddOrgMember(w http.ResponseWriter, r *http.Request) {
+	orgID, role, ok := s.orgFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if role != orgRoleOwner {
+		http.Error(w, "Only organization owners can manage members", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = orgRoleMember
+	}
+	if req.Role != orgRoleOwner && req.Role != orgRoleMember {
+		http.Error(w, "role must be owner or member", http.StatusBadRequest)
+		return
+	}
+
+	var memberID int
+	if err := s.db.QueryRow("SELECT id FROM users WHERE email = ?", req.Email).Scan(&memberID); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if _, err := s.db.Exec(`
+		INSERT INTO org_members (org_id, user_id, role, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (org_id, user_id) DO UPDATE SET role = excluded.role
+	`, orgID, memberID, req.Role, time.Now().Unix()); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.projectsCache.invalidate(memberID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(OrgMember{UserID: memberID, Email: req.Email, Role: req.Role})
+}
+
+// handleRemoveOrgMember removes a member. Owners can remove anyone and
+// members can remove themselves, but the last owner cannot leave.
+func (s *Server) handleRemoveOrgMember(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	orgID, role, ok := s.orgFromRequest(w, r)
+	if !ok {
+		return
+	}
+	memberID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	if role != orgRoleOwner && memberID != userID {
+		http.Error(w, "Only organization owners can manage members", http.StatusForbidden)
+		return
+	}
+	serviceOrg, err := s.serviceAccountOrg(memberID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if serviceOrg != 0 {
+		http.Error(w, "Delete the service account instead", http.StatusConflict)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM org_members WHERE org_id = ? AND user_id = ?", orgID, memberID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	var owners int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM org_members WHERE org_id = ? AND role = ?", orgID, orgRoleOwner).Scan(&owners); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if owners == 0 {
+		http.Error(w, "An organization needs at least one owner", http.StatusConflict)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.projectsCache.invalidate(memberID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"testing"
+)
+
+func (ts *testServer) uploadToOrg(t *testing.T, token string, orgID int) (Project, *http.Response) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("name", "shared")
+	mw.WriteField("org_id", fmt.Sprint(orgID))
+	part, _ := mw.CreateFormFile("project", "site.zip")
+	part.Write(siteZip(t))
+	mw.Close()
+
+	var project Project
+	resp := ts.do(t, "POST", "/api/upload", token, &body, mw.FormDataContentType(), &project)
+	return project, resp
+}
+
+func TestOrgProjectsAreSharedWithMembers(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	alice := ts.signUp(t, "alice@example.com", "correct horse battery")
+	bob := ts.signUp(t, "bob@example.com", "correct horse battery")
+	carol := ts.signUp(t, "carol@example.com", "correct horse battery")
+
+	var org Org
+	if resp := ts.postJSON(t, "/api/orgs", alice, map[string]string{"name": "Acme"}, &org); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create org: status %d", resp.StatusCode)
+	}
+	var bobMember OrgMember
+	if resp := ts.postJSON(t, fmt.Sprintf("/api/orgs/%d/members", org.ID), alice, map[string]string{"email": "bob@example.com"}, &bobMember); resp.StatusCode != http.StatusOK {
+		t.Fatalf("add member: status %d", resp.StatusCode)
+	}
+	if resp := ts.postJSON(t, fmt.Sprintf("/api/orgs/%d/members", org.ID), bob, map[string]string{"email": "carol@example.com"}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("member adding members: status %d, want 403", resp.StatusCode)
+	}
+
+	if _, resp := ts.uploadToOrg(t, carol, org.ID); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("non-member uploading to the org: status %d, want 403", resp.StatusCode)
+	}
+	project, resp := ts.uploadToOrg(t, alice, org.ID)
+	if resp.StatusCode != http.StatusOK || project.OrgID != org.ID {
+		t.Fatalf("org upload: status %d, project %+v", resp.StatusCode, project)
+	}
+	ts.waitForStatus(t, alice, project.ID)
+
+	var projects []Project
+	ts.do(t, "GET", "/api/projects", bob, nil, "", &projects)
+	if len(projects) != 1 || projects[0].ID != project.ID || projects[0].UserID == 0 {
+		t.Fatalf("bob's projects = %+v", projects)
+	}
+	if resp := ts.do(t, "GET", "/api/projects/"+project.ID+"/logs", bob, nil, "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("member reading logs: status %d", resp.StatusCode)
+	}
+	if resp := ts.do(t, "GET", "/api/projects/"+project.ID, carol, nil, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("non-member reading the project: status %d, want 404", resp.StatusCode)
+	}
+
+	if resp := ts.do(t, "DELETE", fmt.Sprintf("/api/orgs/%d/members/%d", org.ID, bobMember.UserID), bob, nil, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("leaving the org: status %d", resp.StatusCode)
+	}
+	projects = nil
+	ts.do(t, "GET", "/api/projects", bob, nil, "", &projects)
+	if len(projects) != 0 {
+		t.Errorf("projects after leaving = %+v", projects)
+	}
+}
+
+func TestOrgKeepsAnOwner(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	alice := ts.signUp(t, "alice@example.com", "correct horse battery")
+
+	var org Org
+	ts.postJSON(t, "/api/orgs", alice, map[string]string{"name": "Acme"}, &org)
+	var members []OrgMember
+	ts.do(t, "GET", fmt.Sprintf("/api/orgs/%d/members", org.ID), alice, nil, "", &members)
+	if len(members) != 1 || members[0].Role != orgRoleOwner {
+		t.Fatalf("members = %+v", members)
+	}
+	if resp := ts.do(t, "DELETE", fmt.Sprintf("/api/orgs/%d/members/%d", org.ID, members[0].UserID), alice, nil, "", nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("last owner leaving: status %d, want 409", resp.StatusCode)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// Requests to URLs that users choose (webhooks, archive downloads, Git
+// clones) must not reach the server's own network: loopback, private and
+// link-local addresses, cloud metadata endpoints among them. Checking a URL's
+// host when it is saved isn't enough, as DNS can change and redirects can
+// lead anywhere, so the address is checked again on every connection.
+
+// publicHostAllowed reports whether users' URLs may connect to ip.
+var publicHostAllowed = func(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified())
+}
+
+// publicDialer connects only to addresses publicHostAllowed accepts.
+func publicDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicHostAllowed(ip) {
+				return fmt.Errorf("%s is not a public address", host)
+			}
+			return nil
+		},
+	}
+}
+
+// publicClient is an HTTP client for users' URLs: it connects only to public
+// addresses and follows at most 5 redirects, each to one of schemes.
+func publicClient(schemes map[string]bool, timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = publicDialer().DialContext
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if !schemes[req.URL.Scheme] {
+				return fmt.Errorf("redirected to a %s URL", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// resolvePublicHost looks up host and returns one of its addresses, failing if
+// any of them is internal. For clients that can't use publicDialer, the
+// address should be pinned so that the name isn't resolved again.
+func resolvePublicHost(ctx context.Context, host string) (net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return nil, fmt.Errorf("cannot resolve %s", host)
+	}
+	for _, addr := range addrs {
+		if !publicHostAllowed(addr.IP) {
+			return nil, fmt.Errorf("%s is not a public host", host)
+		}
+	}
+	return addrs[0].IP, nil
+}
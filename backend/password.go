@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"unicode"
+)
+
+type passwordError struct {
+	Code    string
+	Message string
+}
+
+// passwordPolicy holds a deployment's password rules. bcrypt ignores
+// everything past 72 bytes, so that is always the maximum.
+type passwordPolicy struct {
+	minLength    int
+	requireMixed bool
+	breach       *breachFilter
+}
+
+func (s *Server) initPasswordPolicy() {
+	s.passwordPolicy = passwordPolicy{
+		minLength:    envInt("GRAPE_PASSWORD_MIN_LENGTH", 8),
+		requireMixed: envString("GRAPE_PASSWORD_REQUIRE_MIXED", "false") == "true",
+	}
+	if path := envString("GRAPE_PASSWORD_BREACH_FILTER", ""); path != "" {
+		bf, err := openBreachFilter(path)
+		if err != nil {
+			log.Fatalf("GRAPE_PASSWORD_BREACH_FILTER: %v", err)
+		}
+		s.passwordPolicy.breach = bf
+	}
+}
+
+// checkPasswordStrength returns nil if password is acceptable.
+func (s *Server) checkPasswordStrength(password string) *passwordError {
+	policy := s.passwordPolicy
+	if len(password) < policy.minLength {
+		return &passwordError{"password_too_short", fmt.Sprintf("Password must be at least %d characters", policy.minLength)}
+	}
+	if len(password) > 72 {
+		return &passwordError{"password_too_long", "Password must be at most 72 bytes"}
+	}
+
+	if policy.requireMixed {
+		var letter, digit bool
+		for _, r := range password {
+			switch {
+			case unicode.IsLetter(r):
+				letter = true
+			case unicode.IsDigit(r):
+				digit = true
+			}
+		}
+		if !letter || !digit {
+			return &passwordError{"password_too_simple", "Password must contain both letters and digits"}
+		}
+	}
+
+	if policy.breach != nil {
+		breached, err := policy.breach.contains(password)
+		if err != nil {
+			// An unreadable filter shouldn't lock everyone out of signing up
+			log.Printf("breach filter lookup failed: %v", err)
+		}
+		if breached {
+			return &passwordError{"password_breached", "This password has appeared in a data breach; choose another"}
+		}
+	}
+	return nil
+}
+
+// setPassword stores a new password, which must already have passed
+// checkPasswordStrength. signOut revokes every token issued before.
+func (s *Server) setPassword(userID int, password string, signOut bool) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	query := "UPDATE users SET password = ?, token_version = token_version + 1 WHERE id = ?"
+	if !signOut {
+		query = "UPDATE users SET password = ? WHERE id = ?"
+	}
+	_, err = s.db.Exec(query, hash, userID)
+	return err
+}
+
+func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	var req struct {
+		CurrentPassword     string `json:"current_password"`
+		NewPassword         string `json:"new_password"`
+		LogoutOtherSessions *bool  `json:"logout_other_sessions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+
+	var hash string
+	if err := s.db.QueryRow("SELECT password FROM users WHERE id = ?", userID).Scan(&hash); err != nil {
+		writeJSONError(w, http.StatusNotFound, "user_not_found", "User not found")
+		return
+	}
+	if !checkPassword(req.CurrentPassword, hash) {
+		writeJSONError(w, http.StatusForbidden, "wrong_password", "Current password is incorrect")
+		return
+	}
+	if perr := s.checkPasswordStrength(req.NewPassword); perr != nil {
+		writeJSONError(w, http.StatusBadRequest, perr.Code, perr.Message)
+		return
+	}
+
+	// Signing out other sessions is the default; it is what users expect
+	// after changing a password they think was compromised.
+	signOut := req.LogoutOtherSessions == nil || *req.LogoutOtherSessions
+	if err := s.setPassword(userID, req.NewPassword, signOut); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+
+	// The caller's session carries on under the new password
+	sessionID, _ := r.Context().Value("sessionID").(string)
+	tokens, err := s.issueTokens(r, userID, sessionID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Error generating token")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
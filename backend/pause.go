@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// A paused project keeps its files, deployments and settings, but its site
+// answers every request with a 503 until it is resumed. Builds still run
+// while it is paused, so a fix can be deployed before the site comes back.
+
+const pausedPage = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Site paused</title></head>
+<body style="font-family: sans-serif; text-align: center; padding: 4em 1em">
+<h1>Site paused</h1>
+<p>The owner of this site has paused it. Check back later.</p>
+</body>
+</html>
+`
+
+func servePaused(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprint(w, pausedPage)
+}
+
+func (s *Server) handlePauseProject(w http.ResponseWriter, r *http.Request) {
+	s.setPaused(w, r, true)
+}
+
+func (s *Server) handleResumeProject(w http.ResponseWriter, r *http.Request) {
+	s.setPaused(w, r, false)
+}
+
+// setPaused pauses or resumes the project's site and returns the project.
+// Doing either twice is harmless. Deployers and above only.
+func (s *Server) setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	projectID, userID, ok := s.authorizeProject(w, r, roleDeployer)
+	if !ok {
+		return
+	}
+	project, err := s.loadProject(projectID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if project.Status == "archived" {
+		writeJSONError(w, http.StatusConflict, "project_archived", "Archived projects are not served")
+		return
+	}
+
+	if project.Paused != paused {
+		var pausedAt int64
+		action := "resumed"
+		if paused {
+			pausedAt, action = time.Now().Unix(), "paused"
+		}
+		if _, err := s.db.Exec("UPDATE projects SET paused_at = ? WHERE id = ?", pausedAt, projectID); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+			return
+		}
+		var email string
+		s.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email)
+		s.recordHistory(projectID, "pause", action, email+" "+action+" the site")
+		s.invalidateProjectLists(projectID, project.UserID)
+		project.Paused = paused
+	}
+
+	role, _ := s.projectRole(projectID, userID)
+	project.Role = role.String()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
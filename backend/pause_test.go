@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPauseAndResume(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID
+
+	var paused Project
+	if resp := ts.postJSON(t, path+"/pause", token, nil, &paused); resp.StatusCode != http.StatusOK {
+		t.Fatalf("pause: status %d", resp.StatusCode)
+	}
+	if !paused.Paused || paused.Status != "live" {
+		t.Errorf("paused %+v", paused)
+	}
+	resp, err := ts.http.Client().Get(ts.http.URL + "/deploy/" + project.ID + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), "Site paused") {
+		t.Errorf("paused site: status %d, body %q", resp.StatusCode, body)
+	}
+	var listed []Project
+	ts.do(t, "GET", "/api/projects", token, nil, "", &listed)
+	if len(listed) != 1 || !listed[0].Paused {
+		t.Errorf("listed %+v", listed)
+	}
+
+	viewer := ts.signUp(t, "bob@example.com", "correct horse battery 1")
+	ts.do(t, "PUT", path+"/members", token, jsonBody(map[string]string{"email": "bob@example.com", "role": "viewer"}), "application/json", nil)
+	if resp := ts.postJSON(t, path+"/resume", viewer, nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("viewer resuming: status %d, want 403", resp.StatusCode)
+	}
+
+	var resumed Project
+	if resp := ts.postJSON(t, path+"/resume", token, nil, &resumed); resp.StatusCode != http.StatusOK || resumed.Paused {
+		t.Fatalf("resume: status %d, project %+v", resp.StatusCode, resumed)
+	}
+	if page := ts.livePage(t, project.ID); page != "<h1>hello</h1>" {
+		t.Errorf("resumed site = %q", page)
+	}
+}
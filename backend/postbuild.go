@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// postBuildStep post-processes a finished build output directory. Steps must
+// be safe to re-run against output they have already processed.
+type postBuildStep struct {
+	name string
+	run  func(dir, siteURL string) (string, error)
+}
+
+var postBuildSteps = []postBuildStep{
+	{"sitemap", generateSitemap},
+	{"optimize-images", optimizeImages},
+}
+
+// enabledPostBuildSteps filters postBuildSteps by GRAPE_POSTBUILD_STEPS
+// (comma-separated names, "none" to disable); all steps run by default.
+func enabledPostBuildSteps() []postBuildStep {
+	setting := envString("GRAPE_POSTBUILD_STEPS", "")
+	if setting == "" {
+		return postBuildSteps
+	}
+	var steps []postBuildStep
+	for _, step := range postBuildSteps {
+		for _, name := range strings.Split(setting, ",") {
+			if strings.TrimSpace(name) == step.name {
+				steps = append(steps, step)
+			}
+		}
+	}
+	return steps
+}
+
+// runPostBuildSteps runs steps against dir, records each result and returns
+// a log of what happened. A failed step does not fail the build.
+func (s *Server) runPostBuildSteps(projectID, dir string, steps []postBuildStep) (string, bool) {
+	var subdomain string
+	s.db.QueryRow("SELECT subdomain FROM projects WHERE id = ?", projectID).Scan(&subdomain)
+	siteURL := "https://" + subdomain
+
+	var out strings.Builder
+	ok := true
+	for _, step := range steps {
+		output, err := step.run(dir, siteURL)
+		status := "succeeded"
+		if err != nil {
+			status = "failed"
+			ok = false
+			output = err.Error()
+		}
+		fmt.Fprintf(&out, "\n[post-build] %s %s: %s", step.name, status, output)
+
+		if _, err := s.execWithRetry(`
+			INSERT INTO postbuild_results (project_id, step, status, output, updated_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (project_id, step) DO UPDATE SET status = excluded.status, output = excluded.output, updated_at = excluded.updated_at
+		`, projectID, step.name, status, output, time.Now().Unix()); err != nil {
+			log.Printf("project %s: cannot record post-build result: %v", projectID, err)
+		}
+	}
+	return out.String(), ok
+}
+
+type sitemapURL struct {
+	Loc string `xml:"loc"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// generateSitemap writes sitemap.xml listing every HTML page, unless the
+// project already ships its own.
+func generateSitemap(dir, siteURL string) (string, error) {
+	target := filepath.Join(dir, "sitemap.xml")
+	if _, err := os.Stat(target); err == nil {
+		return "project provides its own sitemap.xml", nil
+	}
+
+	set := sitemapURLSet{Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(p) != ".html" {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		urlPath := "/" + filepath.ToSlash(rel)
+		if path.Base(urlPath) == "index.html" {
+			urlPath = strings.TrimSuffix(urlPath, "index.html")
+		}
+		set.URLs = append(set.URLs, sitemapURL{Loc: siteURL + urlPath})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	data, err := xml.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(target, append([]byte(xml.Header), data...), 0644); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("wrote %d URLs", len(set.URLs)), nil
+}
+
+// optimizeImages losslessly recompresses PNGs, keeping whichever version is
+// smaller.
+func optimizeImages(dir, _ string) (string, error) {
+	var count int
+	var saved int64
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.ToLower(filepath.Ext(p)) != ".png" {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		img, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", filepath.Base(p), err)
+		}
+
+		var buf bytes.Buffer
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		if err := enc.Encode(&buf, img); err != nil {
+			return err
+		}
+		if int64(buf.Len()) < info.Size() {
+			if err := os.WriteFile(p, buf.Bytes(), info.Mode()); err != nil {
+				return err
+			}
+			count++
+			saved += info.Size() - int64(buf.Len())
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("recompressed %d images, saved %d bytes", count, saved), nil
+}
+
+func (s *Server) recordHistory(projectID, kind, status, detail string) {
+	if _, err := s.execWithRetry(
+		"INSERT INTO project_history (project_id, kind, status, detail, created_at) VALUES (?, ?, ?, ?, ?)",
+		projectID, kind, status, detail, time.Now().Unix(),
+	); err != nil {
+		log.Printf("project %s: cannot record history: %v", projectID, err)
+	}
+}
+
+// handleRerunPostBuild re-runs only the post-build steps that failed, against
+// the live output of the last successful build. The result is published as a
+// new deployment that replaces the live one in a single update, so visitors
+// never see a half-processed site, and the old output stays to roll back to.
+func (s *Server) handleRerunPostBuild(w http.ResponseWriter, r *http.Request) {
+	projectID, userID, ok := s.authorizeProject(w, r, roleDeployer)
+	if !ok {
+		return
+	}
+
+	var (
+		status, live string
+		ownerID      int
+	)
+	err := s.db.QueryRow("SELECT status, user_id, live_deployment FROM projects WHERE id = ?", projectID).Scan(&status, &ownerID, &live)
+	if err != nil {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+	if status != "live" {
+		http.Error(w, "Project has no successful build to post-process", http.StatusConflict)
+		return
+	}
+
+	rows, err := s.db.Query("SELECT step FROM postbuild_results WHERE project_id = ? AND status = 'failed'", projectID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	failed := map[string]bool{}
+	for rows.Next() {
+		var step string
+		if rows.Scan(&step) == nil {
+			failed[step] = true
+		}
+	}
+	rows.Close()
+
+	var steps []postBuildStep
+	for _, step := range postBuildSteps {
+		if failed[step.name] {
+			steps = append(steps, step)
+		}
+	}
+	if len(steps) == 0 {
+		http.Error(w, "No failed post-build steps to re-run", http.StatusConflict)
+		return
+	}
+
+	// Steps work on a local copy of the live output
+	livePrefix := deployPrefix(projectID)
+	if live != "" {
+		livePrefix = deploymentPrefix(projectID, live)
+	}
+	workPath := filepath.Join(s.cfg.StagingDir, projectID+".postbuild")
+	os.RemoveAll(workPath)
+	defer os.RemoveAll(workPath)
+	if err := fetchDir(s.storage, livePrefix, workPath); err != nil {
+		log.Printf("project %s: cannot fetch live output: %v", projectID, err)
+		http.Error(w, "Cannot read live output", http.StatusInternalServerError)
+		return
+	}
+
+	output, ok := s.runPostBuildSteps(projectID, workPath, steps)
+	size := dirSize(workPath)
+	deploymentID, err := s.copyDeployment(projectID, live, "postbuild", userID)
+	if err != nil {
+		log.Printf("project %s: cannot record post-processed deployment: %v", projectID, err)
+		http.Error(w, "Cannot publish post-processed output", http.StatusInternalServerError)
+		return
+	}
+	discard := func() {
+		s.execWithRetry("DELETE FROM deployments WHERE id = ?", deploymentID)
+		s.storage.Delete(deploymentPrefix(projectID, deploymentID))
+	}
+	if err := publishDir(s.storage, workPath, deploymentPrefix(projectID, deploymentID)); err != nil {
+		log.Printf("project %s: cannot publish post-processed output: %v", projectID, err)
+		discard()
+		http.Error(w, "Cannot publish post-processed output", http.StatusInternalServerError)
+		return
+	}
+	// Conditional, so a build or rollback that went live meanwhile wins
+	res, err := s.execWithRetry("UPDATE projects SET live_deployment = ? WHERE id = ? AND live_deployment = ? AND status = 'live'",
+		deploymentID, projectID, live)
+	if err != nil {
+		discard()
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		discard()
+		http.Error(w, "The live deployment changed meanwhile; try again", http.StatusConflict)
+		return
+	}
+	s.execWithRetry("UPDATE deployments SET size = ? WHERE id = ?", size, deploymentID)
+	s.setDeploymentExpiry(projectID, deploymentID, false)
+	if live == "" {
+		if err := s.dropLegacyDeploy(projectID); err != nil {
+			log.Printf("project %s: cannot remove unversioned deploy: %v", projectID, err)
+		}
+	}
+	s.pruneDeployments(projectID, deploymentID)
+	result := "succeeded"
+	if !ok {
+		result = "failed"
+	}
+	s.execWithRetry("UPDATE projects SET build_log = build_log || ? WHERE id = ?", output, projectID)
+	s.invalidateProjectLists(projectID, ownerID)
+	s.recordHistory(projectID, "postbuild-rerun", result, strings.TrimSpace(output))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": result,
+		"output": strings.TrimSpace(output),
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRerunPostBuildPublishesNewDeployment(t *testing.T) {
+	ts := newTestServer(t, countingRunner{n: new(atomic.Int32)})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID
+
+	var before []Deployment
+	ts.do(t, "GET", path+"/deployments", token, nil, "", &before)
+	original := before[0].ID
+	oldFiles, _ := ts.storage.List(deploymentPrefix(project.ID, original))
+
+	if _, err := ts.db.Exec("UPDATE postbuild_results SET status = 'failed' WHERE project_id = ? AND step = 'sitemap'", project.ID); err != nil {
+		t.Fatal(err)
+	}
+	if resp := ts.postJSON(t, path+"/rerun-postbuild", token, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("rerun: status %d", resp.StatusCode)
+	}
+
+	var after []Deployment
+	ts.do(t, "GET", path+"/deployments", token, nil, "", &after)
+	if len(after) != 2 || after[0].Trigger != "postbuild" || !after[0].Live || after[1].ID != original || after[1].Live {
+		t.Fatalf("deployments after rerun %+v", after)
+	}
+	if after[0].Size == 0 || after[0].FinishedAt < time.Now().Add(-time.Minute).Unix() {
+		t.Errorf("post-processed deployment %+v", after[0])
+	}
+	if files, _ := ts.storage.List(deploymentPrefix(project.ID, original)); len(files) != len(oldFiles) {
+		t.Errorf("original output changed: %d files, had %d", len(files), len(oldFiles))
+	}
+	if got := ts.livePage(t, project.ID); got != "build 1" {
+		t.Errorf("live page %q after rerun", got)
+	}
+
+	// Nothing left to re-run
+	if resp := ts.postJSON(t, path+"/rerun-postbuild", token, nil, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("second rerun: status %d, want 409", resp.StatusCode)
+	}
+}
+
+func TestRerunPostBuildRunsOnlyFailedSteps(t *testing.T) {
+	runner := countingRunner{n: new(atomic.Int32)}
+	ts := newTestServer(t, runner)
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID
+
+	var before []Deployment
+	ts.do(t, "GET", path+"/deployments", token, nil, "", &before)
+	original := deploymentPrefix(project.ID, before[0].ID)
+
+	// The sitemap step failed and left no sitemap; image optimization is
+	// marked with a timestamp that a re-run would overwrite
+	if err := ts.storage.Delete(original + "sitemap.xml"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.db.Exec("UPDATE postbuild_results SET status = 'failed', updated_at = 1 WHERE project_id = ? AND step = 'sitemap'", project.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.db.Exec("UPDATE postbuild_results SET updated_at = 1 WHERE project_id = ? AND step = 'optimize-images'", project.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	var rerun struct {
+		Status string `json:"status"`
+		Output string `json:"output"`
+	}
+	if resp := ts.postJSON(t, path+"/rerun-postbuild", token, nil, &rerun); resp.StatusCode != http.StatusOK || rerun.Status != "succeeded" {
+		t.Fatalf("rerun: status %d, %+v", resp.StatusCode, rerun)
+	}
+	if strings.Contains(rerun.Output, "optimize-images") {
+		t.Errorf("rerun output mentions a step that succeeded: %q", rerun.Output)
+	}
+	if n := runner.n.Load(); n != 1 {
+		t.Errorf("build ran %d times, want 1", n)
+	}
+
+	results := map[string]struct {
+		status    string
+		updatedAt int64
+	}{}
+	rows, err := ts.db.Query("SELECT step, status, updated_at FROM postbuild_results WHERE project_id = ?", project.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var step, status string
+		var updatedAt int64
+		if err := rows.Scan(&step, &status, &updatedAt); err != nil {
+			t.Fatal(err)
+		}
+		results[step] = struct {
+			status    string
+			updatedAt int64
+		}{status, updatedAt}
+	}
+	rows.Close()
+	if r := results["sitemap"]; r.status != "succeeded" || r.updatedAt == 1 {
+		t.Errorf("sitemap result %+v, want re-run and succeeded", r)
+	}
+	if r := results["optimize-images"]; r.status != "succeeded" || r.updatedAt != 1 {
+		t.Errorf("optimize-images result %+v, want untouched", r)
+	}
+
+	// The sitemap lands in the new deployment, not the one that was live
+	var after []Deployment
+	ts.do(t, "GET", path+"/deployments", token, nil, "", &after)
+	if _, err := ts.storage.Stat(deploymentPrefix(project.ID, after[0].ID) + "sitemap.xml"); err != nil {
+		t.Errorf("new deployment has no sitemap: %v", err)
+	}
+	if _, err := ts.storage.Stat(original + "sitemap.xml"); err == nil {
+		t.Error("rerun wrote into the deployment that was live")
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// projectConfig is grape.yaml (or grape.yml) at the root of an upload:
+//
+//	build:
+//	  command: npm run build:prod
+//	  output: dist
+//	  node: "20"
+//	redirects:
+//	  - from: /blog/*
+//	    to: https://blog.example.com/*
+//	    status: 301
+//	headers:
+//	  - for: /assets/*
+//	    values:
+//	      Cache-Control: public, max-age=31536000, immutable
+//
+// It is validated at upload, before anything is built.
+type projectConfig struct {
+	Build     buildConfig    `yaml:"build"`
+	Redirects []redirectRule `yaml:"redirects"`
+	Headers   []struct {
+		For    string            `yaml:"for"`
+		Values map[string]string `yaml:"values"`
+	} `yaml:"headers"`
+}
+
+// buildConfig overrides what the worker would otherwise detect.
+type buildConfig struct {
+	Command string `yaml:"command" json:"command,omitempty"`
+	Output  string `yaml:"output" json:"output,omitempty"`
+	Node    string `yaml:"node" json:"node,omitempty"`
+}
+
+type redirectRule struct {
+	From   string `yaml:"from" json:"from"`
+	To     string `yaml:"to" json:"to"`
+	Status int    `yaml:"status" json:"status"`
+}
+
+const maxBuildCommandLength = 1000
+
+// Node.js major versions the builders have installed.
+var nodeVersions = parseCommaSet(envString("GRAPE_NODE_VERSIONS", "18,20,22"))
+
+var validRedirectStatus = map[int]bool{301: true, 302: true, 307: true, 308: true}
+
+var nodeVersionPattern = regexp.MustCompile(`^[0-9]+$`)
+
+func (c buildConfig) validate() error {
+	if len(c.Command) > maxBuildCommandLength {
+		return fmt.Errorf("build.command is longer than %d characters", maxBuildCommandLength)
+	}
+	if strings.ContainsAny(c.Command, "\r\n") {
+		return errors.New("build.command must be a single line")
+	}
+	if c.Output != "" {
+		clean := path.Clean(filepath.ToSlash(c.Output))
+		if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return errors.New("build.output must be a directory inside the project")
+		}
+	}
+	if c.Node != "" && (!nodeVersionPattern.MatchString(c.Node) || !nodeVersions[c.Node]) {
+		versions := make([]string, 0, len(nodeVersions))
+		for v := range nodeVersions {
+			versions = append(versions, v)
+		}
+		sort.Strings(versions)
+		return fmt.Errorf("build.node must be a major version, one of %s", strings.Join(versions, ", "))
+	}
+	return nil
+}
+
+func (r redirectRule) validate() error {
+	if !strings.HasPrefix(r.From, "/") {
+		return fmt.Errorf("redirect from %q must start with /", r.From)
+	}
+	if strings.Contains(strings.TrimSuffix(r.From, "*"), "*") {
+		return fmt.Errorf("redirect from %q may only end in *", r.From)
+	}
+	if !strings.HasPrefix(r.To, "/") && !strings.HasPrefix(r.To, "https://") && !strings.HasPrefix(r.To, "http://") {
+		return fmt.Errorf("redirect to %q must be a path or an http(s) URL", r.To)
+	}
+	if !validRedirectStatus[r.Status] {
+		return fmt.Errorf("redirect status %d must be 301, 302, 307 or 308", r.Status)
+	}
+	return nil
+}
+
+// target is where path goes under this rule, or "" if the rule doesn't
+// apply. A trailing * in From matches any suffix, which replaces a trailing *
+// in To.
+func (r redirectRule) target(urlPath string) string {
+	prefix, wildcard := strings.CutSuffix(r.From, "*")
+	switch {
+	case wildcard && strings.HasPrefix(urlPath, prefix):
+		if to, ok := strings.CutSuffix(r.To, "*"); ok {
+			return to + strings.TrimPrefix(urlPath, prefix)
+		}
+		return r.To
+	case !wildcard && urlPath == r.From:
+		return r.To
+	}
+	return ""
+}
+
+func parseProjectConfig(r io.Reader) (*projectConfig, error) {
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	var cfg projectConfig
+	if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if err := cfg.Build.validate(); err != nil {
+		return nil, err
+	}
+	for i := range cfg.Redirects {
+		if cfg.Redirects[i].Status == 0 {
+			cfg.Redirects[i].Status = http.StatusMovedPermanently
+		}
+		if err := cfg.Redirects[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range cfg.Headers {
+		if !strings.HasPrefix(h.For, "/") {
+			return nil, fmt.Errorf("headers for %q must start with /", h.For)
+		}
+		for name := range h.Values {
+			if !allowedCustomHeaders[http.CanonicalHeaderKey(name)] {
+				return nil, fmt.Errorf("header %q is not allowed", name)
+			}
+		}
+	}
+	return &cfg, nil
+}
+
+// headerRules turns the headers section into the same rules as _headers.
+func (c *projectConfig) headerRules() []headerRule {
+	var rules []headerRule
+	for _, h := range c.Headers {
+		rule := headerRule{Pattern: h.For, Headers: map[string]string{}}
+		for name, value := range h.Values {
+			rule.Headers[http.CanonicalHeaderKey(name)] = value
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// loadProjectConfig parses the project's grape.yaml, returning nil when it
+// has none.
+func loadProjectConfig(projectPath string) (*projectConfig, error) {
+	for _, name := range []string{"grape.yaml", "grape.yml"} {
+		data, err := os.ReadFile(filepath.Join(projectPath, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := parseProjectConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return cfg, nil
+	}
+	return nil, nil
+}
+
+// loadSiteFiles reads the serving and build settings an upload carries in
+// grape.yaml and _headers, encoded for storage on the project row.
+func loadSiteFiles(projectPath string) (headerRules, redirects, build string, err error) {
+	cfg, err := loadProjectConfig(projectPath)
+	if err != nil {
+		return "", "", "", err
+	}
+	headerRules, err = loadHeadersFile(projectPath)
+	if err != nil || cfg == nil {
+		return headerRules, "", "", err
+	}
+
+	if rules := cfg.headerRules(); len(rules) > 0 {
+		var fromFile []headerRule
+		if headerRules != "" {
+			json.Unmarshal([]byte(headerRules), &fromFile)
+		}
+		rules = append(rules, fromFile...)
+		sort.SliceStable(rules, func(i, j int) bool {
+			return rules[i].specificity() < rules[j].specificity()
+		})
+		data, _ := json.Marshal(rules)
+		headerRules = string(data)
+	}
+	if len(cfg.Redirects) > 0 {
+		data, _ := json.Marshal(cfg.Redirects)
+		redirects = string(data)
+	}
+	if cfg.Build != (buildConfig{}) {
+		data, _ := json.Marshal(cfg.Build)
+		build = string(data)
+	}
+	return headerRules, redirects, build, nil
+}
+
+// buildConfigEnv passes the project's build settings to the worker.
+func (s *Server) buildConfigEnv(projectID string) []string {
+	var stored string
+	s.db.QueryRow("SELECT build_config FROM projects WHERE id = ?", projectID).Scan(&stored)
+	var c buildConfig
+	if stored == "" || json.Unmarshal([]byte(stored), &c) != nil {
+		return nil
+	}
+	var env []string
+	for _, v := range [][2]string{
+		{"GRAPE_BUILD_COMMAND", c.Command},
+		{"GRAPE_OUTPUT_DIR", c.Output},
+		{"GRAPE_NODE_VERSION", c.Node},
+	} {
+		if v[1] != "" {
+			env = append(env, v[0]+"="+v[1])
+		}
+	}
+	return env
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func configZip(t *testing.T, config string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, body := range map[string]string{"index.html": "<h1>hello</h1>", "grape.yaml": config} {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseProjectConfig(t *testing.T) {
+	cfg, err := parseProjectConfig(strings.NewReader("build:\n  command: npm run build:prod\n  output: dist\n  node: \"20\"\nredirects:\n  - from: /blog/*\n    to: https://blog.example.com/*\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Build.Command != "npm run build:prod" || cfg.Build.Node != "20" || cfg.Redirects[0].Status != http.StatusMovedPermanently {
+		t.Errorf("parsed %+v", cfg)
+	}
+	if got := cfg.Redirects[0].target("/blog/2024/hello"); got != "https://blog.example.com/2024/hello" {
+		t.Errorf("redirect target %q", got)
+	}
+
+	for _, bad := range []string{
+		"biuld:\n  command: make\n",
+		"build:\n  output: ../etc\n",
+		"build:\n  node: \"12\"\n",
+		"redirects:\n  - from: blog\n    to: /\n",
+		"redirects:\n  - from: /a\n    to: /b\n    status: 200\n",
+		"headers:\n  - for: /*\n    values:\n      Set-Cookie: a=b\n",
+	} {
+		if _, err := parseProjectConfig(strings.NewReader(bad)); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+func TestProjectConfigUpload(t *testing.T) {
+	ts := newTestServer(t, envEchoRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+
+	if _, resp := ts.upload(t, token, "bad", configZip(t, "build:\n  node: \"12\"\n")); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid grape.yaml: status %d, want 400", resp.StatusCode)
+	}
+
+	project, resp := ts.upload(t, token, "site", configZip(t, "build:\n  command: make site\n  output: public\nredirects:\n  - from: /old\n    to: /new\n    status: 302\nheaders:\n  - for: /*\n    values:\n      X-Robots-Tag: noindex\n"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: status %d", resp.StatusCode)
+	}
+	ts.waitForStatus(t, token, project.ID)
+
+	var logs struct{ Log string }
+	ts.do(t, "GET", "/api/projects/"+project.ID+"/logs", token, nil, "", &logs)
+	if !strings.Contains(logs.Log, "GRAPE_BUILD_COMMAND=make site") || !strings.Contains(logs.Log, "GRAPE_OUTPUT_DIR=public") {
+		t.Errorf("build env did not carry the config: %q", logs.Log)
+	}
+
+	client := ts.http.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	site := ts.http.URL + "/deploy/" + project.ID
+	redirect, err := client.Get(site + "/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirect.Body.Close()
+	if redirect.StatusCode != http.StatusFound || redirect.Header.Get("Location") != "/deploy/"+project.ID+"/new" {
+		t.Errorf("redirect: %d to %q", redirect.StatusCode, redirect.Header.Get("Location"))
+	}
+	page, err := client.Get(site + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Body.Close()
+	if page.Header.Get("X-Robots-Tag") != "noindex" {
+		t.Errorf("configured header missing: %v", page.Header)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GET /api/projects takes page (from 1), limit (default 50, at most
+// maxProjectPageSize), status (comma-separated), tag (comma-separated or
+// repeated; projects need all of them), q (matched against names and
+// subdomains) and sort (created_at, name or status, with a leading "-"
+// for descending; -created_at by default). The number of matching projects
+// is sent in X-Total-Count.
+
+const (
+	defaultProjectPageSize = 50
+	maxProjectPageSize     = 100
+)
+
+type projectListQuery struct {
+	page, limit int
+	statuses    map[string]bool
+	tags        []string
+	q           string
+	sortBy      string
+	descending  bool
+}
+
+func parseProjectListQuery(v url.Values) (projectListQuery, error) {
+	query := projectListQuery{page: 1, limit: defaultProjectPageSize, sortBy: "created_at", descending: true}
+	if s := v.Get("page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return query, errors.New("page must be a positive number")
+		}
+		query.page = n
+	}
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxProjectPageSize {
+			return query, fmt.Errorf("limit must be between 1 and %d", maxProjectPageSize)
+		}
+		query.limit = n
+	}
+	if s := v.Get("status"); s != "" {
+		query.statuses = parseCommaSet(s)
+		for status := range query.statuses {
+			if _, ok := statusTransitions[status]; !ok {
+				return query, fmt.Errorf("unknown status %q", status)
+			}
+		}
+	}
+	for _, s := range v["tag"] {
+		for tag := range parseCommaSet(s) {
+			query.tags = append(query.tags, tag)
+		}
+	}
+	query.q = strings.ToLower(strings.TrimSpace(v.Get("q")))
+	if s := v.Get("sort"); s != "" {
+		query.sortBy, query.descending = strings.TrimPrefix(s, "-"), strings.HasPrefix(s, "-")
+		switch query.sortBy {
+		case "created_at", "name", "status":
+		default:
+			return query, errors.New("sort must be created_at, name or status")
+		}
+	}
+	return query, nil
+}
+
+func (q projectListQuery) matches(p Project) bool {
+	if q.statuses != nil && !q.statuses[p.Status] {
+		return false
+	}
+	for _, tag := range q.tags {
+		if !hasTag(p.Tags, tag) {
+			return false
+		}
+	}
+	return q.q == "" || strings.Contains(strings.ToLower(p.Name), q.q) || strings.Contains(p.Subdomain, q.q)
+}
+
+// apply returns the requested page of projects and how many match in all.
+// projects is not modified, as it may be shared through the cache.
+func (q projectListQuery) apply(projects []Project) ([]Project, int) {
+	matched := []Project{}
+	for _, p := range projects {
+		if q.matches(p) {
+			matched = append(matched, p)
+		}
+	}
+	less := func(a, b Project) bool {
+		switch q.sortBy {
+		case "name":
+			return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		case "status":
+			return a.Status < b.Status
+		}
+		return a.CreatedAt < b.CreatedAt
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if q.descending {
+			return less(matched[j], matched[i])
+		}
+		return less(matched[i], matched[j])
+	})
+
+	start := (q.page - 1) * q.limit
+	if start >= len(matched) {
+		return []Project{}, len(matched)
+	}
+	end := start + q.limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+	return matched[start:end], len(matched)
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestProjectListQuery(t *testing.T) {
+	projects := []Project{
+		{ID: "c", Name: "Charlie", Status: "failed", Subdomain: "c.grape.ai", CreatedAt: 3},
+		{ID: "b", Name: "bravo", Status: "live", Subdomain: "shop.grape.ai", CreatedAt: 2},
+		{ID: "a", Name: "Alpha", Status: "live", Subdomain: "a.grape.ai", CreatedAt: 1},
+	}
+	ids := func(ps []Project) string {
+		var s string
+		for _, p := range ps {
+			s += p.ID
+		}
+		return s
+	}
+	for raw, want := range map[string]struct {
+		ids   string
+		total int
+	}{
+		"":                      {"cba", 3},
+		"sort=name":             {"abc", 3},
+		"sort=-name":            {"cba", 3},
+		"sort=created_at":       {"abc", 3},
+		"status=live":           {"ba", 2},
+		"status=live,failed":    {"cba", 3},
+		"q=SHOP":                {"b", 1},
+		"q=ar":                  {"c", 1},
+		"limit=2":               {"cb", 3},
+		"limit=2&page=2":        {"a", 3},
+		"limit=2&page=3":        {"", 3},
+		"status=live&sort=name": {"ab", 2},
+	} {
+		v, _ := url.ParseQuery(raw)
+		q, err := parseProjectListQuery(v)
+		if err != nil {
+			t.Errorf("%q: %v", raw, err)
+			continue
+		}
+		page, total := q.apply(projects)
+		if ids(page) != want.ids || total != want.total {
+			t.Errorf("%q: got %q of %d, want %q of %d", raw, ids(page), total, want.ids, want.total)
+		}
+	}
+	if ids(projects) != "cba" {
+		t.Errorf("apply reordered its input: %q", ids(projects))
+	}
+
+	for _, raw := range []string{"page=0", "limit=101", "limit=x", "status=gone", "sort=size"} {
+		v, _ := url.ParseQuery(raw)
+		if _, err := parseProjectListQuery(v); err == nil {
+			t.Errorf("%q: no error", raw)
+		}
+	}
+}
+
+func TestListProjectsPage(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	for _, name := range []string{"one", "two"} {
+		project, _ := ts.upload(t, token, name, siteZip(t))
+		ts.waitForStatus(t, token, project.ID)
+	}
+
+	var projects []Project
+	resp := ts.do(t, "GET", "/api/projects?limit=1&sort=name", token, nil, "", &projects)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Total-Count") != "2" {
+		t.Fatalf("status %d, X-Total-Count %q", resp.StatusCode, resp.Header.Get("X-Total-Count"))
+	}
+	if len(projects) != 1 || projects[0].Name != "one" || projects[0].BuildLog != "" {
+		t.Errorf("page %+v", projects)
+	}
+	if resp := ts.do(t, "GET", "/api/projects?status=nope", token, nil, "", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown status: status %d, want 400", resp.StatusCode)
+	}
+}
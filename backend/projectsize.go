@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+)
+
+// Each project's source and build output may take up to maxProjectSize.
+// Archives that would expand past it are refused on upload and stop being
+// extracted once they reach it, and builds whose output is bigger fail. The
+// sizes are measured at every build and shown with the project.
+
+// maxProjectSize is the most an extracted source or a build output may take;
+// 0 for no limit.
+var maxProjectSize = int64(envInt("GRAPE_MAX_PROJECT_SIZE_MB", 1024)) << 20
+
+// ProjectStorage is how much space a project takes.
+type ProjectStorage struct {
+	// The extracted source plus the stored upload
+	SourceBytes int64 `json:"source_bytes"`
+	// The output of every deployment kept
+	DeployBytes int64 `json:"deploy_bytes"`
+	// The cap on the source and on each build's output, if any
+	LimitBytes int64 `json:"limit_bytes,omitempty"`
+}
+
+// checkProjectSize fails if size is over maxProjectSize; what names the
+// thing measured.
+func checkProjectSize(what string, size int64) error {
+	if maxProjectSize > 0 && size > maxProjectSize {
+		return fmt.Errorf("%s is %d MB, more than the %d MB a project may use", what, size>>20, maxProjectSize>>20)
+	}
+	return nil
+}
+
+// extractBudget counts the bytes written while extracting an archive, so
+// entries that lie about their size can't go past maxProjectSize either.
+type extractBudget struct {
+	written int64
+}
+
+// copy writes src to dst, failing once the archive's total would pass the
+// limit.
+func (b *extractBudget) copy(dst io.Writer, src io.Reader) error {
+	if maxProjectSize <= 0 {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	n, err := io.Copy(dst, io.LimitReader(src, maxProjectSize-b.written+1))
+	b.written += n
+	if err != nil {
+		return err
+	}
+	return checkProjectSize("extracted archive", b.written)
+}
+
+// recordSourceSize measures the project's extracted source and stored upload.
+func (s *Server) recordSourceSize(projectID, projectPath string) {
+	size := dirSize(projectPath)
+	if key, _, err := s.findUpload(projectID); err == nil {
+		size += s.storedSize(key)
+	}
+	if _, err := s.execWithRetry("UPDATE projects SET source_bytes = ? WHERE id = ?", size, projectID); err != nil {
+		log.Printf("project %s: cannot record source size: %v", projectID, err)
+	}
+}
+
+// projectStorageUsage is the space the project takes, as last measured.
+func (s *Server) projectStorageUsage(projectID string) (ProjectStorage, error) {
+	usage := ProjectStorage{LimitBytes: maxProjectSize}
+	err := s.db.QueryRow(`
+		SELECT p.source_bytes, COALESCE((SELECT SUM(d.size) FROM deployments d WHERE d.project_id = p.id AND d.status = ?), 0)
+		FROM projects p WHERE p.id = ?
+	`, deploySucceeded, projectID).Scan(&usage.SourceBytes, &usage.DeployBytes)
+	return usage, err
+}
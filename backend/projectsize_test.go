@@ -0,0 +1,79 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// randomZip is an archive of files of random, incompressible bytes.
+func randomZip(t *testing.T, sizes map[string]int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, size := range sizes {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, size)
+		rand.Read(data)
+		f.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProjectSizeLimit(t *testing.T) {
+	saved := maxProjectSize
+	maxProjectSize = 10 << 10
+	t.Cleanup(func() { maxProjectSize = saved })
+	ts := newTestServer(t, sourceRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+
+	if _, resp := ts.upload(t, token, "big", randomZip(t, map[string]int{"index.html": 4 << 10, "big.bin": 20 << 10})); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("upload over the size limit: status %d, want 400", resp.StatusCode)
+	}
+
+	project, resp := ts.upload(t, token, "site", randomZip(t, map[string]int{"index.html": 4 << 10}))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: status %d", resp.StatusCode)
+	}
+	if p := ts.waitForStatus(t, token, project.ID); p.Status != "live" {
+		t.Fatalf("build %s: %s", p.Status, p.BuildLog)
+	}
+	var p Project
+	ts.do(t, "GET", "/api/projects/"+project.ID, token, nil, "", &p)
+	if p.Storage == nil || p.Storage.SourceBytes < 4<<10 || p.Storage.DeployBytes < 4<<10 || p.Storage.LimitBytes != 10<<10 {
+		t.Errorf("storage %+v", p.Storage)
+	}
+
+	// The output is checked on every build
+	maxProjectSize = 4000
+	ts.do(t, "POST", "/api/projects/"+project.ID+"/rebuild", token, nil, "", nil)
+	if p := ts.waitForStatus(t, token, project.ID); p.Status != "failed" || !strings.Contains(p.BuildLog, "build output is") {
+		t.Errorf("oversized build %s: %s", p.Status, p.BuildLog)
+	}
+}
+
+func TestExtractionStopsAtSizeLimit(t *testing.T) {
+	saved := maxProjectSize
+	maxProjectSize = 10 << 10
+	t.Cleanup(func() { maxProjectSize = saved })
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "site.zip")
+	if err := os.WriteFile(archive, randomZip(t, map[string]int{"a.bin": 8 << 10, "b.bin": 8 << 10}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := extractArchive(archive, filepath.Join(dir, "out"), formatZip)
+	if err == nil || !strings.Contains(err.Error(), "a project may use") {
+		t.Errorf("extracting past the limit: %v", err)
+	}
+}
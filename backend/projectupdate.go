@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxProjectNameLength        = 100
+	maxProjectDescriptionLength = 1000
+)
+
+// handleUpdateProject changes a project's name, description, tags and serving
+// and build settings. Fields left out of the body keep their value; build
+// settings apply from the next build. A new root directory must exist in the
+// stored source, whose grape.yaml and _headers there take over right away.
+func (s *Server) handleUpdateProject(w http.ResponseWriter, r *http.Request) {
+	projectID, userID, ok := s.authorizeProject(w, r, roleDeployer)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name            *string   `json:"name"`
+		Description     *string   `json:"description"`
+		Preset          *string   `json:"preset"`
+		ForceHTTPS      *bool     `json:"force_https"`
+		HealthCheckPath *string   `json:"health_check_path"`
+		BuildTimeout    *string   `json:"build_timeout"`
+		Tags            *[]string `json:"tags"`
+		RootDir         *string   `json:"root_dir"`
+		KeepDeployments *int      `json:"keep_deployments"`
+		RequireApproval *bool     `json:"require_approval"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+
+	var sets []string
+	var args []interface{}
+	set := func(column string, value interface{}) {
+		sets = append(sets, column+" = ?")
+		args = append(args, value)
+	}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || utf8.RuneCountInString(name) > maxProjectNameLength {
+			writeJSONError(w, http.StatusBadRequest, "invalid_name", fmt.Sprintf("Name must be 1-%d characters", maxProjectNameLength))
+			return
+		}
+		set("name", name)
+	}
+	if req.Description != nil {
+		description := strings.TrimSpace(*req.Description)
+		if utf8.RuneCountInString(description) > maxProjectDescriptionLength {
+			writeJSONError(w, http.StatusBadRequest, "invalid_description", fmt.Sprintf("Description must be at most %d characters", maxProjectDescriptionLength))
+			return
+		}
+		set("description", description)
+	}
+	if req.Preset != nil {
+		if _, ok := urlPresets[*req.Preset]; !ok {
+			writeJSONError(w, http.StatusBadRequest, "invalid_preset", "Unknown preset")
+			return
+		}
+		set("url_preset", *req.Preset)
+	}
+	if req.ForceHTTPS != nil {
+		set("force_https", *req.ForceHTTPS)
+	}
+	if req.HealthCheckPath != nil {
+		if *req.HealthCheckPath != "" && !strings.HasPrefix(*req.HealthCheckPath, "/") {
+			writeJSONError(w, http.StatusBadRequest, "invalid_health_check_path", "health_check_path must start with /")
+			return
+		}
+		set("health_check_path", *req.HealthCheckPath)
+	}
+	if req.BuildTimeout != nil {
+		timeout, err := parseBuildTimeout(*req.BuildTimeout)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_build_timeout", "Invalid build_timeout: "+err.Error())
+			return
+		}
+		set("build_timeout", int(timeout.Seconds()))
+	}
+	if req.KeepDeployments != nil {
+		if err := validateKeepDeployments(*req.KeepDeployments); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_keep_deployments", err.Error())
+			return
+		}
+		set("keep_deployments", *req.KeepDeployments)
+	}
+	if req.RequireApproval != nil {
+		// Deployers must not be able to lift the gate they are held by
+		if role, _ := s.projectRole(projectID, userID); role < roleAdmin {
+			writeJSONError(w, http.StatusForbidden, "insufficient_role", "Changing require_approval requires the admin role on the project")
+			return
+		}
+		set("require_approval", *req.RequireApproval)
+	}
+	if req.RootDir != nil {
+		rootDir, err := validateRootDir(*req.RootDir)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_root_dir", err.Error())
+			return
+		}
+		projectPath := filepath.Join(s.cfg.ProjectsDir, projectID)
+		if err := s.restoreSource(projectID, projectPath); err != nil {
+			writeJSONError(w, http.StatusGone, "source_unavailable", "Project source is no longer available, please upload again")
+			return
+		}
+		if err := checkProjectRoot(projectPath, rootDir); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_root_dir", err.Error())
+			return
+		}
+		headerRules, redirectRules, buildConfig, err := loadSiteFiles(projectRoot(projectPath, rootDir))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_root_dir", "Invalid "+err.Error())
+			return
+		}
+		set("root_dir", rootDir)
+		set("header_rules", headerRules)
+		set("redirect_rules", redirectRules)
+		set("build_config", buildConfig)
+	}
+	var tags []string
+	if req.Tags != nil {
+		var err error
+		if tags, err = normalizeTags(*req.Tags); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_tags", err.Error())
+			return
+		}
+	}
+	if len(sets) == 0 && req.Tags == nil {
+		writeJSONError(w, http.StatusBadRequest, "nothing_to_update", "Set at least one field")
+		return
+	}
+
+	if err := s.updateProject(projectID, sets, args, tags, req.Tags != nil); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	project, err := s.loadProject(projectID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	s.invalidateProjectLists(projectID, project.UserID)
+	role, _ := s.projectRole(projectID, userID)
+	project.Role = role.String()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
+
+// updateProject applies the column assignments in sets and, if setTags,
+// replaces the project's tags.
+func (s *Server) updateProject(projectID string, sets []string, args []interface{}, tags []string, setTags bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if len(sets) > 0 {
+		if _, err := tx.Exec("UPDATE projects SET "+strings.Join(sets, ", ")+" WHERE id = ?", append(args, projectID)...); err != nil {
+			return err
+		}
+	}
+	if setTags {
+		if err := setProjectTags(tx, projectID, tags); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUpdateProject(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID
+
+	// Listing first caches the old name
+	var listed []Project
+	ts.do(t, "GET", "/api/projects", token, nil, "", &listed)
+
+	var updated Project
+	body := map[string]interface{}{"name": "  Marketing site ", "description": "Landing pages", "force_https": true}
+	if resp := ts.do(t, "PATCH", path, token, jsonBody(body), "application/json", &updated); resp.StatusCode != http.StatusOK {
+		t.Fatalf("update: status %d", resp.StatusCode)
+	}
+	if updated.Name != "Marketing site" || updated.Description != "Landing pages" || !updated.ForceHTTPS || updated.Preset != project.Preset {
+		t.Errorf("updated %+v", updated)
+	}
+	ts.do(t, "GET", "/api/projects", token, nil, "", &listed)
+	if len(listed) != 1 || listed[0].Name != "Marketing site" {
+		t.Errorf("listed %+v", listed)
+	}
+
+	for _, bad := range []map[string]interface{}{
+		{},
+		{"name": " "},
+		{"name": strings.Repeat("a", maxProjectNameLength+1)},
+		{"preset": "nope"},
+		{"health_check_path": "healthz"},
+		{"build_timeout": "soon"},
+	} {
+		if resp := ts.do(t, "PATCH", path, token, jsonBody(bad), "application/json", nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: status %d, want 400", bad, resp.StatusCode)
+		}
+	}
+
+	other := ts.signUp(t, "bob@example.com", "correct horse battery 1")
+	if resp := ts.do(t, "PATCH", path, other, jsonBody(map[string]string{"name": "mine"}), "application/json", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("stranger renaming: status %d, want 404", resp.StatusCode)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Forwarding headers are only believed when the request comes from one of
+// these networks (GRAPE_TRUSTED_PROXIES, comma-separated IPs or CIDRs).
+var trustedProxies = parseTrustedProxies(os.Getenv("GRAPE_TRUSTED_PROXIES"))
+
+func parseTrustedProxies(v string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("ignoring invalid trusted proxy %q: %v", entry, err)
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return trustedProxy(net.ParseIP(host))
+}
+
+func trustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestScheme reports "https" or "http" for the client-facing connection.
+func requestScheme(r *http.Request) string {
+	if fromTrustedProxy(r) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+			return strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// clientIP returns the address of the client, as reported by a trusted proxy
+// if there is one. Proxies append the address they saw to X-Forwarded-For, so
+// the header is read from the right and the first hop that isn't one of ours
+// is the client; anything left of it was sent by the client and can't be
+// believed.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !fromTrustedProxy(r) {
+		return host
+	}
+	var hops []string
+	for _, fwd := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(fwd, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			// Garbage in the chain: nothing further left can be trusted
+			break
+		}
+		if !trustedProxy(ip) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trustedProxies = parseTrustedProxies("127.0.0.1,10.0.0.0/8")
+	t.Cleanup(func() { trustedProxies = nil })
+
+	for _, tc := range []struct {
+		remote string
+		fwd    []string
+		want   string
+	}{
+		{"127.0.0.1:4000", []string{"203.0.113.9"}, "203.0.113.9"},
+		// The client sent its own header and nginx appended the real address
+		{"127.0.0.1:4000", []string{"198.51.100.1, 203.0.113.9"}, "203.0.113.9"},
+		{"127.0.0.1:4000", []string{"198.51.100.1, 203.0.113.9, 10.1.2.3"}, "203.0.113.9"},
+		{"127.0.0.1:4000", []string{"198.51.100.1", "203.0.113.9"}, "203.0.113.9"},
+		{"127.0.0.1:4000", []string{"10.1.2.3"}, "10.1.2.3"},
+		{"127.0.0.1:4000", []string{"not-an-ip, 10.1.2.3"}, "10.1.2.3"},
+		{"127.0.0.1:4000", nil, "127.0.0.1"},
+		// Not from a proxy: the header is the client's own claim
+		{"203.0.113.50:4000", []string{"198.51.100.1"}, "203.0.113.50"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		for _, v := range tc.fwd {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r); got != tc.want {
+			t.Errorf("clientIP from %s with %q = %s, want %s", tc.remote, tc.fwd, got, tc.want)
+		}
+	}
+}
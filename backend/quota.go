@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type tierLimits struct {
+	MaxProjects     int   `json:"max_projects"`
+	MaxStorageBytes int64 `json:"max_storage_bytes"`
+}
+
+var (
+	tiers = map[string]tierLimits{
+		"free": {
+			MaxProjects:     envInt("GRAPE_FREE_MAX_PROJECTS", 3),
+			MaxStorageBytes: int64(envInt("GRAPE_FREE_MAX_STORAGE_MB", 200)) << 20,
+		},
+		"pro": {
+			MaxProjects:     envInt("GRAPE_PRO_MAX_PROJECTS", 50),
+			MaxStorageBytes: int64(envInt("GRAPE_PRO_MAX_STORAGE_MB", 10240)) << 20,
+		},
+		// Anonymous guest accounts, see guest.go
+		"guest": {
+			MaxProjects:     envInt("GRAPE_GUEST_MAX_PROJECTS", 1),
+			MaxStorageBytes: int64(envInt("GRAPE_GUEST_MAX_STORAGE_MB", 50)) << 20,
+		},
+	}
+
+	// What happens to existing projects when a user drops to a smaller tier:
+	// "block" keeps them but refuses uploads until the user is back under quota,
+	// "archive" takes the oldest projects offline until the user fits.
+	downgradePolicy = envString("GRAPE_DOWNGRADE_POLICY", "block")
+)
+
+type QuotaState struct {
+	Tier         string `json:"tier"`
+	Projects     int    `json:"projects"`
+	StorageBytes int64  `json:"storage_bytes"`
+	tierLimits
+	// Whether MaxProjects was set for the user rather than by the tier
+	CustomMaxProjects bool `json:"custom_max_projects,omitempty"`
+}
+
+func (q QuotaState) overProjects() bool { return q.Projects > q.MaxProjects }
+func (q QuotaState) overStorage() bool  { return q.StorageBytes > q.MaxStorageBytes }
+
+// canUpload reports whether one more project fits, and if not, why.
+func (q QuotaState) canUpload() (bool, string) {
+	switch {
+	case q.overProjects():
+		return false, fmt.Sprintf("Your %s plan allows %d projects and you have %d; remove %d to upload again",
+			q.Tier, q.MaxProjects, q.Projects, q.Projects-q.MaxProjects+1)
+	case q.Projects >= q.MaxProjects:
+		return false, fmt.Sprintf("Your %s plan allows %d projects", q.Tier, q.MaxProjects)
+	case q.StorageBytes >= q.MaxStorageBytes:
+		return false, fmt.Sprintf("Your %s plan allows %d MB of storage and you are using %d MB",
+			q.Tier, q.MaxStorageBytes>>20, q.StorageBytes>>20)
+	}
+	return true, ""
+}
+
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func (s *Server) projectStorage(projectID string) int64 {
+	size := dirSize(filepath.Join(s.cfg.ProjectsDir, projectID)) + s.storedSize(deployPrefix(projectID))
+	if key, _, err := s.findUpload(projectID); err == nil {
+		size += s.storedSize(key)
+	}
+	return size
+}
+
+func (s *Server) userQuota(userID int) (QuotaState, error) {
+	var q QuotaState
+	var maxProjects int
+	if err := s.db.QueryRow("SELECT tier, max_projects FROM users WHERE id = ?", userID).Scan(&q.Tier, &maxProjects); err != nil {
+		return q, err
+	}
+	limits, ok := tiers[q.Tier]
+	if !ok {
+		limits = tiers["free"]
+	}
+	q.tierLimits = limits
+	if maxProjects > 0 {
+		q.MaxProjects, q.CustomMaxProjects = maxProjects, true
+	}
+
+	rows, err := s.db.Query("SELECT id FROM projects WHERE user_id = ? AND status != 'archived'", userID)
+	if err != nil {
+		return q, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return q, err
+		}
+		q.Projects++
+		q.StorageBytes += s.projectStorage(id)
+	}
+	return q, rows.Err()
+}
+
+// archiveProject takes a project offline without deleting its source.
+func (s *Server) archiveProject(projectID string) error {
+	var status string
+	if err := s.db.QueryRow("SELECT status FROM projects WHERE id = ?", projectID).Scan(&status); err != nil {
+		return err
+	}
+	ok, err := s.updateProjectStatus(projectID, status, "archived")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("status changed from %s while archiving", status)
+	}
+	s.projectsCache.clear()
+	if err := s.storage.Delete(deployPrefix(projectID)); err != nil {
+		return err
+	}
+	return s.forgetDeployments(projectID)
+}
+
+// setUserTier changes a user's tier and applies the downgrade policy if the
+// user no longer fits. It returns the IDs of any projects that were archived.
+func (s *Server) setUserTier(userID int, tier string) ([]string, error) {
+	if _, ok := tiers[tier]; !ok {
+		return nil, fmt.Errorf("unknown tier %q", tier)
+	}
+	res, err := s.execWithRetry("UPDATE users SET tier = ? WHERE id = ?", tier, userID)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("user %d not found", userID)
+	}
+
+	if downgradePolicy != "archive" {
+		return nil, nil
+	}
+
+	q, err := s.userQuota(userID)
+	if err != nil || (!q.overProjects() && !q.overStorage()) {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id FROM projects WHERE user_id = ? AND status NOT IN ('archived', 'queued', 'building')
+		ORDER BY created_at ASC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	var oldest []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			oldest = append(oldest, id)
+		}
+	}
+	rows.Close()
+
+	var archived []string
+	for _, id := range oldest {
+		if !q.overProjects() && !q.overStorage() {
+			break
+		}
+		size := s.projectStorage(id)
+		if err := s.archiveProject(id); err != nil {
+			log.Printf("project %s: cannot archive: %v", id, err)
+			continue
+		}
+		archived = append(archived, id)
+		q.Projects--
+		q.StorageBytes -= size
+	}
+	return archived, nil
+}
+
+func (s *Server) handleAdminSetTier(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Tier string `json:"tier"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	archived, err := s.setUserTier(userID, req.Tier)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q, err := s.userQuota(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	allowed, reason := q.canUpload()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"quota":             q,
+		"policy":            downgradePolicy,
+		"archived_projects": archived,
+		"uploads_allowed":   allowed,
+		"reason":            reason,
+	})
+}
+
+// maxProjectLimit bounds the per-user max_projects override.
+const maxProjectLimit = 10000
+
+// handleAdminSetProjectLimit gives a user their own project limit in place of
+// their tier's ({"max_projects": n}; 0 goes back to the tier's). Projects
+// over a lowered limit are kept, but uploads are refused until the user is
+// back under it.
+func (s *Server) handleAdminSetProjectLimit(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		MaxProjects *int `json:"max_projects"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MaxProjects == nil {
+		http.Error(w, "Expected {\"max_projects\": n}", http.StatusBadRequest)
+		return
+	}
+	if *req.MaxProjects < 0 || *req.MaxProjects > maxProjectLimit {
+		http.Error(w, fmt.Sprintf("max_projects must be 0-%d", maxProjectLimit), http.StatusBadRequest)
+		return
+	}
+
+	res, err := s.execWithRetry("UPDATE users SET max_projects = ? WHERE id = ?", *req.MaxProjects, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("user %d: project limit set to %d", userID, *req.MaxProjects)
+	s.writeQuota(w, userID)
+}
+
+// handleGetQuota shows the caller's usage against their plan's limits, and
+// whether they can upload another project.
+func (s *Server) handleGetQuota(w http.ResponseWriter, r *http.Request) {
+	s.writeQuota(w, r.Context().Value("userID").(int))
+}
+
+func (s *Server) writeQuota(w http.ResponseWriter, userID int) {
+	q, err := s.userQuota(userID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	allowed, reason := q.canUpload()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"quota":           q,
+		"uploads_allowed": allowed,
+		"reason":          reason,
+	})
+}
+
+func writeQuotaError(w http.ResponseWriter, q QuotaState, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   "over_quota",
+		"message": reason,
+		"quota":   q,
+	})
+}
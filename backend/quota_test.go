@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestProjectLimits(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	admin := ts.signUpAdmin(t, "root@example.com", "correct horse battery 1")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+
+	type usage struct {
+		Quota          QuotaState `json:"quota"`
+		UploadsAllowed bool       `json:"uploads_allowed"`
+		Reason         string     `json:"reason"`
+	}
+	var got usage
+	if resp := ts.do(t, "GET", "/api/me/quota", token, nil, "", &got); resp.StatusCode != http.StatusOK {
+		t.Fatalf("quota: status %d", resp.StatusCode)
+	}
+	free := tiers["free"]
+	if got.Quota.Tier != "free" || got.Quota.Projects != 1 || got.Quota.MaxProjects != free.MaxProjects || got.Quota.CustomMaxProjects || !got.UploadsAllowed {
+		t.Errorf("usage %+v", got)
+	}
+
+	var me Profile
+	ts.do(t, "GET", "/api/me", token, nil, "", &me)
+	limitPath := "/api/admin/users/" + strconv.Itoa(me.ID) + "/max-projects"
+	if resp := ts.do(t, "PUT", limitPath, token, jsonBody(map[string]int{"max_projects": 1}), "application/json", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("setting a limit without the admin role: status %d, want 403", resp.StatusCode)
+	}
+	if resp := ts.do(t, "PUT", limitPath, admin, jsonBody(map[string]int{"max_projects": -1}), "application/json", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("negative limit: status %d, want 400", resp.StatusCode)
+	}
+	got = usage{}
+	ts.do(t, "PUT", limitPath, admin, jsonBody(map[string]int{"max_projects": 1}), "application/json", &got)
+	if got.Quota.MaxProjects != 1 || !got.Quota.CustomMaxProjects || got.UploadsAllowed || got.Reason == "" {
+		t.Errorf("usage at the custom limit %+v", got)
+	}
+
+	if _, resp := ts.upload(t, token, "second", siteZip(t)); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("upload over the limit: status %d, want 403", resp.StatusCode)
+	}
+
+	// 0 goes back to the tier's limit
+	got = usage{}
+	ts.do(t, "PUT", limitPath, admin, jsonBody(map[string]int{"max_projects": 0}), "application/json", &got)
+	if got.Quota.MaxProjects != free.MaxProjects || got.Quota.CustomMaxProjects {
+		t.Errorf("usage after clearing the limit %+v", got)
+	}
+	if _, resp := ts.upload(t, token, "second", siteZip(t)); resp.StatusCode != http.StatusOK {
+		t.Errorf("upload under the tier's limit: status %d", resp.StatusCode)
+	}
+}
+
+func TestDowngradePolicy(t *testing.T) {
+	for _, policy := range []string{"block", "archive"} {
+		t.Run(policy, func(t *testing.T) {
+			saved := downgradePolicy
+			downgradePolicy = policy
+			t.Cleanup(func() { downgradePolicy = saved })
+			ts := newTestServer(t, stubRunner{})
+			token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+			admin := ts.signUpAdmin(t, "root@example.com", "correct horse battery 1")
+			var me Profile
+			ts.do(t, "GET", "/api/me", token, nil, "", &me)
+			tierPath := "/api/admin/users/" + strconv.Itoa(me.ID) + "/tier"
+
+			ts.do(t, "PUT", tierPath, admin, jsonBody(map[string]string{"tier": "pro"}), "application/json", nil)
+			free := tiers["free"].MaxProjects
+			var ids []string
+			for i := 0; i <= free; i++ {
+				project, resp := ts.upload(t, token, "site"+strconv.Itoa(i), siteZip(t))
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("upload %d on pro: status %d", i, resp.StatusCode)
+				}
+				ts.waitForStatus(t, token, project.ID)
+				// Oldest first, whatever the clock's resolution
+				ts.db.Exec("UPDATE projects SET created_at = ? WHERE id = ?", 1000+i, project.ID)
+				ids = append(ids, project.ID)
+			}
+
+			var got struct {
+				Quota            QuotaState `json:"quota"`
+				Policy           string     `json:"policy"`
+				ArchivedProjects []string   `json:"archived_projects"`
+				UploadsAllowed   bool       `json:"uploads_allowed"`
+			}
+			if resp := ts.do(t, "PUT", tierPath, admin, jsonBody(map[string]string{"tier": "free"}), "application/json", &got); resp.StatusCode != http.StatusOK {
+				t.Fatalf("downgrade: status %d", resp.StatusCode)
+			}
+			if got.Policy != policy || got.Quota.Tier != "free" || got.UploadsAllowed {
+				t.Errorf("after downgrade %+v", got)
+			}
+			if _, resp := ts.upload(t, token, "another", siteZip(t)); resp.StatusCode != http.StatusForbidden {
+				t.Errorf("upload after downgrade: status %d, want 403", resp.StatusCode)
+			}
+
+			statuses := map[string]string{}
+			for _, id := range ids {
+				var p Project
+				ts.do(t, "GET", "/api/projects/"+id, token, nil, "", &p)
+				statuses[id] = p.Status
+			}
+			switch policy {
+			case "block":
+				if len(got.ArchivedProjects) != 0 || got.Quota.Projects != free+1 {
+					t.Errorf("block archived %v, %d projects left", got.ArchivedProjects, got.Quota.Projects)
+				}
+				for id, status := range statuses {
+					if status != "live" {
+						t.Errorf("project %s is %s, want it kept live", id, status)
+					}
+				}
+			case "archive":
+				if len(got.ArchivedProjects) != 1 || got.ArchivedProjects[0] != ids[0] || got.Quota.Projects != free {
+					t.Errorf("archive archived %v, want the oldest %s; %d projects left", got.ArchivedProjects, ids[0], got.Quota.Projects)
+				}
+				if statuses[ids[0]] != "archived" || statuses[ids[1]] != "live" {
+					t.Errorf("statuses %v", statuses)
+				}
+				if page := ts.livePage(t, ids[0]); strings.Contains(page, "hello") {
+					t.Errorf("archived project still served: %q", page)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a set of token buckets, one per key (an IP or a user). Each
+// bucket holds up to limit tokens and refills at limit per window, so clients
+// can burst up to the limit and then continue at the average rate.
+type rateLimiter struct {
+	limit    int
+	window   time.Duration
+	counters *serverCounters
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// parseRate parses a limit such as "10/1m" or "100/1h". "0" disables
+// limiting.
+func parseRate(v string) (limit int, window time.Duration, err error) {
+	if strings.TrimSpace(v) == "0" {
+		return 0, 0, nil
+	}
+	n, per, ok := strings.Cut(v, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("want requests/window, e.g. 10/1m")
+	}
+	limit, err = strconv.Atoi(strings.TrimSpace(n))
+	if err != nil || limit <= 0 {
+		return 0, 0, fmt.Errorf("invalid request count %q", n)
+	}
+	window, err = parseDuration(per)
+	if err != nil {
+		return 0, 0, err
+	}
+	return limit, window, nil
+}
+
+// newRateLimiter reads a limit from the environment. A disabled limiter is
+// nil, which lets every request through. Rejections are counted in counters.
+func newRateLimiter(key, def string, counters *serverCounters) *rateLimiter {
+	v := os.Getenv(key)
+	if v == "" {
+		v = def
+	}
+	limit, window, err := parseRate(v)
+	if err != nil {
+		log.Printf("invalid %s %q, using %s: %v", key, v, def, err)
+		limit, window, _ = parseRate(def)
+	}
+	if limit == 0 {
+		return nil
+	}
+	return &rateLimiter{limit: limit, window: window, counters: counters, buckets: make(map[string]*tokenBucket)}
+}
+
+type rateDecision struct {
+	allowed    bool
+	remaining  int
+	retryAfter time.Duration // until the next token, when refused
+	resetAt    time.Time     // when the bucket is full again
+}
+
+func (l *rateLimiter) take(key string, now time.Time) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rate := float64(l.limit) / l.window.Seconds()
+	l.sweep(now, rate)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.limit), updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.limit), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	d := rateDecision{allowed: b.tokens >= 1}
+	if d.allowed {
+		b.tokens--
+	} else {
+		d.retryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	d.remaining = int(b.tokens)
+	d.resetAt = now.Add(time.Duration((float64(l.limit) - b.tokens) / rate * float64(time.Second)))
+	return d
+}
+
+// sweep drops buckets that have refilled completely, since they are no
+// different from a new one. Callers hold l.mu.
+func (l *rateLimiter) sweep(now time.Time, rate float64) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*rate >= float64(l.limit) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// wrap limits next to the limiter's rate for each key. It sets
+// X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset (a Unix
+// time) on every response, and answers 429 with Retry-After once a key runs
+// out.
+func (l *rateLimiter) wrap(next http.HandlerFunc, key func(*http.Request) string) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		d := l.take(key(r), time.Now())
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(l.limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(d.remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(float64(d.resetAt.UnixNano())/1e9)), 10))
+		if !d.allowed {
+			l.counters.RateLimited.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.retryAfter.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "rate_limited", "Too many requests, try again later")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// rateKeyUser keys authenticated routes by user; it must run inside
+// authMiddleware.
+func rateKeyUser(r *http.Request) string {
+	return strconv.Itoa(r.Context().Value("userID").(int))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefills(t *testing.T) {
+	l := &rateLimiter{limit: 2, window: time.Minute, buckets: make(map[string]*tokenBucket)}
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 2; i++ {
+		if d := l.take("a", now); !d.allowed {
+			t.Fatalf("request %d refused", i+1)
+		}
+	}
+	d := l.take("a", now)
+	if d.allowed || d.remaining != 0 || d.retryAfter != 30*time.Second {
+		t.Fatalf("over the limit: %+v", d)
+	}
+	if d := l.take("b", now); !d.allowed {
+		t.Error("keys share a bucket")
+	}
+	if d := l.take("a", now.Add(30*time.Second)); !d.allowed {
+		t.Error("bucket did not refill")
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for v, want := range map[string]int{"10/1m": 10, "5/30": 5, "0": 0} {
+		limit, _, err := parseRate(v)
+		if err != nil || limit != want {
+			t.Errorf("parseRate(%q) = %d, %v", v, limit, err)
+		}
+	}
+	for _, v := range []string{"", "10", "x/1m", "-1/1m", "10/0s"} {
+		if _, _, err := parseRate(v); err == nil {
+			t.Errorf("parseRate(%q) accepted", v)
+		}
+	}
+}
+
+func TestLoginIsRateLimited(t *testing.T) {
+	t.Setenv("GRAPE_RATE_LIMIT_AUTH", "4/1m")
+	ts := newTestServer(t, stubRunner{})
+	ts.signUp(t, "ada@example.com", "correct horse battery 1")
+
+	creds := map[string]string{"email": "ada@example.com", "password": "wrong password 1"}
+	resp := ts.postJSON(t, "/api/login", "", creds, nil)
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("X-RateLimit-Remaining") != "1" || resp.Header.Get("X-RateLimit-Limit") != "4" {
+		t.Fatalf("third request: status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+	ts.postJSON(t, "/api/login", "", creds, nil)
+
+	before := ts.counters.RateLimited.Load()
+	resp = ts.postJSON(t, "/api/login", "", creds, nil)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("over the limit: status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+	if ts.counters.RateLimited.Load() != before+1 {
+		t.Error("rejection not counted")
+	}
+}
+
+func TestUploadsAreRateLimitedPerUser(t *testing.T) {
+	t.Setenv("GRAPE_RATE_LIMIT_UPLOAD", "1/1h")
+	ts := newTestServer(t, stubRunner{})
+	alice := ts.signUp(t, "alice@example.com", "correct horse battery")
+	bob := ts.signUp(t, "bob@example.com", "correct horse battery")
+
+	project, resp := ts.upload(t, alice, "one", siteZip(t))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first upload: status %d", resp.StatusCode)
+	}
+	ts.waitForStatus(t, alice, project.ID)
+	if _, resp := ts.upload(t, alice, "two", siteZip(t)); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second upload: status %d, want 429", resp.StatusCode)
+	}
+	project, resp = ts.upload(t, bob, "three", siteZip(t))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("other user's upload: status %d", resp.StatusCode)
+	}
+	ts.waitForStatus(t, bob, project.ID)
+}
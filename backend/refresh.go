@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Access tokens are short-lived JWTs; clients trade a refresh token for a new
+// pair when one expires. Every refresh token is single-use: it is replaced on
+// each refresh, and presenting a replaced one again revokes its whole family,
+// since that means it was copied.
+var (
+	accessTokenTTL  = envDuration("GRAPE_ACCESS_TOKEN_TTL", 15*time.Minute)
+	refreshTokenTTL = envDuration("GRAPE_REFRESH_TOKEN_TTL", 30*24*time.Hour)
+)
+
+var (
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	errRefreshTokenExpired = errors.New("refresh token expired")
+	errRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+type tokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// issueTokens signs an access token and stores a new refresh token for
+// userID. An empty family starts a new session on behalf of r's client.
+func (s *Server) issueTokens(r *http.Request, userID int, family string) (tokenPair, error) {
+	if family == "" {
+		family = generateID()
+	}
+	access, err := s.generateToken(userID, family)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	var version int
+	if err := s.db.QueryRow("SELECT token_version FROM users WHERE id = ?", userID).Scan(&version); err != nil {
+		return tokenPair{}, err
+	}
+	now := time.Now()
+	if err := s.touchSession(r, userID, family, version, now); err != nil {
+		return tokenPair{}, err
+	}
+	refresh := randomToken()
+	_, err = s.db.Exec(`
+		INSERT INTO refresh_tokens (user_id, token_hash, family, token_version, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, userID, hashToken(refresh), family, version, now.Unix(), now.Add(refreshTokenTTL).Unix())
+	if err != nil {
+		return tokenPair{}, err
+	}
+	// Expired tokens are no longer needed for reuse detection
+	s.db.Exec("DELETE FROM refresh_tokens WHERE user_id = ? AND expires_at <= ?", userID, now.Unix())
+
+	return tokenPair{Token: access, RefreshToken: refresh, ExpiresIn: int(accessTokenTTL.Seconds())}, nil
+}
+
+// rotateRefreshToken consumes token and returns the user it belongs to and
+// the session family to continue.
+func (s *Server) rotateRefreshToken(token string) (userID int, family string, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var (
+		id, version, current int
+		expiresAt, revokedAt int64
+	)
+	err = tx.QueryRow(`
+		SELECT r.id, r.user_id, r.family, r.token_version, r.expires_at, r.revoked_at, u.token_version
+		FROM refresh_tokens r JOIN users u ON u.id = r.user_id
+		WHERE r.token_hash = ?
+	`, hashToken(token)).Scan(&id, &userID, &family, &version, &expiresAt, &revokedAt, &current)
+	if err == sql.ErrNoRows {
+		return 0, "", errInvalidRefreshToken
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	now := time.Now().Unix()
+	switch {
+	case revokedAt != 0:
+		if err := revokeSession(tx, family, now); err != nil {
+			return 0, "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, "", err
+		}
+		return 0, "", errRefreshTokenReused
+	case now >= expiresAt:
+		return 0, "", errRefreshTokenExpired
+	case version != current:
+		return 0, "", errTokenRevoked
+	}
+
+	if _, err := tx.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE id = ?", now, id); err != nil {
+		return 0, "", err
+	}
+	return userID, family, tx.Commit()
+}
+
+// revokeRefreshFamily ends the session token belongs to. Unknown tokens are
+// ignored.
+func (s *Server) revokeRefreshFamily(token string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var family string
+	err = tx.QueryRow("SELECT family FROM refresh_tokens WHERE token_hash = ?", hashToken(token)).Scan(&family)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := revokeSession(tx, family, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func decodeRefreshToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return "", false
+	}
+	if req.RefreshToken == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_refresh_token", "refresh_token is required")
+		return "", false
+	}
+	return req.RefreshToken, true
+}
+
+// handleRefresh exchanges a refresh token for a new access and refresh token.
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	token, ok := decodeRefreshToken(w, r)
+	if !ok {
+		return
+	}
+
+	userID, family, err := s.rotateRefreshToken(token)
+	switch {
+	case errors.Is(err, errRefreshTokenExpired):
+		writeJSONError(w, http.StatusUnauthorized, "refresh_token_expired", "Refresh token expired, sign in again")
+		return
+	case errors.Is(err, errRefreshTokenReused):
+		writeJSONError(w, http.StatusUnauthorized, "refresh_token_reused", "Refresh token was already used; the session has been revoked")
+		return
+	case errors.Is(err, errTokenRevoked):
+		writeJSONError(w, http.StatusUnauthorized, "token_revoked", "Session has been revoked, sign in again")
+		return
+	case errors.Is(err, errInvalidRefreshToken):
+		writeJSONError(w, http.StatusUnauthorized, "invalid_refresh_token", "Invalid refresh token")
+		return
+	case err != nil:
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+
+	pair, err := s.issueTokens(r, userID, family)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Error generating token")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pair)
+}
+
+// handleLogout revokes the session the refresh token belongs to.
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	token, ok := decodeRefreshToken(w, r)
+	if !ok {
+		return
+	}
+	if err := s.revokeRefreshFamily(token); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
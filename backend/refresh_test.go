@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func (ts *testServer) login(t *testing.T, email, password string) tokenPair {
+	t.Helper()
+	var pair tokenPair
+	if resp := ts.postJSON(t, "/api/login", "", map[string]string{"email": email, "password": password}, &pair); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: status %d", resp.StatusCode)
+	}
+	if pair.Token == "" || pair.RefreshToken == "" || pair.ExpiresIn <= 0 {
+		t.Fatalf("login returned %+v", pair)
+	}
+	return pair
+}
+
+func (ts *testServer) refresh(t *testing.T, refreshToken string) (tokenPair, *http.Response) {
+	t.Helper()
+	var pair tokenPair
+	resp := ts.postJSON(t, "/api/auth/refresh", "", map[string]string{"refresh_token": refreshToken}, &pair)
+	return pair, resp
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	ts.signUp(t, "ada@example.com", "correct horse battery 1")
+	first := ts.login(t, "ada@example.com", "correct horse battery 1")
+
+	second, resp := ts.refresh(t, first.RefreshToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("refresh: status %d", resp.StatusCode)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Error("refresh token was not rotated")
+	}
+	if resp := ts.do(t, "GET", "/api/projects", second.Token, nil, "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("new access token rejected: status %d", resp.StatusCode)
+	}
+
+	third, resp := ts.refresh(t, second.RefreshToken)
+	if resp.StatusCode != http.StatusOK || third.RefreshToken == "" {
+		t.Fatalf("second refresh: status %d", resp.StatusCode)
+	}
+}
+
+func TestReusedRefreshTokenRevokesSession(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	ts.signUp(t, "ada@example.com", "correct horse battery 1")
+	first := ts.login(t, "ada@example.com", "correct horse battery 1")
+	other := ts.login(t, "ada@example.com", "correct horse battery 1")
+
+	second, _ := ts.refresh(t, first.RefreshToken)
+	if _, resp := ts.refresh(t, first.RefreshToken); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("reused token: status %d, want 401", resp.StatusCode)
+	}
+	if _, resp := ts.refresh(t, second.RefreshToken); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token rotated from a reused one: status %d, want 401", resp.StatusCode)
+	}
+	if _, resp := ts.refresh(t, other.RefreshToken); resp.StatusCode != http.StatusOK {
+		t.Errorf("unrelated session: status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestLogoutRevokesRefreshToken(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	ts.signUp(t, "ada@example.com", "correct horse battery 1")
+	pair := ts.login(t, "ada@example.com", "correct horse battery 1")
+
+	if resp := ts.postJSON(t, "/api/auth/logout", "", map[string]string{"refresh_token": pair.RefreshToken}, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("logout: status %d", resp.StatusCode)
+	}
+	if _, resp := ts.refresh(t, pair.RefreshToken); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("refresh after logout: status %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestPasswordChangeRevokesRefreshTokens(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	ts.signUp(t, "ada@example.com", "correct horse battery 1")
+	pair := ts.login(t, "ada@example.com", "correct horse battery 1")
+
+	var changed tokenPair
+	resp := ts.postJSON(t, "/api/me/password", pair.Token,
+		map[string]string{"current_password": "correct horse battery 1", "new_password": "correct horse battery 2"}, &changed)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("change password: status %d", resp.StatusCode)
+	}
+	if _, resp := ts.refresh(t, pair.RefreshToken); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("old refresh token: status %d, want 401", resp.StatusCode)
+	}
+	if _, resp := ts.refresh(t, changed.RefreshToken); resp.StatusCode != http.StatusOK {
+		t.Errorf("refresh token from the password change: status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestInvalidRefreshToken(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	if _, resp := ts.refresh(t, "nope"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401", resp.StatusCode)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	appURL        = envString("GRAPE_APP_URL", "http://localhost:5173")
+	resetTokenTTL = envDuration("GRAPE_RESET_TOKEN_TTL", time.Hour)
+)
+
+// sendPasswordReset issues a single-use reset token for userID and mails the
+// reset link to email.
+func (s *Server) sendPasswordReset(userID int, email string) error {
+	token := randomToken()
+	_, err := s.db.Exec(
+		"INSERT INTO password_resets (token_hash, user_id, expires_at) VALUES (?, ?, ?)",
+		hashToken(token), userID, time.Now().Add(resetTokenTTL).Unix(),
+	)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", appURL, token)
+	return s.mailer.Send(email, "Reset your Grape.ai password",
+		fmt.Sprintf("Someone asked to reset the password for this account. If it was you, open this link to choose a new one:\n\n%s\n\nThe link expires in %s. If you didn't ask, you can ignore this email.", link, resetTokenTTL))
+}
+
+// handleForgotPassword mails a reset link. It answers the same way whether or
+// not the address has an account, so it can't be used to probe for users.
+func (s *Server) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	if strings.TrimSpace(req.Email) == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_email", "email is required")
+		return
+	}
+
+	var userID int
+	if err := s.db.QueryRow("SELECT id FROM users WHERE email = ?", req.Email).Scan(&userID); err == nil {
+		if err := s.sendPasswordReset(userID, req.Email); err != nil {
+			log.Printf("user %d: cannot send password reset: %v", userID, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "If that address has an account, a reset link is on its way"})
+}
+
+// handleResetPassword sets a new password from a reset token. Every existing
+// session is signed out, and the user's outstanding reset links stop working.
+func (s *Server) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+
+	var (
+		userID    int
+		expiresAt int64
+	)
+	err := s.db.QueryRow("SELECT user_id, expires_at FROM password_resets WHERE token_hash = ?", hashToken(req.Token)).
+		Scan(&userID, &expiresAt)
+	if err != nil || time.Now().Unix() > expiresAt {
+		writeJSONError(w, http.StatusBadRequest, "invalid_reset_token", "Invalid or expired reset token")
+		return
+	}
+	if perr := s.checkPasswordStrength(req.Password); perr != nil {
+		writeJSONError(w, http.StatusBadRequest, perr.Code, perr.Message)
+		return
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Error hashing password")
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	// Deleting the token first makes a concurrent second use fail here
+	res, err := tx.Exec("DELETE FROM password_resets WHERE token_hash = ?", hashToken(req.Token))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_reset_token", "Invalid or expired reset token")
+		return
+	}
+	// The link arrived by email, which proves the address too
+	if _, err := tx.Exec("UPDATE users SET password = ?, verified = 1, token_version = token_version + 1 WHERE id = ?", hash, userID); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM password_resets WHERE user_id = ?", userID); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+var resetLink = regexp.MustCompile(`reset-password\?token=([0-9a-f]+)`)
+
+func TestPasswordReset(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	ts.signUp(t, "ada@example.com", "correct horse battery 1")
+	session := ts.login(t, "ada@example.com", "correct horse battery 1")
+
+	sent := len(ts.mailer.sent)
+	if resp := ts.postJSON(t, "/api/auth/forgot", "", map[string]string{"email": "nobody@example.com"}, nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("forgot for unknown email: status %d", resp.StatusCode)
+	}
+	if len(ts.mailer.sent) != sent {
+		t.Fatal("mail sent for an unknown address")
+	}
+
+	if resp := ts.postJSON(t, "/api/auth/forgot", "", map[string]string{"email": "ada@example.com"}, nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("forgot: status %d", resp.StatusCode)
+	}
+	m := resetLink.FindStringSubmatch(ts.mailer.last())
+	if m == nil {
+		t.Fatalf("no reset link in %q", ts.mailer.last())
+	}
+	token := m[1]
+
+	if resp := ts.postJSON(t, "/api/auth/reset", "", map[string]string{"token": token, "password": "short"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("weak password: status %d, want 400", resp.StatusCode)
+	}
+	if resp := ts.postJSON(t, "/api/auth/reset", "", map[string]string{"token": token, "password": "correct horse battery 2"}, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("reset: status %d", resp.StatusCode)
+	}
+	if resp := ts.postJSON(t, "/api/auth/reset", "", map[string]string{"token": token, "password": "correct horse battery 3"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("reused reset token: status %d, want 400", resp.StatusCode)
+	}
+
+	if resp := ts.postJSON(t, "/api/login", "", map[string]string{"email": "ada@example.com", "password": "correct horse battery 1"}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("old password: status %d, want 401", resp.StatusCode)
+	}
+	ts.login(t, "ada@example.com", "correct horse battery 2")
+
+	if resp := ts.do(t, "GET", "/api/projects", session.Token, nil, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("session from before the reset: status %d, want 401", resp.StatusCode)
+	}
+	if _, resp := ts.refresh(t, session.RefreshToken); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("refresh token from before the reset: status %d, want 401", resp.StatusCode)
+	}
+}
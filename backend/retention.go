@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Every successful build keeps its output so it can be previewed and rolled
+// back to, which adds up. Old deployments can be deleted one by one, and a
+// project can keep only its newest few: the rest are deleted after each
+// successful build. Deployments served live, at an alias or at a branch host,
+// and the one waiting for approval, are never deleted.
+
+// keepDeployments is how many successful deployments projects keep unless
+// they set their own keep_deployments; 0 keeps them all.
+var keepDeployments = envInt("GRAPE_KEEP_DEPLOYMENTS", 0)
+
+// maxKeepDeployments bounds the keep_deployments setting.
+const maxKeepDeployments = 1000
+
+var (
+	errDeploymentLive  = errors.New("deployment is live")
+	errDeploymentInUse = errors.New("deployment is served at an alias or branch, or awaiting approval")
+	errDeploymentBuild = errors.New("deployment is still building")
+)
+
+// validateKeepDeployments checks a keep_deployments setting.
+func validateKeepDeployments(n int) error {
+	if n < 0 || n > maxKeepDeployments {
+		return fmt.Errorf("keep_deployments must be 0-%d", maxKeepDeployments)
+	}
+	return nil
+}
+
+// deleteDeployment removes a finished deployment's record and output, unless
+// it is served. sql.ErrNoRows if the project has no such deployment.
+func (s *Server) deleteDeployment(projectID, deploymentID string) error {
+	var (
+		status      string
+		live, inUse bool
+	)
+	err := s.db.QueryRow(`
+		SELECT d.status, d.id = p.live_deployment, d.id = p.pending_deployment
+			OR EXISTS (SELECT 1 FROM project_aliases a WHERE a.project_id = d.project_id AND a.deployment_id = d.id)
+			OR EXISTS (SELECT 1 FROM branch_deploys b WHERE b.project_id = d.project_id AND b.deployment_id = d.id)
+		FROM deployments d JOIN projects p ON p.id = d.project_id
+		WHERE d.id = ? AND d.project_id = ?
+	`, deploymentID, projectID).Scan(&status, &live, &inUse)
+	if err != nil {
+		return err
+	}
+	switch {
+	case status == "queued" || status == "building":
+		return errDeploymentBuild
+	case live:
+		return errDeploymentLive
+	case inUse:
+		return errDeploymentInUse
+	}
+
+	// Conditional, so a rollback or alias switch to it meanwhile keeps it
+	res, err := s.execWithRetry(`
+		DELETE FROM deployments WHERE id = ? AND project_id = ?
+			AND id NOT IN (SELECT live_deployment FROM projects WHERE id = ? UNION SELECT pending_deployment FROM projects WHERE id = ?)
+			AND id NOT IN (SELECT deployment_id FROM project_aliases WHERE project_id = ?)
+			AND id NOT IN (SELECT deployment_id FROM branch_deploys WHERE project_id = ?)
+	`, deploymentID, projectID, projectID, projectID, projectID, projectID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errDeploymentInUse
+	}
+	return s.storage.Delete(deploymentPrefix(projectID, deploymentID))
+}
+
+// pruneDeployments applies the project's retention setting once deploymentID
+// has been promoted, deleting the oldest successful deployments beyond it.
+func (s *Server) pruneDeployments(projectID, deploymentID string) {
+	var keep int
+	s.db.QueryRow("SELECT keep_deployments FROM projects WHERE id = ?", projectID).Scan(&keep)
+	if keep == 0 {
+		keep = keepDeployments
+	}
+	if keep <= 0 {
+		return
+	}
+
+	// The new deployment is still "building" here, so it takes one of the
+	// places without being listed
+	rows, err := s.db.Query(`
+		SELECT id FROM deployments WHERE project_id = ? AND status = ? AND id != ?
+		ORDER BY rowid DESC LIMIT -1 OFFSET ?
+	`, projectID, deploySucceeded, deploymentID, keep-1)
+	if err != nil {
+		log.Printf("project %s: cannot apply deployment retention: %v", projectID, err)
+		return
+	}
+	var old []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			old = append(old, id)
+		}
+	}
+	rows.Close()
+
+	deleted := 0
+	for _, id := range old {
+		err := s.deleteDeployment(projectID, id)
+		switch {
+		case err == nil:
+			deleted++
+		case errors.Is(err, errDeploymentLive), errors.Is(err, errDeploymentInUse):
+		default:
+			log.Printf("project %s: cannot delete old deployment %s: %v", projectID, id, err)
+		}
+	}
+	if deleted > 0 {
+		log.Printf("project %s: deleted %d old deployments, keeping %d", projectID, deleted, keep)
+		s.recordHistory(projectID, "retention", "deleted", fmt.Sprintf("deleted %d old deployments", deleted))
+	}
+}
+
+// handleDeleteDeployment deletes one deployment and its output to free space.
+// The live deployment, those served at an alias or branch host and the one
+// waiting for approval can't be deleted. Deployers and above only.
+func (s *Server) handleDeleteDeployment(w http.ResponseWriter, r *http.Request) {
+	projectID, userID, ok := s.authorizeProject(w, r, roleDeployer)
+	if !ok {
+		return
+	}
+	deploymentID := mux.Vars(r)["deploymentID"]
+
+	err := s.deleteDeployment(projectID, deploymentID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		writeJSONError(w, http.StatusNotFound, "deployment_not_found", "Deployment not found")
+		return
+	case errors.Is(err, errDeploymentBuild):
+		writeJSONError(w, http.StatusConflict, "build_in_progress", "Wait for the build to finish before deleting it")
+		return
+	case errors.Is(err, errDeploymentLive):
+		writeJSONError(w, http.StatusConflict, "deployment_live", "The live deployment can't be deleted; roll back or deploy another version first")
+		return
+	case errors.Is(err, errDeploymentInUse):
+		writeJSONError(w, http.StatusConflict, "deployment_in_use", "The deployment is served at an alias or branch, or waiting for approval")
+		return
+	case err != nil:
+		log.Printf("project %s: cannot delete deployment %s: %v", projectID, deploymentID, err)
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Cannot delete the deployment")
+		return
+	}
+	log.Printf("project %s: deployment %s deleted by user %d", projectID, deploymentID, userID)
+	s.recordHistory(projectID, "deployment", "deleted", deploymentID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDeleteDeployments(t *testing.T) {
+	ts := newTestServer(t, countingRunner{n: new(atomic.Int32)})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID
+	rebuild := func() {
+		ts.do(t, "POST", path+"/rebuild", token, nil, "", nil)
+		ts.waitForStatus(t, token, project.ID)
+	}
+	rebuild()
+	rebuild()
+
+	var deployments []Deployment
+	ts.do(t, "GET", path+"/deployments", token, nil, "", &deployments)
+	if len(deployments) != 3 {
+		t.Fatalf("deployments %+v", deployments)
+	}
+	live, middle, first := deployments[0].ID, deployments[1].ID, deployments[2].ID
+	ts.postJSON(t, path+"/aliases", token, map[string]string{"name": "staging", "deployment_id": first}, nil)
+
+	remove := func(id string) int {
+		return ts.do(t, "DELETE", path+"/deployments/"+id, token, nil, "", nil).StatusCode
+	}
+	if status := remove(live); status != http.StatusConflict {
+		t.Errorf("deleting the live deployment: status %d, want 409", status)
+	}
+	if status := remove(first); status != http.StatusConflict {
+		t.Errorf("deleting an aliased deployment: status %d, want 409", status)
+	}
+	if status := remove(middle); status != http.StatusNoContent {
+		t.Fatalf("delete: status %d", status)
+	}
+	if status := remove(middle); status != http.StatusNotFound {
+		t.Errorf("deleting twice: status %d, want 404", status)
+	}
+	if objects, _ := ts.storage.List(deploymentPrefix(project.ID, middle)); len(objects) != 0 {
+		t.Errorf("deleted deployment's files kept: %v", objects)
+	}
+	if got := ts.livePage(t, project.ID); got != "build 3" {
+		t.Errorf("live page %q after deleting an old deployment", got)
+	}
+
+	// Keep the newest two; the aliased one stays on top of them
+	var updated Project
+	ts.do(t, "PATCH", path, token, jsonBody(map[string]int{"keep_deployments": 2}), "application/json", &updated)
+	if updated.KeepDeployments != 2 {
+		t.Fatalf("updated %+v", updated)
+	}
+	if resp := ts.do(t, "PATCH", path, token, jsonBody(map[string]int{"keep_deployments": -1}), "application/json", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("negative keep_deployments: status %d, want 400", resp.StatusCode)
+	}
+	rebuild()
+	rebuild()
+	deployments = nil
+	ts.do(t, "GET", path+"/deployments", token, nil, "", &deployments)
+	var ids []string
+	for _, d := range deployments {
+		ids = append(ids, d.ID)
+	}
+	if len(deployments) != 3 || !deployments[0].Live || deployments[2].ID != first {
+		t.Errorf("after retention, deployments %v", ids)
+	}
+	if objects, _ := ts.storage.List(deploymentPrefix(project.ID, live)); len(objects) != 0 {
+		t.Errorf("pruned deployment's files kept: %v", objects)
+	}
+	if got := ts.livePage(t, project.ID); got != "build 5" {
+		t.Errorf("live page %q, want build 5", got)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Revoking a session already locks out its access tokens, but a single leaked
+// token can be revoked on its own: access tokens carry an ID (jti), and
+// revoked IDs are kept until the token would have expired anyway.
+
+// tokenDenied reports whether the access token with this ID was revoked.
+func (s *Server) tokenDenied(jti string) (bool, error) {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM revoked_tokens WHERE jti = ?", jti).Scan(&n)
+	return n > 0, err
+}
+
+// denyToken revokes one access token.
+func (s *Server) denyToken(claims *Claims) error {
+	now := time.Now()
+	expires := now.Add(accessTokenTTL)
+	if claims.ExpiresAt != nil {
+		expires = claims.ExpiresAt.Time
+	}
+	if _, err := s.db.Exec("INSERT OR IGNORE INTO revoked_tokens (jti, user_id, expires_at) VALUES (?, ?, ?)",
+		claims.ID, claims.UserID, expires.Unix()); err != nil {
+		return err
+	}
+	s.db.Exec("DELETE FROM revoked_tokens WHERE expires_at <= ?", now.Unix())
+	return nil
+}
+
+// handleRevokeToken revokes an access or refresh token, in the manner of
+// RFC 7009: holding the token is all it takes, and tokens that are unknown,
+// expired or already revoked are accepted just the same.
+func (s *Server) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	req.Token = strings.TrimSpace(req.Token)
+	if req.Token == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing_token", "token is required")
+		return
+	}
+
+	var err error
+	if strings.Count(req.Token, ".") == 2 {
+		claims := &Claims{}
+		_, perr := jwt.ParseWithClaims(req.Token, claims, s.keys.verificationKey,
+			jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
+		if perr == nil && claims.ID != "" {
+			err = s.denyToken(claims)
+		}
+	} else {
+		err = s.revokeRefreshFamily(req.Token)
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
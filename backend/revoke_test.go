@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRevokeAccessToken(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	ts.signUp(t, "ada@example.com", "correct horse battery 1")
+	pair := ts.login(t, "ada@example.com", "correct horse battery 1")
+
+	if resp := ts.postJSON(t, "/api/auth/revoke", "", map[string]string{"token": pair.Token}, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("revoke: status %d", resp.StatusCode)
+	}
+	if resp := ts.do(t, "GET", "/api/projects", pair.Token, nil, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("revoked access token: status %d, want 401", resp.StatusCode)
+	}
+
+	// The session itself lives on
+	next, resp := ts.refresh(t, pair.RefreshToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("refresh after revoking the access token: status %d", resp.StatusCode)
+	}
+	if resp := ts.do(t, "GET", "/api/projects", next.Token, nil, "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("fresh access token: status %d", resp.StatusCode)
+	}
+
+	if resp := ts.postJSON(t, "/api/auth/revoke", "", map[string]string{"token": next.RefreshToken}, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("revoke refresh token: status %d", resp.StatusCode)
+	}
+	if resp := ts.do(t, "GET", "/api/projects", next.Token, nil, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("access token of a revoked session: status %d, want 401", resp.StatusCode)
+	}
+
+	for _, token := range []string{"not-a-token", "a.b.c"} {
+		if resp := ts.postJSON(t, "/api/auth/revoke", "", map[string]string{"token": token}, nil); resp.StatusCode != http.StatusNoContent {
+			t.Errorf("revoke %q: status %d, want 204", token, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Project roles, lowest first. Viewers can read a project and its build logs,
+// deployers can also rebuild it and change its build environment, and admins
+// can do anything, including deleting it and managing its members. The
+// uploader is always an admin and org members are viewers; explicit grants
+// live in project_members.
+type projectRole int
+
+const (
+	roleNone projectRole = iota
+	roleViewer
+	roleDeployer
+	roleAdmin
+)
+
+var projectRoleNames = []string{"", "viewer", "deployer", "admin"}
+
+func (r projectRole) String() string { return projectRoleNames[r] }
+
+func parseProjectRole(name string) (projectRole, bool) {
+	for i, n := range projectRoleNames {
+		if n != "" && n == name {
+			return projectRole(i), true
+		}
+	}
+	return roleNone, false
+}
+
+// accessibleProjectIDs is a subquery of the IDs of projects the user can see.
+// It takes the user ID once.
+const accessibleProjectIDs = "(SELECT project_id FROM project_access WHERE user_id = ?)"
+
+// visibleProjects restricts a query on projects to those the user can see.
+const visibleProjects = "id IN " + accessibleProjectIDs
+
+type ProjectMember struct {
+	UserID  int    `json:"user_id"`
+	Email   string `json:"email"`
+	Role    string `json:"role"`
+	AddedAt int64  `json:"added_at"`
+}
+
+// projectRole returns the highest role the user holds on the project, or
+// roleNone if they cannot see it.
+func (s *Server) projectRole(projectID string, userID int) (projectRole, error) {
+	rows, err := s.db.Query("SELECT role FROM project_access WHERE project_id = ? AND user_id = ?", projectID, userID)
+	if err != nil {
+		return roleNone, err
+	}
+	defer rows.Close()
+
+	role := roleNone
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return roleNone, err
+		}
+		if r, ok := parseProjectRole(name); ok && r > role {
+			role = r
+		}
+	}
+	return role, rows.Err()
+}
+
+// authorizeProject checks that the caller holds at least the given role on
+// the {id} project. Callers who cannot see the project get a 404, so its
+// existence isn't revealed; those who can but lack the role get a 403.
+func (s *Server) authorizeProject(w http.ResponseWriter, r *http.Request, need projectRole) (projectID string, userID int, ok bool) {
+	projectID = mux.Vars(r)["id"]
+	userID = r.Context().Value("userID").(int)
+
+	role, err := s.projectRole(projectID, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return "", 0, false
+	}
+	if role == roleNone {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return "", 0, false
+	}
+	if role < need {
+		writeJSONError(w, http.StatusForbidden, "insufficient_role", "This requires the "+need.String()+" role on the project")
+		return "", 0, false
+	}
+	return projectID, userID, true
+}
+
+// projectAudience returns everyone who can see the project.
+func (s *Server) projectAudience(projectID string) []int {
+	rows, err := s.db.Query("SELECT DISTINCT user_id FROM project_access WHERE project_id = ?", projectID)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if rows.Scan(&userID) == nil {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs
+}
+
+// invalidateProjectLists drops the cached project lists of everyone who can
+// see the project.
+func (s *Server) invalidateProjectLists(projectID string, ownerID int) {
+	s.projectsCache.invalidate(ownerID)
+	for _, userID := range s.projectAudience(projectID) {
+		s.projectsCache.invalidate(userID)
+	}
+}
+
+// handleDeleteProject removes a project and all of its files. Admins only.
+func (s *Server) handleDeleteProject(w http.ResponseWriter, r *http.Request) {
+	projectID, userID, ok := s.authorizeProject(w, r, roleAdmin)
+	if !ok {
+		return
+	}
+
+	var (
+		ownerID int
+		status  string
+	)
+	if err := s.db.QueryRow("SELECT user_id, status FROM projects WHERE id = ?", projectID).Scan(&ownerID, &status); err != nil {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+	// Admins can still force-remove a project mid-build through the admin API
+	if status == "queued" || status == "building" {
+		writeJSONError(w, http.StatusConflict, "build_in_progress", "Wait for the build to finish before deleting the project")
+		return
+	}
+	if err := s.deleteProject(projectID); err != nil {
+		log.Printf("project %s: deletion failed: %v", projectID, err)
+		http.Error(w, "Could not delete project", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("project %s (user %d) deleted by user %d", projectID, ownerID, userID)
+	s.publishStatus(projectID, ownerID, "deleted")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleListProjectMembers(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleViewer)
+	if !ok {
+		return
+	}
+
+	rows, err := s.db.Query(`
+		SELECT u.id, u.email, m.role, m.created_at FROM project_members m JOIN users u ON u.id = m.user_id
+		WHERE m.project_id = ? ORDER BY m.created_at
+	`, projectID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	members := []ProjectMember{}
+	for rows.Next() {
+		var m ProjectMember
+		if err := rows.Scan(&m.UserID, &m.Email, &m.Role, &m.AddedAt); err != nil {
+			continue
+		}
+		members = append(members, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// handleSetProjectMember grants an existing user a role on the project, or
+// changes the role they have. Admins only.
+func (s *Server) handleSetProjectMember(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleAdmin)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if _, ok := parseProjectRole(req.Role); !ok {
+		http.Error(w, "role must be viewer, deployer or admin", http.StatusBadRequest)
+		return
+	}
+
+	var memberID, ownerID int
+	if err := s.db.QueryRow("SELECT id FROM users WHERE email = ?", req.Email).Scan(&memberID); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err := s.db.QueryRow("SELECT user_id FROM projects WHERE id = ?", projectID).Scan(&ownerID); err != nil {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+	if memberID == ownerID {
+		http.Error(w, "The project's owner is always an admin", http.StatusConflict)
+		return
+	}
+
+	now := time.Now().Unix()
+	if _, err := s.db.Exec(`
+		INSERT INTO project_members (project_id, user_id, role, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (project_id, user_id) DO UPDATE SET role = excluded.role
+	`, projectID, memberID, req.Role, now); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.projectsCache.invalidate(memberID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ProjectMember{UserID: memberID, Email: req.Email, Role: req.Role, AddedAt: now})
+}
+
+// handleRemoveProjectMember revokes a grant. Admins can remove anyone and
+// members can remove themselves.
+func (s *Server) handleRemoveProjectMember(w http.ResponseWriter, r *http.Request) {
+	projectID, userID, ok := s.authorizeProject(w, r, roleViewer)
+	if !ok {
+		return
+	}
+	memberID, err := strconv.Atoi(mux.Vars(r)["userID"])
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	if memberID != userID {
+		if _, _, ok := s.authorizeProject(w, r, roleAdmin); !ok {
+			return
+		}
+	}
+
+	res, err := s.db.Exec("DELETE FROM project_members WHERE project_id = ? AND user_id = ?", projectID, memberID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	s.projectsCache.invalidate(memberID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProjectRoles(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	alice := ts.signUp(t, "alice@example.com", "correct horse battery")
+	bob := ts.signUp(t, "bob@example.com", "correct horse battery")
+	carol := ts.signUp(t, "carol@example.com", "correct horse battery")
+
+	project, _ := ts.upload(t, alice, "team", siteZip(t))
+	ts.waitForStatus(t, alice, project.ID)
+	path := "/api/projects/" + project.ID
+
+	grant := func(email, role string) *http.Response {
+		return ts.do(t, "PUT", path+"/members", alice, jsonBody(map[string]string{"email": email, "role": role}), "application/json", nil)
+	}
+	if resp := grant("bob@example.com", "viewer"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("grant viewer: status %d", resp.StatusCode)
+	}
+	if resp := grant("alice@example.com", "viewer"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("demoting the owner: status %d, want 409", resp.StatusCode)
+	}
+
+	var seen Project
+	ts.do(t, "GET", path, bob, nil, "", &seen)
+	if seen.Role != "viewer" {
+		t.Errorf("bob's role = %q", seen.Role)
+	}
+	if resp := ts.do(t, "GET", path+"/logs", bob, nil, "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("viewer reading logs: status %d", resp.StatusCode)
+	}
+	for _, req := range []struct{ method, path string }{
+		{"POST", path + "/rebuild"},
+		{"GET", path + "/env"},
+		{"DELETE", path},
+	} {
+		if resp := ts.do(t, req.method, req.path, bob, nil, "", nil); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("viewer %s %s: status %d, want 403", req.method, req.path, resp.StatusCode)
+		}
+	}
+	if resp := ts.do(t, "GET", path+"/logs", carol, nil, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("stranger reading logs: status %d, want 404", resp.StatusCode)
+	}
+
+	grant("bob@example.com", "deployer")
+	if resp := ts.do(t, "POST", path+"/rebuild", bob, nil, "", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("deployer rebuild: status %d", resp.StatusCode)
+	}
+	ts.waitForStatus(t, bob, project.ID)
+	if resp := ts.do(t, "POST", path+"/redeploy", bob, nil, "", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("deployer redeploy: status %d", resp.StatusCode)
+	}
+	ts.waitForStatus(t, bob, project.ID)
+	if resp := ts.postJSON(t, path+"/env", bob, map[string]string{"key": "API_URL", "value": "https://api.example.com"}, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("deployer setting env: status %d", resp.StatusCode)
+	}
+	if resp := ts.do(t, "PUT", path+"/webhook", bob, jsonBody(map[string]string{"url": ""}), "application/json", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("deployer setting webhook: status %d, want 403", resp.StatusCode)
+	}
+	if resp := ts.do(t, "DELETE", path, bob, nil, "", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("deployer deleting: status %d, want 403", resp.StatusCode)
+	}
+
+	var projects []Project
+	ts.do(t, "GET", "/api/projects", bob, nil, "", &projects)
+	if len(projects) != 1 {
+		t.Fatalf("bob's projects = %+v", projects)
+	}
+	if resp := ts.do(t, "DELETE", path, alice, nil, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("admin deleting: status %d", resp.StatusCode)
+	}
+	projects = nil
+	ts.do(t, "GET", "/api/projects", bob, nil, "", &projects)
+	if len(projects) != 0 {
+		t.Errorf("bob's projects after deletion = %+v", projects)
+	}
+}
+
+func TestMembersCanLeaveProject(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	alice := ts.signUp(t, "alice@example.com", "correct horse battery")
+	bob := ts.signUp(t, "bob@example.com", "correct horse battery")
+
+	project, _ := ts.upload(t, alice, "team", siteZip(t))
+	ts.waitForStatus(t, alice, project.ID)
+	path := "/api/projects/" + project.ID
+
+	var member ProjectMember
+	ts.do(t, "PUT", path+"/members", alice, jsonBody(map[string]string{"email": "bob@example.com", "role": "viewer"}), "application/json", &member)
+	if resp := ts.do(t, "DELETE", fmt.Sprintf("%s/members/%d", path, member.UserID), bob, nil, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("leaving: status %d", resp.StatusCode)
+	}
+	if resp := ts.do(t, "GET", path, bob, nil, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("after leaving: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestDeleteProject(t *testing.T) {
+	ts := newTestServer(t, hangingRunner{})
+	session := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, session, "site", siteZip(t))
+
+	if resp := ts.do(t, "DELETE", "/api/projects/"+project.ID, session, nil, "", nil); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("delete during a build: status %d, want 409", resp.StatusCode)
+	}
+	if _, err := ts.failProjectsIn("\nstopped", "queued", "building"); err != nil {
+		t.Fatal(err)
+	}
+	ts.builds.cancelAndWait([]string{project.ID}, 5*time.Second)
+
+	if resp := ts.do(t, "DELETE", "/api/projects/"+project.ID, session, nil, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: status %d", resp.StatusCode)
+	}
+	if resp := ts.do(t, "GET", "/api/projects/"+project.ID, session, nil, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleted project: status %d, want 404", resp.StatusCode)
+	}
+	ts.cleanupFiles(context.Background())
+	if _, _, err := ts.findUpload(project.ID); err == nil {
+		t.Error("uploaded archive survived deletion")
+	}
+	if _, err := os.Stat(filepath.Join(ts.cfg.ProjectsDir, project.ID)); !os.IsNotExist(err) {
+		t.Errorf("extracted source survived deletion: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A project's root directory is where its site lives inside the uploaded
+// archive or repository, e.g. apps/web of a monorepo. Only that subtree is
+// built, its grape.yaml and _headers apply, and pushes that change nothing
+// under it don't trigger builds. The whole source is still stored, so
+// workspace files elsewhere stay available to the build.
+
+// maxRootDirLength bounds the root directory setting.
+const maxRootDirLength = 200
+
+// validateRootDir normalizes a root directory to a clean relative slash path,
+// "" for the top of the source.
+func validateRootDir(dir string) (string, error) {
+	dir = strings.Trim(strings.TrimSpace(strings.ReplaceAll(dir, `\`, "/")), "/")
+	if len(dir) > maxRootDirLength {
+		return "", fmt.Errorf("root_dir must be at most %d characters", maxRootDirLength)
+	}
+	dir = path.Clean(dir)
+	if dir == "." {
+		return "", nil
+	}
+	if dir == ".." || strings.HasPrefix(dir, "../") {
+		return "", errors.New("root_dir must stay inside the project")
+	}
+	return dir, nil
+}
+
+// projectRoot is the directory of a source checkout at projectPath that is
+// built.
+func projectRoot(projectPath, rootDir string) string {
+	return filepath.Join(projectPath, filepath.FromSlash(rootDir))
+}
+
+// checkProjectRoot reports a root directory missing from the source.
+func checkProjectRoot(projectPath, rootDir string) error {
+	if rootDir == "" {
+		return nil
+	}
+	info, err := os.Stat(projectRoot(projectPath, rootDir))
+	if err != nil || !info.IsDir() {
+		return fmt.Errorf("root directory %s not found in the source", rootDir)
+	}
+	return nil
+}
+
+// touchesRootDir reports whether a push changing files (slash paths from the
+// top of the repository) may change the site under rootDir. A nil list
+// means the provider didn't say, so the push is built.
+func touchesRootDir(rootDir string, files []string) bool {
+	if rootDir == "" || files == nil {
+		return true
+	}
+	for _, f := range files {
+		if f == rootDir || strings.HasPrefix(f, rootDir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// rootDir returns the project's root directory setting.
+func (s *Server) rootDir(projectID string) string {
+	var dir string
+	s.db.QueryRow("SELECT root_dir FROM projects WHERE id = ?", projectID).Scan(&dir)
+	return dir
+}
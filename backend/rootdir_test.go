@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"testing"
+)
+
+func TestValidateRootDir(t *testing.T) {
+	for in, want := range map[string]string{
+		"":             "",
+		"/":            "",
+		".":            "",
+		"apps/web":     "apps/web",
+		"/apps/web/":   "apps/web",
+		`apps\web`:     "apps/web",
+		"apps/./web//": "apps/web",
+	} {
+		if got, err := validateRootDir(in); err != nil || got != want {
+			t.Errorf("validateRootDir(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"..", "../secrets", "apps/../../etc"} {
+		if _, err := validateRootDir(in); err == nil {
+			t.Errorf("validateRootDir(%q) accepted", in)
+		}
+	}
+
+	if !touchesRootDir("apps/web", nil) || !touchesRootDir("", []string{"README.md"}) {
+		t.Error("unknown changes or no root directory must build")
+	}
+	if !touchesRootDir("apps/web", []string{"README.md", "apps/web/index.html"}) {
+		t.Error("change under the root directory ignored")
+	}
+	if touchesRootDir("apps/web", []string{"apps/website/index.html", "README.md"}) {
+		t.Error("change outside the root directory builds")
+	}
+}
+
+// monorepoZip holds a site under apps/web and another at the top.
+func monorepoZip(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, page := range map[string]string{"index.html": "<h1>top</h1>", "apps/web/index.html": "<h1>web</h1>"} {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(page))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRootDirBuilds(t *testing.T) {
+	ts := newTestServer(t, sourceRunner{})
+	remote := ts.gitRemote(t, "/srv/monorepo")
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+
+	upload := func(rootDir string) (Project, *http.Response) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("name", "monorepo")
+		mw.WriteField("root_dir", rootDir)
+		part, _ := mw.CreateFormFile("project", "site.zip")
+		part.Write(monorepoZip(t))
+		mw.Close()
+		var project Project
+		resp := ts.send(t, "POST", "/api/upload", token, &body, http.Header{"Content-Type": {mw.FormDataContentType()}}, &project)
+		return project, resp
+	}
+	if _, resp := upload("apps/api"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("missing root directory: status %d, want 400", resp.StatusCode)
+	}
+	project, resp := upload("/apps/web/")
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload: status %d", resp.StatusCode)
+	}
+	if p := ts.waitForStatus(t, token, project.ID); p.Status != "live" || p.RootDir != "apps/web" {
+		t.Fatalf("project %+v", p)
+	}
+	if got := ts.livePage(t, project.ID); got != "<h1>web</h1>" {
+		t.Errorf("live page %q, want the apps/web site", got)
+	}
+
+	path := "/api/projects/" + project.ID
+	if resp := ts.do(t, "PATCH", path, token, jsonBody(map[string]string{"root_dir": "apps/api"}), "application/json", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("PATCH to a missing root directory: status %d, want 400", resp.StatusCode)
+	}
+	var updated Project
+	ts.do(t, "PATCH", path, token, jsonBody(map[string]string{"root_dir": ""}), "application/json", &updated)
+	if updated.RootDir != "" {
+		t.Fatalf("updated %+v", updated)
+	}
+	ts.do(t, "POST", path+"/rebuild", token, nil, "", nil)
+	ts.waitForStatus(t, token, project.ID)
+	if got := ts.livePage(t, project.ID); got != "<h1>top</h1>" {
+		t.Errorf("after clearing root_dir, live page %q", got)
+	}
+
+	// Pushes are built only when they touch the root directory
+	ts.do(t, "PATCH", path, token, jsonBody(map[string]string{"root_dir": "apps/web"}), "application/json", nil)
+	var link gitLink
+	ts.do(t, "PUT", path+"/git", token, jsonBody(map[string]string{"repo_url": remote}), "application/json", &link)
+	payload := []byte(`{"ref": "refs/heads/main", "after": "3f9a1c2b", "repository": {"clone_url": "` + remote + `"},
+		"commits": [{"id": "3f9a1c2b", "message": "Docs", "modified": ["README.md", "apps/api/main.go"]}]}`)
+	header := http.Header{"X-Github-Event": {"push"}, "X-Hub-Signature-256": {signWebhook(link.Secret, payload)}}
+	var result map[string][]string
+	resp = ts.send(t, "POST", "/api/hooks/github", "", bytes.NewReader(payload), header, &result)
+	if resp.StatusCode != http.StatusAccepted || len(result["queued"]) != 0 || len(result["skipped"]) != 1 {
+		t.Errorf("unrelated push: status %d, %v", resp.StatusCode, result)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3Storage keeps objects in an S3-compatible bucket (AWS, MinIO, R2, ...).
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+}
+
+func newS3Storage() (*s3Storage, error) {
+	bucket := envString("GRAPE_S3_BUCKET", "")
+	if bucket == "" {
+		return nil, errors.New("GRAPE_S3_BUCKET is required")
+	}
+	client, err := minio.New(envString("GRAPE_S3_ENDPOINT", "s3.amazonaws.com"), &minio.Options{
+		Creds: credentials.NewStaticV4(
+			envString("GRAPE_S3_ACCESS_KEY", ""), envString("GRAPE_S3_SECRET_KEY", ""), ""),
+		Region: envString("GRAPE_S3_REGION", ""),
+		Secure: envString("GRAPE_S3_INSECURE", "false") != "true",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := client.BucketExists(context.Background(), bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("bucket " + bucket + " does not exist")
+	}
+	return &s3Storage{client: client, bucket: bucket}, nil
+}
+
+func s3Error(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return fs.ErrNotExist
+	}
+	return err
+}
+
+func (s *s3Storage) Put(key string, r io.Reader) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, key, r, -1, minio.PutObjectOptions{
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+	})
+	return err
+}
+
+func (s *s3Storage) Get(key string) (io.ReadSeekCloser, ObjectInfo, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, ObjectInfo{}, s3Error(err)
+	}
+	// GetObject is lazy; Stat makes the request and surfaces missing keys
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, ObjectInfo{}, s3Error(err)
+	}
+	return obj, ObjectInfo{Key: key, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *s3Storage) Stat(key string) (ObjectInfo, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, s3Error(err)
+	}
+	return ObjectInfo{Key: key, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *s3Storage) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		objects = append(objects, ObjectInfo{Key: obj.Key, Size: obj.Size, ModTime: obj.LastModified})
+	}
+	return objects, nil
+}
+
+func (s *s3Storage) Delete(prefix string) error {
+	ctx := context.Background()
+	if !strings.HasSuffix(prefix, "/") {
+		return s.client.RemoveObject(ctx, s.bucket, prefix, minio.RemoveObjectOptions{})
+	}
+
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true})
+	for res := range s.client.RemoveObjects(ctx, s.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if res.Err != nil {
+			return res.Err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Projects can be rebuilt on a cron schedule, e.g. nightly for a static site
+// that pulls content from a CMS at build time. A background loop checks every
+// minute for schedules that are due and rebuilds from the stored source, like
+// POST /rebuild. A run that finds a build already going is skipped; runs
+// missed while the server was down happen once when it is back.
+
+// scheduleInterval is how often due schedules are looked for.
+const scheduleInterval = time.Minute
+
+// maxProjectSchedules is how many schedules a project may have.
+const maxProjectSchedules = 5
+
+// scheduleMinInterval is the shortest gap allowed between runs of a schedule.
+var scheduleMinInterval = envDuration("GRAPE_SCHEDULE_MIN_INTERVAL", time.Hour)
+
+// Outcomes of a scheduled run, kept as the schedule's last_status.
+const (
+	scheduleQueued  = "queued"
+	scheduleSkipped = "skipped"
+	scheduleFailed  = "failed"
+)
+
+// Schedule is a recurring rebuild of a project.
+type Schedule struct {
+	ID         int    `json:"id"`
+	Cron       string `json:"cron"`
+	Timezone   string `json:"timezone"`
+	CreatedBy  int    `json:"created_by"`
+	CreatedAt  int64  `json:"created_at"`
+	NextRunAt  int64  `json:"next_run_at"`
+	LastRunAt  int64  `json:"last_run_at,omitempty"`
+	LastStatus string `json:"last_status,omitempty"`
+}
+
+// nextScheduleRun parses a schedule and returns its first run after now.
+func nextScheduleRun(expr, timezone string, now time.Time) (time.Time, error) {
+	c, err := parseCron(expr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unknown timezone %q", timezone)
+	}
+	next := c.next(now.In(loc))
+	if next.IsZero() {
+		return next, errors.New("the schedule never runs")
+	}
+	return next, nil
+}
+
+// validateSchedule checks a new schedule and returns its first run. Runs must
+// be at least scheduleMinInterval apart.
+func validateSchedule(expr, timezone string, now time.Time) (time.Time, error) {
+	first, err := nextScheduleRun(expr, timezone, now)
+	if err != nil {
+		return first, err
+	}
+	c, _ := parseCron(expr)
+	prev := first
+	for i := 0; i < 100; i++ {
+		next := c.next(prev)
+		if next.IsZero() {
+			break
+		}
+		if next.Sub(prev) < scheduleMinInterval {
+			return first, fmt.Errorf("runs must be at least %s apart", scheduleMinInterval)
+		}
+		prev = next
+	}
+	return first, nil
+}
+
+// runSchedules starts due scheduled builds until ctx is cancelled.
+func (s *Server) runSchedules(ctx context.Context) {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		s.runDueSchedules(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runDueSchedules starts a rebuild for every schedule due at now and moves
+// each to its next run.
+func (s *Server) runDueSchedules(now time.Time) {
+	rows, err := s.db.Query(`
+		SELECT id, project_id, cron, timezone, created_by, next_run_at FROM project_schedules
+		WHERE next_run_at <= ? ORDER BY next_run_at
+	`, now.Unix())
+	if err != nil {
+		log.Printf("schedules: %v", err)
+		return
+	}
+	type dueSchedule struct {
+		id, createdBy         int
+		projectID, expr, zone string
+		nextRunAt             int64
+	}
+	var due []dueSchedule
+	for rows.Next() {
+		var d dueSchedule
+		if rows.Scan(&d.id, &d.projectID, &d.expr, &d.zone, &d.createdBy, &d.nextRunAt) == nil {
+			due = append(due, d)
+		}
+	}
+	rows.Close()
+
+	for _, d := range due {
+		next, err := nextScheduleRun(d.expr, d.zone, now)
+		if err != nil {
+			log.Printf("project %s: schedule %d is invalid: %v", d.projectID, d.id, err)
+			next = now.Add(24 * time.Hour)
+		}
+		// Conditional, so only one instance runs it
+		res, err := s.execWithRetry("UPDATE project_schedules SET next_run_at = ?, last_run_at = ? WHERE id = ? AND next_run_at = ?",
+			next.Unix(), now.Unix(), d.id, d.nextRunAt)
+		if err != nil {
+			log.Printf("project %s: cannot advance schedule %d: %v", d.projectID, d.id, err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		status := s.scheduledRebuild(d.projectID, d.createdBy)
+		s.execWithRetry("UPDATE project_schedules SET last_status = ? WHERE id = ?", status, d.id)
+	}
+}
+
+// scheduledRebuild rebuilds the project from its stored source unless a
+// build is already queued or running, returning the run's outcome.
+func (s *Server) scheduledRebuild(projectID string, userID int) string {
+	var ownerID int
+	var status string
+	if err := s.db.QueryRow("SELECT user_id, status FROM projects WHERE id = ?", projectID).Scan(&ownerID, &status); err != nil {
+		log.Printf("project %s: scheduled build: %v", projectID, err)
+		return scheduleFailed
+	}
+	if status == "queued" || status == "building" || status == "archived" {
+		return scheduleSkipped
+	}
+	if _, _, err := s.findUpload(projectID); err != nil {
+		log.Printf("project %s: scheduled build: source unavailable: %v", projectID, err)
+		return scheduleFailed
+	}
+	queued, err := s.updateProjectStatusLog(projectID, status, "queued", "")
+	if err != nil {
+		log.Printf("project %s: cannot queue scheduled build: %v", projectID, err)
+		return scheduleFailed
+	}
+	if !queued {
+		return scheduleSkipped
+	}
+	log.Printf("project %s: scheduled rebuild", projectID)
+	s.publishStatus(projectID, ownerID, "queued")
+	src := s.lastDeploySource(projectID)
+	src.Trigger, src.UserID = "schedule", userID
+	s.startBuild(projectID, filepath.Join(s.cfg.ProjectsDir, projectID), src)
+	return scheduleQueued
+}
+
+// handleListSchedules returns the project's schedules.
+func (s *Server) handleListSchedules(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleViewer)
+	if !ok {
+		return
+	}
+	rows, err := s.db.Query(`
+		SELECT id, cron, timezone, created_by, created_at, next_run_at, last_run_at, last_status
+		FROM project_schedules WHERE project_id = ? ORDER BY id
+	`, projectID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	defer rows.Close()
+
+	schedules := []Schedule{}
+	for rows.Next() {
+		var sc Schedule
+		if err := rows.Scan(&sc.ID, &sc.Cron, &sc.Timezone, &sc.CreatedBy, &sc.CreatedAt, &sc.NextRunAt, &sc.LastRunAt, &sc.LastStatus); err != nil {
+			continue
+		}
+		schedules = append(schedules, sc)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedules)
+}
+
+// handleCreateSchedule adds a rebuild schedule to the project. Deployers and
+// above only.
+func (s *Server) handleCreateSchedule(w http.ResponseWriter, r *http.Request) {
+	projectID, userID, ok := s.authorizeProject(w, r, roleDeployer)
+	if !ok {
+		return
+	}
+	var req struct {
+		Cron     string `json:"cron"`
+		Timezone string `json:"timezone"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	sc := Schedule{
+		Cron:      strings.Join(strings.Fields(req.Cron), " "),
+		Timezone:  strings.TrimSpace(req.Timezone),
+		CreatedBy: userID,
+		CreatedAt: time.Now().Unix(),
+	}
+	if sc.Timezone == "" {
+		sc.Timezone = "UTC"
+	}
+	// Local would follow the server's zone, not the user's
+	if sc.Timezone == "Local" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_schedule", `Unknown timezone "Local"`)
+		return
+	}
+	next, err := validateSchedule(sc.Cron, sc.Timezone, time.Now())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_schedule", "Invalid schedule: "+err.Error())
+		return
+	}
+	sc.NextRunAt = next.Unix()
+
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM project_schedules WHERE project_id = ?", projectID).Scan(&count); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if count >= maxProjectSchedules {
+		writeJSONError(w, http.StatusConflict, "too_many_schedules", fmt.Sprintf("A project can have at most %d schedules", maxProjectSchedules))
+		return
+	}
+	res, err := s.db.Exec(`
+		INSERT INTO project_schedules (project_id, cron, timezone, created_by, created_at, next_run_at) VALUES (?, ?, ?, ?, ?, ?)
+	`, projectID, sc.Cron, sc.Timezone, sc.CreatedBy, sc.CreatedAt, sc.NextRunAt)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	id, _ := res.LastInsertId()
+	sc.ID = int(id)
+	log.Printf("project %s: schedule %d (%s %s) added by user %d", projectID, sc.ID, sc.Cron, sc.Timezone, userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sc)
+}
+
+// handleDeleteSchedule removes one of the project's schedules. Deployers and
+// above only.
+func (s *Server) handleDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	projectID, userID, ok := s.authorizeProject(w, r, roleDeployer)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["scheduleID"])
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "schedule_not_found", "Schedule not found")
+		return
+	}
+	res, err := s.db.Exec("DELETE FROM project_schedules WHERE id = ? AND project_id = ?", id, projectID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeJSONError(w, http.StatusNotFound, "schedule_not_found", "Schedule not found")
+		return
+	}
+	log.Printf("project %s: schedule %d removed by user %d", projectID, id, userID)
+	w.WriteHeader(http.StatusNoContent)
+}
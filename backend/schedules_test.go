@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidateSchedule(t *testing.T) {
+	now := time.Date(2026, 3, 4, 10, 17, 0, 0, time.UTC)
+	next, err := validateSchedule("0 3 * * *", "Europe/Paris", now)
+	if err != nil || !next.Equal(time.Date(2026, 3, 5, 2, 0, 0, 0, time.UTC)) {
+		t.Errorf("nightly in Paris: %s, %v", next.UTC(), err)
+	}
+	for expr, zone := range map[string]string{
+		"*/5 * * * *":  "UTC",
+		"0,30 * * * *": "UTC",
+		"0 3 * * *":    "Mars/Olympus_Mons",
+		"0 0 30 2 *":   "UTC",
+	} {
+		if _, err := validateSchedule(expr, zone, now); err == nil {
+			t.Errorf("validateSchedule(%q, %q) accepted", expr, zone)
+		}
+	}
+}
+
+func TestScheduledRebuilds(t *testing.T) {
+	ts := newTestServer(t, countingRunner{n: new(atomic.Int32)})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID
+
+	if resp := ts.postJSON(t, path+"/schedules", token, map[string]string{"cron": "* * * * *"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("every minute: status %d, want 400", resp.StatusCode)
+	}
+	var schedule Schedule
+	if resp := ts.postJSON(t, path+"/schedules", token, map[string]string{"cron": "@daily"}, &schedule); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: status %d", resp.StatusCode)
+	}
+	if schedule.Timezone != "UTC" || schedule.NextRunAt <= time.Now().Unix() {
+		t.Errorf("schedule %+v", schedule)
+	}
+
+	// Not due yet
+	ts.runDueSchedules(time.Now())
+	ts.waitForStatus(t, token, project.ID)
+	if got := ts.livePage(t, project.ID); got != "build 1" {
+		t.Fatalf("ran early: %q", got)
+	}
+
+	due := time.Unix(schedule.NextRunAt, 0)
+	ts.runDueSchedules(due)
+	ts.waitForStatus(t, token, project.ID)
+	if got := ts.livePage(t, project.ID); got != "build 2" {
+		t.Errorf("after the scheduled run, live page %q", got)
+	}
+	var schedules []Schedule
+	ts.do(t, "GET", path+"/schedules", token, nil, "", &schedules)
+	if len(schedules) != 1 || schedules[0].LastStatus != scheduleQueued || schedules[0].LastRunAt != due.Unix() ||
+		schedules[0].NextRunAt != due.Add(24*time.Hour).Unix() {
+		t.Errorf("schedules %+v", schedules)
+	}
+	var deployments []Deployment
+	ts.do(t, "GET", path+"/deployments", token, nil, "", &deployments)
+	if deployments[0].Trigger != "schedule" {
+		t.Errorf("deployment %+v", deployments[0])
+	}
+
+	// Only once, however often the loop looks
+	ts.runDueSchedules(due.Add(time.Minute))
+	ts.waitForStatus(t, token, project.ID)
+	if got := ts.livePage(t, project.ID); got != "build 2" {
+		t.Errorf("ran twice: %q", got)
+	}
+
+	resp := ts.do(t, "DELETE", fmt.Sprintf("%s/schedules/%d", path, schedule.ID), token, nil, "", nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: status %d", resp.StatusCode)
+	}
+	ts.runDueSchedules(due.Add(48 * time.Hour))
+	ts.waitForStatus(t, token, project.ID)
+	if got := ts.livePage(t, project.ID); got != "build 2" {
+		t.Errorf("deleted schedule ran: %q", got)
+	}
+}
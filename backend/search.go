@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxSearchResults = 50
+
+// initSearchIndex creates the FTS5 index over project names and build logs,
+// kept in sync by triggers and rebuilt at startup in case it drifted while a
+// non-FTS build was running against this database. A binary built without
+// FTS5 support (go-sqlite3 needs the sqlite_fts5 build tag) only starts with
+// GRAPE_SEARCH_LIKE_FALLBACK=true, and search then scans with LIKE.
+func (s *Server) initSearchIndex() {
+	_, err := s.db.Exec(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS projects_fts
+		USING fts5(name, build_log, content='projects', content_rowid='rowid')
+	`)
+	if err != nil {
+		if envString("GRAPE_SEARCH_LIKE_FALLBACK", "false") != "true" {
+			log.Fatalf("Full-text search unavailable (%v): build with -tags sqlite_fts5, or set GRAPE_SEARCH_LIKE_FALLBACK=true to search with a slower LIKE scan", err)
+		}
+		log.Printf("Full-text search unavailable (%v), falling back to LIKE", err)
+		// Triggers writing to a missing module would break every project update
+		for _, trigger := range []string{"projects_fts_ai", "projects_fts_ad", "projects_fts_au"} {
+			s.db.Exec("DROP TRIGGER IF EXISTS " + trigger)
+		}
+		return
+	}
+
+	for _, stmt := range []string{`
+		CREATE TRIGGER IF NOT EXISTS projects_fts_ai AFTER INSERT ON projects BEGIN
+			INSERT INTO projects_fts (rowid, name, build_log) VALUES (new.rowid, new.name, new.build_log);
+		END`, `
+		CREATE TRIGGER IF NOT EXISTS projects_fts_ad AFTER DELETE ON projects BEGIN
+			INSERT INTO projects_fts (projects_fts, rowid, name, build_log) VALUES ('delete', old.rowid, old.name, old.build_log);
+		END`, `
+		CREATE TRIGGER IF NOT EXISTS projects_fts_au AFTER UPDATE OF name, build_log ON projects BEGIN
+			INSERT INTO projects_fts (projects_fts, rowid, name, build_log) VALUES ('delete', old.rowid, old.name, old.build_log);
+			INSERT INTO projects_fts (rowid, name, build_log) VALUES (new.rowid, new.name, new.build_log);
+		END`,
+		`INSERT INTO projects_fts (projects_fts) VALUES ('rebuild')`,
+	} {
+		if _, err := s.db.Exec(stmt); err != nil {
+			log.Fatal(err)
+		}
+	}
+	s.searchFTS = true
+}
+
+// ftsQuery turns free text into an FTS5 query that ANDs each word as a
+// prefix match, quoting words so user input can't inject FTS syntax.
+func ftsQuery(q string) string {
+	var terms []string
+	for _, word := range strings.Fields(q) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (s *Server) handleSearchProjects(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		http.Error(w, "Missing q parameter", http.StatusBadRequest)
+		return
+	}
+
+	limit := maxSearchResults
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 && n < limit {
+		limit = n
+	}
+
+	var (
+		query string
+		args  []interface{}
+	)
+	if s.searchFTS {
+		query = `
+			SELECT p.id, p.user_id, p.name, p.status, p.subdomain, p.created_at, p.url_preset, p.force_https, COALESCE(p.org_id, 0)
+			FROM projects_fts JOIN projects p ON p.rowid = projects_fts.rowid
+			WHERE projects_fts MATCH ? AND p.id IN ` + accessibleProjectIDs + `
+			ORDER BY p.created_at DESC LIMIT ?`
+		args = []interface{}{ftsQuery(q), userID, limit}
+	} else {
+		like := "%" + escapeLike(q) + "%"
+		query = `
+			SELECT id, user_id, name, status, subdomain, created_at, url_preset, force_https, COALESCE(org_id, 0)
+			FROM projects
+			WHERE ` + visibleProjects + ` AND (name LIKE ? ESCAPE '\' OR build_log LIKE ? ESCAPE '\')
+			ORDER BY created_at DESC LIMIT ?`
+		args = []interface{}{userID, like, like, limit}
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	projects := []Project{}
+	for rows.Next() {
+		var p Project
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Name, &p.Status, &p.Subdomain, &p.CreatedAt, &p.Preset, &p.ForceHTTPS, &p.OrgID); err != nil {
+			continue
+		}
+		projects = append(projects, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projects)
+}
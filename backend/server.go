@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/cipher"
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Config holds the settings a Server is constructed with.
+type Config struct {
+	DBPath      string
+	KeysDir     string
+	UploadsDir  string
+	ProjectsDir string
+	DeployDir   string
+	StagingDir  string
+	ExportsDir  string
+	WorkerPath  string
+	// GitSchemes are the URL schemes repositories may be cloned over
+	GitSchemes map[string]bool
+}
+
+func defaultConfig() Config {
+	return Config{
+		DBPath:      envString("DB_PATH", "grape.db"),
+		KeysDir:     envString("GRAPE_JWT_KEYS_DIR", "keys"),
+		UploadsDir:  envString("UPLOADS_DIR", "uploads"),
+		ProjectsDir: envString("PROJECTS_DIR", "projects"),
+		DeployDir:   envString("DEPLOY_DIR", "deploy"),
+		StagingDir:  envString("STAGING_DIR", "staging"),
+		ExportsDir:  envString("EXPORTS_DIR", "exports"),
+		WorkerPath:  envString("GRAPE_WORKER_PATH", "../builder/worker.py"),
+		GitSchemes:  map[string]bool{"https": true},
+	}
+}
+
+// Server holds the API's dependencies. HTTP handlers and the build pipeline
+// are methods on it, so a test can run one against a scratch database, temp
+// directories and a stub BuildRunner.
+type Server struct {
+	db             *sql.DB
+	cfg            Config
+	runner         BuildRunner
+	storage        Storage
+	mailer         Mailer
+	projectsCache  *projectListCache
+	authLimiter    *rateLimiter
+	uploadLimiter  *rateLimiter
+	cleanupWake    chan struct{}
+	sso            map[string]ssoProvider
+	keys           *keyring
+	captcha        captchaVerifier
+	passwordPolicy passwordPolicy
+	envCipher      cipher.AEAD
+	builds         *buildTracker
+	buildSlots     *buildLimiter
+	events         *eventBus
+	counters       *serverCounters
+	searchFTS      bool
+}
+
+// NewServer migrates db and prepares the data directories and storage backend
+// described by cfg.
+func NewServer(cfg Config, db *sql.DB, runner BuildRunner) *Server {
+	counters := &serverCounters{}
+	s := &Server{
+		db:            db,
+		cfg:           cfg,
+		runner:        runner,
+		mailer:        logMailer{},
+		projectsCache: newProjectListCache(counters),
+		authLimiter:   newRateLimiter("GRAPE_RATE_LIMIT_AUTH", "10/1m", counters),
+		uploadLimiter: newRateLimiter("GRAPE_RATE_LIMIT_UPLOAD", "30/1h", counters),
+		cleanupWake:   make(chan struct{}, 1),
+		builds:        newBuildTracker(),
+		buildSlots:    newBuildLimiter(envInt("GRAPE_BUILD_CONCURRENCY", runtime.NumCPU())),
+		events:        newEventBus(),
+		counters:      counters,
+	}
+	s.migrate()
+	s.initSearchIndex()
+	s.ensureDirs()
+	s.initStorage()
+	s.initSSO()
+	s.initCaptcha()
+	s.initPasswordPolicy()
+	keys, err := loadKeyring(cfg.KeysDir)
+	if err != nil {
+		log.Fatalf("JWT signing keys: %v", err)
+	}
+	s.keys = keys
+	s.initEnvCipher()
+	return s
+}
+
+func openDB(path string) *sql.DB {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+func (s *Server) ensureDirs() {
+	for _, dir := range []string{s.cfg.UploadsDir, s.cfg.ProjectsDir, s.cfg.DeployDir, s.cfg.StagingDir, s.cfg.ExportsDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Handler returns the API router, wrapped in the CORS middleware.
+func (s *Server) Handler() http.Handler {
+	r := mux.NewRouter()
+	r.Use(metricsMiddleware)
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	// Auth routes
+	r.HandleFunc("/api/register", s.authLimiter.wrap(s.handleRegister, clientIP)).Methods("POST")
+	r.HandleFunc("/api/login", s.authLimiter.wrap(s.handleLogin, clientIP)).Methods("POST")
+	r.HandleFunc("/api/verify", s.handleVerify).Methods("GET")
+	r.HandleFunc("/api/auth/refresh", s.handleRefresh).Methods("POST")
+	r.HandleFunc("/api/auth/logout", s.handleLogout).Methods("POST")
+	r.HandleFunc("/api/auth/revoke", s.handleRevokeToken).Methods("POST")
+	r.HandleFunc("/api/auth/forgot", s.authLimiter.wrap(s.handleForgotPassword, clientIP)).Methods("POST")
+	r.HandleFunc("/api/auth/reset", s.authLimiter.wrap(s.handleResetPassword, clientIP)).Methods("POST")
+	r.HandleFunc("/.well-known/jwks.json", s.handleJWKS).Methods("GET")
+	r.HandleFunc("/api/auth/captcha", s.authLimiter.wrap(s.handleCaptchaConfig, clientIP)).Methods("GET")
+	r.HandleFunc("/api/hooks/{provider}", s.handleGitHook).Methods("POST")
+	r.HandleFunc("/api/guest", s.authLimiter.wrap(s.handleCreateGuest, clientIP)).Methods("POST")
+	r.HandleFunc("/api/guest/claim", s.authMiddleware(s.handleClaimGuest)).Methods("POST")
+	r.HandleFunc("/api/auth/unlock", s.authLimiter.wrap(s.handleUnlockAccount, clientIP)).Methods("POST")
+	r.HandleFunc("/api/auth/magic-link", s.authLimiter.wrap(s.handleRequestMagicLink, clientIP)).Methods("POST")
+	r.HandleFunc("/api/auth/magic-link/verify", s.authLimiter.wrap(s.handleRedeemMagicLink, clientIP)).Methods("POST")
+	r.HandleFunc("/api/auth/sso", s.handleListSSO).Methods("GET")
+	r.HandleFunc("/api/auth/sso/{provider}/login", s.authLimiter.wrap(s.handleSSOLogin, clientIP)).Methods("GET")
+	r.HandleFunc("/api/auth/sso/{provider}/callback", s.authLimiter.wrap(s.handleSSOCallback, clientIP)).Methods("GET")
+	r.HandleFunc("/api/auth/2fa/setup", s.authMiddleware(s.handleSetup2FA)).Methods("POST")
+	r.HandleFunc("/api/auth/2fa/verify", s.authMiddleware(s.handleVerify2FA)).Methods("POST")
+	r.HandleFunc("/api/auth/2fa", s.authMiddleware(s.handleDisable2FA)).Methods("DELETE")
+
+	// Protected routes
+	r.HandleFunc("/api/me", s.authMiddleware(s.handleGetMe)).Methods("GET")
+	r.HandleFunc("/api/me", s.authMiddleware(s.handleUpdateMe)).Methods("PATCH")
+	r.HandleFunc("/api/account", s.authMiddleware(s.handleDeleteAccount)).Methods("DELETE")
+	r.HandleFunc("/api/me", s.authMiddleware(s.handleDeleteAccount)).Methods("DELETE")
+	r.HandleFunc("/api/me/quota", s.authMiddleware(s.handleGetQuota)).Methods("GET")
+	r.HandleFunc("/api/me/logins", s.authMiddleware(s.handleListLogins)).Methods("GET")
+	r.HandleFunc("/api/me/devices", s.authMiddleware(s.handleListDevices)).Methods("GET")
+	r.HandleFunc("/api/me/export", s.authMiddleware(s.handleRequestExport)).Methods("POST")
+	r.HandleFunc("/api/me/exports", s.authMiddleware(s.handleListExports)).Methods("GET")
+	r.HandleFunc("/api/me/exports/{id}", s.authMiddleware(s.handleGetExport)).Methods("GET")
+	r.HandleFunc("/api/exports/{id}/download", s.handleDownloadExport).Methods("GET")
+	r.HandleFunc("/api/me/ip-allowlist", s.authMiddleware(s.handleGetIPAllowlist)).Methods("GET")
+	r.HandleFunc("/api/me/ip-allowlist", s.authMiddleware(s.handleSetIPAllowlist)).Methods("PUT")
+	r.HandleFunc("/api/me/devices/{id}", s.authMiddleware(s.handleSignOutDevice)).Methods("DELETE")
+	r.HandleFunc("/api/me/password", s.authMiddleware(s.handleChangePassword)).Methods("POST")
+	r.HandleFunc("/api/me/webhook-secret", s.authMiddleware(s.handleWebhookSecret)).Methods("GET", "POST")
+	r.HandleFunc("/api/keys", s.authMiddleware(s.handleCreateAPIKey)).Methods("POST")
+	r.HandleFunc("/api/keys", s.authMiddleware(s.handleListAPIKeys)).Methods("GET")
+	r.HandleFunc("/api/keys/{id}", s.authMiddleware(s.handleDeleteAPIKey)).Methods("DELETE")
+	r.HandleFunc("/api/tokens", s.authMiddleware(s.handleCreateAPIKey)).Methods("POST")
+	r.HandleFunc("/api/tokens", s.authMiddleware(s.handleListAPIKeys)).Methods("GET")
+	r.HandleFunc("/api/tokens/{id}", s.authMiddleware(s.handleDeleteAPIKey)).Methods("DELETE")
+	r.HandleFunc("/api/sessions", s.authMiddleware(s.handleListSessions)).Methods("GET")
+	r.HandleFunc("/api/sessions", s.authMiddleware(s.handleRevokeOtherSessions)).Methods("DELETE")
+	r.HandleFunc("/api/sessions/{id}", s.authMiddleware(s.handleRevokeSession)).Methods("DELETE")
+	r.HandleFunc("/api/orgs", s.authMiddleware(s.handleCreateOrg)).Methods("POST")
+	r.HandleFunc("/api/orgs", s.authMiddleware(s.handleListOrgs)).Methods("GET")
+	r.HandleFunc("/api/orgs/{id}/members", s.authMiddleware(s.handleListOrgMembers)).Methods("GET")
+	r.HandleFunc("/api/orgs/{id}/members", s.authMiddleware(s.handleAddOrgMember)).Methods("POST")
+	r.HandleFunc("/api/orgs/{id}/members/{userID}", s.authMiddleware(s.handleRemoveOrgMember)).Methods("DELETE")
+	r.HandleFunc("/api/orgs/{id}/invites", s.authMiddleware(s.handleCreateInvite)).Methods("POST")
+	r.HandleFunc("/api/orgs/{id}/invites", s.authMiddleware(s.handleListInvites)).Methods("GET")
+	r.HandleFunc("/api/orgs/{id}/invites/{inviteID}", s.authMiddleware(s.handleRevokeInvite)).Methods("DELETE")
+	r.HandleFunc("/api/orgs/{id}/service-accounts", s.authMiddleware(s.handleCreateServiceAccount)).Methods("POST")
+	r.HandleFunc("/api/orgs/{id}/service-accounts", s.authMiddleware(s.handleListServiceAccounts)).Methods("GET")
+	r.HandleFunc("/api/orgs/{id}/service-accounts/{accountID}", s.authMiddleware(s.handleDeleteServiceAccount)).Methods("DELETE")
+	r.HandleFunc("/api/orgs/{id}/service-accounts/{accountID}/keys", s.authMiddleware(s.handleCreateServiceAccountKey)).Methods("POST")
+	r.HandleFunc("/api/orgs/{id}/service-accounts/{accountID}/keys/{keyID}", s.authMiddleware(s.handleDeleteServiceAccountKey)).Methods("DELETE")
+	r.HandleFunc("/api/invites/{token}", s.handleGetInvite).Methods("GET")
+	r.HandleFunc("/api/invites/{token}/accept", s.authMiddleware(s.handleAcceptInvite)).Methods("POST")
+	r.HandleFunc("/api/upload", s.authMiddleware(s.uploadLimiter.wrap(s.handleUpload, rateKeyUser), scopeDeployWrite)).Methods("POST")
+	r.HandleFunc("/api/projects", s.authMiddleware(s.handleProjects, scopeProjectsRead, scopeStatusRead)).Methods("GET")
+	r.HandleFunc("/api/projects/from-git", s.authMiddleware(s.uploadLimiter.wrap(s.handleDeployFromGit, rateKeyUser), scopeDeployWrite)).Methods("POST")
+	r.HandleFunc("/api/projects/from-url", s.authMiddleware(s.uploadLimiter.wrap(s.handleDeployFromURL, rateKeyUser), scopeDeployWrite)).Methods("POST")
+	r.HandleFunc("/api/tags", s.authMiddleware(s.handleListTags, scopeProjectsRead)).Methods("GET")
+	r.HandleFunc("/api/subdomains/check", s.authMiddleware(s.handleCheckSubdomain, scopeProjectsRead)).Methods("GET")
+	r.HandleFunc("/api/projects/search", s.authMiddleware(s.handleSearchProjects, scopeProjectsRead, scopeStatusRead)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}", s.authMiddleware(s.handleProjectStatus, scopeProjectsRead, scopeStatusRead)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}", s.authMiddleware(s.handleUpdateProject, scopeProjectsWrite)).Methods("PATCH")
+	r.HandleFunc("/api/projects/{id}", s.authMiddleware(s.handleDeleteProject, scopeDeployWrite)).Methods("DELETE")
+	r.HandleFunc("/api/projects/{id}/download", s.authMiddleware(s.handleDownload, scopeProjectsRead)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}/files", s.authMiddleware(s.handleListFiles, scopeProjectsRead)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}/logs", s.authMiddleware(s.handleProjectLogs, scopeProjectsRead, scopeStatusRead)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}/rebuild", s.authMiddleware(s.handleRebuild, scopeDeployWrite)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}/redeploy", s.authMiddleware(s.handleRebuild, scopeDeployWrite)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}/deployments", s.authMiddleware(s.handleListDeployments, scopeProjectsRead)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}/deployments/{deploymentID}/logs", s.authMiddleware(s.handleDeploymentLogs, scopeProjectsRead)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}/deployments/{deploymentID}", s.authMiddleware(s.handleDeleteDeployment, scopeDeployWrite)).Methods("DELETE")
+	r.HandleFunc("/api/projects/{id}/rollback", s.authMiddleware(s.handleRollback, scopeDeployWrite)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}/approve", s.authMiddleware(s.handleApproveDeployment, scopeDeployWrite)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}/reject", s.authMiddleware(s.handleRejectDeployment, scopeDeployWrite)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}/aliases", s.authMiddleware(s.handleListAliases, scopeProjectsRead)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}/aliases", s.authMiddleware(s.handleSetAlias, scopeDeployWrite)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}/aliases/{name}", s.authMiddleware(s.handleDeleteAlias, scopeDeployWrite)).Methods("DELETE")
+	r.HandleFunc("/api/projects/{id}/branches", s.authMiddleware(s.handleListBranchDeploys, scopeProjectsRead)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}/schedules", s.authMiddleware(s.handleListSchedules, scopeProjectsRead)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}/schedules", s.authMiddleware(s.handleCreateSchedule, scopeDeployWrite)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}/schedules/{scheduleID}", s.authMiddleware(s.handleDeleteSchedule, scopeDeployWrite)).Methods("DELETE")
+	r.HandleFunc("/api/projects/{id}/pause", s.authMiddleware(s.handlePauseProject, scopeDeployWrite)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}/resume", s.authMiddleware(s.handleResumeProject, scopeDeployWrite)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}/rerun-postbuild", s.authMiddleware(s.handleRerunPostBuild, scopeDeployWrite)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}/git", s.authMiddleware(s.handleGetGitLink, scopeProjectsRead)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}/git", s.authMiddleware(s.handleSetGitLink, scopeProjectsWrite)).Methods("PUT")
+	r.HandleFunc("/api/projects/{id}/git", s.authMiddleware(s.handleDeleteGitLink, scopeProjectsWrite)).Methods("DELETE")
+	r.HandleFunc("/api/projects/{id}/env", s.authMiddleware(s.handleListEnv, scopeProjectsRead)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}/env", s.authMiddleware(s.handleSetEnv, scopeProjectsWrite)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}/env", s.authMiddleware(s.handleDeleteEnv, scopeProjectsWrite)).Methods("DELETE")
+	r.HandleFunc("/api/projects/{id}/webhook", s.authMiddleware(s.handleSetWebhook, scopeProjectsWrite)).Methods("PUT")
+	r.HandleFunc("/api/projects/{id}/members", s.authMiddleware(s.handleListProjectMembers, scopeProjectsRead)).Methods("GET")
+	r.HandleFunc("/api/projects/{id}/members", s.authMiddleware(s.handleSetProjectMember, scopeProjectsWrite)).Methods("PUT")
+	r.HandleFunc("/api/projects/{id}/members/{userID}", s.authMiddleware(s.handleRemoveProjectMember, scopeProjectsWrite)).Methods("DELETE")
+	r.HandleFunc("/api/projects/{id}/subdomain", s.authMiddleware(s.handleSetSubdomain, scopeProjectsWrite)).Methods("PUT")
+	r.HandleFunc("/api/projects/{id}/clone", s.authMiddleware(s.handleCloneProject, scopeDeployWrite)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}/transfer", s.authMiddleware(s.handleCreateTransfer, scopeProjectsWrite)).Methods("POST")
+	r.HandleFunc("/api/projects/{id}/transfers", s.authMiddleware(s.handleListProjectTransfers, scopeProjectsRead)).Methods("GET")
+	r.HandleFunc("/api/transfers", s.authMiddleware(s.handleListTransfers, scopeProjectsRead)).Methods("GET")
+	r.HandleFunc("/api/transfers/{id}/accept", s.authMiddleware(s.handleAcceptTransfer, scopeProjectsWrite)).Methods("POST")
+	r.HandleFunc("/api/transfers/{id}/decline", s.authMiddleware(s.handleDeclineTransfer, scopeProjectsWrite)).Methods("POST")
+	r.HandleFunc("/api/transfers/{id}", s.authMiddleware(s.handleCancelTransfer, scopeProjectsWrite)).Methods("DELETE")
+
+	// Admin routes
+	r.HandleFunc("/api/admin/events/stream", eventSourceToken(s.adminMiddleware(s.handleAdminEventStream))).Methods("GET")
+	r.HandleFunc("/api/admin/users/{id}/tier", s.adminMiddleware(s.handleAdminSetTier)).Methods("PUT")
+	r.HandleFunc("/api/admin/debug/counters", s.adminMiddleware(s.handleAdminCounters)).Methods("GET")
+	r.HandleFunc("/api/admin/users", s.adminMiddleware(s.handleAdminListUsers)).Methods("GET")
+	r.HandleFunc("/api/admin/users/{id}/max-projects", s.adminMiddleware(s.handleAdminSetProjectLimit)).Methods("PUT")
+	r.HandleFunc("/api/admin/users/{id}/impersonate", s.adminMiddleware(s.handleImpersonate)).Methods("POST")
+	r.HandleFunc("/api/admin/impersonations", s.adminMiddleware(s.handleListImpersonations)).Methods("GET")
+	r.HandleFunc("/api/admin/impersonations/{id}/requests", s.adminMiddleware(s.handleListImpersonationRequests)).Methods("GET")
+	r.HandleFunc("/api/admin/projects", s.adminMiddleware(s.handleAdminListProjects)).Methods("GET")
+	r.HandleFunc("/api/admin/projects/{id}", s.adminMiddleware(s.handleAdminDeleteProject)).Methods("DELETE")
+	r.HandleFunc("/api/admin/projects/{id}/fail", s.adminMiddleware(s.handleAdminFailBuild)).Methods("POST")
+
+	// Serve static files from deploy directory
+	r.PathPrefix("/deploy/").HandlerFunc(s.handleDeploy)
+
+	return s.siteHostMiddleware(corsMiddleware(r))
+}
+
+func (s *Server) Close() error {
+	return s.db.Close()
+}
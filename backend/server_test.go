@@ -0,0 +1,325 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	bcryptCost = bcrypt.MinCost
+}
+
+// stubRunner stands in for the Python worker: it writes a one-page site, or
+// fails with err.
+type stubRunner struct {
+	output string
+	err    error
+}
+
+func (r stubRunner) Run(ctx context.Context, projectPath, stagePath string, timeout time.Duration, env []string, onStage func(string)) (string, error) {
+	onStage("build")
+	if r.err != nil {
+		return r.output, r.err
+	}
+	if err := os.MkdirAll(stagePath, 0755); err != nil {
+		return "", err
+	}
+	return r.output, os.WriteFile(filepath.Join(stagePath, "index.html"), []byte("<h1>hello</h1>"), 0644)
+}
+
+// captureMailer keeps sent messages so tests can follow links in them.
+type captureMailer struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (m *captureMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, body)
+	return nil
+}
+
+func (m *captureMailer) last() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.sent) == 0 {
+		return ""
+	}
+	return m.sent[len(m.sent)-1]
+}
+
+type testServer struct {
+	*Server
+	http   *httptest.Server
+	mailer *captureMailer
+}
+
+func newTestServer(t *testing.T, runner BuildRunner) *testServer {
+	t.Helper()
+	t.Setenv("GRAPE_STORAGE", "local")
+	// Plain go test builds lack FTS5; -tags sqlite_fts5 tests full-text search
+	t.Setenv("GRAPE_SEARCH_LIKE_FALLBACK", "true")
+
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.DBPath = filepath.Join(dir, "grape.db")
+	cfg.UploadsDir = filepath.Join(dir, "uploads")
+	cfg.ProjectsDir = filepath.Join(dir, "projects")
+	cfg.DeployDir = filepath.Join(dir, "deploy")
+	cfg.StagingDir = filepath.Join(dir, "staging")
+	cfg.ExportsDir = filepath.Join(dir, "exports")
+	cfg.KeysDir = filepath.Join(dir, "keys")
+
+	s := NewServer(cfg, openDB(cfg.DBPath), runner)
+	mailer := &captureMailer{}
+	s.mailer = mailer
+	ts := httptest.NewServer(s.Handler())
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	cleanupDone := make(chan struct{})
+	go func() {
+		s.runFileCleanup(bgCtx)
+		close(cleanupDone)
+	}()
+
+	t.Cleanup(func() {
+		ts.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		s.drainBuilds(ctx)
+		stopBackground()
+		<-cleanupDone
+		s.Close()
+	})
+	return &testServer{Server: s, http: ts, mailer: mailer}
+}
+
+// do sends a request and decodes a JSON response into out, if given.
+func (ts *testServer) do(t *testing.T, method, path, token string, body io.Reader, contentType string, out interface{}) *http.Response {
+	t.Helper()
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	return ts.send(t, method, path, token, body, header, out)
+}
+
+func (ts *testServer) send(t *testing.T, method, path, token string, body io.Reader, header http.Header, out interface{}) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.http.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := ts.http.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: decoding %q: %v", method, path, data, err)
+		}
+	}
+	return resp
+}
+
+func (ts *testServer) postJSON(t *testing.T, path, token string, in, out interface{}) *http.Response {
+	t.Helper()
+	return ts.do(t, "POST", path, token, jsonBody(in), "application/json", out)
+}
+
+func jsonBody(v interface{}) io.Reader {
+	body, _ := json.Marshal(v)
+	return bytes.NewReader(body)
+}
+
+var verifyLink = regexp.MustCompile(`/api/verify\?token=[0-9a-f]+`)
+
+// signUp registers and verifies a user, then logs in and returns the token.
+func (ts *testServer) signUp(t *testing.T, email, password string) string {
+	t.Helper()
+	creds := map[string]string{"email": email, "password": password}
+
+	var registered struct{ Token string }
+	if resp := ts.postJSON(t, "/api/register", "", creds, &registered); resp.StatusCode != http.StatusOK {
+		t.Fatalf("register: status %d", resp.StatusCode)
+	}
+	link := verifyLink.FindString(ts.mailer.last())
+	if link == "" {
+		t.Fatalf("no verification link in %q", ts.mailer.last())
+	}
+	if resp := ts.do(t, "GET", link, "", nil, "", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("verify: status %d", resp.StatusCode)
+	}
+
+	var loggedIn struct {
+		Token string
+		User  struct{ Verified bool }
+	}
+	if resp := ts.postJSON(t, "/api/login", "", creds, &loggedIn); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: status %d", resp.StatusCode)
+	}
+	if loggedIn.Token == "" || !loggedIn.User.Verified {
+		t.Fatalf("login returned %+v", loggedIn)
+	}
+	return loggedIn.Token
+}
+
+func siteZip(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, err := zw.Create("index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("<h1>hello</h1>"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func (ts *testServer) upload(t *testing.T, token, name string, archive []byte) (Project, *http.Response) {
+	t.Helper()
+	return ts.uploadWithHeader(t, token, name, archive, http.Header{})
+}
+
+func (ts *testServer) uploadWithHeader(t *testing.T, token, name string, archive []byte, header http.Header) (Project, *http.Response) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("name", name)
+	part, err := mw.CreateFormFile("project", "site.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(archive)
+	mw.Close()
+
+	header.Set("Content-Type", mw.FormDataContentType())
+	var project Project
+	resp := ts.send(t, "POST", "/api/upload", token, &body, header, &project)
+	return project, resp
+}
+
+// waitForStatus polls the project until it leaves the queued and building
+// states.
+func (ts *testServer) waitForStatus(t *testing.T, token, projectID string) Project {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var project Project
+		if resp := ts.do(t, "GET", "/api/projects/"+projectID, token, nil, "", &project); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status: %d", resp.StatusCode)
+		}
+		if project.Status != "queued" && project.Status != "building" {
+			return project
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("project still %s", project.Status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestUploadBuildsAndDeploys(t *testing.T) {
+	ts := newTestServer(t, stubRunner{output: "built\n"})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery")
+
+	project, resp := ts.upload(t, token, "hello", siteZip(t))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: status %d", resp.StatusCode)
+	}
+	if project.Status != "queued" || project.Name != "hello" {
+		t.Fatalf("upload returned %+v", project)
+	}
+
+	project = ts.waitForStatus(t, token, project.ID)
+	if project.Status != "live" {
+		t.Fatalf("status = %s, log:\n%s", project.Status, project.BuildLog)
+	}
+	if !strings.Contains(project.BuildLog, "built") {
+		t.Errorf("build log %q does not contain the worker output", project.BuildLog)
+	}
+
+	var projects []Project
+	ts.do(t, "GET", "/api/projects", token, nil, "", &projects)
+	if len(projects) != 1 || projects[0].ID != project.ID {
+		t.Errorf("projects = %+v", projects)
+	}
+
+	resp = ts.do(t, "GET", "/deploy/"+project.ID+"/", "", nil, "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("deployed site: status %d", resp.StatusCode)
+	}
+}
+
+func TestFailedBuildKeepsLog(t *testing.T) {
+	ts := newTestServer(t, stubRunner{output: "npm ERR! missing script: build\n", err: errors.New("exit status 1")})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery")
+
+	project, resp := ts.upload(t, token, "broken", siteZip(t))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: status %d", resp.StatusCode)
+	}
+	project = ts.waitForStatus(t, token, project.ID)
+	if project.Status != "failed" {
+		t.Fatalf("status = %s", project.Status)
+	}
+	if !strings.Contains(project.BuildLog, "missing script") || !strings.Contains(project.BuildLog, "exit status 1") {
+		t.Errorf("build log %q", project.BuildLog)
+	}
+}
+
+func TestUploadRequiresVerifiedEmail(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+
+	var registered struct{ Token string }
+	ts.postJSON(t, "/api/register", "", map[string]string{"email": "ada@example.com", "password": "correct horse battery"}, &registered)
+	if _, resp := ts.upload(t, registered.Token, "hello", siteZip(t)); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("unverified upload: status %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestProjectsAreScopedToOwner(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	alice := ts.signUp(t, "alice@example.com", "correct horse battery")
+	bob := ts.signUp(t, "bob@example.com", "correct horse battery")
+
+	project, _ := ts.upload(t, alice, "mine", siteZip(t))
+	ts.waitForStatus(t, alice, project.ID)
+
+	if resp := ts.do(t, "GET", "/api/projects/"+project.ID, bob, nil, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("other user's project: status %d, want 404", resp.StatusCode)
+	}
+	if resp := ts.do(t, "GET", "/api/projects/"+project.ID, "", nil, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous request: status %d, want 401", resp.StatusCode)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Service accounts are non-human members of an org for CI/CD. Each is backed
+// by a users row so projects and keys can reference it, but that row has no
+// usable password or deliverable address: the account only authenticates
+// with API keys, which org owners issue and revoke. It joins its org as a
+// member, deploys into it by default, and the org's owners administer the
+// projects it creates.
+
+type ServiceAccount struct {
+	ID        int      `json:"id"`
+	OrgID     int      `json:"org_id"`
+	Name      string   `json:"name"`
+	CreatedAt int64    `json:"created_at"`
+	Keys      []APIKey `json:"keys"`
+}
+
+// serviceAccountOrg returns the org a service account belongs to, or 0 for a
+// regular user.
+func (s *Server) serviceAccountOrg(userID int) (int, error) {
+	var orgID int
+	err := s.db.QueryRow("SELECT org_id FROM service_accounts WHERE user_id = ?", userID).Scan(&orgID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return orgID, err
+}
+
+// ownedOrgFromRequest is orgFromRequest for routes only owners may use.
+func (s *Server) ownedOrgFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	orgID, role, ok := s.orgFromRequest(w, r)
+	if !ok {
+		return 0, false
+	}
+	if role != orgRoleOwner {
+		http.Error(w, "Only organization owners can manage service accounts", http.StatusForbidden)
+		return 0, false
+	}
+	return orgID, true
+}
+
+// serviceAccountFromRequest resolves {accountID} to a service account of
+// the owned org.
+func (s *Server) serviceAccountFromRequest(w http.ResponseWriter, r *http.Request) (orgID, accountID int, ok bool) {
+	orgID, ok = s.ownedOrgFromRequest(w, r)
+	if !ok {
+		return 0, 0, false
+	}
+	accountID, err := strconv.Atoi(mux.Vars(r)["accountID"])
+	if err == nil {
+		var found int
+		err = s.db.QueryRow("SELECT user_id FROM service_accounts WHERE user_id = ? AND org_id = ?", accountID, orgID).Scan(&found)
+	}
+	if err != nil {
+		http.Error(w, "Service account not found", http.StatusNotFound)
+		return 0, 0, false
+	}
+	return orgID, accountID, true
+}
+
+// handleCreateServiceAccount adds a service account with a first API key.
+func (s *Server) handleCreateServiceAccount(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	orgID, ok := s.ownedOrgFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		http.Error(w, "Name must be 1-100 characters", http.StatusBadRequest)
+		return
+	}
+	scopes, err := validateScopes(req.Scopes)
+	if err != nil {
+		http.Error(w, "Invalid scopes: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// .invalid never resolves, so nothing can be mailed to the account
+	email := fmt.Sprintf("svc-%s@service.invalid", randomToken()[:16])
+	accountID, err := createPasswordlessUser(tx, email, true)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().Unix()
+	if _, err := tx.Exec("INSERT INTO service_accounts (user_id, org_id, name, created_by, created_at) VALUES (?, ?, ?, ?, ?)",
+		accountID, orgID, req.Name, userID, now); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("INSERT INTO org_members (org_id, user_id, role, created_at) VALUES (?, ?, ?, ?)",
+		orgID, accountID, orgRoleMember, now); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	key, err := s.createAPIKey(accountID, req.Name, scopes)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ServiceAccount{ID: accountID, OrgID: orgID, Name: req.Name, CreatedAt: now, Keys: []APIKey{key}})
+}
+
+func (s *Server) handleListServiceAccounts(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := s.ownedOrgFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := s.db.Query("SELECT user_id, org_id, name, created_at FROM service_accounts WHERE org_id = ? ORDER BY name", orgID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	accounts := []ServiceAccount{}
+	for rows.Next() {
+		var a ServiceAccount
+		if err := rows.Scan(&a.ID, &a.OrgID, &a.Name, &a.CreatedAt); err != nil {
+			continue
+		}
+		accounts = append(accounts, a)
+	}
+	rows.Close()
+
+	for i := range accounts {
+		if accounts[i].Keys, err = s.listAPIKeys(accounts[i].ID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accounts)
+}
+
+// handleDeleteServiceAccount removes a service account and its keys. Its
+// projects stay up and pass to the owner deleting it.
+func (s *Server) handleDeleteServiceAccount(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	_, accountID, ok := s.serviceAccountFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := s.db.Exec("UPDATE projects SET user_id = ? WHERE user_id = ?", userID, accountID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.deleteAccount(accountID); err != nil {
+		log.Printf("service account %d: deletion failed: %v", accountID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	s.projectsCache.invalidate(userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCreateServiceAccountKey issues another key, e.g. to rotate one.
+func (s *Server) handleCreateServiceAccountKey(w http.ResponseWriter, r *http.Request) {
+	_, accountID, ok := s.serviceAccountFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Name == "" {
+		req.Name = "API key"
+	}
+	scopes, err := validateScopes(req.Scopes)
+	if err != nil {
+		http.Error(w, "Invalid scopes: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key, err := s.createAPIKey(accountID, req.Name, scopes)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
+
+func (s *Server) handleDeleteServiceAccountKey(w http.ResponseWriter, r *http.Request) {
+	_, accountID, ok := s.serviceAccountFromRequest(w, r)
+	if !ok {
+		return
+	}
+	keyID, err := strconv.Atoi(mux.Vars(r)["keyID"])
+	if err != nil {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	res, err := s.db.Exec("DELETE FROM api_keys WHERE id = ? AND user_id = ?", keyID, accountID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// orphanedServiceAccounts returns the service accounts of orgs in which
+// userID is the only person left, which go when that user's account does.
+func (s *Server) orphanedServiceAccounts(userID int) ([]int, error) {
+	rows, err := s.db.Query(`
+		SELECT sa.user_id FROM service_accounts sa
+		WHERE sa.org_id IN (SELECT org_id FROM org_members WHERE user_id = ?)
+		AND NOT EXISTS (
+			SELECT 1 FROM org_members m WHERE m.org_id = sa.org_id AND m.user_id != ?
+			AND m.user_id NOT IN (SELECT user_id FROM service_accounts)
+		)
+	`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
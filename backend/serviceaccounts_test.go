@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestServiceAccountDeploysIntoOrg(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	alice := ts.signUp(t, "alice@example.com", "correct horse battery")
+	bob := ts.signUp(t, "bob@example.com", "correct horse battery")
+	var org Org
+	ts.postJSON(t, "/api/orgs", alice, map[string]string{"name": "Acme"}, &org)
+	ts.postJSON(t, fmt.Sprintf("/api/orgs/%d/members", org.ID), alice, map[string]string{"email": "bob@example.com"}, nil)
+	accountsPath := fmt.Sprintf("/api/orgs/%d/service-accounts", org.ID)
+
+	if resp := ts.postJSON(t, accountsPath, bob, map[string]interface{}{"name": "ci"}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("member creating a service account: status %d, want 403", resp.StatusCode)
+	}
+	var account ServiceAccount
+	resp := ts.postJSON(t, accountsPath, alice, map[string]interface{}{"name": "ci", "scopes": []string{scopeDeployWrite, scopeProjectsRead}}, &account)
+	if resp.StatusCode != http.StatusCreated || len(account.Keys) != 1 || account.Keys[0].Key == "" {
+		t.Fatalf("create service account: status %d, %+v", resp.StatusCode, account)
+	}
+	key := account.Keys[0].Key
+
+	project, resp := ts.upload(t, key, "site", siteZip(t))
+	if resp.StatusCode != http.StatusOK || project.OrgID != org.ID {
+		t.Fatalf("service account upload: status %d, project %+v", resp.StatusCode, project)
+	}
+	ts.waitForStatus(t, alice, project.ID)
+
+	var status Project
+	ts.do(t, "GET", "/api/projects/"+project.ID, alice, nil, "", &status)
+	if status.Role != "admin" {
+		t.Errorf("org owner's role on the service account's project = %q, want admin", status.Role)
+	}
+	ts.do(t, "GET", "/api/projects/"+project.ID, bob, nil, "", &status)
+	if status.Role != "viewer" {
+		t.Errorf("org member's role = %q, want viewer", status.Role)
+	}
+	if resp := ts.do(t, "GET", "/api/me", key, nil, "", nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("service account key on an account route: status %d, want 403", resp.StatusCode)
+	}
+	if resp := ts.do(t, "DELETE", fmt.Sprintf("/api/orgs/%d/members/%d", org.ID, account.ID), alice, nil, "", nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("removing the service account as a member: status %d, want 409", resp.StatusCode)
+	}
+
+	// A second key for rotation, then the first one is revoked
+	var second APIKey
+	if resp := ts.postJSON(t, fmt.Sprintf("%s/%d/keys", accountsPath, account.ID), alice, map[string]interface{}{"scopes": []string{scopeProjectsRead}}, &second); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create key: status %d", resp.StatusCode)
+	}
+	if resp := ts.do(t, "DELETE", fmt.Sprintf("%s/%d/keys/%d", accountsPath, account.ID, account.Keys[0].ID), alice, nil, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("revoke key: status %d", resp.StatusCode)
+	}
+	if resp := ts.do(t, "GET", "/api/projects", key, nil, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("revoked key: status %d, want 401", resp.StatusCode)
+	}
+	var listed []ServiceAccount
+	ts.do(t, "GET", accountsPath, alice, nil, "", &listed)
+	if len(listed) != 1 || len(listed[0].Keys) != 1 || listed[0].Keys[0].ID != second.ID || listed[0].Keys[0].Key != "" {
+		t.Errorf("listed service accounts = %+v", listed)
+	}
+
+	// Deleting the account hands its projects to the owner
+	if resp := ts.do(t, "DELETE", fmt.Sprintf("%s/%d", accountsPath, account.ID), alice, nil, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete service account: status %d", resp.StatusCode)
+	}
+	if resp := ts.do(t, "GET", "/api/projects", second.Key, nil, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("key of a deleted service account: status %d, want 401", resp.StatusCode)
+	}
+	ts.do(t, "GET", "/api/projects/"+project.ID, alice, nil, "", &status)
+	if status.Role != "admin" || status.Status != "live" {
+		t.Errorf("project after deleting its service account = %+v", status)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Every sign-in starts a session, which lives as long as its refresh token
+// family. Access tokens carry the session ID, so revoking a session locks out
+// its access token straight away rather than when it expires.
+
+type Session struct {
+	ID         string `json:"id"`
+	Device     string `json:"device"`
+	IP         string `json:"ip"`
+	CreatedAt  int64  `json:"created_at"`
+	LastUsedAt int64  `json:"last_used_at"`
+	Current    bool   `json:"current"`
+}
+
+// maxDeviceLength bounds the stored User-Agent.
+const maxDeviceLength = 256
+
+// touchSession records a sign-in or refresh of the session, creating it if
+// it is new.
+func (s *Server) touchSession(r *http.Request, userID int, sessionID string, version int, now time.Time) error {
+	device := r.UserAgent()
+	if len(device) > maxDeviceLength {
+		device = device[:maxDeviceLength]
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO sessions (id, user_id, user_agent, ip, token_version, created_at, last_used_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET ip = excluded.ip, token_version = excluded.token_version,
+			last_used_at = excluded.last_used_at, expires_at = excluded.expires_at
+	`, sessionID, userID, device, clientIP(r), version, now.Unix(), now.Unix(), now.Add(refreshTokenTTL).Unix())
+	return err
+}
+
+// sessionRevoked reports whether the session has been revoked or removed.
+func (s *Server) sessionRevoked(userID int, sessionID string) (bool, error) {
+	var revokedAt int64
+	err := s.db.QueryRow("SELECT revoked_at FROM sessions WHERE id = ? AND user_id = ?", sessionID, userID).Scan(&revokedAt)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return revokedAt != 0, nil
+}
+
+// revokeSession ends a session and invalidates its refresh tokens.
+func revokeSession(tx *sql.Tx, sessionID string, now int64) error {
+	if _, err := tx.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at = 0", now, sessionID); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE family = ? AND revoked_at = 0", now, sessionID)
+	return err
+}
+
+// handleListSessions lists the user's active sessions, newest first.
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	current, _ := r.Context().Value("sessionID").(string)
+
+	rows, err := s.db.Query(`
+		SELECT s.id, s.user_agent, s.ip, s.created_at, s.last_used_at
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.user_id = ? AND s.revoked_at = 0 AND s.expires_at > ? AND s.token_version = u.token_version
+		ORDER BY s.last_used_at DESC
+	`, userID, time.Now().Unix())
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var sess Session
+		if err := rows.Scan(&sess.ID, &sess.Device, &sess.IP, &sess.CreatedAt, &sess.LastUsedAt); err != nil {
+			continue
+		}
+		sess.Current = sess.ID == current
+		sessions = append(sessions, sess)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// handleRevokeSession signs out one session, which may be the current one.
+func (s *Server) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	sessionID := mux.Vars(r)["id"]
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var revokedAt int64
+	err = tx.QueryRow("SELECT revoked_at FROM sessions WHERE id = ? AND user_id = ?", sessionID, userID).Scan(&revokedAt)
+	if err == sql.ErrNoRows || revokedAt != 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := revokeSession(tx, sessionID, time.Now().Unix()); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRevokeOtherSessions signs out every session except the current one.
+func (s *Server) handleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	current, _ := r.Context().Value("sessionID").(string)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id FROM sessions WHERE user_id = ? AND revoked_at = 0 AND id != ?", userID, current)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	now := time.Now().Unix()
+	for _, id := range ids {
+		if err := revokeSession(tx, id, now); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"revoked": len(ids)})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func (ts *testServer) loginFrom(t *testing.T, device string) tokenPair {
+	t.Helper()
+	header := http.Header{"Content-Type": {"application/json"}, "User-Agent": {device}}
+	body := jsonBody(map[string]string{"email": "ada@example.com", "password": "correct horse battery 1"})
+	var pair tokenPair
+	if resp := ts.send(t, "POST", "/api/login", "", body, header, &pair); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login: status %d", resp.StatusCode)
+	}
+	return pair
+}
+
+func (ts *testServer) sessions(t *testing.T, token string) []Session {
+	t.Helper()
+	var sessions []Session
+	if resp := ts.do(t, "GET", "/api/sessions", token, nil, "", &sessions); resp.StatusCode != http.StatusOK {
+		t.Fatalf("sessions: status %d", resp.StatusCode)
+	}
+	return sessions
+}
+
+func TestRevokeSession(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	ts.signUp(t, "ada@example.com", "correct horse battery 1")
+	laptopToken := ts.loginFrom(t, "laptop")
+	// Sign out the sessions started while signing up
+	ts.do(t, "DELETE", "/api/sessions", laptopToken.Token, nil, "", nil)
+	phone := ts.loginFrom(t, "phone")
+
+	var phoneSession *Session
+	sessions := ts.sessions(t, phone.Token)
+	for i, s := range sessions {
+		if s.Current {
+			phoneSession = &sessions[i]
+		}
+	}
+	if len(sessions) != 2 || phoneSession == nil || phoneSession.Device != "phone" || phoneSession.IP == "" {
+		t.Fatalf("sessions = %+v", sessions)
+	}
+
+	// Revoking a session locks out its unexpired access token at once
+	if resp := ts.do(t, "DELETE", "/api/sessions/"+phoneSession.ID, laptopToken.Token, nil, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("revoke: status %d", resp.StatusCode)
+	}
+	if resp := ts.do(t, "GET", "/api/projects", phone.Token, nil, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("revoked access token: status %d, want 401", resp.StatusCode)
+	}
+	if _, resp := ts.refresh(t, phone.RefreshToken); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("revoked refresh token: status %d, want 401", resp.StatusCode)
+	}
+	if resp := ts.do(t, "DELETE", "/api/sessions/"+phoneSession.ID, laptopToken.Token, nil, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("revoking twice: status %d, want 404", resp.StatusCode)
+	}
+
+	tablet := ts.loginFrom(t, "tablet")
+	var result struct{ Revoked int }
+	ts.do(t, "DELETE", "/api/sessions", laptopToken.Token, nil, "", &result)
+	if result.Revoked != 1 {
+		t.Errorf("revoked %d other sessions, want 1", result.Revoked)
+	}
+	if resp := ts.do(t, "GET", "/api/projects", laptopToken.Token, nil, "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("current session after signing out others: status %d", resp.StatusCode)
+	}
+	if resp := ts.do(t, "GET", "/api/projects", tablet.Token, nil, "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("signed-out session: status %d, want 401", resp.StatusCode)
+	}
+	if n := len(ts.sessions(t, laptopToken.Token)); n != 1 {
+		t.Errorf("%d sessions left, want 1", n)
+	}
+}
+
+func TestSessionsNotForeignUsers(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	ts.signUp(t, "ada@example.com", "correct horse battery 1")
+	bob := ts.signUp(t, "bob@example.com", "correct horse battery 1")
+
+	ada := ts.loginFrom(t, "laptop")
+	for _, s := range ts.sessions(t, ada.Token) {
+		if resp := ts.do(t, "DELETE", "/api/sessions/"+s.ID, bob, nil, "", nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("revoking another user's session: status %d, want 404", resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+)
+
+// Single sign-on lets self-hosted installs delegate login to a corporate
+// identity provider. The browser is sent to the provider and comes back to
+// the callback, which signs the user in with the same tokens /api/login
+// issues. Providers plug in through ssoProvider; OIDC is built in, and SAML
+// IdPs can be connected through an OIDC bridge such as Dex or Keycloak.
+
+// ssoLoginTTL bounds how long a user can spend at the provider.
+const ssoLoginTTL = 10 * time.Minute
+
+// ssoLogin is the per-attempt secret state, kept server-side until the
+// callback.
+type ssoLogin struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+type ssoIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+type ssoProvider interface {
+	// AuthURL is where to send the browser to sign in.
+	AuthURL(login ssoLogin) string
+	// Identity completes a sign-in from the provider's callback request.
+	Identity(ctx context.Context, r *http.Request, login ssoLogin) (ssoIdentity, error)
+}
+
+type oidcProvider struct {
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+func newOIDCProvider(ctx context.Context, issuer, clientID, clientSecret, redirectURL string) (*oidcProvider, error) {
+	p, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &oidcProvider{
+		oauth: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     p.Endpoint(),
+			RedirectURL:  redirectURL,
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+		verifier: p.Verifier(&oidc.Config{ClientID: clientID}),
+	}, nil
+}
+
+func (p *oidcProvider) AuthURL(login ssoLogin) string {
+	return p.oauth.AuthCodeURL(login.State, oidc.Nonce(login.Nonce), oauth2.S256ChallengeOption(login.Verifier))
+}
+
+func (p *oidcProvider) Identity(ctx context.Context, r *http.Request, login ssoLogin) (ssoIdentity, error) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		return ssoIdentity{}, fmt.Errorf("provider returned %s: %s", e, q.Get("error_description"))
+	}
+	token, err := p.oauth.Exchange(ctx, q.Get("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		return ssoIdentity{}, err
+	}
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return ssoIdentity{}, errors.New("no id_token in token response")
+	}
+	idToken, err := p.verifier.Verify(ctx, raw)
+	if err != nil {
+		return ssoIdentity{}, err
+	}
+	if idToken.Nonce != login.Nonce {
+		return ssoIdentity{}, errors.New("id_token nonce mismatch")
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return ssoIdentity{}, err
+	}
+	return ssoIdentity{Subject: idToken.Subject, Email: claims.Email, EmailVerified: claims.EmailVerified}, nil
+}
+
+// initSSO sets up the providers configured in the environment. A provider
+// that can't be reached at startup is left out rather than stopping the
+// server.
+func (s *Server) initSSO() {
+	s.sso = map[string]ssoProvider{}
+
+	issuer := envString("GRAPE_OIDC_ISSUER", "")
+	if issuer == "" {
+		return
+	}
+	name := envString("GRAPE_OIDC_NAME", "oidc")
+	redirectURL := fmt.Sprintf("%s/api/auth/sso/%s/callback", publicURL, name)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p, err := newOIDCProvider(ctx, issuer, os.Getenv("GRAPE_OIDC_CLIENT_ID"), os.Getenv("GRAPE_OIDC_CLIENT_SECRET"), redirectURL)
+	if err != nil {
+		log.Printf("SSO provider %s disabled: %v", name, err)
+		return
+	}
+	s.sso[name] = p
+	log.Printf("SSO provider %s enabled (%s)", name, issuer)
+}
+
+// handleListSSO lists the configured providers, for login pages.
+func (s *Server) handleListSSO(w http.ResponseWriter, r *http.Request) {
+	type provider struct {
+		Name     string `json:"name"`
+		LoginURL string `json:"login_url"`
+	}
+	providers := []provider{}
+	for name := range s.sso {
+		providers = append(providers, provider{Name: name, LoginURL: "/api/auth/sso/" + name + "/login"})
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].Name < providers[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(providers)
+}
+
+// handleSSOLogin sends the browser to the provider.
+func (s *Server) handleSSOLogin(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := s.sso[name]
+	if !ok {
+		http.Error(w, "Unknown SSO provider", http.StatusNotFound)
+		return
+	}
+
+	login := ssoLogin{State: randomToken(), Nonce: randomToken(), Verifier: oauth2.GenerateVerifier()}
+	now := time.Now()
+	s.db.Exec("DELETE FROM sso_logins WHERE expires_at <= ?", now.Unix())
+	if _, err := s.db.Exec(
+		"INSERT INTO sso_logins (state_hash, provider, nonce, verifier, expires_at) VALUES (?, ?, ?, ?, ?)",
+		hashToken(login.State), name, login.Nonce, login.Verifier, now.Add(ssoLoginTTL).Unix(),
+	); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, provider.AuthURL(login), http.StatusFound)
+}
+
+// ssoRedirect returns the browser to the frontend, with the outcome in the
+// URL fragment so tokens never reach server logs.
+func ssoRedirect(w http.ResponseWriter, r *http.Request, fragment url.Values) {
+	http.Redirect(w, r, appURL+"/sso-callback#"+fragment.Encode(), http.StatusFound)
+}
+
+// handleSSOCallback finishes a sign-in and hands the frontend a token pair.
+func (s *Server) handleSSOCallback(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := s.sso[name]
+	if !ok {
+		http.Error(w, "Unknown SSO provider", http.StatusNotFound)
+		return
+	}
+
+	login, err := s.consumeSSOLogin(name, r.URL.Query().Get("state"))
+	if err != nil {
+		ssoRedirect(w, r, url.Values{"error": {"invalid_state"}})
+		return
+	}
+	identity, err := provider.Identity(r.Context(), r, login)
+	if err != nil {
+		log.Printf("SSO %s: sign-in failed: %v", name, err)
+		ssoRedirect(w, r, url.Values{"error": {"sso_failed"}})
+		return
+	}
+	userID, err := s.ssoUser(name, identity)
+	if errors.Is(err, errSSOEmailConflict) {
+		s.recordLogin(r, 0, identity.Email, loginSSO, "email_conflict")
+		ssoRedirect(w, r, url.Values{"error": {"email_conflict"}})
+		return
+	}
+	if err != nil {
+		log.Printf("SSO %s: cannot resolve user for %s: %v", name, identity.Subject, err)
+		ssoRedirect(w, r, url.Values{"error": {"sso_failed"}})
+		return
+	}
+
+	tokens, err := s.issueTokens(r, userID, "")
+	if err != nil {
+		ssoRedirect(w, r, url.Values{"error": {"sso_failed"}})
+		return
+	}
+	s.recordLogin(r, userID, identity.Email, loginSSO, "")
+	ssoRedirect(w, r, url.Values{
+		"token":         {tokens.Token},
+		"refresh_token": {tokens.RefreshToken},
+		"expires_in":    {fmt.Sprint(tokens.ExpiresIn)},
+	})
+}
+
+// consumeSSOLogin redeems the state of a sign-in started by handleSSOLogin.
+// Each state works once.
+func (s *Server) consumeSSOLogin(provider, state string) (ssoLogin, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return ssoLogin{}, err
+	}
+	defer tx.Rollback()
+
+	login := ssoLogin{State: state}
+	var (
+		owner     string
+		expiresAt int64
+	)
+	err = tx.QueryRow("SELECT provider, nonce, verifier, expires_at FROM sso_logins WHERE state_hash = ?", hashToken(state)).
+		Scan(&owner, &login.Nonce, &login.Verifier, &expiresAt)
+	if err != nil {
+		return ssoLogin{}, err
+	}
+	if _, err := tx.Exec("DELETE FROM sso_logins WHERE state_hash = ?", hashToken(state)); err != nil {
+		return ssoLogin{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return ssoLogin{}, err
+	}
+	if owner != provider || time.Now().Unix() > expiresAt {
+		return ssoLogin{}, errors.New("state expired or for another provider")
+	}
+	return login, nil
+}
+
+var errSSOEmailConflict = errors.New("an account with this email exists but the provider has not verified it")
+
+// ssoUser finds the account for a provider identity. The first sign-in links
+// an existing account with the same email, which needs the provider to vouch
+// for the address, or else creates a new account.
+func (s *Server) ssoUser(provider string, identity ssoIdentity) (int, error) {
+	var userID int
+	err := s.db.QueryRow("SELECT user_id FROM sso_identities WHERE provider = ? AND subject = ?", provider, identity.Subject).Scan(&userID)
+	if err == nil {
+		return userID, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+	email := strings.TrimSpace(identity.Email)
+	if email == "" {
+		return 0, errors.New("provider returned no email")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID)
+	switch {
+	case err == nil && !identity.EmailVerified:
+		return 0, errSSOEmailConflict
+	case err == nil:
+		if _, err := tx.Exec("UPDATE users SET verified = 1 WHERE id = ?", userID); err != nil {
+			return 0, err
+		}
+	case err == sql.ErrNoRows:
+		if userID, err = createPasswordlessUser(tx, email, identity.EmailVerified); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, err
+	}
+
+	if _, err := tx.Exec("INSERT INTO sso_identities (provider, subject, user_id, created_at) VALUES (?, ?, ?, ?)",
+		provider, identity.Subject, userID, time.Now().Unix()); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeIdP is a minimal OpenID Connect provider: it hands out an id_token for
+// whatever identity the test set, bound to the nonce of the last sign-in.
+type fakeIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu       sync.Mutex
+	nonce    string
+	subject  string
+	email    string
+	verified bool
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		enc := base64.RawURLEncoding
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   enc.EncodeToString(key.N.Bytes()),
+			"e":   enc.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("code_verifier") == "" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		idp.mu.Lock()
+		claims := jwt.MapClaims{
+			"iss":            idp.URL,
+			"aud":            "grape",
+			"sub":            idp.subject,
+			"email":          idp.email,
+			"email_verified": idp.verified,
+			"nonce":          idp.nonce,
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Minute).Unix(),
+		}
+		idp.mu.Unlock()
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "test"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "at", "token_type": "Bearer", "id_token": signed})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *fakeIdP) as(subject, email string, verified bool) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.subject, idp.email, idp.verified = subject, email, verified
+}
+
+// ssoSignIn walks through the redirects of a sign-in and returns the
+// fragment the frontend would receive.
+func (ts *testServer) ssoSignIn(t *testing.T, idp *fakeIdP) url.Values {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	resp, err := client.Get(ts.http.URL + "/api/auth/sso/corp/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	authURL, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("login: status %d, location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	q := authURL.Query()
+	if q.Get("code_challenge_method") != "S256" {
+		t.Errorf("login redirect without PKCE: %s", authURL)
+	}
+	idp.mu.Lock()
+	idp.nonce = q.Get("nonce")
+	idp.mu.Unlock()
+
+	resp, err = client.Get(ts.http.URL + "/api/auth/sso/corp/callback?code=abc&state=" + url.QueryEscape(q.Get("state")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("callback: status %d, location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	fragment, _ := url.ParseQuery(back.Fragment)
+	return fragment
+}
+
+func TestSSOSignIn(t *testing.T) {
+	idp := newFakeIdP(t)
+	t.Setenv("GRAPE_OIDC_ISSUER", idp.URL)
+	t.Setenv("GRAPE_OIDC_CLIENT_ID", "grape")
+	t.Setenv("GRAPE_OIDC_NAME", "corp")
+	ts := newTestServer(t, stubRunner{})
+
+	var providers []struct {
+		Name string `json:"name"`
+	}
+	ts.do(t, "GET", "/api/auth/sso", "", nil, "", &providers)
+	if len(providers) != 1 || providers[0].Name != "corp" {
+		t.Fatalf("providers = %+v", providers)
+	}
+
+	idp.as("u-1", "grace@example.com", true)
+	first := ts.ssoSignIn(t, idp)
+	if first.Get("token") == "" || first.Get("refresh_token") == "" {
+		t.Fatalf("first sign-in: %v", first)
+	}
+	var me Profile
+	if resp := ts.do(t, "GET", "/api/me", first.Get("token"), nil, "", &me); resp.StatusCode != http.StatusOK {
+		t.Fatalf("me: status %d", resp.StatusCode)
+	}
+	if me.Email != "grace@example.com" || !me.Verified {
+		t.Errorf("SSO account = %+v", me)
+	}
+
+	// The same subject comes back to the same account, even with a new email
+	idp.as("u-1", "grace.hopper@example.com", true)
+	var again Profile
+	ts.do(t, "GET", "/api/me", ts.ssoSignIn(t, idp).Get("token"), nil, "", &again)
+	if again.Email != "grace@example.com" {
+		t.Errorf("second sign-in landed on %q", again.Email)
+	}
+
+	// An existing password account is only linked if the IdP vouches for the email
+	ts.signUp(t, "ada@example.com", "correct horse battery")
+	idp.as("u-2", "ada@example.com", false)
+	if got := ts.ssoSignIn(t, idp); got.Get("error") != "email_conflict" {
+		t.Errorf("unverified email: %v, want email_conflict", got)
+	}
+	idp.as("u-2", "ada@example.com", true)
+	var linked Profile
+	ts.do(t, "GET", "/api/me", ts.ssoSignIn(t, idp).Get("token"), nil, "", &linked)
+	if linked.Email != "ada@example.com" {
+		t.Errorf("linked sign-in landed on %q", linked.Email)
+	}
+}
+
+func TestSSOCallbackRejectsUnknownState(t *testing.T) {
+	idp := newFakeIdP(t)
+	t.Setenv("GRAPE_OIDC_ISSUER", idp.URL)
+	t.Setenv("GRAPE_OIDC_CLIENT_ID", "grape")
+	t.Setenv("GRAPE_OIDC_NAME", "corp")
+	ts := newTestServer(t, stubRunner{})
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(ts.http.URL + "/api/auth/sso/corp/callback?code=abc&state=forged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	back, _ := url.Parse(resp.Header.Get("Location"))
+	if back == nil || back.Fragment != "error=invalid_state" {
+		t.Errorf("forged state: location %q", resp.Header.Get("Location"))
+	}
+	if resp := ts.do(t, "GET", "/api/auth/sso/other/login", "", nil, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown provider: status %d, want 404", resp.StatusCode)
+	}
+}
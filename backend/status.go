@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// statusTransitions is the project lifecycle: which statuses each status may
+// move to. Anything else is a bug or a lost race.
+var statusTransitions = map[string][]string{
+	"queued":    {"building", "cancelled", "failed", "archived"},
+	"building":  {"live", "failed", "cancelled"},
+	"live":      {"queued", "archived"},
+	"failed":    {"queued", "archived"},
+	"cancelled": {"queued", "archived"},
+	"archived":  {},
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range statusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// updateProjectStatus moves a project from one status to another, but only if
+// it is still in from, so concurrent writers resolve deterministically. ok
+// reports whether this call made the transition.
+func (s *Server) updateProjectStatus(projectID, from, to string) (ok bool, err error) {
+	if !canTransition(from, to) {
+		return false, fmt.Errorf("illegal status transition %s -> %s", from, to)
+	}
+	res, err := s.execWithRetry("UPDATE projects SET status = ? WHERE id = ? AND status = ?", to, projectID, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if n > 0 {
+		s.syncDeployment(projectID, to)
+	}
+	return n > 0, err
+}
+
+// updateProjectStatusLog is updateProjectStatus that also replaces the build
+// log in the same statement, so a log is never attached to a transition that
+// lost a race.
+func (s *Server) updateProjectStatusLog(projectID, from, to, buildLog string) (ok bool, err error) {
+	if !canTransition(from, to) {
+		return false, fmt.Errorf("illegal status transition %s -> %s", from, to)
+	}
+	res, err := s.execWithRetry("UPDATE projects SET status = ?, build_log = ? WHERE id = ? AND status = ?",
+		to, buildLog, projectID, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if n > 0 {
+		s.setDeploymentLog(projectID, buildLog)
+		s.syncDeployment(projectID, to)
+	}
+	return n > 0, err
+}
+
+// appendBuildLog adds note to the project's build log and to its latest
+// deployment's.
+func (s *Server) appendBuildLog(projectID, note string) error {
+	if _, err := s.execWithRetry("UPDATE projects SET build_log = build_log || ? WHERE id = ?", note, projectID); err != nil {
+		return err
+	}
+	_, err := s.execWithRetry(`
+		UPDATE deployments SET build_log = build_log || ?
+		WHERE id = (SELECT id FROM deployments WHERE project_id = ? ORDER BY rowid DESC LIMIT 1)
+	`, note, projectID)
+	return err
+}
+
+// failProjectsIn moves every project in one of the given statuses to failed,
+// appending note to its build log. It returns how many were failed.
+func (s *Server) failProjectsIn(note string, statuses ...string) (int, error) {
+	type pending struct{ id, status string }
+	var projects []pending
+	for _, status := range statuses {
+		rows, err := s.db.Query("SELECT id FROM projects WHERE status = ?", status)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err == nil {
+				projects = append(projects, pending{id, status})
+			}
+		}
+		rows.Close()
+	}
+
+	var failed int
+	for _, p := range projects {
+		ok, err := s.updateProjectStatus(p.id, p.status, "failed")
+		if err != nil {
+			return failed, err
+		}
+		if !ok {
+			continue
+		}
+		failed++
+		if err := s.appendBuildLog(p.id, note); err != nil {
+			log.Printf("project %s: cannot append to build log: %v", p.id, err)
+		}
+	}
+	s.projectsCache.clear()
+	return failed, nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage holds uploaded archives and deployed site files under
+// slash-separated keys such as "uploads/{id}.zip" and "deploy/{id}/index.html".
+// Missing keys are reported as fs.ErrNotExist.
+type Storage interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadSeekCloser, ObjectInfo, error)
+	Stat(key string) (ObjectInfo, error)
+	// List returns every object whose key starts with prefix.
+	List(prefix string) ([]ObjectInfo, error)
+	// Delete removes key, or everything under it when it ends in "/".
+	Delete(prefix string) error
+}
+
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// dirPublisher is implemented by backends that can swap a whole directory in
+// more cheaply than uploading it file by file.
+type dirPublisher interface {
+	publishDir(dir, prefix string) error
+}
+
+func uploadKey(projectID, format string) string {
+	return "uploads/" + projectID + archiveExt(format)
+}
+
+func deployPrefix(projectID string) string { return "deploy/" + projectID + "/" }
+
+// findUpload locates the project's stored archive, whichever format it is in.
+func (s *Server) findUpload(projectID string) (key, format string, err error) {
+	for _, f := range archiveFormats {
+		key := uploadKey(projectID, f.format)
+		if _, err := s.storage.Stat(key); err == nil {
+			return key, f.format, nil
+		}
+	}
+	return "", "", fs.ErrNotExist
+}
+
+// initStorage picks the backend from GRAPE_STORAGE ("local" or "s3").
+func (s *Server) initStorage() {
+	switch backend := envString("GRAPE_STORAGE", "local"); backend {
+	case "local":
+		s.storage = &localStorage{dirs: map[string]string{"uploads": s.cfg.UploadsDir, "deploy": s.cfg.DeployDir, "exports": s.cfg.ExportsDir}}
+	case "s3":
+		st, err := newS3Storage()
+		if err != nil {
+			log.Fatalf("S3 storage: %v", err)
+		}
+		s.storage = st
+	default:
+		log.Fatalf("unknown GRAPE_STORAGE %q", backend)
+	}
+}
+
+// localStorage maps the first segment of a key to a directory on disk.
+type localStorage struct {
+	dirs map[string]string
+}
+
+func (s *localStorage) path(key string) (string, error) {
+	ns, rest, _ := strings.Cut(key, "/")
+	dir, ok := s.dirs[ns]
+	if !ok {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	for _, seg := range strings.Split(rest, "/") {
+		if seg == ".." {
+			return "", fmt.Errorf("invalid storage key %q", key)
+		}
+	}
+	return filepath.Join(dir, filepath.FromSlash(rest)), nil
+}
+
+func (s *localStorage) Put(key string, r io.Reader) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *localStorage) Get(key string) (io.ReadSeekCloser, ObjectInfo, error) {
+	info, err := s.Stat(key)
+	if err != nil {
+		return nil, info, err
+	}
+	p, _ := s.path(key)
+	f, err := os.Open(p)
+	return f, info, err
+}
+
+func (s *localStorage) Stat(key string) (ObjectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return ObjectInfo{}, fs.ErrNotExist
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *localStorage) List(prefix string) ([]ObjectInfo, error) {
+	root, err := s.path(strings.TrimSuffix(prefix, "/"))
+	if err != nil {
+		return nil, err
+	}
+	var objects []ObjectInfo
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		key := strings.TrimSuffix(prefix, "/")
+		if rel != "." {
+			key += "/" + filepath.ToSlash(rel)
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
+
+func (s *localStorage) Delete(prefix string) error {
+	p, err := s.path(strings.TrimSuffix(prefix, "/"))
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+// publishDir renames dir into place. The previous version is only removed once
+// the new one is live, and is restored on failure.
+func (s *localStorage) publishDir(dir, prefix string) error {
+	live, err := s.path(strings.TrimSuffix(prefix, "/"))
+	if err != nil {
+		return err
+	}
+	prev := live + ".prev"
+	if err := os.MkdirAll(filepath.Dir(live), 0755); err != nil {
+		return err
+	}
+
+	os.RemoveAll(prev)
+	hadPrev := true
+	if err := os.Rename(live, prev); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		hadPrev = false
+	}
+
+	if err := os.Rename(dir, live); err != nil {
+		if hadPrev {
+			os.Rename(prev, live)
+		}
+		return err
+	}
+
+	os.RemoveAll(prev)
+	return nil
+}
+
+// publishDir replaces everything under prefix with the contents of dir. New
+// files are written before stale ones are removed so the site never goes
+// missing midway.
+func publishDir(st Storage, dir, prefix string) error {
+	if p, ok := st.(dirPublisher); ok {
+		return p.publishDir(dir, prefix)
+	}
+
+	keep := map[string]bool{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		key := prefix + filepath.ToSlash(rel)
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := st.Put(key, f); err != nil {
+			return err
+		}
+		keep[key] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	existing, err := st.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, obj := range existing {
+		if !keep[obj.Key] {
+			if err := st.Delete(obj.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// fetchDir copies everything under prefix into dir.
+func fetchDir(st Storage, prefix, dir string) error {
+	objects, err := st.List(prefix)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		target := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(obj.Key, prefix)))
+		if err := fetchFile(st, obj.Key, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fetchFile(st Storage, key, target string) error {
+	rc, _, err := st.Get(key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, rc); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// storedSize is the total size of the objects under prefix.
+func (s *Server) storedSize(prefix string) int64 {
+	objects, err := s.storage.List(prefix)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, obj := range objects {
+		size += obj.Size
+	}
+	return size
+}
+
+// siteFiles is a deployed site: the objects stored under prefix, addressed by
+// URL-style paths such as "/about.html".
+type siteFiles struct {
+	store  Storage
+	prefix string
+}
+
+func (s *Server) liveSiteFiles(projectID string) siteFiles {
+	return siteFiles{s.storage, s.liveDeployPrefix(projectID)}
+}
+
+// localSiteFiles serves a build output directory that has not been published,
+// e.g. for health checks.
+func localSiteFiles(dir string) siteFiles {
+	return siteFiles{&localStorage{dirs: map[string]string{"site": dir}}, "site/"}
+}
+
+func (f siteFiles) key(urlPath string) string {
+	return f.prefix + strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+}
+
+func (f siteFiles) exists(urlPath string) bool {
+	_, err := f.store.Stat(f.key(urlPath))
+	return err == nil
+}
+
+func (f siteFiles) open(urlPath string) (io.ReadSeekCloser, ObjectInfo, error) {
+	return f.store.Get(f.key(urlPath))
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var baseDomain = envString("GRAPE_BASE_DOMAIN", "grape.ai")
+
+// A project that changes its slug keeps the old one for this long, answering
+// it with redirects to the new one; nobody else can claim it meanwhile.
+var subdomainRedirectTTL = envDuration("GRAPE_SUBDOMAIN_REDIRECT_TTL", 90*24*time.Hour)
+
+var validSubdomain = regexp.MustCompile(`^[a-z0-9-]{3,63}$`)
+
+// Every project is also reachable at {id}.{baseDomain}, and each deployment at
+// {deploymentID}-{project}.{baseDomain}, so slugs shaped like an ID (see
+// generateID) are kept free.
+var projectIDSubdomain = regexp.MustCompile(`^[0-9a-f]{16}(-|$)`)
+
+// maxLabelLength is the longest a DNS label may be.
+const maxLabelLength = 63
+
+var reservedSubdomains = map[string]bool{
+	"www": true, "api": true, "admin": true, "app": true, "dashboard": true,
+	"mail": true, "smtp": true, "ftp": true, "static": true, "cdn": true,
+	"assets": true, "deploy": true, "status": true, "docs": true, "help": true,
+	"support": true, "blog": true, "auth": true, "login": true, "grape": true,
+}
+
+func init() {
+	// GRAPE_RESERVED_SUBDOMAINS adds to the list, e.g. for brand names
+	for slug := range parseCommaSet(envString("GRAPE_RESERVED_SUBDOMAINS", "")) {
+		reservedSubdomains[slug] = true
+	}
+}
+
+func validateSubdomain(slug string) error {
+	if !validSubdomain.MatchString(slug) {
+		return errors.New("subdomain must be 3-63 characters of lowercase letters, digits and hyphens")
+	}
+	if strings.HasPrefix(slug, "-") || strings.HasSuffix(slug, "-") {
+		return errors.New("subdomain cannot start or end with a hyphen")
+	}
+	if strings.Contains(slug, "--") {
+		return errors.New("subdomain cannot contain \"--\", which separates branch deploys from the project")
+	}
+	if reservedSubdomains[slug] || projectIDSubdomain.MatchString(slug) {
+		return errors.New("subdomain is reserved")
+	}
+	return nil
+}
+
+// subdomainTaken reports whether a project other than projectID serves host
+// or still redirects from it.
+func (s *Server) subdomainTaken(host, projectID string) bool {
+	var exists bool
+	s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM projects WHERE subdomain = ? AND id != ?)
+		OR EXISTS (SELECT 1 FROM subdomain_redirects WHERE subdomain = ? AND project_id != ? AND expires_at > ?)`,
+		host, projectID, host, projectID, time.Now().Unix()).Scan(&exists)
+	return exists
+}
+
+// redirectForHost returns the current host of the project that used to be
+// served at host, if it still redirects from there.
+func (s *Server) redirectForHost(host string) string {
+	var target string
+	s.db.QueryRow(`
+		SELECT p.subdomain FROM subdomain_redirects r JOIN projects p ON p.id = r.project_id
+		WHERE r.subdomain = ? AND r.expires_at > ? AND p.status != 'archived'
+	`, host, time.Now().Unix()).Scan(&target)
+	return target
+}
+
+// siteForHost returns the ID of the project served at host, if any: the one
+// whose subdomain it is, or the one whose ID is its first label.
+func (s *Server) siteForHost(host string) string {
+	label := strings.TrimSuffix(host, "."+baseDomain)
+	var projectID string
+	s.db.QueryRow("SELECT id FROM projects WHERE (subdomain = ? OR id = ?) AND status != 'archived' ORDER BY subdomain = ? DESC LIMIT 1",
+		host, label, host).Scan(&projectID)
+	return projectID
+}
+
+// previewHost is where a deployment of the project stays reachable after
+// newer ones go live. Previews of projects whose slug is too long to fit in
+// one label are named after the project ID instead.
+func previewHost(projectID, subdomain, deploymentID string) string {
+	label := deploymentID + "-" + strings.TrimSuffix(subdomain, "."+baseDomain)
+	if len(label) > maxLabelLength {
+		label = deploymentID + "-" + projectID
+	}
+	return label + "." + baseDomain
+}
+
+// previewForHost returns the project and successful deployment a preview
+// host names, if any.
+func (s *Server) previewForHost(host string) (projectID, deploymentID string) {
+	label := strings.TrimSuffix(host, "."+baseDomain)
+	if len(label) < 18 || !projectIDSubdomain.MatchString(label) {
+		return "", ""
+	}
+	deploymentID, project := label[:16], label[17:]
+	s.db.QueryRow(`
+		SELECT p.id FROM deployments d JOIN projects p ON p.id = d.project_id
+		WHERE d.id = ? AND d.status = ? AND (p.subdomain = ? OR p.id = ?) AND p.status != 'archived'
+	`, deploymentID, deploySucceeded, project+"."+baseDomain, project).Scan(&projectID)
+	if projectID == "" {
+		return "", ""
+	}
+	return projectID, deploymentID
+}
+
+// siteHostMiddleware serves project sites on their own hostnames, for when
+// requests reach the API directly rather than through Nginx.
+func (s *Server) siteHostMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.HasSuffix(host, "."+baseDomain) {
+			if projectID, deploymentID := s.previewForHost(host); projectID != "" {
+				s.serveSite(w, r, projectID, siteFiles{s.storage, deploymentPrefix(projectID, deploymentID)}, "/")
+				return
+			}
+			if projectID, deploymentID := s.aliasForHost(host); deploymentID != "" {
+				s.serveSite(w, r, projectID, siteFiles{s.storage, deploymentPrefix(projectID, deploymentID)}, "/")
+				return
+			}
+			if projectID := s.siteForHost(host); projectID != "" {
+				s.serveSite(w, r, projectID, s.liveSiteFiles(projectID), "/")
+				return
+			}
+			if projectID, deploymentID := s.branchForHost(host); deploymentID != "" {
+				s.serveSite(w, r, projectID, siteFiles{s.storage, deploymentPrefix(projectID, deploymentID)}, "/")
+				return
+			}
+			if target := s.redirectForHost(host); target != "" {
+				http.Redirect(w, r, requestScheme(r)+"://"+target+r.URL.RequestURI(), http.StatusMovedPermanently)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type subdomainCheck struct {
+	Slug      string `json:"slug"`
+	Subdomain string `json:"subdomain"`
+	Available bool   `json:"available"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// handleCheckSubdomain reports whether ?slug= could be used for a new
+// project, and why not.
+func (s *Server) handleCheckSubdomain(w http.ResponseWriter, r *http.Request) {
+	slug := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("slug")))
+	check := subdomainCheck{Slug: slug, Subdomain: slug + "." + baseDomain}
+	if err := validateSubdomain(slug); err != nil {
+		check.Reason = err.Error()
+	} else if s.subdomainTaken(check.Subdomain, "") {
+		check.Reason = "subdomain is already taken"
+	} else {
+		check.Available = true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(check)
+}
+
+// handleSetSubdomain moves the project to another slug, or back to its ID
+// with an empty one. The old slug redirects to the new host for
+// GRAPE_SUBDOMAIN_REDIRECT_TTL. Admins only.
+func (s *Server) handleSetSubdomain(w http.ResponseWriter, r *http.Request) {
+	projectID, userID, ok := s.authorizeProject(w, r, roleAdmin)
+	if !ok {
+		return
+	}
+	var req struct {
+		Slug string `json:"slug"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	subdomain := projectID + "." + baseDomain
+	if slug := strings.ToLower(strings.TrimSpace(req.Slug)); slug != "" {
+		if err := validateSubdomain(slug); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_subdomain", "Invalid subdomain: "+err.Error())
+			return
+		}
+		subdomain = slug + "." + baseDomain
+	}
+
+	project, err := s.loadProject(projectID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if project.Subdomain != subdomain {
+		if s.subdomainTaken(subdomain, projectID) {
+			writeJSONError(w, http.StatusConflict, "subdomain_taken", "Subdomain "+subdomain+" is already taken")
+			return
+		}
+		if err := s.moveSubdomain(projectID, project.Subdomain, subdomain); err != nil {
+			if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+				writeJSONError(w, http.StatusConflict, "subdomain_taken", "Subdomain "+subdomain+" is already taken")
+				return
+			}
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+			return
+		}
+		s.recordHistory(projectID, "subdomain", "changed", project.Subdomain+" -> "+subdomain)
+		s.invalidateProjectLists(projectID, project.UserID)
+		project.Subdomain = subdomain
+	}
+
+	role, _ := s.projectRole(projectID, userID)
+	project.Role = role.String()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
+
+// moveSubdomain serves the project at to, redirecting from "from" unless
+// that was its ID host, which keeps working anyway.
+func (s *Server) moveSubdomain(projectID, from, to string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	// The project may be taking back one of its old slugs, or an expired one
+	if _, err := tx.Exec("DELETE FROM subdomain_redirects WHERE subdomain = ? AND (project_id = ? OR expires_at <= ?)", to, projectID, now.Unix()); err != nil {
+		return err
+	}
+	if from != projectID+"."+baseDomain {
+		if _, err := tx.Exec(`
+			INSERT INTO subdomain_redirects (subdomain, project_id, created_at, expires_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (subdomain) DO UPDATE SET project_id = excluded.project_id, created_at = excluded.created_at, expires_at = excluded.expires_at
+		`, from, projectID, now.Unix(), now.Add(subdomainRedirectTTL).Unix()); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE projects SET subdomain = ? WHERE id = ?", to, projectID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
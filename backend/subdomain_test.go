@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"testing"
+)
+
+func TestValidateSubdomain(t *testing.T) {
+	for slug, ok := range map[string]bool{
+		"my-site":          true,
+		"ab":               false,
+		"-site":            false,
+		"admin":            false,
+		"0123456789abcdef": false,
+		"0123456789abcdeg": true,
+	} {
+		if err := validateSubdomain(slug); (err == nil) != ok {
+			t.Errorf("validateSubdomain(%q) = %v", slug, err)
+		}
+	}
+}
+
+func TestHostRouting(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("name", "site")
+	mw.WriteField("subdomain", "my-site")
+	part, _ := mw.CreateFormFile("project", "site.zip")
+	part.Write(siteZip(t))
+	mw.Close()
+	var project Project
+	if resp := ts.do(t, "POST", "/api/upload", token, &body, mw.FormDataContentType(), &project); resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: status %d", resp.StatusCode)
+	}
+	ts.waitForStatus(t, token, project.ID)
+
+	get := func(host, path string) (int, string) {
+		req, _ := http.NewRequest("GET", ts.http.URL+path, nil)
+		req.Host = host
+		resp, err := ts.http.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	for _, host := range []string{"my-site." + baseDomain, "MY-SITE." + baseDomain + ":8443", project.ID + "." + baseDomain} {
+		if status, page := get(host, "/"); status != http.StatusOK || page != "<h1>hello</h1>" {
+			t.Errorf("GET / on %s: %d %q", host, status, page)
+		}
+	}
+	if _, page := get("my-site."+baseDomain, "/api/projects"); page != "<h1>hello</h1>" {
+		t.Errorf("API path on a site host served %q, want the site", page)
+	}
+	if status, _ := get("other."+baseDomain, "/deploy/"+project.ID+"/"); status != http.StatusOK {
+		t.Errorf("unknown subdomain falls through to the API: status %d", status)
+	}
+}
+
+func TestChangeSubdomain(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	other := ts.signUp(t, "bob@example.com", "correct horse battery 1")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	path := "/api/projects/" + project.ID + "/subdomain"
+
+	check := func(slug string) subdomainCheck {
+		var c subdomainCheck
+		ts.do(t, "GET", "/api/subdomains/check?slug="+slug, other, nil, "", &c)
+		return c
+	}
+	if c := check("my-app"); !c.Available || c.Subdomain != "my-app."+baseDomain {
+		t.Errorf("free slug %+v", c)
+	}
+	if c := check("admin"); c.Available || c.Reason == "" {
+		t.Errorf("reserved slug %+v", c)
+	}
+
+	var moved Project
+	if resp := ts.do(t, "PUT", path, token, jsonBody(map[string]string{"slug": "My-App"}), "application/json", &moved); resp.StatusCode != http.StatusOK {
+		t.Fatalf("set slug: status %d", resp.StatusCode)
+	}
+	if moved.Subdomain != "my-app."+baseDomain {
+		t.Errorf("moved %+v", moved)
+	}
+	if c := check("my-app"); c.Available {
+		t.Errorf("used slug %+v", c)
+	}
+	ts.do(t, "PUT", path, token, jsonBody(map[string]string{"slug": "my-new-app"}), "application/json", &moved)
+
+	// The old slug now redirects, and stays out of reach of other projects
+	if c := check("my-app"); c.Available {
+		t.Errorf("redirecting slug %+v", c)
+	}
+	client := *ts.http.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	req, _ := http.NewRequest("GET", ts.http.URL+"/about?x=1", nil)
+	req.Host = "my-app." + baseDomain
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want := "http://my-new-app." + baseDomain + "/about?x=1"; resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != want {
+		t.Errorf("old slug: status %d, Location %q, want %s", resp.StatusCode, resp.Header.Get("Location"), want)
+	}
+
+	theirs, _ := ts.upload(t, other, "theirs", siteZip(t))
+	ts.waitForStatus(t, other, theirs.ID)
+	if resp := ts.do(t, "PUT", "/api/projects/"+theirs.ID+"/subdomain", other, jsonBody(map[string]string{"slug": "my-app"}), "application/json", nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("claiming a redirecting slug: status %d, want 409", resp.StatusCode)
+	}
+	if resp := ts.do(t, "PUT", path, token, jsonBody(map[string]string{"slug": "my-app"}), "application/json", &moved); resp.StatusCode != http.StatusOK || moved.Subdomain != "my-app."+baseDomain {
+		t.Errorf("taking back the old slug: status %d, project %+v", resp.StatusCode, moved)
+	}
+	if resp := ts.do(t, "PUT", path, token, jsonBody(map[string]string{"slug": "api"}), "application/json", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("reserved slug: status %d, want 400", resp.StatusCode)
+	}
+}
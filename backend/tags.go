@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Tags are free-form labels for organizing projects, set with PATCH
+// /api/projects/{id} and matched by GET /api/projects?tag=. They are stored
+// lowercased, so Client-X and client-x are the same tag.
+
+const (
+	maxTagLength      = 40
+	maxTagsPerProject = 20
+)
+
+// normalizeTags trims, lowercases and dedupes tags, rejecting ones that
+// can't be told apart in a comma-separated ?tag= filter.
+func normalizeTags(raw []string) ([]string, error) {
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, t := range raw {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || utf8.RuneCountInString(t) > maxTagLength || strings.ContainsAny(t, ",\r\n\t") {
+			return nil, fmt.Errorf("tags must be 1-%d characters without commas", maxTagLength)
+		}
+		if !seen[t] {
+			seen[t] = true
+			tags = append(tags, t)
+		}
+	}
+	if len(tags) > maxTagsPerProject {
+		return nil, fmt.Errorf("a project can have at most %d tags", maxTagsPerProject)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// setProjectTags replaces the project's tags.
+func setProjectTags(tx *sql.Tx, projectID string, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM project_tags WHERE project_id = ?", projectID); err != nil {
+		return err
+	}
+	for _, t := range tags {
+		if _, err := tx.Exec("INSERT INTO project_tags (project_id, tag) VALUES (?, ?)", projectID, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) projectTags(projectID string) ([]string, error) {
+	rows, err := s.db.Query("SELECT tag FROM project_tags WHERE project_id = ? ORDER BY tag", projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// visibleProjectTags maps the projects the user can see to their tags.
+func (s *Server) visibleProjectTags(userID int) (map[string][]string, error) {
+	rows, err := s.db.Query("SELECT project_id, tag FROM project_tags WHERE project_id IN "+accessibleProjectIDs+" ORDER BY tag", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := map[string][]string{}
+	for rows.Next() {
+		var projectID, t string
+		if err := rows.Scan(&projectID, &t); err != nil {
+			return nil, err
+		}
+		tags[projectID] = append(tags[projectID], t)
+	}
+	return tags, rows.Err()
+}
+
+type tagCount struct {
+	Tag      string `json:"tag"`
+	Projects int    `json:"projects"`
+}
+
+// handleListTags returns the tags on projects the user can see, with how
+// many projects carry each.
+func (s *Server) handleListTags(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	rows, err := s.db.Query("SELECT tag, COUNT(*) FROM project_tags WHERE project_id IN "+accessibleProjectIDs+" GROUP BY tag ORDER BY tag", userID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	defer rows.Close()
+
+	tags := []tagCount{}
+	for rows.Next() {
+		var t tagCount
+		if err := rows.Scan(&t.Tag, &t.Projects); err != nil {
+			continue
+		}
+		tags = append(tags, t)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	tags, err := normalizeTags([]string{" Client-X ", "staging", "client-x"})
+	if err != nil || !reflect.DeepEqual(tags, []string{"client-x", "staging"}) {
+		t.Errorf("normalizeTags = %v, %v", tags, err)
+	}
+	for _, bad := range [][]string{{""}, {"a,b"}, {strings.Repeat("a", maxTagLength+1)}} {
+		if _, err := normalizeTags(bad); err == nil {
+			t.Errorf("normalizeTags(%q): no error", bad)
+		}
+	}
+}
+
+func TestProjectTags(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	var ids []string
+	for _, name := range []string{"shop", "blog"} {
+		project, _ := ts.upload(t, token, name, siteZip(t))
+		ts.waitForStatus(t, token, project.ID)
+		ids = append(ids, project.ID)
+	}
+
+	var updated Project
+	body := map[string]interface{}{"tags": []string{"Client-X", "prod"}}
+	if resp := ts.do(t, "PATCH", "/api/projects/"+ids[0], token, jsonBody(body), "application/json", &updated); resp.StatusCode != http.StatusOK {
+		t.Fatalf("tag: status %d", resp.StatusCode)
+	}
+	if !reflect.DeepEqual(updated.Tags, []string{"client-x", "prod"}) {
+		t.Errorf("tags %v", updated.Tags)
+	}
+	ts.do(t, "PATCH", "/api/projects/"+ids[1], token, jsonBody(map[string]interface{}{"tags": []string{"prod"}}), "application/json", nil)
+
+	list := func(query string) []Project {
+		var projects []Project
+		ts.do(t, "GET", "/api/projects"+query, token, nil, "", &projects)
+		return projects
+	}
+	if projects := list("?tag=client-x"); len(projects) != 1 || projects[0].ID != ids[0] {
+		t.Errorf("?tag=client-x: %+v", projects)
+	}
+	if projects := list("?tag=prod"); len(projects) != 2 {
+		t.Errorf("?tag=prod: %+v", projects)
+	}
+	if projects := list("?tag=prod,CLIENT-X"); len(projects) != 1 {
+		t.Errorf("?tag=prod,CLIENT-X: %+v", projects)
+	}
+
+	var tags []tagCount
+	ts.do(t, "GET", "/api/tags", token, nil, "", &tags)
+	if !reflect.DeepEqual(tags, []tagCount{{"client-x", 1}, {"prod", 2}}) {
+		t.Errorf("tags %+v", tags)
+	}
+
+	// An empty list clears them
+	updated = Project{}
+	ts.do(t, "PATCH", "/api/projects/"+ids[0], token, jsonBody(map[string]interface{}{"tags": []string{}}), "application/json", &updated)
+	if len(updated.Tags) != 0 || len(list("?tag=client-x")) != 0 {
+		t.Errorf("cleared tags %v", updated.Tags)
+	}
+	if resp := ts.do(t, "PATCH", "/api/projects/"+ids[0], token, jsonBody(map[string]interface{}{"tags": []string{"a,b"}}), "application/json", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("comma in a tag: status %d, want 400", resp.StatusCode)
+	}
+}
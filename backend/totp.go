@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP follows RFC 6238 with the parameters authenticator apps assume:
+// SHA-1, six digits, 30-second steps.
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// Codes from one step either side are accepted to allow for clock drift
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+var (
+	errOTPRequired = errors.New("one-time code required")
+	errInvalidOTP  = errors.New("invalid one-time code")
+)
+
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000), nil
+}
+
+// matchTOTP returns the time step code is valid for, or -1.
+func matchTOTP(secret, code string, now time.Time) int64 {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		want, err := totpCode(secret, step)
+		if err == nil && hmac.Equal([]byte(want), []byte(code)) {
+			return step
+		}
+	}
+	return -1
+}
+
+func totpURI(secret, email string) string {
+	label := url.PathEscape("Grape.ai:" + email)
+	return fmt.Sprintf("otpauth://totp/%s?secret=%s&issuer=Grape.ai&digits=%d&period=%d", label, secret, totpDigits, totpPeriod)
+}
+
+func newRecoveryCode() string {
+	b := make([]byte, 5)
+	rand.Read(b)
+	code := hex.EncodeToString(b)
+	return code[:5] + "-" + code[5:]
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// checkSecondFactor verifies otp, either a current TOTP code or an unused
+// recovery code, for a user with two-factor authentication enabled. Each TOTP
+// code and recovery code works only once.
+func (s *Server) checkSecondFactor(userID int, otp string) error {
+	otp = strings.TrimSpace(otp)
+	if otp == "" {
+		return errOTPRequired
+	}
+
+	var (
+		secret   string
+		lastStep int64
+	)
+	if err := s.db.QueryRow("SELECT totp_secret, totp_last_step FROM users WHERE id = ?", userID).Scan(&secret, &lastStep); err != nil {
+		return err
+	}
+	if step := matchTOTP(secret, otp, time.Now()); step >= 0 {
+		res, err := s.db.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, userID, step)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errInvalidOTP
+		}
+		return nil
+	}
+
+	res, err := s.db.Exec("DELETE FROM recovery_codes WHERE user_id = ? AND code_hash = ?", userID, hashToken(normalizeRecoveryCode(otp)))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errInvalidOTP
+	}
+	return nil
+}
+
+func (s *Server) totpEnabled(userID int) (bool, error) {
+	var enabled bool
+	err := s.db.QueryRow("SELECT totp_enabled FROM users WHERE id = ?", userID).Scan(&enabled)
+	return enabled, err
+}
+
+// requireSecondFactor guards sensitive actions of signed-in users: if they
+// have two-factor authentication on, otp must be valid. It writes the error
+// response itself and reports whether to go on.
+func (s *Server) requireSecondFactor(w http.ResponseWriter, userID int, otp string) bool {
+	enabled, err := s.totpEnabled(userID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return false
+	}
+	if !enabled {
+		return true
+	}
+	switch err := s.checkSecondFactor(userID, otp); {
+	case errors.Is(err, errOTPRequired):
+		writeJSONError(w, http.StatusForbidden, "otp_required", "Enter the code from your authenticator app or a recovery code")
+		return false
+	case errors.Is(err, errInvalidOTP):
+		writeJSONError(w, http.StatusForbidden, "invalid_otp", "Invalid one-time code")
+		return false
+	case err != nil:
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return false
+	}
+	return true
+}
+
+// handleSetup2FA starts enrolment: it stores a new secret, which only takes
+// effect once a code from it is confirmed through handleVerify2FA.
+func (s *Server) handleSetup2FA(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	var (
+		email   string
+		enabled bool
+	)
+	if err := s.db.QueryRow("SELECT email, totp_enabled FROM users WHERE id = ?", userID).Scan(&email, &enabled); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if enabled {
+		writeJSONError(w, http.StatusConflict, "2fa_enabled", "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret := newTOTPSecret()
+	if _, err := s.db.Exec("UPDATE users SET totp_secret = ? WHERE id = ?", secret, userID); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"secret": secret, "otpauth_url": totpURI(secret, email)})
+}
+
+// handleVerify2FA confirms enrolment with a code from the authenticator and
+// returns the recovery codes. They are only ever shown here.
+func (s *Server) handleVerify2FA(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+
+	var (
+		secret  string
+		enabled bool
+	)
+	if err := s.db.QueryRow("SELECT totp_secret, totp_enabled FROM users WHERE id = ?", userID).Scan(&secret, &enabled); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if enabled {
+		writeJSONError(w, http.StatusConflict, "2fa_enabled", "Two-factor authentication is already enabled")
+		return
+	}
+	if secret == "" {
+		writeJSONError(w, http.StatusBadRequest, "2fa_not_setup", "Call /api/auth/2fa/setup first")
+		return
+	}
+	step := matchTOTP(secret, strings.TrimSpace(req.Code), time.Now())
+	if step < 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_otp", "Invalid code")
+		return
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	tx, err := s.db.Begin()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	for i := range codes {
+		codes[i] = newRecoveryCode()
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashToken(normalizeRecoveryCode(codes[i]))); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+			return
+		}
+	}
+	if _, err := tx.Exec("UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ?", step, userID); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"enabled": true, "recovery_codes": codes})
+}
+
+// handleDisable2FA turns two-factor authentication off; it takes a current
+// code or a recovery code, so a stolen session alone can't remove it.
+func (s *Server) handleDisable2FA(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	enabled, err := s.totpEnabled(userID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if !enabled {
+		writeJSONError(w, http.StatusConflict, "2fa_disabled", "Two-factor authentication is not enabled")
+		return
+	}
+	switch err := s.checkSecondFactor(userID, req.Code); {
+	case errors.Is(err, errOTPRequired), errors.Is(err, errInvalidOTP):
+		writeJSONError(w, http.StatusBadRequest, "invalid_otp", "Invalid code")
+		return
+	case err != nil:
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		"UPDATE users SET totp_enabled = 0, totp_secret = '' WHERE id = ?",
+		"DELETE FROM recovery_codes WHERE user_id = ?",
+	} {
+		if _, err := tx.Exec(stmt, userID); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, truncated to six digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for _, tc := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{2000000000, "279037"},
+	} {
+		got, err := totpCode(secret, tc.unix/totpPeriod)
+		if err != nil || got != tc.want {
+			t.Errorf("totpCode at %d = %q, %v; want %q", tc.unix, got, err, tc.want)
+		}
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	session := ts.signUp(t, "ada@example.com", "correct horse battery")
+
+	var setup struct {
+		Secret     string `json:"secret"`
+		OTPAuthURL string `json:"otpauth_url"`
+	}
+	if resp := ts.postJSON(t, "/api/auth/2fa/setup", session, nil, &setup); resp.StatusCode != http.StatusOK {
+		t.Fatalf("setup: status %d", resp.StatusCode)
+	}
+	step := time.Now().Unix() / totpPeriod
+	code, _ := totpCode(setup.Secret, step)
+
+	if resp := ts.postJSON(t, "/api/auth/2fa/verify", session, map[string]string{"code": "000000x"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("verify with a wrong code: status %d, want 400", resp.StatusCode)
+	}
+	var verified struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if resp := ts.postJSON(t, "/api/auth/2fa/verify", session, map[string]string{"code": code}, &verified); resp.StatusCode != http.StatusOK {
+		t.Fatalf("verify: status %d", resp.StatusCode)
+	}
+	if len(verified.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes", len(verified.RecoveryCodes))
+	}
+
+	login := func(otp string) *http.Response {
+		return ts.postJSON(t, "/api/login", "", map[string]string{"email": "ada@example.com", "password": "correct horse battery", "otp": otp}, nil)
+	}
+	if resp := login(""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("login without a code: status %d, want 401", resp.StatusCode)
+	}
+	if resp := login(code); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("login replaying the enrolment code: status %d, want 401", resp.StatusCode)
+	}
+	next, _ := totpCode(setup.Secret, step+1)
+	if resp := login(next); resp.StatusCode != http.StatusOK {
+		t.Errorf("login with a fresh code: status %d", resp.StatusCode)
+	}
+
+	recovery := verified.RecoveryCodes[0]
+	if resp := login(recovery); resp.StatusCode != http.StatusOK {
+		t.Errorf("login with a recovery code: status %d", resp.StatusCode)
+	}
+	if resp := login(recovery); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("reusing a recovery code: status %d, want 401", resp.StatusCode)
+	}
+
+	if resp := ts.do(t, "DELETE", "/api/auth/2fa", session, nil, "", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("disable without a code: status %d, want 400", resp.StatusCode)
+	}
+	if resp := ts.send(t, "DELETE", "/api/auth/2fa", session, jsonBody(map[string]string{"code": verified.RecoveryCodes[1]}), nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("disable: status %d", resp.StatusCode)
+	}
+	if resp := login(""); resp.StatusCode != http.StatusOK {
+		t.Errorf("login after disabling: status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A project changes hands in two steps: its owner (or an owner of its org)
+// offers it to another user or to an org, and that user (or an owner of that
+// org) accepts. The project keeps its ID, so its files, deployments, domain
+// and environment go with it untouched. What belonged to the old owner does
+// not: member grants, the Git link and the notification webhook are cleared.
+// Resolved transfers are kept as the project's ownership trail.
+
+var transferTTL = envDuration("GRAPE_TRANSFER_TTL", 7*24*time.Hour)
+
+const (
+	transferPending   = "pending"
+	transferAccepted  = "accepted"
+	transferDeclined  = "declined"
+	transferCancelled = "cancelled"
+	// transferExpired is never stored: it is how a pending transfer past its
+	// expiry is reported
+	transferExpired = "expired"
+)
+
+type ProjectTransfer struct {
+	ID          int    `json:"id"`
+	ProjectID   string `json:"project_id"`
+	ProjectName string `json:"project_name"`
+	FromUserID  int    `json:"from_user_id"`
+	FromEmail   string `json:"from_email"`
+	FromOrgID   int    `json:"from_org_id,omitempty"`
+	ToUserID    int    `json:"to_user_id,omitempty"`
+	ToEmail     string `json:"to_email,omitempty"`
+	ToOrgID     int    `json:"to_org_id,omitempty"`
+	ToOrgName   string `json:"to_org_name,omitempty"`
+	Status      string `json:"status"`
+	CreatedBy   int    `json:"created_by"`
+	CreatedAt   int64  `json:"created_at"`
+	ExpiresAt   int64  `json:"expires_at"`
+	ResolvedBy  int    `json:"resolved_by,omitempty"`
+	ResolvedAt  int64  `json:"resolved_at,omitempty"`
+}
+
+var errTransferInvalid = errors.New("transfer is no longer pending")
+
+const transferColumns = `
+	t.id, t.project_id, COALESCE(p.name, ''), t.from_user, COALESCE(fu.email, ''), t.from_org,
+	t.to_user, COALESCE(tu.email, ''), t.to_org, COALESCE(o.name, ''), t.status,
+	t.created_by, t.created_at, t.expires_at, t.resolved_by, t.resolved_at
+	FROM project_transfers t
+	LEFT JOIN projects p ON p.id = t.project_id
+	LEFT JOIN users fu ON fu.id = t.from_user
+	LEFT JOIN users tu ON tu.id = t.to_user
+	LEFT JOIN orgs o ON o.id = t.to_org`
+
+func scanTransfer(row interface{ Scan(...interface{}) error }) (ProjectTransfer, error) {
+	var t ProjectTransfer
+	err := row.Scan(&t.ID, &t.ProjectID, &t.ProjectName, &t.FromUserID, &t.FromEmail, &t.FromOrgID,
+		&t.ToUserID, &t.ToEmail, &t.ToOrgID, &t.ToOrgName, &t.Status,
+		&t.CreatedBy, &t.CreatedAt, &t.ExpiresAt, &t.ResolvedBy, &t.ResolvedAt)
+	if t.Status == transferPending && time.Now().Unix() > t.ExpiresAt {
+		t.Status = transferExpired
+	}
+	return t, err
+}
+
+func (s *Server) queryTransfers(where string, args ...interface{}) ([]ProjectTransfer, error) {
+	rows, err := s.db.Query("SELECT "+transferColumns+" WHERE "+where+" ORDER BY t.created_at DESC, t.id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []ProjectTransfer{}
+	for rows.Next() {
+		t, err := scanTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, t)
+	}
+	return transfers, rows.Err()
+}
+
+func (s *Server) loadTransfer(id int) (ProjectTransfer, error) {
+	return scanTransfer(s.db.QueryRow("SELECT "+transferColumns+" WHERE t.id = ?", id))
+}
+
+// ownsProject reports whether the user may give the project away: they own
+// it, or own the org it belongs to.
+func (s *Server) ownsProject(projectID string, userID int) (bool, error) {
+	var ownerID, orgID int
+	if err := s.db.QueryRow("SELECT user_id, COALESCE(org_id, 0) FROM projects WHERE id = ?", projectID).Scan(&ownerID, &orgID); err != nil {
+		return false, err
+	}
+	if ownerID == userID {
+		return true, nil
+	}
+	if orgID == 0 {
+		return false, nil
+	}
+	role, err := s.orgRole(orgID, userID)
+	return role == orgRoleOwner, err
+}
+
+// receivesTransfer reports whether the user may accept or decline t.
+func (s *Server) receivesTransfer(t ProjectTransfer, userID int) (bool, error) {
+	if t.ToOrgID == 0 {
+		return t.ToUserID == userID, nil
+	}
+	role, err := s.orgRole(t.ToOrgID, userID)
+	return role == orgRoleOwner, err
+}
+
+// transferRecipient describes who a transfer goes to, for the history.
+func transferRecipient(t ProjectTransfer) string {
+	if t.ToOrgID != 0 {
+		return fmt.Sprintf("organization %s (%d)", t.ToOrgName, t.ToOrgID)
+	}
+	return t.ToEmail
+}
+
+// handleCreateTransfer offers the project to a user, by email, or to an org.
+// Offering it again replaces the pending offer.
+func (s *Server) handleCreateTransfer(w http.ResponseWriter, r *http.Request) {
+	projectID, userID, ok := s.authorizeProject(w, r, roleAdmin)
+	if !ok {
+		return
+	}
+	owner, err := s.ownsProject(projectID, userID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if !owner {
+		writeJSONError(w, http.StatusForbidden, "not_owner", "Only the project's owner can transfer it")
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+		OrgID int    `json:"org_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if (req.Email == "") == (req.OrgID == 0) {
+		writeJSONError(w, http.StatusBadRequest, "invalid_recipient", "Set either email or org_id")
+		return
+	}
+
+	var fromUser, fromOrg int
+	if err := s.db.QueryRow("SELECT user_id, COALESCE(org_id, 0) FROM projects WHERE id = ?", projectID).Scan(&fromUser, &fromOrg); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	var toUser int
+	if req.Email != "" {
+		if err := s.db.QueryRow("SELECT id FROM users WHERE email = ?", req.Email).Scan(&toUser); err != nil {
+			writeJSONError(w, http.StatusNotFound, "user_not_found", "User not found")
+			return
+		}
+		if toUser == fromUser && fromOrg == 0 {
+			writeJSONError(w, http.StatusConflict, "already_owner", "That user already owns the project")
+			return
+		}
+	} else {
+		var name string
+		if err := s.db.QueryRow("SELECT name FROM orgs WHERE id = ?", req.OrgID).Scan(&name); err != nil {
+			writeJSONError(w, http.StatusNotFound, "org_not_found", "Organization not found")
+			return
+		}
+		if req.OrgID == fromOrg {
+			writeJSONError(w, http.StatusConflict, "already_owner", "The project already belongs to that organization")
+			return
+		}
+	}
+
+	now := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE project_transfers SET status = ?, resolved_by = ?, resolved_at = ? WHERE project_id = ? AND status = ?",
+		transferCancelled, userID, now.Unix(), projectID, transferPending); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	res, err := tx.Exec(`
+		INSERT INTO project_transfers (project_id, from_user, from_org, to_user, to_org, status, created_by, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, projectID, fromUser, fromOrg, toUser, req.OrgID, transferPending, userID, now.Unix(), now.Add(transferTTL).Unix())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	id, _ := res.LastInsertId()
+	transfer, err := s.loadTransfer(int(id))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+
+	var sender string
+	s.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&sender)
+	s.recordHistory(projectID, "transfer", transferPending, fmt.Sprintf("%s offered the project to %s", sender, transferRecipient(transfer)))
+	s.mailTransfer(transfer, sender)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(transfer)
+}
+
+// mailTransfer tells whoever can accept the transfer about it.
+func (s *Server) mailTransfer(t ProjectTransfer, sender string) {
+	recipients := []string{t.ToEmail}
+	if t.ToOrgID != 0 {
+		recipients = nil
+		rows, err := s.db.Query("SELECT u.email FROM org_members m JOIN users u ON u.id = m.user_id WHERE m.org_id = ? AND m.role = ?", t.ToOrgID, orgRoleOwner)
+		if err != nil {
+			log.Printf("transfer %d: cannot list org owners: %v", t.ID, err)
+			return
+		}
+		for rows.Next() {
+			var email string
+			if rows.Scan(&email) == nil {
+				recipients = append(recipients, email)
+			}
+		}
+		rows.Close()
+	}
+	body := fmt.Sprintf("%s wants to transfer the project %s to %s on Grape.ai. Accept or decline it in the dashboard:\n\n%s/transfers\n\nThe offer expires in %s.",
+		sender, t.ProjectName, transferRecipient(t), appURL, transferTTL)
+	for _, to := range recipients {
+		if err := s.mailer.Send(to, "Project transfer: "+t.ProjectName, body); err != nil {
+			log.Printf("transfer %d: cannot mail %s: %v", t.ID, to, err)
+		}
+	}
+}
+
+// handleListProjectTransfers returns every transfer of the project, newest
+// first. Admins only.
+func (s *Server) handleListProjectTransfers(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleAdmin)
+	if !ok {
+		return
+	}
+	transfers, err := s.queryTransfers("t.project_id = ?", projectID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transfers)
+}
+
+// handleListTransfers returns the pending transfers the user can accept and
+// the ones they offered.
+func (s *Server) handleListTransfers(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	now := time.Now().Unix()
+
+	incoming, err := s.queryTransfers(`t.status = ? AND t.expires_at >= ? AND (t.to_user = ? AND t.to_org = 0
+		OR t.to_org IN (SELECT org_id FROM org_members WHERE user_id = ? AND role = ?))`,
+		transferPending, now, userID, userID, orgRoleOwner)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	outgoing, err := s.queryTransfers("t.status = ? AND t.expires_at >= ? AND t.created_by = ?", transferPending, now, userID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]ProjectTransfer{"incoming": incoming, "outgoing": outgoing})
+}
+
+// transferFromRequest loads the transfer in the URL if it is pending and the
+// user may answer it. Anyone else gets a 404.
+func (s *Server) transferFromRequest(w http.ResponseWriter, r *http.Request, userID int) (ProjectTransfer, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Transfer not found")
+		return ProjectTransfer{}, false
+	}
+	t, err := s.loadTransfer(id)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Transfer not found")
+		return t, false
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return t, false
+	}
+	recipient, err := s.receivesTransfer(t, userID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return t, false
+	}
+	if !recipient {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Transfer not found")
+		return t, false
+	}
+	if t.Status != transferPending {
+		writeJSONError(w, http.StatusConflict, "transfer_"+t.Status, "This transfer is "+t.Status)
+		return t, false
+	}
+	return t, true
+}
+
+// handleAcceptTransfer makes the user, or the org they own, the project's
+// owner. The project has to fit in the new owner's quota.
+func (s *Server) handleAcceptTransfer(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	t, ok := s.transferFromRequest(w, r, userID)
+	if !ok {
+		return
+	}
+
+	quota, err := s.userQuota(userID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	quota.Projects++
+	quota.StorageBytes += s.projectStorage(t.ProjectID)
+	switch {
+	case quota.overProjects():
+		writeQuotaError(w, quota, fmt.Sprintf("Your %s plan allows %d projects", quota.Tier, quota.MaxProjects))
+		return
+	case quota.overStorage():
+		writeQuotaError(w, quota, fmt.Sprintf("Your %s plan allows %d MB of storage and the project would take you to %d MB",
+			quota.Tier, quota.MaxStorageBytes>>20, quota.StorageBytes>>20))
+		return
+	}
+
+	// Everyone who could see the project before may not see it after
+	audience := s.projectAudience(t.ProjectID)
+	if err := s.acceptTransfer(t, userID); err != nil {
+		if errors.Is(err, errTransferInvalid) {
+			writeJSONError(w, http.StatusConflict, "transfer_invalid", "The project changed hands since this transfer was offered")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	for _, id := range audience {
+		s.projectsCache.invalidate(id)
+	}
+	s.invalidateProjectLists(t.ProjectID, userID)
+
+	var email string
+	s.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email)
+	s.recordHistory(t.ProjectID, "transfer", transferAccepted, fmt.Sprintf("%s accepted the project for %s", email, transferRecipient(t)))
+	log.Printf("project %s transferred from user %d to user %d (org %d)", t.ProjectID, t.FromUserID, userID, t.ToOrgID)
+
+	project, err := s.loadProject(t.ProjectID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return
+	}
+	project.Role = roleAdmin.String()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
+
+// acceptTransfer hands the project to userID, as long as nobody has moved
+// it or answered the transfer in the meantime.
+func (s *Server) acceptTransfer(t ProjectTransfer, userID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	res, err := tx.Exec("UPDATE project_transfers SET status = ?, resolved_by = ?, resolved_at = ? WHERE id = ? AND status = ? AND expires_at >= ?",
+		transferAccepted, userID, now, t.ID, transferPending, now)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errTransferInvalid
+	}
+	res, err = tx.Exec(`
+		UPDATE projects SET user_id = ?, org_id = ?, webhook_url = '',
+			git_repo = '', git_branch = '', git_token = '', git_webhook_secret = '', git_branch_deploys = 0
+		WHERE id = ? AND user_id = ? AND COALESCE(org_id, 0) = ?
+	`, userID, sql.NullInt64{Int64: int64(t.ToOrgID), Valid: t.ToOrgID != 0}, t.ProjectID, t.FromUserID, t.FromOrgID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errTransferInvalid
+	}
+	if _, err := tx.Exec("DELETE FROM project_members WHERE project_id = ?", t.ProjectID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// handleDeclineTransfer turns the transfer down; the project stays put.
+func (s *Server) handleDeclineTransfer(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	t, ok := s.transferFromRequest(w, r, userID)
+	if !ok {
+		return
+	}
+	if !s.resolveTransfer(w, t.ID, transferDeclined, userID) {
+		return
+	}
+	var email string
+	s.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email)
+	s.recordHistory(t.ProjectID, "transfer", transferDeclined, fmt.Sprintf("%s declined the project for %s", email, transferRecipient(t)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCancelTransfer withdraws a pending transfer. Whoever could offer
+// the project can withdraw the offer.
+func (s *Server) handleCancelTransfer(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Transfer not found")
+		return
+	}
+	t, err := s.loadTransfer(id)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Transfer not found")
+		return
+	}
+	if owner, err := s.ownsProject(t.ProjectID, userID); err != nil || !owner {
+		writeJSONError(w, http.StatusNotFound, "not_found", "Transfer not found")
+		return
+	}
+	if t.Status != transferPending {
+		writeJSONError(w, http.StatusConflict, "transfer_"+t.Status, "This transfer is "+t.Status)
+		return
+	}
+	if !s.resolveTransfer(w, t.ID, transferCancelled, userID) {
+		return
+	}
+	var email string
+	s.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email)
+	s.recordHistory(t.ProjectID, "transfer", transferCancelled, fmt.Sprintf("%s withdrew the offer to %s", email, transferRecipient(t)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resolveTransfer closes a pending transfer with status, answering with an
+// error if that fails.
+func (s *Server) resolveTransfer(w http.ResponseWriter, id int, status string, userID int) bool {
+	res, err := s.db.Exec("UPDATE project_transfers SET status = ?, resolved_by = ?, resolved_at = ? WHERE id = ? AND status = ?",
+		status, userID, time.Now().Unix(), id, transferPending)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal_error", "Database error")
+		return false
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeJSONError(w, http.StatusConflict, "transfer_invalid", "This transfer is no longer pending")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestTransferProjectToUser(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	alice := ts.signUp(t, "alice@example.com", "correct horse battery 0")
+	bob := ts.signUp(t, "bob@example.com", "correct horse battery 0")
+	carol := ts.signUp(t, "carol@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, alice, "site", siteZip(t))
+	ts.waitForStatus(t, alice, project.ID)
+	path := "/api/projects/" + project.ID
+
+	if resp := ts.do(t, "PUT", path+"/members", alice, jsonBody(map[string]string{"email": "carol@example.com", "role": "deployer"}), "application/json", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("grant: status %d", resp.StatusCode)
+	}
+	if resp := ts.postJSON(t, path+"/transfer", carol, map[string]string{"email": "bob@example.com"}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("deployer offering the project: status %d, want 403", resp.StatusCode)
+	}
+	if resp := ts.postJSON(t, path+"/transfer", alice, map[string]string{"email": "alice@example.com"}, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("offering to the owner: status %d, want 409", resp.StatusCode)
+	}
+
+	var transfer ProjectTransfer
+	if resp := ts.postJSON(t, path+"/transfer", alice, map[string]string{"email": "bob@example.com"}, &transfer); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("offer: status %d", resp.StatusCode)
+	}
+	if transfer.Status != transferPending || transfer.ToEmail != "bob@example.com" || transfer.FromEmail != "alice@example.com" {
+		t.Errorf("transfer %+v", transfer)
+	}
+
+	var listed map[string][]ProjectTransfer
+	ts.do(t, "GET", "/api/transfers", bob, nil, "", &listed)
+	if len(listed["incoming"]) != 1 || listed["incoming"][0].ID != transfer.ID || len(listed["outgoing"]) != 0 {
+		t.Errorf("bob's transfers %+v", listed)
+	}
+	accept := fmt.Sprintf("/api/transfers/%d/accept", transfer.ID)
+	if resp := ts.postJSON(t, accept, carol, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("someone else accepting: status %d, want 404", resp.StatusCode)
+	}
+
+	var accepted Project
+	if resp := ts.postJSON(t, accept, bob, nil, &accepted); resp.StatusCode != http.StatusOK {
+		t.Fatalf("accept: status %d", resp.StatusCode)
+	}
+	if accepted.ID != project.ID || accepted.UserID == project.UserID || accepted.Status != "live" {
+		t.Errorf("accepted %+v", accepted)
+	}
+	if resp := ts.postJSON(t, accept, bob, nil, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("accepting twice: status %d, want 409", resp.StatusCode)
+	}
+
+	var projects []Project
+	ts.do(t, "GET", "/api/projects", alice, nil, "", &projects)
+	if len(projects) != 0 {
+		t.Errorf("alice still lists %+v", projects)
+	}
+	if resp := ts.do(t, "GET", path, carol, nil, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("old grant after the transfer: status %d, want 404", resp.StatusCode)
+	}
+	if body := ts.livePage(t, project.ID); body != "<h1>hello</h1>" {
+		t.Error("site went offline with the transfer")
+	}
+
+	var trail []ProjectTransfer
+	ts.do(t, "GET", path+"/transfers", bob, nil, "", &trail)
+	if len(trail) != 1 || trail[0].Status != transferAccepted || trail[0].ResolvedBy != accepted.UserID {
+		t.Errorf("trail %+v", trail)
+	}
+}
+
+func TestTransferProjectToOrg(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	alice := ts.signUp(t, "alice@example.com", "correct horse battery 0")
+	bob := ts.signUp(t, "bob@example.com", "correct horse battery 0")
+	carol := ts.signUp(t, "carol@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, alice, "site", siteZip(t))
+	ts.waitForStatus(t, alice, project.ID)
+	path := "/api/projects/" + project.ID
+
+	var org Org
+	ts.postJSON(t, "/api/orgs", bob, map[string]string{"name": "Acme"}, &org)
+	ts.postJSON(t, fmt.Sprintf("/api/orgs/%d/members", org.ID), bob, map[string]string{"email": "carol@example.com"}, nil)
+
+	var first ProjectTransfer
+	if resp := ts.postJSON(t, path+"/transfer", alice, map[string]int{"org_id": org.ID}, &first); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("offer: status %d", resp.StatusCode)
+	}
+	if resp := ts.postJSON(t, fmt.Sprintf("/api/transfers/%d/decline", first.ID), bob, nil, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("decline: status %d", resp.StatusCode)
+	}
+
+	var second ProjectTransfer
+	ts.postJSON(t, path+"/transfer", alice, map[string]int{"org_id": org.ID}, &second)
+	if resp := ts.postJSON(t, fmt.Sprintf("/api/transfers/%d/accept", second.ID), carol, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("org member accepting: status %d, want 404", resp.StatusCode)
+	}
+	var accepted Project
+	if resp := ts.postJSON(t, fmt.Sprintf("/api/transfers/%d/accept", second.ID), bob, nil, &accepted); resp.StatusCode != http.StatusOK {
+		t.Fatalf("accept: status %d", resp.StatusCode)
+	}
+	if accepted.OrgID != org.ID {
+		t.Errorf("accepted %+v", accepted)
+	}
+	var projects []Project
+	ts.do(t, "GET", "/api/projects", carol, nil, "", &projects)
+	if len(projects) != 1 || projects[0].ID != project.ID {
+		t.Errorf("org member's projects %+v", projects)
+	}
+
+	var trail []ProjectTransfer
+	ts.do(t, "GET", path+"/transfers", bob, nil, "", &trail)
+	if len(trail) != 2 || trail[0].Status != transferAccepted || trail[1].Status != transferDeclined {
+		t.Errorf("trail %+v", trail)
+	}
+}
+
+func TestCancelTransfer(t *testing.T) {
+	ts := newTestServer(t, stubRunner{})
+	alice := ts.signUp(t, "alice@example.com", "correct horse battery 0")
+	bob := ts.signUp(t, "bob@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, alice, "site", siteZip(t))
+	ts.waitForStatus(t, alice, project.ID)
+
+	var transfer ProjectTransfer
+	ts.postJSON(t, "/api/projects/"+project.ID+"/transfer", alice, map[string]string{"email": "bob@example.com"}, &transfer)
+	path := fmt.Sprintf("/api/transfers/%d", transfer.ID)
+	if resp := ts.do(t, "DELETE", path, bob, nil, "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("recipient cancelling: status %d, want 404", resp.StatusCode)
+	}
+	if resp := ts.do(t, "DELETE", path, alice, nil, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("cancel: status %d", resp.StatusCode)
+	}
+	if resp := ts.postJSON(t, path+"/accept", bob, nil, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("accepting a cancelled transfer: status %d, want 409", resp.StatusCode)
+	}
+}
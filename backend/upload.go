@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var maxUploadSize = int64(envInt("GRAPE_MAX_UPLOAD_MB", 100)) << 20
+
+// Form fields are small; anything bigger is not a legitimate upload.
+const maxFormFieldSize = 64 << 10
+
+var (
+	errUploadTooLarge = errors.New("upload too large")
+	errMissingFile    = errors.New("missing project file")
+)
+
+// uploadForm is a multipart upload whose file part has been streamed to disk.
+type uploadForm struct {
+	fields   map[string]string
+	filename string
+	size     int64
+	files    int // parts of a directory upload
+}
+
+func (f *uploadForm) value(name string) string {
+	return f.fields[name]
+}
+
+// receiveUpload reads the multipart body part by part, copying the "project"
+// file straight to dest instead of buffering it in memory. A folder can be
+// sent instead as "files" parts named by their relative paths; those are
+// zipped into dest. Bodies larger than maxUploadSize fail with
+// errUploadTooLarge; dest is removed on any error.
+func receiveUpload(w http.ResponseWriter, r *http.Request, dest string) (*uploadForm, error) {
+	if r.ContentLength > maxUploadSize {
+		return nil, errUploadTooLarge
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	dir := dest + ".files"
+	defer os.RemoveAll(dir)
+	form, err := readUploadParts(r, dest, dir)
+	if err == nil && form.files > 0 {
+		err = zipDirectoryUpload(form, dir, dest)
+	}
+	if err != nil {
+		os.Remove(dest)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, errUploadTooLarge
+		}
+		return nil, err
+	}
+	return form, nil
+}
+
+func readUploadParts(r *http.Request, dest, dir string) (*uploadForm, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	form := &uploadForm{fields: map[string]string{}}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if part.FormName() == "files" && part.FileName() != "" {
+			if form.filename != "" {
+				return nil, errors.New("send either a project archive or files, not both")
+			}
+			if form.files++; form.files > maxArchiveFiles {
+				return nil, fmt.Errorf("upload contains more than the allowed %d files", maxArchiveFiles)
+			}
+			if err := saveDirectoryPart(part, dir); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if part.FormName() == "project" && part.FileName() != "" {
+			if form.filename != "" || form.files > 0 {
+				return nil, errors.New("only one project file may be uploaded")
+			}
+			form.filename = part.FileName()
+			out, err := os.Create(dest)
+			if err != nil {
+				return nil, err
+			}
+			form.size, err = io.Copy(out, part)
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(value) > maxFormFieldSize {
+			return nil, errors.New("form field " + part.FormName() + " is too large")
+		}
+		form.fields[part.FormName()] = string(value)
+	}
+
+	if form.filename == "" && form.files == 0 {
+		return nil, errMissingFile
+	}
+	return form, nil
+}
+
+// saveDirectoryPart writes one file of a directory upload under dir. Its
+// path comes from the part's filename, which Part.FileName would cut down to
+// the base name.
+func saveDirectoryPart(part *multipart.Part, dir string) error {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return err
+	}
+	name := strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(params["filename"], "\\", "/")), "/")
+	if name == "" {
+		return errors.New("file without a name")
+	}
+	if err := checkEntryDepth(name); err != nil {
+		return err
+	}
+
+	dest := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s was sent twice", name)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, part)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// zipDirectoryUpload packs the files of a directory upload into dest. A
+// dropped folder arrives with its own name in front of every path; that
+// folder becomes the project root and names the upload.
+func zipDirectoryUpload(form *uploadForm, dir, dest string) error {
+	root, name := dir, "files"
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) == 1 && entries[0].IsDir() {
+		root, name = filepath.Join(dir, entries[0].Name()), entries[0].Name()
+	}
+	size, err := zipDir(root, dest)
+	if err != nil {
+		return err
+	}
+	form.filename, form.size = name+".zip", size
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// directoryUpload builds a multipart body sending files the way a browser
+// sends a dropped folder: one "files" part per file, named by its path.
+func directoryUpload(t *testing.T, files [][2]string) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, f := range files {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="files"; filename=%q`, f[0]))
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(f[1]))
+	}
+	mw.Close()
+	return &body, mw.FormDataContentType()
+}
+
+func TestDirectoryUpload(t *testing.T) {
+	ts := newTestServer(t, sourceRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+
+	body, contentType := directoryUpload(t, [][2]string{
+		{"my-site/index.html", "<h1>folder</h1>"},
+		{"my-site/css/app.css", "body {}"},
+		{"my-site/css/../../../my-site/notes.txt", "cleaned"},
+	})
+	var project Project
+	if resp := ts.do(t, "POST", "/api/upload", token, body, contentType, &project); resp.StatusCode != http.StatusOK {
+		t.Fatalf("directory upload: status %d", resp.StatusCode)
+	}
+	if p := ts.waitForStatus(t, token, project.ID); p.Status != "live" {
+		t.Fatalf("build %s: %s", p.Status, p.BuildLog)
+	}
+	if got := ts.livePage(t, project.ID); got != "<h1>folder</h1>" {
+		t.Errorf("live page %q", got)
+	}
+	projectPath := filepath.Join(ts.cfg.ProjectsDir, project.ID)
+	if _, err := os.Stat(filepath.Join(projectPath, "css", "app.css")); err != nil {
+		t.Errorf("nested file lost: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(projectPath, "notes.txt")); err != nil {
+		t.Errorf("path with .. not cleaned: %v", err)
+	}
+
+	var deployments []Deployment
+	ts.do(t, "GET", "/api/projects/"+project.ID+"/deployments", token, nil, "", &deployments)
+	if len(deployments) != 1 || deployments[0].SourceName != "my-site.zip" {
+		t.Errorf("deployments %+v", deployments)
+	}
+
+	body, contentType = directoryUpload(t, [][2]string{{"index.html", "a"}, {"./index.html", "b"}})
+	if resp := ts.do(t, "POST", "/api/upload", token, body, contentType, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("duplicate file: status %d, want 400", resp.StatusCode)
+	}
+}
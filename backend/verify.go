@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	publicURL      = envString("GRAPE_PUBLIC_URL", "http://localhost:8080")
+	verifyTokenTTL = envDuration("GRAPE_VERIFY_TOKEN_TTL", 24*time.Hour)
+)
+
+// verificationLink stores a fresh single-use token for userID and returns
+// the link that redeems it. A non-empty newEmail makes the link switch the
+// account to that address.
+func (s *Server) verificationLink(userID int, newEmail string) (string, error) {
+	token := randomToken()
+	_, err := s.db.Exec(
+		"INSERT INTO email_verifications (token_hash, user_id, expires_at, email) VALUES (?, ?, ?, ?)",
+		hashToken(token), userID, time.Now().Add(verifyTokenTTL).Unix(), newEmail,
+	)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/api/verify?token=%s", publicURL, token), nil
+}
+
+// sendVerification mails a confirmation link for a new account to email.
+func (s *Server) sendVerification(userID int, email string) error {
+	link, err := s.verificationLink(userID, "")
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(email, "Verify your Grape.ai account",
+		fmt.Sprintf("Confirm your email address by opening this link:\n\n%s\n\nThe link expires in %s.", link, verifyTokenTTL))
+}
+
+func (s *Server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Missing token", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		userID    int
+		expiresAt int64
+		newEmail  string
+	)
+	err := s.db.QueryRow("SELECT user_id, expires_at, email FROM email_verifications WHERE token_hash = ?", hashToken(token)).
+		Scan(&userID, &expiresAt, &newEmail)
+	if err != nil || time.Now().Unix() > expiresAt {
+		http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if newEmail != "" {
+		_, err = tx.Exec("UPDATE users SET email = ?, verified = 1 WHERE id = ?", newEmail, userID)
+	} else {
+		_, err = tx.Exec("UPDATE users SET verified = 1 WHERE id = ?", userID)
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			http.Error(w, "Email already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM email_verifications WHERE user_id = ?", userID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]interface{}{"verified": true}
+	if newEmail != "" {
+		resp["email"] = newEmail
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) isVerified(userID int) bool {
+	var verified bool
+	s.db.QueryRow("SELECT verified FROM users WHERE id = ?", userID).Scan(&verified)
+	return verified
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	webhookTimeout = envDuration("GRAPE_WEBHOOK_TIMEOUT", 5*time.Second)
+	webhookRetries = envInt("GRAPE_WEBHOOK_RETRIES", 2)
+	webhookBackoff = envDuration("GRAPE_WEBHOOK_BACKOFF", 2*time.Second)
+)
+
+// webhookSchemes are the URL schemes webhooks may use, also after redirects.
+var webhookSchemes = map[string]bool{"http": true, "https": true}
+
+// Only the tail of the build log is sent; it holds the interesting part.
+const webhookLogLimit = 4096
+
+type webhookPayload struct {
+	Event     string  `json:"event"`
+	ProjectID string  `json:"project_id"`
+	Status    string  `json:"status"`
+	Duration  float64 `json:"duration_seconds"`
+	Log       string  `json:"log"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// signWebhook returns the X-Grape-Signature value for body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookSecret returns the user's signing secret, creating one on first use.
+func (s *Server) webhookSecret(userID int) (string, error) {
+	var secret string
+	if err := s.db.QueryRow("SELECT webhook_secret FROM users WHERE id = ?", userID).Scan(&secret); err != nil {
+		return "", err
+	}
+	if secret != "" {
+		return secret, nil
+	}
+	return s.rotateWebhookSecret(userID)
+}
+
+func (s *Server) rotateWebhookSecret(userID int) (string, error) {
+	secret := randomToken()
+	_, err := s.db.Exec("UPDATE users SET webhook_secret = ? WHERE id = ?", secret, userID)
+	return secret, err
+}
+
+// notifyBuildFinished posts the build result to the project's webhook, if it
+// has one. Delivery happens in the background so a slow receiver never holds
+// up the build slot.
+func (s *Server) notifyBuildFinished(projectID string, userID int, status string, duration time.Duration, buildLog string) {
+	var hookURL string
+	s.db.QueryRow("SELECT webhook_url FROM projects WHERE id = ?", projectID).Scan(&hookURL)
+	if hookURL == "" {
+		return
+	}
+	secret, err := s.webhookSecret(userID)
+	if err != nil {
+		log.Printf("project %s: cannot load webhook secret: %v", projectID, err)
+		return
+	}
+
+	if len(buildLog) > webhookLogLimit {
+		buildLog = buildLog[len(buildLog)-webhookLogLimit:]
+	}
+	body, _ := json.Marshal(webhookPayload{
+		Event:     "build.finished",
+		ProjectID: projectID,
+		Status:    status,
+		Duration:  duration.Seconds(),
+		Log:       buildLog,
+		Timestamp: time.Now().Unix(),
+	})
+
+	go func() {
+		if err := deliverWebhook(hookURL, secret, body); err != nil {
+			log.Printf("project %s: webhook delivery failed: %v", projectID, err)
+		}
+	}()
+}
+
+// deliverWebhook POSTs body, retrying non-2xx answers and network errors with
+// exponential backoff.
+func deliverWebhook(hookURL, secret string, body []byte) error {
+	client := publicClient(webhookSchemes, webhookTimeout)
+	delivery := generateID()
+	backoff := webhookBackoff
+
+	var lastErr error
+	for attempt := 0; attempt <= webhookRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		req, err := http.NewRequest("POST", hookURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "Grape.ai-Webhook")
+		req.Header.Set("X-Grape-Event", "build.finished")
+		req.Header.Set("X-Grape-Delivery", delivery)
+		req.Header.Set("X-Grape-Signature", signWebhook(secret, body))
+
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return fmt.Errorf("%d attempts: %v", webhookRetries+1, lastErr)
+}
+
+// validateWebhookURL rejects URLs that can't be delivered to. Hosts that
+// resolve to internal addresses are refused by the delivery client itself;
+// internal IPs given literally are refused here already.
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || !webhookSchemes[u.Scheme] {
+		return fmt.Errorf("must be an absolute http or https URL")
+	}
+	if ip := net.ParseIP(u.Hostname()); (ip != nil && !publicHostAllowed(ip)) || strings.EqualFold(u.Hostname(), "localhost") {
+		return fmt.Errorf("must point to a public host")
+	}
+	return nil
+}
+
+// handleSetWebhook sets or, with an empty url, removes the project's webhook.
+func (s *Server) handleSetWebhook(w http.ResponseWriter, r *http.Request) {
+	projectID, _, ok := s.authorizeProject(w, r, roleAdmin)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.URL != "" {
+		if err := validateWebhookURL(req.URL); err != nil {
+			http.Error(w, "Invalid url: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, err := s.db.Exec("UPDATE projects SET webhook_url = ? WHERE id = ?", req.URL, projectID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": req.URL})
+}
+
+// handleWebhookSecret returns the secret used to sign the user's webhooks;
+// POST replaces it with a new one.
+func (s *Server) handleWebhookSecret(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int)
+
+	var (
+		secret string
+		err    error
+	)
+	if r.Method == "POST" {
+		secret, err = s.rotateWebhookSecret(userID)
+	} else {
+		secret, err = s.webhookSecret(userID)
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"secret": secret})
+}
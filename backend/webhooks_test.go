@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	savedBackoff := webhookBackoff
+	webhookBackoff = time.Millisecond
+	savedAllowed := publicHostAllowed
+	publicHostAllowed = func(net.IP) bool { return true }
+	t.Cleanup(func() {
+		webhookBackoff = savedBackoff
+		publicHostAllowed = savedAllowed
+	})
+
+	var attempts atomic.Int32
+	deliveries := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		// The first attempt of every delivery fails and is retried
+		if attempts.Add(1)%2 == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		deliveries <- r
+		bodies <- body
+	}))
+	defer receiver.Close()
+
+	ts := newTestServer(t, stubRunner{})
+	token := ts.signUp(t, "ada@example.com", "correct horse battery 0")
+	project, _ := ts.upload(t, token, "site", siteZip(t))
+	ts.waitForStatus(t, token, project.ID)
+	if resp := ts.do(t, "PUT", "/api/projects/"+project.ID+"/webhook", token, jsonBody(map[string]string{"url": receiver.URL + "/hook"}), "application/json", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("set webhook: status %d", resp.StatusCode)
+	}
+	var secret struct{ Secret string }
+	ts.do(t, "GET", "/api/me/webhook-secret", token, nil, "", &secret)
+
+	ts.do(t, "POST", "/api/projects/"+project.ID+"/rebuild", token, nil, "", nil)
+	var r *http.Request
+	var body []byte
+	select {
+	case r = <-deliveries:
+		body = <-bodies
+	case <-time.After(10 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+	if got := attempts.Load(); got != 2 {
+		t.Errorf("%d attempts, want 2", got)
+	}
+	if got, want := r.Header.Get("X-Grape-Signature"), signWebhook(secret.Secret, body); got != want || r.Header.Get("X-Grape-Event") != "build.finished" {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil || payload.ProjectID != project.ID || payload.Status != "live" {
+		t.Errorf("payload %s: %v", body, err)
+	}
+
+	// Internal addresses are refused on delivery, whatever the URL said
+	publicHostAllowed = savedAllowed
+	if err := deliverWebhook(receiver.URL, secret.Secret, body); err == nil {
+		t.Error("delivered to a loopback address")
+	}
+	for _, u := range []string{"http://127.0.0.1:8080/hook", "http://169.254.169.254/latest", "http://localhost/hook", "ftp://example.com/hook"} {
+		if resp := ts.do(t, "PUT", "/api/projects/"+project.ID+"/webhook", token, jsonBody(map[string]string{"url": u}), "application/json", nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("webhook %s: status %d, want 400", u, resp.StatusCode)
+		}
+	}
+}
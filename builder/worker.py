@@ -18,11 +18,29 @@ import logging
 logging.basicConfig(level=logging.INFO, format='[%(levelname)s] %(message)s')
 logger = logging.getLogger(__name__)
 
+# The API enforces the overall build deadline; individual commands get the same budget
+BUILD_TIMEOUT = int(os.environ.get('GRAPE_BUILD_TIMEOUT', '600'))
+
+# Overrides from the project's grape.yaml, validated by the API
+BUILD_COMMAND = os.environ.get('GRAPE_BUILD_COMMAND', '')
+OUTPUT_DIR = os.environ.get('GRAPE_OUTPUT_DIR', '')
+NODE_VERSION = os.environ.get('GRAPE_NODE_VERSION', '')
+# One directory per Node.js major version, e.g. /opt/node/20/bin/node
+NODE_VERSIONS_DIR = os.environ.get('GRAPE_NODE_VERSIONS_DIR', '/opt/node')
+
+# Exit code telling the API a failure is transient and worth retrying (EX_TEMPFAIL)
+TRANSIENT_EXIT_CODE = 75
+TRANSIENT_MARKERS = ['ETIMEDOUT', 'ECONNRESET', 'ECONNREFUSED', 'ENOTFOUND', 'EAI_AGAIN', 'socket hang up']
+
+def stage(name):
+    """Report build progress to the API (parsed from stdout, not logged)"""
+    print(f"::stage:{name}", flush=True)
+
 def run_command(cmd, cwd):
     """Run shell command and return success status"""
     try:
         logger.info(f"Running: {' '.join(cmd)} in {cwd}")
-        result = subprocess.run(cmd, cwd=cwd, capture_output=True, text=True, timeout=600)
+        result = subprocess.run(cmd, cwd=cwd, capture_output=True, text=True, timeout=BUILD_TIMEOUT)
         
         if result.stdout:
             logger.info(f"STDOUT: {result.stdout}")
@@ -32,7 +50,7 @@ def run_command(cmd, cwd):
         return result.returncode == 0, result.stdout, result.stderr
     except subprocess.TimeoutExpired:
         logger.error("Command timed out")
-        return False, "", "Build timed out after 10 minutes"
+        return False, "", f"Build timed out after {BUILD_TIMEOUT} seconds"
     except Exception as e:
         logger.error(f"Command failed: {e}")
         return False, "", str(e)
@@ -67,6 +85,15 @@ def detect_project_type(project_path):
         
     return 'unknown'
 
+def select_node_version(version):
+    """Put the requested Node.js major version first on PATH"""
+    bin_dir = os.path.join(NODE_VERSIONS_DIR, version, 'bin')
+    if not os.path.isdir(bin_dir):
+        return False
+    os.environ['PATH'] = bin_dir + os.pathsep + os.environ.get('PATH', '')
+    logger.info(f"Using Node.js {version} from {bin_dir}")
+    return True
+
 def build_node_project(project_path):
     """Build a Node.js project"""
     logger.info("Building Node.js project...")
@@ -78,11 +105,18 @@ def build_node_project(project_path):
         return False, "npm not available"
     
     # Install dependencies
+    stage("install")
     success, stdout, stderr = run_command(['npm', 'install'], project_path)
     if not success:
         return False, f"npm install failed: {stderr}"
     
     # Build project
+    stage("build")
+    if BUILD_COMMAND:
+        success, stdout, stderr = run_command(['sh', '-c', BUILD_COMMAND], project_path)
+        if not success:
+            return False, f"{BUILD_COMMAND} failed: {stderr}"
+        return True, "Build completed successfully"
     success, stdout, stderr = run_command(['npm', 'run', 'build'], project_path)
     if not success:
         logger.warning("npm run build failed, trying npm run dev")
@@ -93,6 +127,13 @@ def build_node_project(project_path):
 
 def find_build_output(project_path):
     """Find the build output directory"""
+    if OUTPUT_DIR:
+        full_path = os.path.join(project_path, OUTPUT_DIR)
+        if os.path.isdir(full_path) and os.listdir(full_path):
+            return full_path
+        logger.error(f"Configured output directory {OUTPUT_DIR} is missing or empty")
+        return None
+
     candidates = [
         'dist',
         'build', 
@@ -183,21 +224,33 @@ def main():
         sys.exit(1)
     
     # Detect project type
+    stage("detect")
     project_type = detect_project_type(project_path)
     logger.info(f"Detected project type: {project_type}")
     
     build_success = True
     build_message = ""
+
+    if NODE_VERSION and not select_node_version(NODE_VERSION):
+        logger.error(f"Node.js {NODE_VERSION} is not installed on this builder")
+        sys.exit(1)
     
-    # Build based on project type
-    if project_type in ['nextjs', 'vite', 'cra', 'node']:
+    # Build based on project type; a configured command always runs
+    if project_type in ['nextjs', 'vite', 'cra', 'node'] or BUILD_COMMAND:
         build_success, build_message = build_node_project(project_path)
+
+    if not build_success and any(marker in build_message for marker in TRANSIENT_MARKERS):
+        logger.error(f"Transient build failure: {build_message}")
+        sys.exit(TRANSIENT_EXIT_CODE)
     
     # Find build output
+    stage("deploy")
     build_output = find_build_output(project_path)
     
     if build_output:
         copy_to_deploy(build_output, deploy_path)
+    elif OUTPUT_DIR:
+        sys.exit(1)
     elif os.path.exists(os.path.join(project_path, "index.html")):
         # Static site - copy entire project
         copy_to_deploy(project_path, deploy_path)
@@ -30,6 +30,42 @@ axios.interceptors.request.use((config) => {
   return config;
 });
 
+// Access tokens are short-lived; swap the refresh token for a new pair once
+// and retry when one expires. Concurrent requests share a single refresh.
+let refreshing: Promise<string> | null = null;
+
+const refreshAccessToken = async () => {
+  const refreshToken = localStorage.getItem('refreshToken');
+  if (!refreshToken) {
+    throw new Error('No refresh token');
+  }
+  const response = await axios.post('/auth/refresh', { refresh_token: refreshToken });
+  localStorage.setItem('token', response.data.token);
+  localStorage.setItem('refreshToken', response.data.refresh_token);
+  return response.data.token as string;
+};
+
+axios.interceptors.response.use(undefined, async (error) => {
+  const config = error.config;
+  if (error.response?.status !== 401 || error.response.data?.error !== 'token_expired' || config._retried) {
+    return Promise.reject(error);
+  }
+  config._retried = true;
+  try {
+    refreshing = refreshing ?? refreshAccessToken();
+    const token = await refreshing;
+    config.headers.Authorization = `Bearer ${token}`;
+    return axios(config);
+  } catch {
+    localStorage.removeItem('token');
+    localStorage.removeItem('refreshToken');
+    localStorage.removeItem('user');
+    return Promise.reject(error);
+  } finally {
+    refreshing = null;
+  }
+});
+
 export function AuthProvider({ children }: { children: ReactNode }) {
   const [user, setUser] = useState<User | null>(null);
   const [loading, setLoading] = useState(true);
@@ -43,6 +79,7 @@ export function AuthProvider({ children }: { children: ReactNode }) {
         setUser(JSON.parse(userData));
       } catch (error) {
         localStorage.removeItem('token');
+        localStorage.removeItem('refreshToken');
         localStorage.removeItem('user');
       }
     }
@@ -52,9 +89,10 @@ export function AuthProvider({ children }: { children: ReactNode }) {
   const login = async (email: string, password: string) => {
     try {
       const response = await axios.post('/login', { email, password });
-      const { token, user } = response.data;
+      const { token, refresh_token, user } = response.data;
       
       localStorage.setItem('token', token);
+      localStorage.setItem('refreshToken', refresh_token);
       localStorage.setItem('user', JSON.stringify(user));
       setUser(user);
     } catch (error: any) {
@@ -65,9 +103,10 @@ export function AuthProvider({ children }: { children: ReactNode }) {
   const register = async (email: string, password: string) => {
     try {
       const response = await axios.post('/register', { email, password });
-      const { token, user } = response.data;
+      const { token, refresh_token, user } = response.data;
       
       localStorage.setItem('token', token);
+      localStorage.setItem('refreshToken', refresh_token);
       localStorage.setItem('user', JSON.stringify(user));
       setUser(user);
     } catch (error: any) {
@@ -76,7 +115,12 @@ export function AuthProvider({ children }: { children: ReactNode }) {
   };
 
   const logout = () => {
+    const refreshToken = localStorage.getItem('refreshToken');
+    if (refreshToken) {
+      axios.post('/auth/logout', { refresh_token: refreshToken }).catch(() => {});
+    }
     localStorage.removeItem('token');
+    localStorage.removeItem('refreshToken');
     localStorage.removeItem('user');
     setUser(null);
   };
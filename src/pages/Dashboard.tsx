@@ -25,15 +25,33 @@ interface Project {
   subdomain: string;
   created_at: number;
   build_log?: string;
+  tags?: string[];
 }
 
+interface SubdomainCheck {
+  slug: string;
+  subdomain: string;
+  available: boolean;
+  reason?: string;
+}
+
+// Projects shown per page of the list
+const PAGE_SIZE = 20;
+
+// Archive formats the API accepts, longest extensions first
+const ARCHIVE_EXTENSIONS = ['.tar.gz', '.tar.zst', '.tgz', '.tzst', '.zip'];
+
 export default function Dashboard() {
   const { user, logout } = useAuth();
   const [projects, setProjects] = useState<Project[]>([]);
+  const [page, setPage] = useState(1);
+  const [total, setTotal] = useState(0);
   const [loading, setLoading] = useState(false);
   const [uploading, setUploading] = useState(false);
   const [selectedFile, setSelectedFile] = useState<File | null>(null);
   const [projectName, setProjectName] = useState('');
+  const [slug, setSlug] = useState('');
+  const [slugCheck, setSlugCheck] = useState<SubdomainCheck | null>(null);
   const [error, setError] = useState('');
   const [success, setSuccess] = useState('');
   const [selectedProject, setSelectedProject] = useState<Project | null>(null);
@@ -45,13 +63,29 @@ export default function Dashboard() {
     // Poll for project status updates every 5 seconds
     const interval = setInterval(loadProjects, 5000);
     return () => clearInterval(interval);
-  }, []);
+  }, [page]);
+
+  // Check the chosen subdomain once the user stops typing
+  useEffect(() => {
+    setSlugCheck(null);
+    if (!slug.trim()) return;
+    const timeout = setTimeout(async () => {
+      try {
+        const response = await axios.get('/subdomains/check', { params: { slug: slug.trim() } });
+        setSlugCheck(response.data);
+      } catch (error) {
+        console.error('Failed to check subdomain:', error);
+      }
+    }, 400);
+    return () => clearTimeout(timeout);
+  }, [slug]);
 
   const loadProjects = async () => {
     try {
       setLoading(true);
-      const response = await axios.get('/projects');
+      const response = await axios.get('/projects', { params: { page, limit: PAGE_SIZE } });
       setProjects(response.data || []);
+      setTotal(Number(response.headers['x-total-count'] || 0));
     } catch (error) {
       console.error('Failed to load projects:', error);
     } finally {
@@ -62,8 +96,9 @@ export default function Dashboard() {
   const handleFileSelect = (e: React.ChangeEvent<HTMLInputElement>) => {
     const file = e.target.files?.[0];
     if (file) {
-      if (!file.name.endsWith('.zip')) {
-        setError('Please select a .zip file');
+      const extension = ARCHIVE_EXTENSIONS.find((ext) => file.name.toLowerCase().endsWith(ext));
+      if (!extension) {
+        setError('Please select a .zip, .tar.gz or .tar.zst file');
         return;
       }
       if (file.size > 100 * 1024 * 1024) { // 100MB limit
@@ -73,7 +108,7 @@ export default function Dashboard() {
       setSelectedFile(file);
       setError('');
       if (!projectName) {
-        setProjectName(file.name.replace('.zip', ''));
+        setProjectName(file.name.slice(0, -extension.length));
       }
     }
   };
@@ -92,6 +127,9 @@ export default function Dashboard() {
       const formData = new FormData();
       formData.append('project', selectedFile);
       formData.append('name', projectName.trim());
+      if (slug.trim()) {
+        formData.append('subdomain', slug.trim());
+      }
 
       const response = await axios.post('/upload', formData, {
         headers: {
@@ -102,6 +140,7 @@ export default function Dashboard() {
       setSuccess('Project uploaded successfully! Building...');
       setSelectedFile(null);
       setProjectName('');
+      setSlug('');
       if (fileInputRef.current) {
         fileInputRef.current.value = '';
       }
@@ -231,12 +270,33 @@ export default function Dashboard() {
 
             <div>
               <label className="block text-sm font-medium text-gray-700 mb-2">
-                Project File (.zip)
+                Subdomain (optional)
+              </label>
+              <div className="flex items-center">
+                <input
+                  type="text"
+                  value={slug}
+                  onChange={(e) => setSlug(e.target.value.toLowerCase())}
+                  className="w-full px-4 py-3 border border-gray-300 rounded-l-lg focus:ring-2 focus:ring-purple-500 focus:border-transparent transition-all duration-200"
+                  placeholder="myapp"
+                />
+                <span className="px-4 py-3 bg-gray-50 border border-l-0 border-gray-300 rounded-r-lg text-gray-500">.grape.ai</span>
+              </div>
+              {slugCheck && (
+                <p className={`mt-2 text-sm ${slugCheck.available ? 'text-green-600' : 'text-red-600'}`}>
+                  {slugCheck.available ? `${slugCheck.subdomain} is available` : slugCheck.reason}
+                </p>
+              )}
+            </div>
+
+            <div>
+              <label className="block text-sm font-medium text-gray-700 mb-2">
+                Project File (.zip, .tar.gz, .tar.zst)
               </label>
               <input
                 ref={fileInputRef}
                 type="file"
-                accept=".zip"
+                accept={ARCHIVE_EXTENSIONS.join(',')}
                 onChange={handleFileSelect}
                 className="w-full px-4 py-3 border border-gray-300 rounded-lg focus:ring-2 focus:ring-purple-500 focus:border-transparent transition-all duration-200 file:mr-4 file:py-2 file:px-4 file:rounded-lg file:border-0 file:text-sm file:font-semibold file:bg-purple-50 file:text-purple-700 hover:file:bg-purple-100"
               />
@@ -275,7 +335,7 @@ export default function Dashboard() {
             </div>
             <button
               onClick={handleUpload}
-              disabled={!selectedFile || !projectName.trim() || uploading}
+              disabled={!selectedFile || !projectName.trim() || uploading || (slugCheck !== null && !slugCheck.available)}
               className="bg-gradient-to-r from-purple-600 to-blue-600 text-white px-6 py-3 rounded-lg font-semibold hover:shadow-lg transform hover:scale-105 transition-all duration-200 disabled:opacity-50 disabled:cursor-not-allowed disabled:transform-none flex items-center space-x-2"
             >
               {uploading ? (
@@ -329,6 +389,15 @@ export default function Dashboard() {
                       {getStatusIcon(project.status)}
                       <div>
                         <h3 className="font-semibold text-gray-900">{project.name}</h3>
+                        {project.tags && project.tags.length > 0 && (
+                          <div className="flex flex-wrap gap-1 mt-1">
+                            {project.tags.map((tag) => (
+                              <span key={tag} className="px-2 py-0.5 rounded-full text-xs bg-purple-50 text-purple-700">
+                                {tag}
+                              </span>
+                            ))}
+                          </div>
+                        )}
                         <p className="text-sm text-gray-500">
                           Created {formatDate(project.created_at)}
                         </p>
@@ -374,6 +443,30 @@ export default function Dashboard() {
               ))}
             </div>
           )}
+
+          {total > PAGE_SIZE && (
+            <div className="mt-6 flex items-center justify-between text-sm text-gray-600">
+              <span>
+                {(page - 1) * PAGE_SIZE + 1}-{Math.min(page * PAGE_SIZE, total)} of {total}
+              </span>
+              <div className="flex space-x-2">
+                <button
+                  onClick={() => setPage(page - 1)}
+                  disabled={page === 1}
+                  className="px-3 py-1 border border-gray-300 rounded-lg hover:bg-gray-50 disabled:opacity-50 disabled:cursor-not-allowed"
+                >
+                  Previous
+                </button>
+                <button
+                  onClick={() => setPage(page + 1)}
+                  disabled={page * PAGE_SIZE >= total}
+                  className="px-3 py-1 border border-gray-300 rounded-lg hover:bg-gray-50 disabled:opacity-50 disabled:cursor-not-allowed"
+                >
+                  Next
+                </button>
+              </div>
+            </div>
+          )}
         </div>
 
         {/* Stats Cards */}
@@ -384,7 +477,7 @@ export default function Dashboard() {
                 <Globe className="w-5 h-5 text-purple-600" />
               </div>
               <div>
-                <p className="text-2xl font-bold text-gray-900">{projects.length}</p>
+                <p className="text-2xl font-bold text-gray-900">{total}</p>
                 <p className="text-sm text-gray-500">Total Projects</p>
               </div>
             </div>